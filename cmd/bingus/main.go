@@ -1,19 +1,89 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/BergurDavidsen/bingus/internal/codegen"
+	"github.com/BergurDavidsen/bingus/internal/fold"
+	"github.com/BergurDavidsen/bingus/internal/format"
+	"github.com/BergurDavidsen/bingus/internal/ir"
 	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/lint"
+	"github.com/BergurDavidsen/bingus/internal/lsp"
 	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+	"github.com/BergurDavidsen/bingus/internal/types"
+	"github.com/BergurDavidsen/bingus/internal/vm"
 )
 
 var file_extension = ".bng"
 var output_folder = "./output/"
 
+// Optimization settings, set by the -O0/-O1/-O2, --dump-passes and
+// --peephole-stats flags.
+var optLevel = 0
+var dumpPasses = false
+var peepholeStats = false
+
+// debugInfo is set by -g: native executables carry DWARF debug information.
+var debugInfo = false
+
+// checked is set by --checked: native executables trap on arithmetic
+// overflow and division by zero.
+var checked = false
+
+// heapDebug is set by --heap-debug: native executables check for double
+// frees and report the memory they did not free at exit.
+var heapDebug = false
+
+// gcStats is set by --gc-stats: native executables report the garbage
+// collections they ran and the bytes those freed at exit.
+var gcStats = false
+
+// annotate is set by --annotate: the generated assembly is interleaved with
+// the source lines it came from.
+var annotate = false
+
+// levelFlag is a boolean-style flag that selects an optimization level
+// when present, so -O2 reads like it does for other compilers.
+type levelFlag int
+
+func (l levelFlag) String() string   { return fmt.Sprint(int(l)) }
+func (l levelFlag) IsBoolFlag() bool { return true }
+func (l levelFlag) Set(s string) error {
+	if s != "true" {
+		return fmt.Errorf("-O%d takes no value", int(l))
+	}
+	optLevel = int(l)
+	return nil
+}
+
+// Warning settings, set by the -W<check>, -Wno-<check> and -Werror flags.
+// Every check is enabled by default.
+var warnings = map[string]bool{}
+var warningsAsErrors = false
+
+// warnFlag is a boolean-style flag that enables or disables a lint check.
+type warnFlag struct {
+	check string
+	on    bool
+}
+
+func (w warnFlag) String() string   { return "" }
+func (w warnFlag) IsBoolFlag() bool { return true }
+func (w warnFlag) Set(s string) error {
+	if s != "true" {
+		return fmt.Errorf("-W%s takes no value", w.check)
+	}
+	warnings[w.check] = w.on
+	return nil
+}
+
 func generateOutputFiles(asm string) {
 	err := os.WriteFile(fmt.Sprintf("%stest.asm", output_folder), []byte(asm), 0644)
 	if err != nil {
@@ -35,13 +105,58 @@ func generateOutputFiles(asm string) {
 	fmt.Println("Compiled file successfully!")
 }
 
-func main() {
+// commands are the subcommands, invoked as `bingus <command> <filename>`.
+// A bare filename compiles to a native executable.
+var commands = map[string]func(filename string){
+	"bytecode": writeBytecode,
+	"disasm":   disasmProgram,
+	"ir":       dumpIR,
+}
 
-	if len(os.Args) != 2 {
-		fmt.Printf("Usage: bingus <filename>%s\n", file_extension)
-		os.Exit(1)
-	}
-	filename := os.Args[1]
+// toolCommands take flags or arguments of their own and are invoked as
+// `bingus <command> [flags] <filename> [args]`.
+var toolCommands = map[string]func(args []string){
+	"run":    runProgram,
+	"exec":   execBytecode,
+	"fmt":    formatSource,
+	"ast":    dumpAST,
+	"tokens": dumpTokens,
+	"lsp":    serveLSP,
+}
+
+func usage() {
+	fmt.Printf("Usage: bingus [flags] [command] <filename>%s\n", file_extension)
+	fmt.Println("")
+	fmt.Println("Commands:")
+	fmt.Printf("  run       execute the program on the bytecode VM (bingus run <filename>%s [args])\n", file_extension)
+	fmt.Printf("  bytecode  compile the program to %s<name>%s\n", output_folder, vm.FileExtension)
+	fmt.Printf("  exec      run a compiled %s file on the bytecode VM (bingus exec <filename>%s [args])\n", vm.FileExtension, vm.FileExtension)
+	fmt.Printf("  disasm    print the bytecode of a %s or %s file\n", file_extension, vm.FileExtension)
+	fmt.Printf("  ir        print the program's intermediate representation\n")
+	fmt.Printf("  fmt       print the program in canonical layout (bingus fmt [--check | -w] <filename>%s)\n", file_extension)
+	fmt.Printf("  ast       print the syntax tree (bingus ast [--json] <filename>%s)\n", file_extension)
+	fmt.Printf("  tokens    print the tokens (bingus tokens [--json] <filename>%s)\n", file_extension)
+	fmt.Printf("  lsp       run the language server on stdin and stdout (bingus lsp)\n")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Printf("  -O0, -O1, -O2  optimization level for native code and ir (default -O0)\n")
+	fmt.Printf("  --dump-passes  print the IR after every optimization pass\n")
+	fmt.Printf("  --peephole-stats\n")
+	fmt.Printf("                 report what the assembly peephole pass removed (-O1 and up)\n")
+	fmt.Printf("  -g             emit DWARF debug information in native executables\n")
+	fmt.Printf("  --checked      trap on integer overflow and division by zero in native code\n")
+	fmt.Printf("  --heap-debug   detect double frees and report leaks at exit in native code\n")
+	fmt.Printf("  --gc-stats     report garbage collections at exit in native code\n")
+	fmt.Printf("  --annotate     comment %stest.asm with the source line of each statement\n", output_folder)
+	fmt.Printf("  -W<check>, -Wno-<check>\n")
+	fmt.Printf("                 enable or disable a warning; all are on by default\n")
+	fmt.Printf("                 checks: %s\n", strings.Join(lint.Checks, ", "))
+	fmt.Printf("  -Werror        treat warnings as errors\n")
+	os.Exit(1)
+}
+
+// readSource reads a source file, exiting on any error.
+func readSource(filename string) string {
 	if filepath.Ext(filename) != file_extension {
 		fmt.Printf("Error: file must have %s extension (got %s)\n", file_extension, filepath.Ext(filename))
 		os.Exit(1)
@@ -51,29 +166,349 @@ func main() {
 		fmt.Printf("Error reading file %s: %v\n", filename, err)
 		os.Exit(1)
 	}
-	// fmt.Println("Source code:")
-	// fmt.Println(string(data))
-	// fmt.Println("")
-
-	tokens := lexer.Lex(string(data))
-	// fmt.Println("Tokens:")
+	return string(data)
+}
 
-	// for _, tok := range tokens {
-	// 	fmt.Printf("%#v\n", tok)
-	// }
+// parseSource reads, lexes and parses a source file, exiting on any error.
+func parseSource(filename string) *parser.Program {
+	tokens, err := lexer.Lex(readSource(filename))
+	if err != nil {
+		fmt.Printf("%s:%v\n", filename, err)
+		os.Exit(1)
+	}
 
 	p := parser.Parser{Tokens: tokens}
-	program := p.ParseProgram()
-	// parser.PrintNodeReflect(program, "")
+	program, err := p.ParseProgram()
+	if err != nil {
+		fmt.Printf("%s:%v\n", filename, err)
+		os.Exit(1)
+	}
+	return program
+}
 
-	// env := NewEnv()
-	// result := env.Eval(program)
-	// fmt.Println("Result: ", result)
+// readProgram reads, lexes and parses a source file, resolves its names,
+// type-checks it, folds its constant expressions and reports lint warnings,
+// exiting on any error.
+func readProgram(filename string) (*parser.Program, *resolve.Table) {
+	program := parseSource(filename)
+	syms, err := resolve.Resolve(program)
+	if err != nil {
+		fmt.Printf("%s:%v\n", filename, err)
+		os.Exit(1)
+	}
+	if err := types.Check(program, syms); err != nil {
+		fmt.Printf("%s:%v\n", filename, err)
+		os.Exit(1)
+	}
+	foldProgram := fold.Program
+	if checked {
+		foldProgram = fold.Checked
+	}
+	if err := foldProgram(program); err != nil {
+		fmt.Printf("%s:%v\n", filename, err)
+		os.Exit(1)
+	}
+
+	found := lint.Lint(program, syms, warnings)
+	for _, w := range found {
+		fmt.Fprintf(os.Stderr, "%s:%v\n", filename, w)
+	}
+	if warningsAsErrors && len(found) > 0 {
+		fmt.Printf("Error: %d warning(s) treated as errors (-Werror)\n", len(found))
+		os.Exit(1)
+	}
+	return program, syms
+}
+
+func compileBytecode(filename string) *vm.Chunk {
+	chunk, err := vm.Compile(readProgram(filename))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	return chunk
+}
+
+// readBytecode loads and verifies a compiled bytecode file.
+func readBytecode(filename string) *vm.Chunk {
+	if filepath.Ext(filename) != vm.FileExtension {
+		fmt.Printf("Error: file must have %s extension (got %s)\n", vm.FileExtension, filepath.Ext(filename))
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Printf("Error reading file %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	chunk, err := vm.Decode(data)
+	if err != nil {
+		fmt.Printf("%s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	return chunk
+}
+
+// runChunk runs a chunk with the command-line arguments args, the first of
+// which names the program.
+func runChunk(chunk *vm.Chunk, args []string) {
+	machine := vm.New(os.Stdin, os.Stdout)
+	machine.Args = args
+	machine.Environ = os.Environ()
+	status, err := machine.Run(chunk)
+	if err != nil {
+		fmt.Printf("Runtime error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(status & 0xff)
+}
+
+func runProgram(args []string) {
+	if len(args) == 0 {
+		usage()
+	}
+	runChunk(compileBytecode(args[0]), args)
+}
+
+func execBytecode(args []string) {
+	if len(args) == 0 {
+		usage()
+	}
+	runChunk(readBytecode(args[0]), args)
+}
+
+func writeBytecode(filename string) {
+	chunk := compileBytecode(filename)
+
+	name := strings.TrimSuffix(filepath.Base(filename), file_extension)
+	outPath := filepath.Join(output_folder, name+vm.FileExtension)
+	if err := os.MkdirAll(output_folder, 0755); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(outPath, vm.Encode(chunk), 0644); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s\n", outPath)
+}
+
+func disasmProgram(filename string) {
+	if filepath.Ext(filename) == vm.FileExtension {
+		vm.Disassemble(os.Stdout, readBytecode(filename))
+		return
+	}
+	vm.Disassemble(os.Stdout, compileBytecode(filename))
+}
+
+// lowerProgram reads a source file, lowers it to IR and optimizes it at the
+// selected level, exiting on any error.
+func lowerProgram(filename string) *ir.Func {
+	fn, err := ir.Lower(readProgram(filename))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fn.Checked = checked
+
+	var dump func(pass string, fn *ir.Func)
+	if dumpPasses {
+		dump = func(pass string, fn *ir.Func) {
+			fmt.Printf("; after %s\n%s\n", pass, fn)
+		}
+	}
+	if err := ir.Optimize(fn, optLevel, dump); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	return fn
+}
+
+func dumpIR(filename string) {
+	fmt.Print(lowerProgram(filename))
+}
+
+func compileNative(filename string) {
+	fn := lowerProgram(filename)
 
 	cg := codegen.NewCodeGen()
-	cg.Gen(program)
+	if debugInfo {
+		dir, err := os.Getwd()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		cg.EnableDebug(filename, dir)
+	}
+	if annotate {
+		cg.Annotate(readSource(filename))
+	}
+	if checked {
+		cg.EnableChecks(filename)
+	}
+	if heapDebug {
+		cg.EnableHeapDebug()
+	}
+	if gcStats {
+		cg.EnableGCStats()
+	}
+	if err := cg.Gen(fn); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if optLevel > 0 {
+		stats := cg.Peephole()
+		if peepholeStats {
+			fmt.Println(stats)
+		}
+	}
 
 	asm := cg.String()
 
 	generateOutputFiles(asm)
 }
+
+// formatSource formats a source file. By default the result is printed;
+// with -w it replaces the file, and with --check nothing is written and the
+// exit status is 1 if the file is not already formatted.
+func formatSource(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	flags.Usage = usage
+	check := flags.Bool("check", false, "")
+	write := flags.Bool("w", false, "")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *check && *write {
+		usage()
+	}
+	filename := flags.Arg(0)
+	data := readSource(filename)
+
+	formatted, err := format.Source(data)
+	if err != nil {
+		fmt.Printf("%s:%v\n", filename, err)
+		os.Exit(1)
+	}
+
+	switch {
+	case *check:
+		if formatted != data {
+			fmt.Printf("%s is not formatted\n", filename)
+			os.Exit(1)
+		}
+	case *write:
+		if formatted != data {
+			if err := os.WriteFile(filename, []byte(formatted), 0644); err != nil {
+				fmt.Printf("Error writing file %s: %v\n", filename, err)
+				os.Exit(1)
+			}
+		}
+	default:
+		fmt.Print(formatted)
+	}
+}
+
+// jsonFlag parses the flags of a command that only takes --json and
+// returns whether it was given, along with the filename.
+func jsonFlag(name string, args []string) (bool, string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = usage
+	asJSON := flags.Bool("json", false, "")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	return *asJSON, flags.Arg(0)
+}
+
+// dumpAST prints the syntax tree of a source file, as JSON with --json.
+func dumpAST(args []string) {
+	asJSON, filename := jsonFlag("ast", args)
+	program := parseSource(filename)
+	if !asJSON {
+		parser.PrintNodeReflect(program, "")
+		return
+	}
+	data, err := parser.EncodeJSON(program)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(data))
+}
+
+// dumpTokens prints the tokens of a source file. With --json the comments
+// and whitespace around them are included as trivia.
+func dumpTokens(args []string) {
+	asJSON, filename := jsonFlag("tokens", args)
+	tokens, tail, err := lexer.LexLossless(readSource(filename))
+	if err != nil {
+		fmt.Printf("%s:%v\n", filename, err)
+		os.Exit(1)
+	}
+	if !asJSON {
+		for _, tok := range tokens {
+			fmt.Printf("%s\t%s\t%q\n", tok.Pos, lexer.TypeName(tok.Type), tok.Literal)
+		}
+		return
+	}
+	data, err := lexer.EncodeJSON(tokens, tail)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(data))
+}
+
+// serveLSP runs the language server over stdio. Stdout carries the
+// protocol, so errors go to stderr.
+func serveLSP(args []string) {
+	if len(args) != 0 {
+		usage()
+	}
+	if err := lsp.NewServer(os.Stdin, os.Stdout).Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "bingus lsp: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	flags := flag.NewFlagSet("bingus", flag.ExitOnError)
+	flags.Usage = usage
+	for level := 0; level <= 2; level++ {
+		flags.Var(levelFlag(level), fmt.Sprintf("O%d", level), "")
+	}
+	flags.BoolVar(&dumpPasses, "dump-passes", false, "")
+	flags.BoolVar(&peepholeStats, "peephole-stats", false, "")
+	flags.BoolVar(&debugInfo, "g", false, "")
+	flags.BoolVar(&annotate, "annotate", false, "")
+	flags.BoolVar(&checked, "checked", false, "")
+	flags.BoolVar(&heapDebug, "heap-debug", false, "")
+	flags.BoolVar(&gcStats, "gc-stats", false, "")
+	for _, check := range lint.Checks {
+		warnings[check] = true
+		flags.Var(warnFlag{check, true}, "W"+check, "")
+		flags.Var(warnFlag{check, false}, "Wno-"+check, "")
+	}
+	flags.BoolVar(&warningsAsErrors, "Werror", false, "")
+	flags.Parse(os.Args[1:])
+	args := flags.Args()
+
+	if len(args) > 0 {
+		if cmd, ok := toolCommands[args[0]]; ok {
+			cmd(args[1:])
+			return
+		}
+	}
+
+	switch len(args) {
+	case 1:
+		compileNative(args[0])
+	case 2:
+		cmd, ok := commands[args[0]]
+		if !ok {
+			usage()
+		}
+		cmd(args[1])
+	default:
+		usage()
+	}
+}
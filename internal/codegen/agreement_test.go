@@ -0,0 +1,149 @@
+package codegen
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/eval"
+	"github.com/BergurDavidsen/bingus/internal/ir"
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/randprog"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+// parse parses a program and resolves its names.
+func parse(t *testing.T, src string) (*parser.Program, *resolve.Table) {
+	t.Helper()
+	tokens, err := lexer.Lex(src)
+	if err != nil {
+		t.Fatalf("lex: %v\n%s", err, src)
+	}
+	p := parser.Parser{Tokens: tokens}
+	prog, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, src)
+	}
+	syms, err := resolve.Resolve(prog)
+	if err != nil {
+		t.Fatalf("resolve: %v\n%s", err, src)
+	}
+	return prog, syms
+}
+
+// requireTools skips the test if nasm or ld, which runCmd needs, is
+// missing.
+func requireTools(t *testing.T) {
+	t.Helper()
+	for _, tool := range []string{"nasm", "ld"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+}
+
+// compile lowers src, optimizes it at level and returns the assembly.
+// setup, if not nil, configures the code generator first; the function is
+// lowered in checked mode when setup enables checks.
+func compile(t *testing.T, src string, level int, setup func(cg *CodeGen)) string {
+	t.Helper()
+	cg := NewCodeGen()
+	if setup != nil {
+		setup(cg)
+	}
+	fn, err := ir.Lower(parse(t, src))
+	if err != nil {
+		t.Fatalf("lower: %v\n%s", err, src)
+	}
+	fn.Checked = cg.checks != nil
+	if err := ir.Optimize(fn, level, nil); err != nil {
+		t.Fatalf("optimize: %v\n%s", err, src)
+	}
+	if err := cg.Gen(fn); err != nil {
+		t.Fatalf("gen: %v\n%s", err, src)
+	}
+	if level > 0 {
+		cg.Peephole()
+	}
+	return cg.String()
+}
+
+// run runs asm like runCmd and returns the program's output and exit code.
+func run(t *testing.T, dir, asm string) (string, int) {
+	t.Helper()
+	stdout, _, status := runCmd(t, dir, asm, nil)
+	return stdout, status
+}
+
+// runCmd assembles and links asm with nasm and ld, runs the program and
+// returns its output, its error output and its exit code. setup, if not
+// nil, can give the command its stdin, arguments and environment.
+func runCmd(t *testing.T, dir, asm string, setup func(cmd *exec.Cmd)) (string, string, int) {
+	t.Helper()
+	asmPath := filepath.Join(dir, "prog.asm")
+	objPath := filepath.Join(dir, "prog.o")
+	binPath := filepath.Join(dir, "prog")
+	if err := os.WriteFile(asmPath, []byte(asm), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("nasm", "-f", "elf64", asmPath, "-o", objPath).CombinedOutput(); err != nil {
+		t.Fatalf("nasm: %v\n%s", err, out)
+	}
+	if out, err := exec.Command("ld", "-o", binPath, objPath).CombinedOutput(); err != nil {
+		t.Fatalf("ld: %v\n%s", err, out)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(binPath)
+	if setup != nil {
+		setup(cmd)
+	}
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stdout.String(), stderr.String(), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+// TestEvalAgreement checks that random programs compiled at every
+// optimization level print and exit exactly like the tree-walking evaluator.
+func TestEvalAgreement(t *testing.T) {
+	requireTools(t)
+
+	n := 50
+	if testing.Short() {
+		n = 5
+	}
+	r := rand.New(rand.NewPCG(3, 3))
+	dir := t.TempDir()
+
+	for i := 0; i < n; i++ {
+		src := randprog.Generate(r)
+
+		var want bytes.Buffer
+		prog, syms := parse(t, src)
+		wantCode, err := eval.NewEnv(nil, &want, syms).Eval(prog)
+		if err != nil {
+			t.Fatalf("eval: %v\n%s", err, src)
+		}
+
+		for level := 0; level <= 2; level++ {
+			got, gotCode := run(t, dir, compile(t, src, level, nil))
+
+			if got != want.String() || gotCode != wantCode&0xff {
+				t.Fatalf("program disagrees with evaluator at -O%d\n%s\ncompiled: exit %d, output:\n%s\nevaluated: exit %d, output:\n%s",
+					level, src, gotCode, got, wantCode&0xff, want.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BergurDavidsen/bingus/internal/ir"
+)
+
+// Annotate makes the generated assembly easier to follow back to source:
+// String puts each source line as a comment before the instructions
+// generated for it, and Gen names block labels after their construct and
+// line, such as .while_start_L6. source is the program's text.
+func (cg *CodeGen) Annotate(source string) {
+	cg.source = strings.Split(source, "\n")
+}
+
+// sourceComment renders source line n (1-based) as an assembly comment.
+func (cg *CodeGen) sourceComment(n int) string {
+	text := ""
+	if n <= len(cg.source) {
+		text = strings.TrimSpace(cg.source[n-1])
+	}
+	return fmt.Sprintf("; line %d: %s", n, text)
+}
+
+// lineLabels names each block that came from a source construct after the
+// construct and its line. When several such blocks would share a name, as
+// with two loops on one line, the later ones also get their block number.
+func lineLabels(fn *ir.Func) map[*ir.Block]string {
+	labels := map[*ir.Block]string{}
+	taken := map[string]bool{}
+	for _, b := range fn.Blocks {
+		if b.Line == 0 {
+			continue
+		}
+		name := fmt.Sprintf(".%s_L%d", b.Name, b.Line)
+		if taken[name] {
+			name = fmt.Sprintf("%s_%d", name, b.ID)
+		}
+		taken[name] = true
+		labels[b] = name
+	}
+	return labels
+}
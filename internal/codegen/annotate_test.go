@@ -0,0 +1,57 @@
+package codegen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/ir"
+)
+
+func TestAnnotate(t *testing.T) {
+	src := `let i = 0;
+while (i < 3) { i = i + 1; }
+while (i > 0) { i = i - 1; }
+return i;
+`
+	gen := func(annotate bool) string {
+		fn, err := ir.Lower(parse(t, src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cg := NewCodeGen()
+		if annotate {
+			cg.Annotate(src)
+		}
+		if err := cg.Gen(fn); err != nil {
+			t.Fatal(err)
+		}
+		cg.Peephole()
+		return cg.String()
+	}
+	plain, annotated := gen(false), gen(true)
+
+	for _, want := range []string{
+		"; line 1: let i = 0;",
+		"; line 2: while (i < 3) { i = i + 1; }",
+		"; line 4: return i;",
+		".while_start_L2:",
+		".while_end_L2:",
+		"jmp .while_start_L2",
+		".while_start_L3:",
+	} {
+		if !strings.Contains(annotated, want+"\n") {
+			t.Errorf("annotated assembly lacks %q:\n%s", want, annotated)
+		}
+	}
+
+	// Annotating only adds comments and renames labels.
+	var comments int
+	for _, l := range strings.Split(annotated, "\n") {
+		if strings.HasPrefix(l, ";") {
+			comments++
+		}
+	}
+	if got, want := strings.Count(annotated, "\n")-comments, strings.Count(plain, "\n"); got != want {
+		t.Errorf("annotated assembly has %d lines besides comments, plain has %d", got, want)
+	}
+}
@@ -0,0 +1,79 @@
+package codegen
+
+import "strings"
+
+type lineKind int
+
+const (
+	lineInstr lineKind = iota // an instruction with operands
+	lineLabel                 // a label definition
+	lineRaw                   // verbatim text, opaque to the peephole pass
+)
+
+// line is one line of generated assembly. Instructions keep their opcode
+// and operands apart so the peephole pass can match on them.
+type line struct {
+	kind lineKind
+	op   string   // opcode, or the label name
+	args []string // operands of an instruction
+	text string   // contents of a raw line
+	src  int      // source line an instruction was generated for; 0 if none
+}
+
+func (l line) String() string {
+	switch l.kind {
+	case lineLabel:
+		return l.op + ":"
+	case lineRaw:
+		return l.text
+	}
+	if len(l.args) == 0 {
+		return "  " + l.op
+	}
+	return "  " + l.op + " " + strings.Join(l.args, ", ")
+}
+
+func (l line) is(op string, nargs int) bool {
+	return l.kind == lineInstr && l.op == op && len(l.args) == nargs
+}
+
+// registerFamilies maps each sub-register the backend uses to its full
+// 64-bit register.
+var registerFamilies = map[string]string{
+	"eax": "rax", "ax": "rax", "al": "rax",
+	"ecx": "rcx", "cl": "rcx",
+	"edx": "rdx", "dl": "rdx",
+	"edi": "rdi",
+	"esi": "rsi",
+}
+
+func family(reg string) string {
+	if f, ok := registerFamilies[reg]; ok {
+		return f
+	}
+	return reg
+}
+
+// isReg reports whether an operand is a bare register rather than memory or
+// an immediate.
+func isReg(operand string) bool {
+	if operand == "" || strings.ContainsAny(operand, "[ ") {
+		return false
+	}
+	_, sub := registerFamilies[operand]
+	return sub || operand[0] == 'r'
+}
+
+// mentions reports whether operand reads or writes any part of reg, either
+// directly or inside a memory address.
+func mentions(operand, reg string) bool {
+	reg = family(reg)
+	for _, word := range strings.FieldsFunc(operand, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	}) {
+		if family(word) == reg {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PanicStatus is the exit status of a program stopped by a runtime error:
+// a failed check or malformed input.
+const PanicStatus = 101
+
+// Messages of the runtime checks. The source position is appended.
+const (
+	msgDivByZero = "division by zero"
+	msgOverflow  = "integer overflow"
+)
+
+// checks is the state of checked arithmetic: one trap per distinct
+// message, each loading its message and jumping to runtime_panic.
+type checks struct {
+	file  string
+	traps map[string]string // message -> trap label
+	msgs  []string          // messages in the order their traps were made
+	divs  int               // divisions checked so far
+}
+
+// EnableChecks makes Gen check arithmetic at run time. Overflow in +, -, *
+// and negation and division by zero no longer wrap around or fault, but
+// print the error and its position in file to stderr and exit with
+// PanicStatus. The function should have been optimized with Checked set,
+// so the optimizer keeps the operations that may trap.
+func (cg *CodeGen) EnableChecks(file string) {
+	cg.checks = &checks{file: file, traps: map[string]string{}}
+}
+
+// trap emits a conditional jump to the trap for msg at the current source
+// line.
+func (cg *CodeGen) trap(jcc, msg string) {
+	msg = fmt.Sprintf("%s at %s:%d", msg, cg.checks.file, cg.src)
+	label, ok := cg.checks.traps[msg]
+	if !ok {
+		label = fmt.Sprintf(".trap_%d", len(cg.checks.msgs))
+		cg.checks.traps[msg] = label
+		cg.checks.msgs = append(cg.checks.msgs, msg)
+	}
+	cg.ins(jcc, label)
+}
+
+// checkDivision traps if the divisor is zero, or if it is -1 and the
+// dividend in rax is the most negative integer, whose quotient overflows.
+func (cg *CodeGen) checkDivision(divisor string) {
+	cg.ins("cmp", divisor, "0")
+	cg.trap("je", msgDivByZero)
+
+	cg.checks.divs++
+	ok := fmt.Sprintf(".div_ok_%d", cg.checks.divs)
+	cg.ins("cmp", divisor, "-1")
+	cg.ins("jne", ok)
+	cg.ins("mov", "rdx", "rax")
+	cg.ins("neg", "rdx")
+	cg.trap("jo", msgOverflow)
+	cg.label(ok)
+}
+
+// genTraps emits the traps after the program's code.
+func (cg *CodeGen) genTraps() {
+	cg.src = 0
+	for i, msg := range cg.checks.msgs {
+		cg.label(cg.checks.traps[msg])
+		cg.ins("lea", "rsi", fmt.Sprintf("[panic_msg_%d]", i))
+		cg.ins("mov", "rdx", fmt.Sprint(len(msg)+1))
+		cg.ins("jmp", "runtime_panic")
+	}
+}
+
+// panicMessages returns the messages of the traps.
+func (cg *CodeGen) panicMessages() string {
+	var sb strings.Builder
+	sb.WriteString("\n\t\tsection .rodata\n")
+	for i, msg := range cg.checks.msgs {
+		sb.WriteString(message(fmt.Sprintf("panic_msg_%d", i), msg))
+	}
+	return sb.String()
+}
+
+// message renders msg and a newline as data at label.
+func message(label, msg string) string {
+	return data(label, msg+"\n")
+}
+
+// data renders the bytes of s at label. They are written as numbers, which
+// every assembler reads the same way.
+func data(label, s string) string {
+	nums := make([]string, len(s))
+	for i := 0; i < len(s); i++ {
+		nums[i] = fmt.Sprintf("0x%02x", s[i])
+	}
+	return fmt.Sprintf("\t\t%s: ; %q\n\t\t\tdb %s\n", label, s, strings.Join(nums, ", "))
+}
+
+// panicRoutine writes the rdx bytes at rsi to stderr and exits with
+// PanicStatus.
+var panicRoutine = fmt.Sprintf(`
+		section .text
+		runtime_panic:
+			mov rax, 1
+			mov rdi, 2
+			syscall
+
+			mov rax, 60
+			mov rdi, %d
+			syscall
+		`, PanicStatus)
@@ -0,0 +1,61 @@
+package codegen
+
+import "testing"
+
+// TestCheckedArithmetic runs programs that overflow or divide by zero with
+// checks enabled at every optimization level.
+func TestCheckedArithmetic(t *testing.T) {
+	requireTools(t)
+
+	tests := []struct {
+		src    string
+		stdout string
+		stderr string
+		status int
+	}{
+		{
+			src:    "let a = 10;\nlet b = 0;\nprint a / 2;\nprint a % b;\nreturn 0;\n",
+			stdout: "5\n",
+			stderr: "division by zero at prog.bng:4\n",
+			status: PanicStatus,
+		},
+		{
+			src:    "let x = 1;\nlet i = 0;\nwhile (i < 70) {\n    x = x * 2;\n    i = i + 1;\n}\nreturn 0;\n",
+			stderr: "integer overflow at prog.bng:4\n",
+			status: PanicStatus,
+		},
+		{
+			src:    "let x = 9223372036854775807;\nlet y = x - 1;\nprint y + 2;\nreturn 1;\n",
+			stderr: "integer overflow at prog.bng:3\n",
+			status: PanicStatus,
+		},
+		{
+			src:    "let x = -9223372036854775807 - 1;\nlet d = -1;\nprint x / d;\nreturn 1;\n",
+			stderr: "integer overflow at prog.bng:3\n",
+			status: PanicStatus,
+		},
+		{
+			src:    "let x = -9223372036854775807 - 1;\nprint -x;\nreturn 1;\n",
+			stderr: "integer overflow at prog.bng:2\n",
+			status: PanicStatus,
+		},
+		{
+			// Dividing by -1 only overflows for the most negative integer.
+			src:    "let x = 9223372036854775807;\nlet d = -1;\nprint x / d;\nprint x - 1;\nreturn 3;\n",
+			stdout: "-9223372036854775807\n9223372036854775806\n",
+			status: 3,
+		},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		for level := 0; level <= 2; level++ {
+			asm := compile(t, tt.src, level, func(cg *CodeGen) { cg.EnableChecks("prog.bng") })
+			stdout, stderr, status := runCmd(t, dir, asm, nil)
+			if stdout != tt.stdout || stderr != tt.stderr || status != tt.status {
+				t.Errorf("-O%d\n%s\ngot stdout %q, stderr %q, exit %d\nwant stdout %q, stderr %q, exit %d",
+					level, tt.src, stdout, stderr, status, tt.stdout, tt.stderr, tt.status)
+			}
+		}
+	}
+}
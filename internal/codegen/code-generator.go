@@ -4,144 +4,229 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/ir"
 )
 
 type CodeGen struct {
-	code           []string
-	scope          []map[string]int
-	stackMark      []int
-	stackPos       int
-	labelCnt       int
-	loopStartStack []string
-	loopEndStack   []string
+	code  []line
+	fn    *ir.Func
+	alloc *allocation
+	src   int // source line of the IR being translated
+
+	debug  *debugInfo           // nil unless EnableDebug was called
+	source []string             // source lines; nil unless Annotate was called
+	labels map[*ir.Block]string // block labels, when they differ from the default
+	checks *checks              // nil unless EnableChecks was called
+	input  bool                 // whether the program reads input
+	args   bool                 // whether the program reads arguments
+	envs   []string             // environment variables the program reads
+
+	heap       bool                   // whether the program allocates
+	heapDebug  bool                   // set by EnableHeapDebug
+	gcStats    bool                   // set by EnableGCStats
+	roots      map[*ir.Instr][]ir.Reg // pointers live across each alloc
+	ptrWords   []objWord              // object words that may hold pointers
+	safepoints []safepoint            // the calls to heap_alloc, in order
 }
 
-func (cg *CodeGen) newLabel(base string) string {
-	cg.labelCnt++
-	return fmt.Sprintf(".%s_%d", base, cg.labelCnt)
+// Error is an error found while generating code, such as an IR operation
+// the backend does not support.
+type Error struct {
+	Msg string
 }
 
-func NewCodeGen() *CodeGen {
-	return &CodeGen{
-		code:      []string{},
-		scope:     []map[string]int{{}},
-		stackMark: []int{},
-		stackPos:  0,
-		labelCnt:  0,
-	}
+func (e *Error) Error() string {
+	return e.Msg
 }
 
-func (cg *CodeGen) pushScope() {
-	cg.scope = append(cg.scope, map[string]int{})
-	cg.stackMark = append(cg.stackMark, cg.stackPos)
+// errorf aborts code generation with an *Error. It is recovered by Gen.
+func (cg *CodeGen) errorf(format string, args ...interface{}) {
+	panic(&Error{Msg: fmt.Sprintf(format, args...)})
 }
 
-func (cg *CodeGen) popScope() {
-	if len(cg.scope) == 0 {
-		panic("no scope to pop")
-	}
-
-	prevMark := cg.stackMark[len(cg.stackMark)-1] // saved at push
-	// compute how much space was allocated while in this scope
-	delta := cg.stackPos - prevMark
-	if delta > 0 {
-		cg.EmitIndent(1, fmt.Sprintf("add rsp, %d", delta))
+func NewCodeGen() *CodeGen {
+	return &CodeGen{
+		code: []line{},
 	}
-
-	cg.scope = cg.scope[:len(cg.scope)-1]
-	cg.stackMark = cg.stackMark[:len(cg.stackMark)-1]
-	cg.stackPos = prevMark
 }
 
-func (cg *CodeGen) currentScope() map[string]int {
-	return cg.scope[len(cg.scope)-1]
+// Emit appends a line of assembly verbatim.
+func (cg *CodeGen) Emit(text string) {
+	cg.code = append(cg.code, line{kind: lineRaw, text: text})
 }
 
-func (cg *CodeGen) declareVar(name string, offset int) {
-	scope := cg.currentScope()
+func (cg *CodeGen) EmitIndent(indent int, text string) {
+	cg.Emit(strings.Repeat("  ", indent) + text)
+}
 
-	if _, exists := scope[name]; exists {
-		panic(fmt.Sprintf("variable already declared in this scope: %s", name))
-	}
+// ins appends an instruction for the current source line.
+func (cg *CodeGen) ins(op string, args ...string) {
+	cg.code = append(cg.code, line{kind: lineInstr, op: op, args: args, src: cg.src})
+}
 
-	scope[name] = offset
+func (cg *CodeGen) label(name string) {
+	cg.code = append(cg.code, line{kind: lineLabel, op: name})
 }
 
-func (cg *CodeGen) lookupVar(name string) (int, bool) {
-	for i := len(cg.scope) - 1; i >= 0; i-- {
-		if offset, ok := cg.scope[i][name]; ok {
-			return offset, true
+// String renders the assembly. Where the instructions move on to another
+// source line, it adds the line as a comment if annotating and a line
+// table row if emitting debug information.
+func (cg *CodeGen) String() string {
+	var lines []string
+	var rows []lineRow
+	last := 0
+	for _, l := range cg.code {
+		if l.kind == lineInstr && l.src != 0 && l.src != last {
+			if cg.source != nil {
+				lines = append(lines, cg.sourceComment(l.src))
+			}
+			if cg.debug != nil {
+				row := lineRow{label: fmt.Sprintf(".row_%d", len(rows)), line: l.src}
+				rows = append(rows, row)
+				lines = append(lines, line{kind: lineLabel, op: row.label}.String())
+			}
+			last = l.src
 		}
+		lines = append(lines, l.String())
 	}
-	return 0, false
+	asm := strings.Join(lines, "\n")
+	if cg.debug != nil {
+		asm += "\n" + cg.debugSections(rows)
+	}
+	return asm
 }
 
-func (cg *CodeGen) Emit(line string) {
-	cg.code = append(cg.code, line)
+// loc is the machine register or stack slot the allocator gave a virtual
+// register.
+func (cg *CodeGen) loc(r ir.Reg) string {
+	return cg.alloc.loc[r]
 }
 
-func (cg *CodeGen) EmitIndent(indent int, line string) {
-	cg.code = append(cg.code, strings.Repeat("  ", indent)+line)
+// word is the stack location of word i of an object.
+func (cg *CodeGen) word(obj *ir.Object, i int64) string {
+	return fmt.Sprintf("QWORD [rbp-%d]", cg.alloc.objects[obj]-8*int(i))
 }
 
-func (cg *CodeGen) String() string {
-	return strings.Join(cg.code, "\n")
+// move copies src to dst, going through rax when both are in memory.
+func (cg *CodeGen) move(dst, src string) {
+	switch {
+	case dst == src:
+	case isMem(dst) && isMem(src):
+		cg.ins("mov", "rax", src)
+		cg.ins("mov", dst, "rax")
+	default:
+		cg.ins("mov", dst, src)
+	}
+}
+
+func (cg *CodeGen) blockLabel(b *ir.Block) string {
+	if name, ok := cg.labels[b]; ok {
+		return name
+	}
+	return "." + b.Label()
 }
 
-func (cg *CodeGen) Gen(node parser.Node) {
+// Gen generates assembly for a function in IR form.
+func (cg *CodeGen) Gen(fn *ir.Func) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			cgErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = cgErr
+		}
+	}()
+
+	cg.fn = fn
+	if cg.source != nil {
+		cg.labels = lineLabels(fn)
+	}
+	var pinned []ir.Reg
+	if cg.debug != nil {
+		pinned = cg.debugVars(fn)
+	}
+	cg.alloc = allocate(fn, pinned)
+	cg.heap = usesHeap(fn)
+	if cg.heap {
+		cg.roots, cg.ptrWords = gcRoots(fn)
+	}
+
 	// Program prologue
 	cg.Emit("section .text")
 	cg.Emit("global _start")
-	cg.Emit("_start:")
+	cg.label("_start")
 
-	cg.EmitIndent(1, "push rbp")
-	cg.EmitIndent(1, "mov rbp, rsp")
+	cg.ins("push", "rbp")
+	cg.ins("mov", "rbp", "rsp")
 
-	switch n := node.(type) {
-	case *parser.Program:
-		lastStmt := n.Statements[len(n.Statements)-1]
+	// Reserve the spill slots and objects. The frame is a multiple of 16
+	// bytes, so rsp stays 8 mod 16 as after push rbp; the runtime helpers
+	// only make syscalls, which need no stricter alignment.
+	if cg.alloc.frameSize > 0 {
+		cg.ins("sub", "rsp", fmt.Sprint(cg.alloc.frameSize))
+	}
+	// The collector reads object words that may hold pointers at every
+	// alloc, so they must not start out as stack garbage.
+	for _, w := range cg.ptrWords {
+		cg.ins("mov", cg.word(w.obj, w.i), "0")
+	}
 
-		if _, ok := lastStmt.(*parser.ReturnStmt); !ok {
-			fmt.Println("Warning: no return statement at end of program; adding a default 'return 0' to end of file.")
-			n.Statements = append(n.Statements, &parser.ReturnStmt{
-				Value: &parser.NumberLiteral{Value: "0"},
-			})
-		}
-		for _, stmt := range n.Statements {
-			cg.GenStmt(stmt)
+	for _, b := range fn.Blocks {
+		cg.label(cg.blockLabel(b))
+		for _, instr := range b.Instrs {
+			cg.genInstr(instr)
 		}
+		cg.genTerm(b.Term)
+	}
+	if cg.checks != nil {
+		cg.genTraps()
+	}
+	cg.genEnvUnset()
+	if cg.debug != nil {
+		cg.label(codeEnd)
 	}
 
 	asmHelper := `
 		section .bss
-		buffer resb 20
+		buffer resb 24
 
 		section .text
 		print_number:
+			mov r10, 1
+
+		; write_number writes rdi and a newline to file descriptor r10.
+		write_number:
 			mov rax, rdi
-			mov rcx, 0
-			lea rbx, [buffer+19]
-			mov byte [rbx], 10
-			dec rbx
+			mov r8, rdi
+			mov rcx, 1
+			lea rsi, [buffer+23]
+			mov byte [rsi], 10
+
+			test rax, rax
+			jns .convert_loop
+			neg rax
 
 		.convert_loop:
 			xor rdx, rdx
-			mov rsi, 10
-			div rsi
+			mov r9, 10
+			div r9
 			add dl, '0'
-			mov [rbx], dl
-			dec rbx
+			dec rsi
+			mov [rsi], dl
 			inc rcx
 			test rax, rax
 			jnz .convert_loop
 
-			inc rbx
+			test r8, r8
+			jns .write
+			dec rsi
+			mov byte [rsi], '-'
+			inc rcx
 
+		.write:
 			mov rax, 1
-			mov rdi, 1
-			mov rsi, rbx
-			inc rcx
+			mov rdi, r10
 			mov rdx, rcx
 			syscall
 
@@ -149,228 +234,186 @@ func (cg *CodeGen) Gen(node parser.Node) {
 		`
 
 	cg.Emit(asmHelper)
+	if cg.input {
+		cg.Emit(inputRuntime())
+	}
+	process := cg.args || len(cg.envs) > 0
+	if process {
+		cg.Emit(cg.processRuntime())
+	}
+	if cg.heap {
+		cg.Emit(cg.heapRuntime())
+		cg.Emit(cg.gcRuntime())
+	}
+	if cg.checks != nil {
+		cg.Emit(cg.panicMessages())
+	}
+	if cg.input || process || cg.heap || cg.checks != nil {
+		cg.Emit(panicRoutine)
+	}
 
+	return nil
 }
 
-func (cg *CodeGen) GenStmt(node parser.Node) {
-	switch n := node.(type) {
-	case *parser.ReturnStmt:
-		val := cg.GenExpr(n.Value)
-		cg.EmitIndent(1, fmt.Sprintf("mov rdi, %s", val)) // exit code
-
-		// Tear down stack frame before exit
-		cg.EmitIndent(1, "mov rsp, rbp")
-		cg.EmitIndent(1, "pop rbp")
-
-		cg.EmitIndent(1, "mov rax, 60") // syscall: exit
-		cg.EmitIndent(1, "syscall")
-	case *parser.LetStmt:
-		val := cg.GenExpr(n.Value)
-
-		cg.stackPos += 8
-		cg.EmitIndent(1, "sub rsp, 8")
-		offset := cg.stackPos
-		cg.declareVar(n.Name.Name, offset)
-
-		cg.EmitIndent(1, fmt.Sprintf("mov QWORD [rbp-%d], %s", offset, val))
-
-	case *parser.PrintStmt:
-		val := cg.GenExpr(n.Value)
-		cg.EmitIndent(1, fmt.Sprintf("mov rdi, %s", val))
-		cg.EmitIndent(1, "call print_number")
-
-	case *parser.IfStmt:
-		cg.GenExpr(n.Guard)
-
-		endLabel := cg.newLabel("endif")
-
-		if len(n.Else) > 0 {
-			elseLabel := cg.newLabel("else")
-			cg.EmitIndent(1, "cmp rax, 0")
-			cg.EmitIndent(1, fmt.Sprintf("je %s", elseLabel))
-
-			// THEN block
-			cg.pushScope()
-			for _, stmt := range n.Then {
-				cg.GenStmt(stmt)
-			}
-			cg.popScope()
+var arith = map[ir.Op]string{
+	ir.OpAdd: "add",
+	ir.OpSub: "sub",
+	ir.OpMul: "imul",
+}
 
-			cg.EmitIndent(1, fmt.Sprintf("jmp %s", endLabel))
+var setcc = map[ir.Op]string{
+	ir.OpLess:      "setl",
+	ir.OpGreater:   "setg",
+	ir.OpLessEq:    "setle",
+	ir.OpGreaterEq: "setge",
+	ir.OpEqual:     "sete",
+}
 
-			// ELSE block
-			cg.Emit(fmt.Sprintf("%s:", elseLabel))
-			cg.pushScope()
-			for _, stmt := range n.Else {
-				cg.GenStmt(stmt)
-			}
-			cg.popScope()
+func (cg *CodeGen) genInstr(instr *ir.Instr) {
+	if instr.Line != 0 {
+		cg.src = instr.Line
+	}
+	switch instr.Op {
+	case ir.OpConst:
+		dst := cg.loc(instr.Dst)
+		if isMem(dst) && int64(int32(instr.Imm)) != instr.Imm {
+			// Memory operands only take sign-extended 32-bit immediates.
+			cg.ins("mov", "rax", fmt.Sprint(instr.Imm))
+			cg.ins("mov", dst, "rax")
 		} else {
-			// No ELSE block
-			cg.EmitIndent(1, "cmp rax, 0")
-			cg.EmitIndent(1, fmt.Sprintf("je %s", endLabel))
-
-			// THEN block
-			cg.pushScope()
-			for _, stmt := range n.Then {
-				cg.GenStmt(stmt)
-			}
-			cg.popScope()
+			cg.ins("mov", dst, fmt.Sprint(instr.Imm))
 		}
 
-		cg.Emit(fmt.Sprintf("%s:", endLabel))
-
-	case *parser.WhileStmt:
-		start_label := cg.newLabel("while_start")
-		end_label := cg.newLabel("while_end")
-
-		cg.loopStartStack = append(cg.loopStartStack, start_label)
-		cg.loopEndStack = append(cg.loopEndStack, end_label)
-
-		cg.Emit(fmt.Sprintf("%s:", start_label))
+	case ir.OpCopy:
+		cg.move(cg.loc(instr.Dst), cg.loc(instr.Args[0]))
 
-		cg.GenExpr(n.Guard)
+	case ir.OpNeg:
+		dst := cg.loc(instr.Dst)
+		cg.move(dst, cg.loc(instr.Args[0]))
+		cg.ins("neg", dst)
+		if cg.checks != nil {
+			cg.trap("jo", msgOverflow)
+		}
 
-		cg.EmitIndent(1, "cmp rax, 0")
-		cg.EmitIndent(1, fmt.Sprintf("je %s", end_label))
+	case ir.OpAdd, ir.OpSub, ir.OpMul:
+		dst, lhs, rhs := cg.loc(instr.Dst), cg.loc(instr.Args[0]), cg.loc(instr.Args[1])
+		if !isMem(dst) && dst != rhs {
+			cg.move(dst, lhs)
+			cg.ins(arith[instr.Op], dst, rhs)
+			if cg.checks != nil {
+				cg.trap("jo", msgOverflow)
+			}
+			return
+		}
+		cg.ins("mov", "rax", lhs)
+		cg.ins(arith[instr.Op], "rax", rhs)
+		if cg.checks != nil {
+			cg.trap("jo", msgOverflow)
+		}
+		cg.ins("mov", dst, "rax")
 
-		cg.pushScope()
+	case ir.OpDiv, ir.OpMod:
+		cg.ins("mov", "rax", cg.loc(instr.Args[0]))
+		if cg.checks != nil {
+			cg.checkDivision(cg.loc(instr.Args[1]))
+		}
+		cg.ins("cqo")
+		cg.ins("idiv", cg.loc(instr.Args[1]))
+		result := "rax"
+		if instr.Op == ir.OpMod {
+			result = "rdx"
+		}
+		cg.ins("mov", cg.loc(instr.Dst), result)
 
-		for _, stmt := range n.Body {
-			cg.GenStmt(stmt)
+	case ir.OpLess, ir.OpGreater, ir.OpLessEq, ir.OpGreaterEq, ir.OpEqual:
+		lhs, rhs := cg.loc(instr.Args[0]), cg.loc(instr.Args[1])
+		if isMem(lhs) && isMem(rhs) {
+			cg.ins("mov", "rax", lhs)
+			lhs = "rax"
 		}
+		cg.ins("cmp", lhs, rhs)
+		cg.ins(setcc[instr.Op], "al")
+		cg.ins("movzx", "rax", "al")
+		cg.ins("mov", cg.loc(instr.Dst), "rax")
 
-		cg.popScope()
+	case ir.OpPrint:
+		cg.ins("mov", "rdi", cg.loc(instr.Args[0]))
+		cg.ins("call", "print_number")
 
-		cg.loopStartStack = cg.loopStartStack[:len(cg.loopStartStack)-1]
-		cg.loopEndStack = cg.loopEndStack[:len(cg.loopEndStack)-1]
+	case ir.OpInput:
+		cg.input = true
+		cg.ins("call", "read_number")
+		cg.ins("mov", cg.loc(instr.Dst), "rax")
 
-		cg.EmitIndent(1, fmt.Sprintf("jmp %s", start_label))
+	case ir.OpArgc:
+		cg.move(cg.loc(instr.Dst), argcLoc)
 
-		cg.Emit(fmt.Sprintf("%s:", end_label))
+	case ir.OpArg:
+		cg.args = true
+		cg.ins("mov", "rdi", cg.loc(instr.Args[0]))
+		cg.ins("call", "arg_number")
+		cg.ins("mov", cg.loc(instr.Dst), "rax")
 
-	case *parser.AssignmentStmt:
-		val := cg.GenExpr(n.Value)
+	case ir.OpEnv:
+		cg.genEnv(instr.Name)
+		cg.ins("mov", cg.loc(instr.Dst), "rax")
 
-		offset, ok := cg.lookupVar(n.Name.Name)
-		if !ok {
-			panic(fmt.Sprintf("undefined variable: %s", n.Name.Name))
-		}
+	case ir.OpAlloc:
+		cg.ins("mov", "rdi", cg.loc(instr.Args[0]))
+		cg.ins("call", "heap_alloc")
+		cg.safepoint(instr)
+		cg.ins("mov", cg.loc(instr.Dst), "rax")
 
-		cg.EmitIndent(1, fmt.Sprintf("mov [rbp-%d], %s", offset, val))
+	case ir.OpFree:
+		cg.ins("mov", "rdi", cg.loc(instr.Args[0]))
+		cg.ins("call", "heap_free")
 
-	case *parser.BreakStmt:
-		if len(cg.loopEndStack) == 0 {
-			panic("break statement not inside loop")
-		}
-		cg.EmitIndent(1, fmt.Sprintf("jmp %s", cg.loopEndStack[len(cg.loopEndStack)-1]))
+	case ir.OpLoad:
+		cg.move(cg.loc(instr.Dst), cg.word(instr.Obj, instr.Imm))
 
-	case *parser.ContinueStmt:
-		if len(cg.loopStartStack) == 0 {
-			panic("continue statement not inside loop")
-		}
-		cg.EmitIndent(1, fmt.Sprintf("jmp %s", cg.loopStartStack[len(cg.loopStartStack)-1]))
+	case ir.OpStore:
+		cg.move(cg.word(instr.Obj, instr.Imm), cg.loc(instr.Args[0]))
 
 	default:
-		panic(fmt.Sprintf("unsupported statement: %T", n))
+		cg.errorf("unsupported IR operation: %s", instr.Op)
 	}
 }
-func (cg *CodeGen) GenExpr(node parser.Node) string {
-	return cg.genExprWithTarget(node, "rax")
-}
 
-func (cg *CodeGen) genExprWithTarget(node parser.Node, target string) string {
-	switch n := node.(type) {
-	case *parser.NumberLiteral:
-		cg.EmitIndent(1, fmt.Sprintf("mov %s, %s", target, n.Value))
-		return n.Value
-	case *parser.IDent:
-		offset, ok := cg.lookupVar(n.Name)
-		if !ok {
-			panic(fmt.Sprintf("undefined variable: %s", n.Name))
+func (cg *CodeGen) genTerm(t ir.Term) {
+	if t.Line != 0 {
+		cg.src = t.Line
+	}
+	switch t.Kind {
+	case ir.TermJump:
+		cg.ins("jmp", cg.blockLabel(t.Then))
+
+	case ir.TermBranch:
+		cond := cg.loc(t.Cond)
+		if isMem(cond) {
+			cg.ins("cmp", cond, "0")
+		} else {
+			cg.ins("test", cond, cond)
 		}
+		cg.ins("je", cg.blockLabel(t.Else))
+		cg.ins("jmp", cg.blockLabel(t.Then))
 
-		cg.EmitIndent(1, fmt.Sprintf("mov %s, [rbp-%d]", target, offset))
-		return target
-	case *parser.BoolLit:
-		val := 0
-		if n.Value {
-			val = 1
-		}
-		cg.EmitIndent(1, fmt.Sprintf("mov %s, %d", target, val))
-		return target
-
-	case *parser.UnaryExpr:
-		cg.GenExpr(n.Right)
-		op := n.Operator
-		if op == "-" {
-			cg.EmitIndent(1, fmt.Sprintf("neg %s", target))
+	case ir.TermReturn:
+		cg.ins("mov", "rdi", cg.loc(t.Value)) // exit code
+		if cg.heap && cg.heapDebug {
+			cg.ins("call", "heap_check")
 		}
-		return target
-
-	case *parser.BinaryExpr:
-
-		op := n.Operator
-
-		if op == "/" {
-			cg.GenExpr(n.Left)
-			cg.EmitIndent(1, "xor rdx, rdx")
-			cg.genExprWithTarget(n.Right, "rbx")
-			cg.EmitIndent(1, "idiv rbx")
-			return target
-
+		if cg.heap && cg.gcStats {
+			cg.ins("call", "gc_stats")
 		}
 
-		cg.genExprWithTarget(n.Left, "rax")
-
-		// Allocate temporary stack slot for LHS
-		cg.EmitIndent(1, "sub rsp, 8")
-		cg.stackPos += 8
-		lhsOffset := cg.stackPos
-		cg.EmitIndent(1, fmt.Sprintf("mov QWORD [rbp-%d], rax", lhsOffset))
-
-		// Generate right-hand side into rax
-		cg.genExprWithTarget(n.Right, "rax")
-
-		// Load LHS back into rbx
-		cg.EmitIndent(1, fmt.Sprintf("mov rbx, [rbp-%d]", lhsOffset))
-
-		switch op {
-		case "+":
-			cg.EmitIndent(1, "add rax, rbx")
-		case "-":
-			cg.EmitIndent(1, "sub rbx, rax")
-			cg.EmitIndent(1, "mov rax, rbx")
-		case "*":
-			cg.EmitIndent(1, "imul rax, rbx")
-		case "<":
-			cg.EmitIndent(1, "cmp rbx, rax")
-			cg.EmitIndent(1, "setl al")
-			cg.EmitIndent(1, "movzx rax, al")
-		case ">":
-			cg.EmitIndent(1, "cmp rbx, rax")
-			cg.EmitIndent(1, "setg al")
-			cg.EmitIndent(1, "movzx rax, al")
-		case "==":
-			cg.EmitIndent(1, "cmp rbx, rax")
-			cg.EmitIndent(1, "sete al")
-			cg.EmitIndent(1, "movzx rax, al")
-		case "<=":
-			cg.EmitIndent(1, "cmp rbx, rax")
-			cg.EmitIndent(1, "setle al")
-			cg.EmitIndent(1, "movzx rax, al")
-		case ">=":
-			cg.EmitIndent(1, "cmp rbx, rax")
-			cg.EmitIndent(1, "setge al")
-			cg.EmitIndent(1, "movzx rax, al")
-		}
+		// Tear down stack frame before exit
+		cg.ins("mov", "rsp", "rbp")
+		cg.ins("pop", "rbp")
 
-		cg.EmitIndent(1, "add rsp, 8")
-		cg.stackPos -= 8
+		cg.ins("mov", "rax", "60") // syscall: exit
+		cg.ins("syscall")
 
-		return target
 	default:
-		panic(fmt.Sprintf("unsupported expression: %T", n))
+		cg.errorf("block is not terminated")
 	}
-
 }
@@ -0,0 +1,409 @@
+package codegen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/BergurDavidsen/bingus/internal/ir"
+)
+
+// Debug information is written as DWARF 4 in three sections of data
+// directives appended to the assembly: .debug_abbrev, .debug_info with one
+// compile unit holding the program's function and its variables, and
+// .debug_line mapping instruction addresses to source lines. Addresses
+// are labels the assembler and linker fill in.
+
+// debugInfo is what EnableDebug records about the source.
+type debugInfo struct {
+	file string // the source file, as named on the command line
+	dir  string // the directory the compiler ran in
+	vars []debugVar
+}
+
+// debugVar is a source variable kept in a stack slot.
+type debugVar struct {
+	name   string
+	line   int // line of its declaration
+	offset int // from rbp
+}
+
+// lineRow is a row of the line table: the label of the first instruction
+// generated for a source line.
+type lineRow struct {
+	label string
+	line  int
+}
+
+// codeEnd is the label after the program's last instruction, ending the
+// function and the line table before the runtime helpers.
+const codeEnd = ".code_end"
+
+// EnableDebug makes Gen keep each variable in a stack slot of its own and
+// String append DWARF debug information, so the program can be debugged
+// by source line and variable name. file is the source file and dir the
+// directory relative to which the debugger finds it.
+//
+// A variable is described only if it is held by a single IR register and
+// no other variable shares its name, which is always the case at -O0
+// unless a name is shadowed. Optimization passes that split a variable
+// across registers leave it out.
+func (cg *CodeGen) EnableDebug(file, dir string) {
+	cg.debug = &debugInfo{file: file, dir: dir}
+}
+
+// debugVars picks the registers of the variables to describe and records
+// them. They are pinned to the first stack slots, in order.
+func (cg *CodeGen) debugVars(fn *ir.Func) []ir.Reg {
+	used := map[ir.Reg]bool{}
+	line := map[ir.Reg]int{}
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			for _, arg := range instr.Args {
+				used[arg] = true
+			}
+			if instr.Dst != ir.NoReg {
+				used[instr.Dst] = true
+				if line[instr.Dst] == 0 {
+					line[instr.Dst] = instr.Line
+				}
+			}
+		}
+		for _, r := range b.Term.Uses() {
+			used[*r] = true
+		}
+	}
+
+	regs := map[string][]ir.Reg{}
+	for r, name := range fn.VarNames {
+		regs[name] = append(regs[name], r)
+	}
+	var pinned []ir.Reg
+	for _, rs := range regs {
+		if len(rs) == 1 && used[rs[0]] {
+			pinned = append(pinned, rs[0])
+		}
+	}
+	sort.Slice(pinned, func(i, j int) bool { return pinned[i] < pinned[j] })
+
+	cg.debug.vars = nil
+	for i, r := range pinned {
+		cg.debug.vars = append(cg.debug.vars, debugVar{name: fn.VarNames[r], line: line[r], offset: -8 * (i + 1)})
+	}
+	return pinned
+}
+
+// DWARF constants used below.
+const (
+	dwTagCompileUnit = 0x11
+	dwTagSubprogram  = 0x2e
+	dwTagVariable    = 0x34
+	dwTagBaseType    = 0x24
+
+	dwAtLocation  = 0x02
+	dwAtName      = 0x03
+	dwAtByteSize  = 0x0b
+	dwAtStmtList  = 0x10
+	dwAtLowPC     = 0x11
+	dwAtHighPC    = 0x12
+	dwAtLanguage  = 0x13
+	dwAtCompDir   = 0x1b
+	dwAtProducer  = 0x25
+	dwAtDeclFile  = 0x3a
+	dwAtDeclLine  = 0x3b
+	dwAtEncoding  = 0x3e
+	dwAtExternal  = 0x3f
+	dwAtFrameBase = 0x40
+	dwAtType      = 0x49
+
+	dwFormAddr        = 0x01
+	dwFormData2       = 0x05
+	dwFormString      = 0x08
+	dwFormData1       = 0x0b
+	dwFormUdata       = 0x0f
+	dwFormRef4        = 0x13
+	dwFormSecOffset   = 0x17
+	dwFormExprloc     = 0x18
+	dwFormFlagPresent = 0x19
+
+	dwOpBreg6 = 0x76 // rbp + offset
+	dwOpFbreg = 0x91 // frame base + offset
+
+	dwAteSigned = 0x05
+
+	// gdb has no Bingus mode. C evaluates expressions over integer
+	// variables the same way.
+	dwLangC99 = 0x0c
+
+	dwLnsCopy         = 0x01
+	dwLnsAdvanceLine  = 0x03
+	dwLneEndSequence  = 0x01
+	dwLneSetAddress   = 0x02
+	lineOpcodeBase    = 13
+	dwarfVersion      = 4
+	dwarfAddrSize     = 8
+	compileUnitHeader = 11 // unit length, version, abbrev offset, address size
+)
+
+// Abbreviation codes.
+const (
+	abbrevCompileUnit = iota + 1
+	abbrevSubprogram
+	abbrevVariable
+	abbrevBaseType
+)
+
+// dwarfData is the contents of a debug section: bytes, and 8-byte
+// addresses of labels that are filled in when the program is linked.
+type dwarfData struct {
+	items []dwarfItem
+	size  int
+}
+
+type dwarfItem struct {
+	bytes []byte
+	addr  string // a label, if this item is an address
+}
+
+func (d *dwarfData) byte(bs ...byte) {
+	if n := len(d.items); n > 0 && d.items[n-1].addr == "" {
+		d.items[n-1].bytes = append(d.items[n-1].bytes, bs...)
+	} else {
+		d.items = append(d.items, dwarfItem{bytes: append([]byte(nil), bs...)})
+	}
+	d.size += len(bs)
+}
+
+func (d *dwarfData) u16(v int) {
+	d.byte(byte(v), byte(v>>8))
+}
+
+func (d *dwarfData) u32(v int) {
+	d.byte(byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (d *dwarfData) uleb(v uint64) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		d.byte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func (d *dwarfData) sleb(v int64) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		done := v == 0 && b&0x40 == 0 || v == -1 && b&0x40 != 0
+		if !done {
+			b |= 0x80
+		}
+		d.byte(b)
+		if done {
+			return
+		}
+	}
+}
+
+// str appends a null-terminated string.
+func (d *dwarfData) str(s string) {
+	d.byte(append([]byte(s), 0)...)
+}
+
+// addr appends the address of a label in the program's code. Local labels
+// are qualified with _start, since the debug sections come after the
+// runtime helpers.
+func (d *dwarfData) addr(label string) {
+	if strings.HasPrefix(label, ".") {
+		label = "_start" + label
+	}
+	d.items = append(d.items, dwarfItem{addr: label})
+	d.size += dwarfAddrSize
+}
+
+func (d *dwarfData) append(o *dwarfData) {
+	for _, item := range o.items {
+		if item.addr != "" {
+			d.addr(item.addr)
+		} else {
+			d.byte(item.bytes...)
+		}
+	}
+}
+
+// unit returns body prefixed with its 32-bit length.
+func unit(body *dwarfData) *dwarfData {
+	d := &dwarfData{}
+	d.u32(body.size)
+	d.append(body)
+	return d
+}
+
+// asm renders the data as a section of NASM data directives.
+func (d *dwarfData) asm(section string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "section %s noalloc\n", section)
+	for _, item := range d.items {
+		if item.addr != "" {
+			fmt.Fprintf(&sb, "  dq %s\n", item.addr)
+			continue
+		}
+		for i := 0; i < len(item.bytes); i += 16 {
+			chunk := item.bytes[i:min(i+16, len(item.bytes))]
+			nums := make([]string, len(chunk))
+			for j, b := range chunk {
+				nums[j] = fmt.Sprintf("0x%02x", b)
+			}
+			fmt.Fprintf(&sb, "  db %s\n", strings.Join(nums, ", "))
+		}
+	}
+	return sb.String()
+}
+
+// debugSections renders the debug information for a program whose line
+// table has the given rows.
+func (cg *CodeGen) debugSections(rows []lineRow) string {
+	return debugAbbrev().asm(".debug_abbrev") +
+		cg.debugInfoUnit().asm(".debug_info") +
+		cg.debugLine(rows).asm(".debug_line")
+}
+
+func debugAbbrev() *dwarfData {
+	d := &dwarfData{}
+	abbrev := func(code, tag int, children bool, attrs ...int) {
+		d.uleb(uint64(code))
+		d.uleb(uint64(tag))
+		if children {
+			d.byte(1)
+		} else {
+			d.byte(0)
+		}
+		for _, a := range attrs {
+			d.uleb(uint64(a))
+		}
+		d.byte(0, 0)
+	}
+	abbrev(abbrevCompileUnit, dwTagCompileUnit, true,
+		dwAtProducer, dwFormString,
+		dwAtLanguage, dwFormData2,
+		dwAtName, dwFormString,
+		dwAtCompDir, dwFormString,
+		dwAtLowPC, dwFormAddr,
+		dwAtHighPC, dwFormAddr,
+		dwAtStmtList, dwFormSecOffset)
+	abbrev(abbrevSubprogram, dwTagSubprogram, true,
+		dwAtName, dwFormString,
+		dwAtExternal, dwFormFlagPresent,
+		dwAtLowPC, dwFormAddr,
+		dwAtHighPC, dwFormAddr,
+		dwAtFrameBase, dwFormExprloc)
+	abbrev(abbrevVariable, dwTagVariable, false,
+		dwAtName, dwFormString,
+		dwAtDeclFile, dwFormData1,
+		dwAtDeclLine, dwFormUdata,
+		dwAtType, dwFormRef4,
+		dwAtLocation, dwFormExprloc)
+	abbrev(abbrevBaseType, dwTagBaseType, false,
+		dwAtName, dwFormString,
+		dwAtEncoding, dwFormData1,
+		dwAtByteSize, dwFormData1)
+	d.byte(0)
+	return d
+}
+
+// debugInfoUnit describes the program as a compile unit with an int type
+// and a function whose frame base is rbp, holding the variables.
+func (cg *CodeGen) debugInfoUnit() *dwarfData {
+	cu := &dwarfData{}
+	cu.uleb(abbrevCompileUnit)
+	cu.str("bingus")
+	cu.u16(dwLangC99)
+	cu.str(cg.debug.file)
+	cu.str(cg.debug.dir)
+	cu.addr("_start")
+	cu.addr(codeEnd)
+	cu.u32(0) // the line table is the only one in .debug_line
+
+	intType := compileUnitHeader + cu.size
+	cu.uleb(abbrevBaseType)
+	cu.str("int")
+	cu.byte(dwAteSigned, 8)
+
+	cu.uleb(abbrevSubprogram)
+	cu.str(cg.fn.Name)
+	cu.addr("_start")
+	cu.addr(codeEnd)
+	cu.uleb(2)
+	cu.byte(dwOpBreg6, 0)
+
+	for _, v := range cg.debug.vars {
+		loc := &dwarfData{}
+		loc.byte(dwOpFbreg)
+		loc.sleb(int64(v.offset))
+
+		cu.uleb(abbrevVariable)
+		cu.str(v.name)
+		cu.byte(1) // file 1 of the line table
+		cu.uleb(uint64(v.line))
+		cu.u32(intType)
+		cu.uleb(uint64(loc.size))
+		cu.append(loc)
+	}
+	cu.byte(0) // end of the subprogram's children
+	cu.byte(0) // end of the compile unit's children
+
+	body := &dwarfData{}
+	body.u16(dwarfVersion)
+	body.u32(0) // the abbreviations are the only ones in .debug_abbrev
+	body.byte(dwarfAddrSize)
+	body.append(cu)
+	return unit(body)
+}
+
+// debugLine is the line number program: one row per run of instructions
+// for a source line, each giving its address explicitly.
+func (cg *CodeGen) debugLine(rows []lineRow) *dwarfData {
+	header := &dwarfData{}
+	header.byte(1, 1, 1) // minimum instruction length, max ops, default is_stmt
+	header.byte(0xfb)    // line base -5
+	header.byte(14)      // line range
+	header.byte(lineOpcodeBase)
+	header.byte(0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1) // standard opcode lengths
+	header.byte(0)                                  // no include directories
+	header.str(cg.debug.file)
+	header.byte(0, 0, 0) // directory, modification time, length
+	header.byte(0)
+
+	setAddress := func(d *dwarfData, label string) {
+		d.byte(0)
+		d.uleb(1 + dwarfAddrSize)
+		d.byte(dwLneSetAddress)
+		d.addr(label)
+	}
+	program := &dwarfData{}
+	line := 1
+	for _, row := range rows {
+		setAddress(program, row.label)
+		if row.line != line {
+			program.byte(dwLnsAdvanceLine)
+			program.sleb(int64(row.line - line))
+			line = row.line
+		}
+		program.byte(dwLnsCopy)
+	}
+	setAddress(program, codeEnd)
+	program.byte(0, 1, dwLneEndSequence)
+
+	body := &dwarfData{}
+	body.u16(dwarfVersion)
+	body.u32(header.size)
+	body.append(header)
+	body.append(program)
+	return unit(body)
+}
@@ -0,0 +1,93 @@
+package codegen
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestDebugInfo builds a program with debug information and reads the
+// line table and variables back from the executable.
+func TestDebugInfo(t *testing.T) {
+	requireTools(t)
+
+	src := `let i = 0;
+let sum = 0;
+while (i < 5) {
+    sum = sum + i;
+    i = i + 1;
+}
+print sum;
+return sum;
+`
+	for level := 0; level <= 1; level++ {
+		asm := compile(t, src, level, func(cg *CodeGen) { cg.EnableDebug("test.bng", "/src") })
+		dir := t.TempDir()
+		if out, code := run(t, dir, asm); out != "10\n" || code != 10 {
+			t.Fatalf("-O%d: output %q, exit %d", level, out, code)
+		}
+
+		exe, err := elf.Open(filepath.Join(dir, "prog"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer exe.Close()
+		data, err := exe.DWARF()
+		if err != nil {
+			t.Fatalf("-O%d: %v", level, err)
+		}
+
+		r := data.Reader()
+		cu, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cu.Tag != dwarf.TagCompileUnit || cu.Val(dwarf.AttrName) != "test.bng" || cu.Val(dwarf.AttrCompDir) != "/src" {
+			t.Fatalf("-O%d: compile unit %+v", level, cu)
+		}
+		lr, err := data.LineReader(cu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lines []int
+		var entry dwarf.LineEntry
+		for lr.Next(&entry) == nil {
+			if !entry.EndSequence {
+				lines = append(lines, entry.Line)
+			}
+		}
+		// The loop's jump back is attributed to the while on line 3.
+		if want := []int{1, 2, 3, 4, 5, 3, 7, 8}; level == 0 && !reflect.DeepEqual(lines, want) {
+			t.Errorf("line table = %v, want %v", lines, want)
+		}
+		if len(lines) == 0 || lines[len(lines)-1] != 8 {
+			t.Errorf("-O%d: line table = %v", level, lines)
+		}
+
+		if level > 0 {
+			continue
+		}
+		vars := map[string][]byte{}
+		for {
+			e, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e == nil {
+				break
+			}
+			if e.Tag == dwarf.TagVariable {
+				vars[e.Val(dwarf.AttrName).(string)] = e.Val(dwarf.AttrLocation).([]byte)
+			}
+		}
+		want := map[string][]byte{
+			"i":   {dwOpFbreg, 0x78}, // -8
+			"sum": {dwOpFbreg, 0x70}, // -16
+		}
+		if !reflect.DeepEqual(vars, want) {
+			t.Errorf("variables = %v, want %v", vars, want)
+		}
+	}
+}
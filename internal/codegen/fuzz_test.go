@@ -0,0 +1,69 @@
+package codegen
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/ir"
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/randprog"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+func FuzzCompile(f *testing.F) {
+	seeds := []string{
+		"",
+		"// only a comment",
+		"return 0;",
+		"print x;",
+		"x = 1;",
+		"let x = 1; let x = 2;",
+		"break;",
+		"continue;",
+		"if (true) { let y = 1; } print y;",
+		"let x = 1; while (x < 3) { let x = x + 1; break; }",
+		"return 7 / 0;",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+	r := rand.New(rand.NewPCG(2, 2))
+	for i := 0; i < 4; i++ {
+		f.Add(randprog.Generate(r))
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		tokens, err := lexer.Lex(input)
+		if err != nil {
+			return
+		}
+		p := parser.Parser{Tokens: tokens}
+		prog, err := p.ParseProgram()
+		if err != nil {
+			return
+		}
+
+		syms, err := resolve.Resolve(prog)
+		if err != nil {
+			if _, ok := err.(*resolve.Error); !ok {
+				t.Fatalf("Resolve returned %T, want *resolve.Error", err)
+			}
+			return
+		}
+
+		fn, err := ir.Lower(prog, syms)
+		if err != nil {
+			if _, ok := err.(*ir.Error); !ok {
+				t.Fatalf("Lower returned %T, want *ir.Error", err)
+			}
+			return
+		}
+
+		if err := NewCodeGen().Gen(fn); err != nil {
+			if _, ok := err.(*Error); !ok {
+				t.Fatalf("Gen returned %T, want *Error", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,335 @@
+package codegen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/BergurDavidsen/bingus/internal/ir"
+)
+
+// msgNoStackMap is the panic message of a collection triggered by a call
+// to heap_alloc that has no stack map.
+const msgNoStackMap = "no stack map for alloc"
+
+// safepoint is a call to heap_alloc, where the collector may run, with the
+// stack map of the pointers that are live across it.
+type safepoint struct {
+	label string // label of the return address
+	regs  int    // bit i is set when calleeSaved[i] holds a pointer
+	slots []int  // offsets from rbp of the stack slots that hold pointers
+}
+
+// EnableGCStats makes the program print how many collections it ran and
+// how many bytes they freed to stderr when it exits.
+func (cg *CodeGen) EnableGCStats() {
+	cg.gcStats = true
+}
+
+// objWord is word i of an object.
+type objWord struct {
+	obj *ir.Object
+	i   int64
+}
+
+// pointers returns the registers and object words of fn that hold
+// pointers: the results of alloc and the registers and words they are
+// copied, stored and loaded to.
+func pointers(fn *ir.Func) (ir.RegSet, map[objWord]bool) {
+	ptrs := ir.RegSet{}
+	words := map[objWord]bool{}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range fn.Blocks {
+			for _, instr := range b.Instrs {
+				switch {
+				case instr.Op == ir.OpStore:
+					w := objWord{instr.Obj, instr.Imm}
+					if ptrs[instr.Args[0]] && !words[w] {
+						words[w] = true
+						changed = true
+					}
+				case ptrs[instr.Dst]:
+				case instr.Op == ir.OpAlloc,
+					instr.Op == ir.OpCopy && ptrs[instr.Args[0]],
+					instr.Op == ir.OpLoad && words[objWord{instr.Obj, instr.Imm}]:
+					ptrs[instr.Dst] = true
+					changed = true
+				}
+			}
+		}
+	}
+	return ptrs, words
+}
+
+// gcRoots returns, for each alloc in fn, the pointers in registers that
+// are live across it, in register order. The object words that may hold
+// pointers are roots at every alloc; they are returned in frame order.
+func gcRoots(fn *ir.Func) (map[*ir.Instr][]ir.Reg, []objWord) {
+	ptrs, words := pointers(fn)
+	live := ir.ComputeLiveness(fn)
+	roots := map[*ir.Instr][]ir.Reg{}
+	for _, b := range fn.Blocks {
+		cur := ir.RegSet{}
+		for r := range live.Out[b] {
+			cur[r] = true
+		}
+		for _, r := range b.Term.Uses() {
+			cur[*r] = true
+		}
+		for i := len(b.Instrs) - 1; i >= 0; i-- {
+			instr := b.Instrs[i]
+			delete(cur, instr.Dst)
+			if instr.Op == ir.OpAlloc {
+				var regs []ir.Reg
+				for r := range cur {
+					if ptrs[r] {
+						regs = append(regs, r)
+					}
+				}
+				sort.Slice(regs, func(i, j int) bool { return regs[i] < regs[j] })
+				roots[instr] = regs
+			}
+			for _, arg := range instr.Args {
+				cur[arg] = true
+			}
+		}
+	}
+
+	var ptrWords []objWord
+	for w := range words {
+		ptrWords = append(ptrWords, w)
+	}
+	sort.Slice(ptrWords, func(i, j int) bool {
+		a, b := ptrWords[i], ptrWords[j]
+		return a.obj.ID < b.obj.ID || a.obj.ID == b.obj.ID && a.i < b.i
+	})
+	return roots, ptrWords
+}
+
+// safepoint labels the return address of the call to heap_alloc just
+// generated for instr and records where the pointers live across it are.
+func (cg *CodeGen) safepoint(instr *ir.Instr) {
+	sp := safepoint{label: fmt.Sprintf(".gc_%d", len(cg.safepoints))}
+	var locs []string
+	for _, r := range cg.roots[instr] {
+		locs = append(locs, cg.loc(r))
+	}
+	for _, w := range cg.ptrWords {
+		locs = append(locs, cg.word(w.obj, w.i))
+	}
+	for _, loc := range locs {
+		if isMem(loc) {
+			var off int
+			if _, err := fmt.Sscanf(loc, "QWORD [rbp-%d]", &off); err != nil {
+				cg.errorf("pointer in unexpected location %s", loc)
+			}
+			sp.slots = append(sp.slots, -off)
+			continue
+		}
+		i := 0
+		for i < len(calleeSaved) && calleeSaved[i] != loc {
+			i++
+		}
+		if i == len(calleeSaved) {
+			cg.errorf("pointer live across alloc in caller-saved %s", loc)
+		}
+		sp.regs |= 1 << i
+	}
+	cg.label(sp.label)
+	cg.safepoints = append(cg.safepoints, sp)
+}
+
+// gcRuntime returns the garbage collector and the stack maps it reads.
+//
+// gc_collect is a mark-and-sweep collector. It looks up the stack map of
+// the call to heap_alloc that triggered it by its return address, marks
+// the blocks that the registers and stack slots listed there point to,
+// and then walks every arena, putting the blocks that were not marked on
+// the free list. Blocks hold no pointers, so marking stops at the roots.
+// After a collection, the next one waits until as many bytes as are still
+// in use, and at least an arena's worth, have been allocated.
+func (cg *CodeGen) gcRuntime() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `
+		section .data
+		gc_threshold dq %[1]d
+
+		section .bss
+		gc_allocated resq 1
+		gc_collections resq 1
+		gc_freed_bytes resq 1
+
+		section .text
+		; gc_collect collects garbage when heap_alloc is called from rsi.
+		; rdi points to rbx, r12, r13, r14 and r15 as they were at the call.
+		gc_collect:
+			mov rax, [heap_arena]
+			test rax, rax
+			jz .find_map
+			mov rdx, [heap_next]
+			mov [rax+8], rdx
+
+		.find_map:
+			lea rcx, [gc_maps]
+		.next_map:
+			mov rax, [rcx]
+			test rax, rax
+			jz .no_map
+			cmp rax, rsi
+			je .mark_regs
+			mov rax, [rcx+16]
+			lea rcx, [rcx+rax*8+24]
+			jmp .next_map
+
+		.mark_regs:
+			mov rdx, [rcx+8]
+			xor r8, r8
+		.mark_reg:
+			test rdx, rdx
+			jz .mark_slots
+			test rdx, 1
+			jz .next_reg
+			mov rax, [rdi+r8*8]
+			call gc_mark
+		.next_reg:
+			shr rdx, 1
+			inc r8
+			jmp .mark_reg
+
+		.mark_slots:
+			mov r8, [rcx+16]
+			add rcx, 24
+		.mark_slot:
+			test r8, r8
+			jz .sweep
+			mov rax, [rcx]
+			mov rax, [rbp+rax]
+			call gc_mark
+			add rcx, 8
+			dec r8
+			jmp .mark_slot
+
+		.sweep:
+			xor r9, r9
+			mov rcx, [heap_arenas]
+		.sweep_arena:
+			test rcx, rcx
+			jz .swept
+			mov rdx, [rcx+8]
+			lea rax, [rcx+32]
+		.sweep_block:
+			cmp rax, rdx
+			ja .next_arena
+			mov r8, [rax-8]
+			cmp r8, %[3]d
+			je .reachable
+			cmp r8, %[2]d
+			jne .next_block
+			mov qword [rax-8], %[4]d
+			mov r8, [heap_free_list]
+			mov [rax], r8
+			mov [heap_free_list], rax
+			mov r8, [rax-16]
+			add [gc_freed_bytes], r8
+`, arenaSize, tagAllocated, tagMarked, tagFree)
+	if cg.heapDebug {
+		sb.WriteString(`			dec qword [heap_live]
+			sub [heap_live_bytes], r8
+`)
+	}
+	fmt.Fprintf(&sb, `			jmp .next_block
+		.reachable:
+			mov qword [rax-8], %[2]d
+			add r9, [rax-16]
+		.next_block:
+			add rax, [rax-16]
+			add rax, 16
+			jmp .sweep_block
+		.next_arena:
+			mov rcx, [rcx]
+			jmp .sweep_arena
+
+		.swept:
+			inc qword [gc_collections]
+			mov qword [gc_allocated], 0
+			cmp r9, %[1]d
+			jae .threshold
+			mov r9, %[1]d
+		.threshold:
+			mov [gc_threshold], r9
+			ret
+
+		.no_map:
+			lea rsi, [no_stack_map_msg]
+			mov rdx, %[4]d
+			jmp runtime_panic
+
+		; gc_mark marks the block rax points to. rax may be 0, from a
+		; variable that was never assigned on some path.
+		gc_mark:
+			test rax, rax
+			jz .not_block
+			cmp qword [rax-8], %[2]d
+			jne .not_block
+			mov qword [rax-8], %[3]d
+		.not_block:
+			ret
+`, arenaSize, tagAllocated, tagMarked, len(msgNoStackMap)+1)
+	if cg.gcStats {
+		fmt.Fprintf(&sb, `
+		; gc_stats reports the collections. It keeps rdi, the exit status.
+		gc_stats:
+			push rdi
+			push rdi
+			mov rax, 1
+			mov rdi, 2
+			lea rsi, [gc_collections_msg]
+			mov rdx, %[1]d
+			syscall
+			mov rdi, [gc_collections]
+			mov r10, 2
+			call write_number
+			mov rax, 1
+			mov rdi, 2
+			lea rsi, [gc_freed_msg]
+			mov rdx, %[2]d
+			syscall
+			mov rdi, [gc_freed_bytes]
+			mov r10, 2
+			call write_number
+			pop rdi
+			pop rdi
+			ret
+`, len(gcCollections), len(gcFreed))
+	}
+
+	sb.WriteString("\n\t\tsection .rodata\n")
+	sb.WriteString(message("no_stack_map_msg", msgNoStackMap))
+	if cg.gcStats {
+		sb.WriteString(data("gc_collections_msg", gcCollections))
+		sb.WriteString(data("gc_freed_msg", gcFreed))
+	}
+	// Each stack map is the return address of a call to heap_alloc, the
+	// mask of callee-saved registers holding pointers, and the number of
+	// stack slots holding pointers followed by their offsets from rbp.
+	// The labels are qualified with _start, since the maps come after the
+	// runtime helpers. A zero ends the maps, so a call without one panics
+	// instead of reading past them.
+	sb.WriteString("\t\tgc_maps:\n")
+	for _, sp := range cg.safepoints {
+		words := []string{"_start" + sp.label, fmt.Sprint(sp.regs), fmt.Sprint(len(sp.slots))}
+		for _, off := range sp.slots {
+			words = append(words, fmt.Sprint(off))
+		}
+		fmt.Fprintf(&sb, "\t\t\tdq %s\n", strings.Join(words, ", "))
+	}
+	sb.WriteString("\t\t\tdq 0\n")
+	return sb.String()
+}
+
+// The statistics --gc-stats prints, each followed by a number.
+const (
+	gcCollections = "gc collections: "
+	gcFreed       = "gc bytes freed: "
+)
@@ -0,0 +1,261 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BergurDavidsen/bingus/internal/ir"
+)
+
+// Messages of heap errors.
+const (
+	msgAllocSize   = "invalid allocation size"
+	msgOutOfMemory = "out of memory"
+	msgDoubleFree  = "double free"
+)
+
+// arenaSize is the size of the arenas the allocator maps from the kernel.
+// Larger blocks get an arena of their own.
+const arenaSize = 1 << 20
+
+// Tags in the header of each block. The collector marks the blocks it
+// reaches, and the debug mode checks the tag on free.
+const (
+	tagAllocated = 0xa110c
+	tagFree      = 0xf4ee
+	tagMarked    = 0x3a4ced
+)
+
+// EnableHeapDebug makes the allocator check each free: freeing a block
+// twice prints an error and exits with PanicStatus. When the program
+// exits, the number of blocks that were neither freed nor collected and
+// their size are printed to stderr.
+func (cg *CodeGen) EnableHeapDebug() {
+	cg.heapDebug = true
+}
+
+// usesHeap reports whether fn allocates.
+func usesHeap(fn *ir.Func) bool {
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Op == ir.OpAlloc {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// heapRuntime returns the allocator.
+//
+// Blocks are carved out of arenas, which are mapped with mmap and linked
+// through their 16-byte header, holding the next arena and where the blocks
+// in it end. A block is a 16-byte header, holding its size and a tag,
+// followed by at least 16 bytes of memory, a multiple of 16 in all.
+// heap_alloc takes the first block on the free list that is large enough,
+// or else carves a new one off the current arena. When that runs out, it
+// first collects garbage if enough has been allocated since the last
+// collection, and then maps a new arena. Blocks too large for an arena get
+// one of their own. heap_free puts a block on the front of the free list,
+// linked through its first 8 bytes.
+func (cg *CodeGen) heapRuntime() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `
+		section .bss
+		heap_free_list resq 1
+		heap_next resq 1
+		heap_end resq 1
+		heap_arena resq 1
+		heap_arenas resq 1
+		heap_live resq 1
+		heap_live_bytes resq 1
+
+		section .text
+		; heap_alloc returns in rax a pointer to a new block of rdi bytes.
+		heap_alloc:
+			test rdi, rdi
+			js .bad_size
+			add rdi, 15
+			and rdi, -16
+			jnz .search_start
+			mov rdi, 16
+
+		.search_start:
+			lea rcx, [heap_free_list]
+		.search:
+			mov rax, [rcx]
+			test rax, rax
+			jz .bump
+			cmp [rax-16], rdi
+			jae .take
+			mov rcx, rax
+			jmp .search
+		.take:
+			mov rdx, [rax]
+			mov [rcx], rdx
+			mov rdi, [rax-16]
+			jmp .done
+
+		.bump:
+			mov rax, [heap_next]
+			lea rdx, [rax+rdi+16]
+			cmp rdx, [heap_end]
+			jbe .carve
+			mov rdx, [gc_allocated]
+			cmp rdx, [gc_threshold]
+			jae .collect
+
+			mov rsi, rdi
+			add rsi, 32
+			cmp rsi, %[1]d
+			ja .map
+			mov rsi, %[1]d
+		.map:
+			push rsi
+			push rdi
+			mov rax, 9
+			xor rdi, rdi
+			mov rdx, 3
+			mov r10, 0x22
+			mov r8, -1
+			xor r9, r9
+			syscall
+			pop rdi
+			pop rsi
+			cmp rax, -4095
+			jae .out_of_memory
+			mov rdx, [heap_arenas]
+			mov [rax], rdx
+			mov [heap_arenas], rax
+			cmp rsi, %[1]d
+			ja .own_arena
+
+			; Record where the blocks in the old arena end.
+			mov rcx, [heap_arena]
+			test rcx, rcx
+			jz .new_arena
+			mov rdx, [heap_next]
+			mov [rcx+8], rdx
+		.new_arena:
+			mov [heap_arena], rax
+			lea rdx, [rax+rsi]
+			mov [heap_end], rdx
+			add rax, 16
+
+		.carve:
+			lea rdx, [rax+rdi+16]
+			mov [heap_next], rdx
+			jmp .header
+		.own_arena:
+			lea rdx, [rax+rsi]
+			mov [rax+8], rdx
+			add rax, 16
+		.header:
+			mov [rax], rdi
+			add rax, 16
+
+		.done:
+			mov qword [rax-8], %[2]d
+			add [gc_allocated], rdi
+`, arenaSize, tagAllocated)
+	if cg.heapDebug {
+		sb.WriteString(`			inc qword [heap_live]
+			add [heap_live_bytes], rdi
+`)
+	}
+	fmt.Fprintf(&sb, `			ret
+
+		; Collect garbage and try again. The collector finds the pointers
+		; in registers among the saved ones.
+		.collect:
+			push rdi
+			push r15
+			push r14
+			push r13
+			push r12
+			push rbx
+			mov rdi, rsp
+			mov rsi, [rsp+48]
+			call gc_collect
+			add rsp, 40
+			pop rdi
+			jmp .search_start
+
+		.bad_size:
+			lea rsi, [alloc_size_msg]
+			mov rdx, %[1]d
+			jmp runtime_panic
+		.out_of_memory:
+			lea rsi, [out_of_memory_msg]
+			mov rdx, %[2]d
+			jmp runtime_panic
+
+		; heap_free frees the block at rdi.
+		heap_free:
+`, len(msgAllocSize)+1, len(msgOutOfMemory)+1)
+	if cg.heapDebug {
+		fmt.Fprintf(&sb, `			cmp qword [rdi-8], %[1]d
+			je .double_free
+			dec qword [heap_live]
+			mov rax, [rdi-16]
+			sub [heap_live_bytes], rax
+`, tagFree)
+	}
+	fmt.Fprintf(&sb, `			mov qword [rdi-8], %[1]d
+			mov rax, [heap_free_list]
+			mov [rdi], rax
+			mov [heap_free_list], rdi
+			ret
+`, tagFree)
+	if cg.heapDebug {
+		fmt.Fprintf(&sb, `
+		.double_free:
+			lea rsi, [double_free_msg]
+			mov rdx, %[1]d
+			jmp runtime_panic
+
+		; heap_check reports the blocks that were not freed. It keeps rdi,
+		; the exit status.
+		heap_check:
+			cmp qword [heap_live], 0
+			je .no_leaks
+			push rdi
+			push rdi
+			mov rax, 1
+			mov rdi, 2
+			lea rsi, [leaked_blocks_msg]
+			mov rdx, %[2]d
+			syscall
+			mov rdi, [heap_live]
+			mov r10, 2
+			call write_number
+			mov rax, 1
+			mov rdi, 2
+			lea rsi, [leaked_bytes_msg]
+			mov rdx, %[3]d
+			syscall
+			mov rdi, [heap_live_bytes]
+			mov r10, 2
+			call write_number
+			pop rdi
+			pop rdi
+		.no_leaks:
+			ret
+`, len(msgDoubleFree)+1, len(leakedBlocks), len(leakedBytes))
+	}
+	sb.WriteString("\n\t\tsection .rodata\n")
+	sb.WriteString(message("alloc_size_msg", msgAllocSize))
+	sb.WriteString(message("out_of_memory_msg", msgOutOfMemory))
+	if cg.heapDebug {
+		sb.WriteString(message("double_free_msg", msgDoubleFree))
+		sb.WriteString(data("leaked_blocks_msg", leakedBlocks))
+		sb.WriteString(data("leaked_bytes_msg", leakedBytes))
+	}
+	return sb.String()
+}
+
+// The leak report, each followed by a number.
+const (
+	leakedBlocks = "leaked blocks: "
+	leakedBytes  = "leaked bytes: "
+)
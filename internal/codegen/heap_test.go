@@ -0,0 +1,188 @@
+package codegen
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHeap(t *testing.T) {
+	requireTools(t)
+
+	tests := []struct {
+		src    string
+		debug  bool
+		stdout string
+		stderr string
+		status int
+	}{
+		{
+			// Freed blocks are reused, and a block too large for an
+			// arena gets its own.
+			src: `
+let a = alloc(40);
+let b = alloc(40);
+print a == b;
+free(a);
+let c = alloc(24);
+print c == a;
+let big = alloc(2000000);
+free(big);
+free(b);
+free(c);
+return 3;`,
+			debug:  true,
+			stdout: "0\n1\n",
+			status: 3,
+		},
+		{
+			src:    "let keep = alloc(1); let p = alloc(0); free(p); return 0;",
+			debug:  true,
+			stderr: "leaked blocks: 1\nleaked bytes: 16\n",
+		},
+		{
+			src:    "let p = alloc(8); free(p); free(p); return 0;",
+			debug:  true,
+			stderr: "double free\n",
+			status: PanicStatus,
+		},
+		{
+			src: "let p = alloc(8); return 0;",
+		},
+		{
+			src:    "print 1; let p = alloc(0 - 1); return 0;",
+			stdout: "1\n",
+			stderr: "invalid allocation size\n",
+			status: PanicStatus,
+		},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		for level := 0; level <= 2; level++ {
+			asm := compile(t, tt.src, level, func(cg *CodeGen) {
+				if tt.debug {
+					cg.EnableHeapDebug()
+				}
+			})
+			stdout, stderr, status := runCmd(t, dir, asm, nil)
+			if stdout != tt.stdout || stderr != tt.stderr || status != tt.status {
+				t.Errorf("-O%d on %q: got stdout %q, stderr %q, exit %d; want stdout %q, stderr %q, exit %d",
+					level, tt.src, stdout, stderr, status, tt.stdout, tt.stderr, tt.status)
+			}
+		}
+	}
+}
+
+func TestGarbageCollection(t *testing.T) {
+	requireTools(t)
+
+	// More pointers are live across the loop than there are callee-saved
+	// registers, so some are found through stack slots. Were any of them
+	// collected, a later alloc would reuse it, and freeing it at the end
+	// would be a double free.
+	const src = `
+let a = alloc(8);
+let b = alloc(8);
+let c = alloc(8);
+let d = alloc(8);
+let e = alloc(8);
+let f = alloc(8);
+let g = alloc(8);
+let reused = 0;
+let i = 0;
+while (i < 200000) {
+    let p = alloc(i % 16);
+    if (p == a) { reused = reused + 1; }
+    if (p == b) { reused = reused + 1; }
+    if (p == c) { reused = reused + 1; }
+    if (p == d) { reused = reused + 1; }
+    if (p == e) { reused = reused + 1; }
+    if (p == f) { reused = reused + 1; }
+    if (p == g) { reused = reused + 1; }
+    if (i % 1000 == 0) {
+        let big = alloc(3000000);
+    }
+    i = i + 1;
+}
+print reused;
+free(a);
+free(b);
+free(c);
+free(d);
+free(e);
+free(f);
+free(g);
+return 0;
+`
+	dir := t.TempDir()
+	for level := 0; level <= 2; level++ {
+		asm := compile(t, src, level, func(cg *CodeGen) {
+			cg.EnableHeapDebug()
+			cg.EnableGCStats()
+		})
+		stdout, stderr, status := runCmd(t, dir, asm, nil)
+		if stdout != "0\n" || status != 0 {
+			t.Fatalf("-O%d: got stdout %q, stderr %q, exit %d; want stdout %q, exit 0", level, stdout, stderr, status, "0\n")
+		}
+
+		var leaked, leakedBytes, collections, freed int
+		_, err := fmt.Sscanf(stderr, "leaked blocks: %d\nleaked bytes: %d\ngc collections: %d\ngc bytes freed: %d\n",
+			&leaked, &leakedBytes, &collections, &freed)
+		if err != nil && leaked == 0 {
+			// Nothing leaked if the last collection came after the last alloc.
+			_, err = fmt.Sscanf(stderr, "gc collections: %d\ngc bytes freed: %d\n", &collections, &freed)
+		}
+		if err != nil {
+			t.Fatalf("-O%d: unexpected stderr %q", level, stderr)
+		}
+		if collections == 0 || freed == 0 {
+			t.Errorf("-O%d: %d collections freed %d bytes; want some of each", level, collections, freed)
+		}
+	}
+}
+
+// The stack map of each call to heap_alloc lists exactly the pointers live
+// across it, whether they are kept in registers, stack slots or struct
+// fields.
+func TestStackMaps(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []int // the number of pointers at each call, in order
+	}{
+		{`
+let a = alloc(8);
+let b = alloc(8);
+let n = 5;
+let c = alloc(8);
+print a == b;
+print c == a;
+print n;
+`, []int{0, 1, 2}},
+		{`
+struct Buffer { size: int, data: ptr }
+let b = Buffer { size: 8, data: alloc(8) };
+let p = alloc(8);
+let q = alloc(8);
+print b.size;
+print p == b.data;
+print q == p;
+`, []int{1, 1, 2}},
+	}
+	for _, tt := range tests {
+		for level := 0; level <= 2; level++ {
+			var cg *CodeGen
+			compile(t, tt.src, level, func(c *CodeGen) { cg = c })
+			var got []int
+			for _, sp := range cg.safepoints {
+				n := len(sp.slots)
+				for regs := sp.regs; regs != 0; regs &= regs - 1 {
+					n++
+				}
+				got = append(got, n)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("-O%d on %q: pointers live across each alloc: %v, want %v", level, tt.src, got, tt.want)
+			}
+		}
+	}
+}
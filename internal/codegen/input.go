@@ -0,0 +1,146 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Messages of malformed input.
+const (
+	msgInvalidInput = "invalid input"
+	msgEndOfInput   = "unexpected end of input"
+)
+
+// inputRuntime returns read_number, which reads a line from stdin and
+// returns it in rax as a signed decimal integer. Spaces and tabs may
+// surround the number, and a carriage return may end it. A line that holds
+// anything else, or a number that does not fit in 64 bits, stops the
+// program through runtime_panic, as does reaching the end of input before
+// the line starts.
+//
+// Input is read through a buffer, so read_number must be the only reader
+// of stdin.
+func inputRuntime() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `
+		section .bss
+		input_buf resb 4096
+		input_pos resq 1
+		input_len resq 1
+
+		section .text
+		; input_byte returns the next byte of stdin in rax, or -1 at the end
+		; of input.
+		input_byte:
+			mov rcx, [input_pos]
+			cmp rcx, [input_len]
+			jb .have_byte
+
+			mov rax, 0
+			mov rdi, 0
+			lea rsi, [input_buf]
+			mov rdx, 4096
+			syscall
+			test rax, rax
+			jle .end
+			mov [input_len], rax
+			xor rcx, rcx
+
+		.have_byte:
+			movzx rax, byte [input_buf+rcx]
+			inc rcx
+			mov [input_pos], rcx
+			ret
+
+		.end:
+			mov rax, -1
+			ret
+
+		; The number is accumulated negated in r10, so that the most negative
+		; integer fits. r8 is set for a minus sign, r9 counts the digits.
+		read_number:
+			xor r10, r10
+			xor r8, r8
+			xor r9, r9
+			call input_byte
+			cmp rax, -1
+			je input_end
+
+		.leading:
+			cmp rax, ' '
+			je .skip_leading
+			cmp rax, 9
+			jne .sign
+		.skip_leading:
+			call input_byte
+			jmp .leading
+
+		.sign:
+			cmp rax, '-'
+			jne .plus
+			mov r8, 1
+			call input_byte
+			jmp .digits
+		.plus:
+			cmp rax, '+'
+			jne .digits
+			call input_byte
+
+		.digits:
+			cmp rax, '0'
+			jl .digits_done
+			cmp rax, '9'
+			jg .digits_done
+			sub rax, '0'
+			imul r10, r10, 10
+			jo input_invalid
+			sub r10, rax
+			jo input_invalid
+			inc r9
+			call input_byte
+			jmp .digits
+
+		.digits_done:
+			test r9, r9
+			jz input_invalid
+
+		.trailing:
+			cmp rax, 10
+			je .done
+			cmp rax, -1
+			je .done
+			cmp rax, ' '
+			je .skip_trailing
+			cmp rax, 9
+			je .skip_trailing
+			cmp rax, 13
+			jne input_invalid
+		.skip_trailing:
+			call input_byte
+			jmp .trailing
+
+		.done:
+			mov rax, r10
+			test r8, r8
+			jnz .negative
+			neg rax
+			jo input_invalid
+		.negative:
+			ret
+
+		input_invalid:
+			lea rsi, [input_invalid_msg]
+			mov rdx, %d
+			jmp runtime_panic
+
+		input_end:
+			lea rsi, [input_end_msg]
+			mov rdx, %d
+			jmp runtime_panic
+
+		section .rodata
+`, len(msgInvalidInput)+1, len(msgEndOfInput)+1)
+	sb.WriteString(message("input_invalid_msg", msgInvalidInput))
+	sb.WriteString(message("input_end_msg", msgEndOfInput))
+	return sb.String()
+}
@@ -0,0 +1,53 @@
+package codegen
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestInput(t *testing.T) {
+	requireTools(t)
+
+	// The count is live across the other reads and the unused read is
+	// still performed.
+	const src = `
+let n = input();
+let sum = 0;
+while (n > 0) {
+    sum = sum + input();
+    n = n - 1;
+}
+print sum;
+let unused = input();
+return 0;
+`
+	tests := []struct {
+		input  string
+		stdout string
+		stderr string
+		status int
+	}{
+		{input: "3\n  10\n-4 \r\n+7\n0", stdout: "13\n"},
+		{input: "1\n-9223372036854775808\n9223372036854775807\n", stdout: "-9223372036854775808\n"},
+		{input: "2\n1\n2\n", stdout: "3\n", stderr: "unexpected end of input\n", status: PanicStatus},
+		{input: "1\n1x\n", stderr: "invalid input\n", status: PanicStatus},
+		{input: "1\n\n", stderr: "invalid input\n", status: PanicStatus},
+		{input: "1\n-\n", stderr: "invalid input\n", status: PanicStatus},
+		{input: "1\n9223372036854775808\n", stderr: "invalid input\n", status: PanicStatus},
+	}
+
+	dir := t.TempDir()
+	for level := 0; level <= 2; level++ {
+		asm := compile(t, src, level, nil)
+		for _, tt := range tests {
+			stdout, stderr, status := runCmd(t, dir, asm, func(cmd *exec.Cmd) {
+				cmd.Stdin = strings.NewReader(tt.input)
+			})
+			if stdout != tt.stdout || stderr != tt.stderr || status != tt.status {
+				t.Errorf("-O%d with input %q: got stdout %q, stderr %q, exit %d; want stdout %q, stderr %q, exit %d",
+					level, tt.input, stdout, stderr, status, tt.stdout, tt.stderr, tt.status)
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package codegen
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PeepholeStats records what the peephole pass did to a program.
+type PeepholeStats struct {
+	Before, After int            // instruction counts
+	Rules         map[string]int // times each rule fired
+}
+
+func (s PeepholeStats) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "peephole: %d -> %d instructions", s.Before, s.After)
+	names := make([]string, 0, len(s.Rules))
+	for name := range s.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&sb, "\n  %-16s %d", name, s.Rules[name])
+	}
+	return sb.String()
+}
+
+// invertJump maps each conditional jump to the one taken in the opposite
+// case.
+var invertJump = map[string]string{
+	"je": "jne", "jne": "je",
+	"jl": "jge", "jge": "jl",
+	"jg": "jle", "jle": "jg",
+}
+
+// Peephole rewrites the generated instructions in place, repeatedly
+// applying local rules until none fires:
+//
+//	self-move         mov a, a                      -> (removed)
+//	redundant-move    mov a, b; mov b, a            -> mov a, b
+//	store-reload      mov [m], r; mov s, [m]        -> mov [m], r; mov s, r
+//	dead-move         mov r, x; mov r, y            -> mov r, y
+//	stack-adjust      sub rsp, n; add rsp, m        -> sub rsp, n-m
+//	jump-to-next      jmp L; L:                     -> L:
+//	branch-inversion  jcc L1; jmp L2; L1:           -> jncc L2; L1:
+//	unreachable       jmp L; <instrs>               -> jmp L
+//
+// Raw lines, such as the runtime helpers, are left alone and act as
+// barriers.
+func (cg *CodeGen) Peephole() PeepholeStats {
+	stats := PeepholeStats{Before: countInstrs(cg.code), Rules: map[string]int{}}
+	for {
+		code, fired := peepholeOnce(cg.code, stats.Rules)
+		cg.code = code
+		if !fired {
+			break
+		}
+	}
+	stats.After = countInstrs(cg.code)
+	return stats
+}
+
+func countInstrs(code []line) int {
+	n := 0
+	for _, l := range code {
+		if l.kind == lineInstr {
+			n++
+		}
+	}
+	return n
+}
+
+// nextLabels returns the labels that immediately follow position i, with
+// no instruction in between.
+func nextLabels(code []line, i int) map[string]bool {
+	labels := map[string]bool{}
+	for j := i; j < len(code) && code[j].kind == lineLabel; j++ {
+		labels[code[j].op] = true
+	}
+	return labels
+}
+
+func peepholeOnce(code []line, rules map[string]int) ([]line, bool) {
+	out := make([]line, 0, len(code))
+	fired := false
+	apply := func(rule string) {
+		rules[rule]++
+		fired = true
+	}
+
+	for i := 0; i < len(code); i++ {
+		cur := code[i]
+		var next line
+		if i+1 < len(code) {
+			next = code[i+1]
+		}
+
+		switch {
+		case cur.is("mov", 2) && cur.args[0] == cur.args[1]:
+			apply("self-move")
+			continue
+
+		case cur.is("mov", 2) && next.is("mov", 2) &&
+			next.args[0] == cur.args[1] && next.args[1] == cur.args[0] &&
+			!mentions(cur.args[1], cur.args[0]):
+			apply("redundant-move")
+			out = append(out, cur)
+			i++
+			continue
+
+		case cur.is("mov", 2) && next.is("mov", 2) && isMem(cur.args[0]) &&
+			isReg(cur.args[1]) && next.args[1] == cur.args[0]:
+			apply("store-reload")
+			out = append(out, cur)
+			if next.args[0] == cur.args[1] {
+				i++
+			} else {
+				code[i+1] = line{kind: lineInstr, op: "mov", args: []string{next.args[0], cur.args[1]}, src: next.src}
+			}
+			continue
+
+		case cur.is("mov", 2) && next.is("mov", 2) && isReg(cur.args[0]) &&
+			next.args[0] == cur.args[0] && !mentions(next.args[1], cur.args[0]):
+			apply("dead-move")
+			continue
+
+		case (cur.is("sub", 2) || cur.is("add", 2)) && cur.args[0] == "rsp":
+			delta, ok := stackDelta(cur)
+			if !ok {
+				break
+			}
+			j := i + 1
+			for ; j < len(code) && (code[j].is("sub", 2) || code[j].is("add", 2)) && code[j].args[0] == "rsp"; j++ {
+				d, ok := stackDelta(code[j])
+				if !ok {
+					break
+				}
+				delta += d
+			}
+			if j == i+1 && delta != 0 {
+				break
+			}
+			apply("stack-adjust")
+			switch {
+			case delta > 0:
+				out = append(out, line{kind: lineInstr, op: "sub", args: []string{"rsp", strconv.Itoa(delta)}, src: cur.src})
+			case delta < 0:
+				out = append(out, line{kind: lineInstr, op: "add", args: []string{"rsp", strconv.Itoa(-delta)}, src: cur.src})
+			}
+			i = j - 1
+			continue
+
+		case cur.is("jmp", 1) && nextLabels(code, i+1)[cur.args[0]]:
+			apply("jump-to-next")
+			continue
+
+		case cur.kind == lineInstr && len(cur.args) == 1 && invertJump[cur.op] != "" &&
+			next.is("jmp", 1) && nextLabels(code, i+2)[cur.args[0]]:
+			apply("branch-inversion")
+			out = append(out, line{kind: lineInstr, op: invertJump[cur.op], args: next.args, src: cur.src})
+			i++
+			continue
+
+		case cur.is("jmp", 1) && next.kind == lineInstr:
+			apply("unreachable")
+			out = append(out, cur)
+			for i+1 < len(code) && code[i+1].kind == lineInstr {
+				i++
+			}
+			continue
+		}
+
+		out = append(out, cur)
+	}
+	return out, fired
+}
+
+// stackDelta returns how many bytes an add or sub on rsp reserves, negative
+// for a release.
+func stackDelta(l line) (int, bool) {
+	n, err := strconv.Atoi(l.args[1])
+	if err != nil {
+		return 0, false
+	}
+	if l.op == "add" {
+		n = -n
+	}
+	return n, true
+}
@@ -0,0 +1,114 @@
+package codegen
+
+import (
+	"strings"
+	"testing"
+)
+
+// asmLines parses the subset of assembly the backend emits: labels end in
+// a colon, everything else is an instruction.
+func asmLines(src string) []line {
+	var code []line
+	for _, text := range strings.Split(strings.TrimSpace(src), "\n") {
+		text = strings.TrimSpace(text)
+		if name, ok := strings.CutSuffix(text, ":"); ok {
+			code = append(code, line{kind: lineLabel, op: name})
+			continue
+		}
+		op, rest, _ := strings.Cut(text, " ")
+		var args []string
+		if rest != "" {
+			args = strings.Split(rest, ", ")
+		}
+		code = append(code, line{kind: lineInstr, op: op, args: args})
+	}
+	return code
+}
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		rule     string
+		in, want string
+	}{
+		{"self-move", `
+			mov rbx, rbx
+			ret`, `
+			ret`},
+		{"redundant-move", `
+			mov QWORD [rbp-8], rbx
+			mov rbx, QWORD [rbp-8]`, `
+			mov QWORD [rbp-8], rbx`},
+		{"store-reload", `
+			mov QWORD [rbp-8], rbx
+			mov r12, QWORD [rbp-8]`, `
+			mov QWORD [rbp-8], rbx
+			mov r12, rbx`},
+		{"dead-move", `
+			mov rax, 5
+			mov rax, rbx`, `
+			mov rax, rbx`},
+		{"stack-adjust", `
+			sub rsp, 8
+			add rsp, 8
+			sub rsp, 16
+			sub rsp, 8`, `
+			sub rsp, 24`},
+		{"jump-to-next", `
+			jmp .b
+			.a:
+			.b:
+			ret`, `
+			.a:
+			.b:
+			ret`},
+		{"branch-inversion", `
+			je .then
+			jmp .else
+			.then:
+			ret`, `
+			jne .else
+			.then:
+			ret`},
+		{"unreachable", `
+			jmp .out
+			mov rax, 1
+			add rax, 2
+			.loop:
+			jmp .loop
+			.out:
+			ret`, `
+			jmp .out
+			.loop:
+			jmp .loop
+			.out:
+			ret`},
+	}
+
+	for _, tt := range tests {
+		cg := &CodeGen{code: asmLines(tt.in)}
+		stats := cg.Peephole()
+		want := &CodeGen{code: asmLines(tt.want)}
+		if cg.String() != want.String() {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.rule, cg, want)
+		}
+		if stats.Rules[tt.rule] == 0 {
+			t.Errorf("%s: rule did not fire, stats: %v", tt.rule, stats)
+		}
+	}
+}
+
+func TestPeepholeKeepsDependentMoves(t *testing.T) {
+	// Each pair reads the first move's result, so nothing may be removed.
+	src := `
+		mov rax, 5
+		mov rax, QWORD [rax+8]
+		mov rbx, rcx
+		mov rcx, rdx
+		mov QWORD [rbp-8], rbx
+		mov rbx, QWORD [rbp-16]`
+	cg := &CodeGen{code: asmLines(src)}
+	before := cg.String()
+	if stats := cg.Peephole(); stats.After != stats.Before || cg.String() != before {
+		t.Errorf("got\n%s\nwant it unchanged", cg)
+	}
+}
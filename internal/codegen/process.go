@@ -0,0 +1,174 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Messages of missing or malformed arguments and environment variables.
+const (
+	msgArgRange   = "argument index out of range"
+	msgArgInvalid = "invalid argument"
+)
+
+// The kernel starts a process with argc at rsp, followed by the argv
+// pointers, a null pointer, the envp pointers and another null pointer.
+// _start saves rsp in rbp after pushing the old rbp, and rbp is left alone
+// for the rest of the program, so the runtime finds argc at rbp+8 and argv
+// at rbp+16.
+const argcLoc = "QWORD [rbp+8]"
+
+// envVar returns the index of the environment variable name among those
+// the program reads, adding it if it is new.
+func (cg *CodeGen) envVar(name string) int {
+	for i, env := range cg.envs {
+		if env == name {
+			return i
+		}
+	}
+	cg.envs = append(cg.envs, name)
+	return len(cg.envs) - 1
+}
+
+// envUnsetMsg and envInvalidMsg are the errors for environment variable
+// name.
+func envUnsetMsg(name string) string {
+	return fmt.Sprintf("environment variable %s is not set", name)
+}
+
+func envInvalidMsg(name string) string {
+	return fmt.Sprintf("environment variable %s is not an integer", name)
+}
+
+// genEnv reads environment variable name into rax.
+func (cg *CodeGen) genEnv(name string) {
+	i := cg.envVar(name)
+	cg.ins("lea", "rdi", fmt.Sprintf("[env_name_%d]", i))
+	cg.ins("mov", "rsi", fmt.Sprint(len(name)+1))
+	cg.ins("call", "env_lookup")
+	cg.ins("test", "rax", "rax")
+	cg.ins("jz", fmt.Sprintf(".env_unset_%d", i))
+	cg.ins("mov", "rdi", "rax")
+	cg.ins("lea", "rsi", fmt.Sprintf("[env_invalid_msg_%d]", i))
+	cg.ins("mov", "rdx", fmt.Sprint(len(envInvalidMsg(name))+1))
+	cg.ins("call", "parse_number")
+}
+
+// genEnvUnset emits, after the program's code, the jumps to runtime_panic
+// for environment variables that are not set.
+func (cg *CodeGen) genEnvUnset() {
+	cg.src = 0
+	for i, name := range cg.envs {
+		cg.label(fmt.Sprintf(".env_unset_%d", i))
+		cg.ins("lea", "rsi", fmt.Sprintf("[env_unset_msg_%d]", i))
+		cg.ins("mov", "rdx", fmt.Sprint(len(envUnsetMsg(name))+1))
+		cg.ins("jmp", "runtime_panic")
+	}
+}
+
+// processRuntime returns the routines that read arguments and environment
+// variables, and the names and messages of the variables the program reads.
+//
+// parse_number parses the NUL-terminated signed decimal at rdi into rax,
+// stopping the program with the rdx-byte message at rsi if it is malformed
+// or does not fit in 64 bits. arg_number reads argument rdi with it.
+// env_lookup returns in rax a pointer to the value of the variable whose
+// rsi-byte "NAME=" prefix is at rdi, or 0 if it is not set.
+func (cg *CodeGen) processRuntime() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `
+		section .text
+		; The number is accumulated negated in r10, so that the most negative
+		; integer fits. r8 is set for a minus sign, r9 counts the digits.
+		parse_number:
+			xor r10, r10
+			xor r8, r8
+			xor r9, r9
+			movzx rax, byte [rdi]
+			cmp rax, '-'
+			jne .plus
+			mov r8, 1
+			inc rdi
+			jmp .digits
+		.plus:
+			cmp rax, '+'
+			jne .digits
+			inc rdi
+
+		.digits:
+			movzx rax, byte [rdi]
+			cmp rax, '0'
+			jl .digits_done
+			cmp rax, '9'
+			jg .digits_done
+			sub rax, '0'
+			imul r10, r10, 10
+			jo runtime_panic
+			sub r10, rax
+			jo runtime_panic
+			inc r9
+			inc rdi
+			jmp .digits
+
+		.digits_done:
+			test rax, rax
+			jnz runtime_panic
+			test r9, r9
+			jz runtime_panic
+			mov rax, r10
+			test r8, r8
+			jnz .negative
+			neg rax
+			jo runtime_panic
+		.negative:
+			ret
+
+		arg_number:
+			cmp rdi, %[1]s
+			jae .out_of_range
+			mov rdi, [rbp+16+rdi*8]
+			lea rsi, [arg_invalid_msg]
+			mov rdx, %[2]d
+			jmp parse_number
+		.out_of_range:
+			lea rsi, [arg_range_msg]
+			mov rdx, %[3]d
+			jmp runtime_panic
+
+		env_lookup:
+			mov rcx, %[1]s
+			lea r8, [rbp+24+rcx*8]
+		.next_var:
+			mov r9, [r8]
+			test r9, r9
+			jz .unset
+			xor rcx, rcx
+		.compare:
+			cmp rcx, rsi
+			je .found
+			mov al, [r9+rcx]
+			cmp al, [rdi+rcx]
+			jne .skip_var
+			inc rcx
+			jmp .compare
+		.skip_var:
+			add r8, 8
+			jmp .next_var
+		.found:
+			lea rax, [r9+rcx]
+			ret
+		.unset:
+			xor rax, rax
+			ret
+
+		section .rodata
+`, argcLoc, len(msgArgInvalid)+1, len(msgArgRange)+1)
+	sb.WriteString(message("arg_invalid_msg", msgArgInvalid))
+	sb.WriteString(message("arg_range_msg", msgArgRange))
+	for i, name := range cg.envs {
+		sb.WriteString(data(fmt.Sprintf("env_name_%d", i), name+"="))
+		sb.WriteString(message(fmt.Sprintf("env_unset_msg_%d", i), envUnsetMsg(name)))
+		sb.WriteString(message(fmt.Sprintf("env_invalid_msg_%d", i), envInvalidMsg(name)))
+	}
+	return sb.String()
+}
@@ -0,0 +1,90 @@
+package codegen
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestArgsAndEnv(t *testing.T) {
+	requireTools(t)
+
+	const src = `
+print argc();
+let i = 1;
+let sum = 0;
+while (i < argc()) {
+    sum = sum + arg(i);
+    i = i + 1;
+}
+print sum;
+print env("N") * 10 + env("M");
+let last = arg(argc() - 1);
+return 0;
+`
+	tests := []struct {
+		args   []string
+		env    []string
+		stdout string
+		stderr string
+		status int
+	}{
+		{
+			args:   []string{"1", "-9223372036854775808", "+7"},
+			env:    []string{"NN=1", "N=4", "M=-2"},
+			stdout: "4\n-9223372036854775800\n38\n",
+		},
+		{
+			env:    []string{"N=1", "M=2"},
+			stdout: "1\n0\n12\n",
+			stderr: "invalid argument\n",
+			status: PanicStatus,
+		},
+		{
+			args:   []string{"1", "2x"},
+			stdout: "3\n",
+			stderr: "invalid argument\n",
+			status: PanicStatus,
+		},
+		{
+			args:   []string{"9223372036854775808"},
+			stdout: "2\n",
+			stderr: "invalid argument\n",
+			status: PanicStatus,
+		},
+		{
+			args:   []string{""},
+			stdout: "2\n",
+			stderr: "invalid argument\n",
+			status: PanicStatus,
+		},
+		{
+			args:   []string{"3"},
+			env:    []string{"N=1", "MM=2"},
+			stdout: "2\n3\n",
+			stderr: "environment variable M is not set\n",
+			status: PanicStatus,
+		},
+		{
+			args:   []string{"3"},
+			env:    []string{"N=-", "M=2"},
+			stdout: "2\n3\n",
+			stderr: "environment variable N is not an integer\n",
+			status: PanicStatus,
+		},
+	}
+
+	dir := t.TempDir()
+	for level := 0; level <= 2; level++ {
+		asm := compile(t, src, level, nil)
+		for _, tt := range tests {
+			stdout, stderr, status := runCmd(t, dir, asm, func(cmd *exec.Cmd) {
+				cmd.Args = append(cmd.Args, tt.args...)
+				cmd.Env = tt.env
+			})
+			if stdout != tt.stdout || stderr != tt.stderr || status != tt.status {
+				t.Errorf("-O%d with args %q and environment %q: got stdout %q, stderr %q, exit %d; want stdout %q, stderr %q, exit %d",
+					level, tt.args, tt.env, stdout, stderr, status, tt.stdout, tt.stderr, tt.status)
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package codegen
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/BergurDavidsen/bingus/internal/ir"
+)
+
+// Registers the allocator hands out. rax, rcx, rdx and rdi are kept free as
+// scratch registers for instruction selection, division and calls.
+//
+// The runtime routines called for print, input, arg, env, alloc and free
+// and their syscalls clobber the caller-saved registers, so a value that is
+// live across one of them must be given a callee-saved one.
+var (
+	calleeSaved = []string{"rbx", "r12", "r13", "r14", "r15"}
+	callerSaved = []string{"rsi", "r8", "r9", "r10", "r11"}
+)
+
+// interval is the range of instruction positions over which a virtual
+// register may hold a live value.
+type interval struct {
+	reg        ir.Reg
+	start, end int
+	crossCall  bool
+}
+
+// allocation maps each virtual register to a machine register or a stack
+// slot, and each object to its place in the frame.
+type allocation struct {
+	loc       map[ir.Reg]string
+	numSlots  int
+	objects   map[*ir.Object]int // offset of word 0 below rbp
+	frameSize int
+}
+
+// liveIntervals numbers the instructions and terminators of fn in block
+// order and returns one interval per register, covering every position at
+// which the register is live. Registers live across a loop are covered from
+// the loop's first block to its last.
+func liveIntervals(fn *ir.Func) []*interval {
+	live := ir.ComputeLiveness(fn)
+	byReg := map[ir.Reg]*interval{}
+	touch := func(r ir.Reg, pos int) {
+		iv := byReg[r]
+		if iv == nil {
+			byReg[r] = &interval{reg: r, start: pos, end: pos}
+			return
+		}
+		iv.start = min(iv.start, pos)
+		iv.end = max(iv.end, pos)
+	}
+
+	var calls []int
+	pos := 0
+	for _, b := range fn.Blocks {
+		for r := range live.In[b] {
+			touch(r, pos)
+		}
+		for _, instr := range b.Instrs {
+			for _, arg := range instr.Args {
+				touch(arg, pos)
+			}
+			if instr.Dst != ir.NoReg {
+				touch(instr.Dst, pos)
+			}
+			if isCall(instr.Op) {
+				calls = append(calls, pos)
+			}
+			pos++
+		}
+		for _, r := range b.Term.Uses() {
+			touch(*r, pos)
+		}
+		for r := range live.Out[b] {
+			touch(r, pos)
+		}
+		pos++
+	}
+
+	intervals := make([]*interval, 0, len(byReg))
+	for _, iv := range byReg {
+		for _, c := range calls {
+			if iv.start < c && c < iv.end {
+				iv.crossCall = true
+				break
+			}
+		}
+		intervals = append(intervals, iv)
+	}
+	sort.Slice(intervals, func(i, j int) bool {
+		if intervals[i].start != intervals[j].start {
+			return intervals[i].start < intervals[j].start
+		}
+		return intervals[i].reg < intervals[j].reg
+	})
+	return intervals
+}
+
+// allocate assigns locations with linear-scan register allocation (Poletto
+// and Sarkar). When every suitable register is taken, the interval that
+// ends last is spilled to the stack. The pinned registers skip allocation
+// and get the first stack slots, in order, so pinned[i] lives at
+// rbp-8*(i+1).
+func allocate(fn *ir.Func, pinned []ir.Reg) *allocation {
+	a := &allocation{loc: map[ir.Reg]string{}}
+	free := map[string]bool{}
+	for _, r := range calleeSaved {
+		free[r] = true
+	}
+	for _, r := range callerSaved {
+		free[r] = true
+	}
+
+	// pick returns a free register suitable for iv, preferring caller-saved
+	// ones so the callee-saved registers stay available for values that
+	// live across calls.
+	pick := func(iv *interval) string {
+		if !iv.crossCall {
+			for _, r := range callerSaved {
+				if free[r] {
+					return r
+				}
+			}
+		}
+		for _, r := range calleeSaved {
+			if free[r] {
+				return r
+			}
+		}
+		return ""
+	}
+	spill := func(iv *interval) {
+		a.numSlots++
+		a.loc[iv.reg] = fmt.Sprintf("QWORD [rbp-%d]", 8*a.numSlots)
+	}
+
+	isPinned := map[ir.Reg]bool{}
+	for _, r := range pinned {
+		isPinned[r] = true
+		spill(&interval{reg: r})
+	}
+
+	var active []*interval // sorted by increasing end
+	insert := func(iv *interval) {
+		i := sort.Search(len(active), func(i int) bool { return active[i].end > iv.end })
+		active = append(active, nil)
+		copy(active[i+1:], active[i:])
+		active[i] = iv
+	}
+
+	for _, iv := range liveIntervals(fn) {
+		if isPinned[iv.reg] {
+			continue
+		}
+		// Expire intervals that ended before this one starts. An interval
+		// ending at iv.start is still read by the instruction defining iv,
+		// so it keeps its register.
+		kept := active[:0]
+		for _, old := range active {
+			if old.end < iv.start {
+				free[a.loc[old.reg]] = true
+			} else {
+				kept = append(kept, old)
+			}
+		}
+		active = kept
+
+		if r := pick(iv); r != "" {
+			free[r] = false
+			a.loc[iv.reg] = r
+			insert(iv)
+			continue
+		}
+
+		// Steal the register of the active interval that ends last, if it
+		// ends after this one and its register is usable here.
+		victim := -1
+		for i := len(active) - 1; i >= 0; i-- {
+			if !iv.crossCall || isCalleeSaved(a.loc[active[i].reg]) {
+				victim = i
+				break
+			}
+		}
+		if victim >= 0 && active[victim].end > iv.end {
+			old := active[victim]
+			a.loc[iv.reg] = a.loc[old.reg]
+			spill(old)
+			active = append(active[:victim], active[victim+1:]...)
+			insert(iv)
+		} else {
+			spill(iv)
+		}
+	}
+
+	// The objects go below the spill slots, each with its words in order
+	// from lower to higher addresses.
+	a.objects = map[*ir.Object]int{}
+	words := a.numSlots
+	for _, obj := range fn.Objects {
+		words += obj.Size
+		a.objects[obj] = 8 * words
+	}
+	a.frameSize = (8*words + 15) &^ 15
+	return a
+}
+
+func isCalleeSaved(r string) bool {
+	for _, c := range calleeSaved {
+		if c == r {
+			return true
+		}
+	}
+	return false
+}
+
+// isCall reports whether op is generated as a call into the runtime.
+func isCall(op ir.Op) bool {
+	switch op {
+	case ir.OpPrint, ir.OpInput, ir.OpArg, ir.OpEnv, ir.OpAlloc, ir.OpFree:
+		return true
+	}
+	return false
+}
+
+func isMem(loc string) bool {
+	return loc[0] == 'Q'
+}
@@ -0,0 +1,120 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/eval"
+	"github.com/BergurDavidsen/bingus/internal/ir"
+	"github.com/BergurDavidsen/bingus/internal/randprog"
+)
+
+// pressureProgram keeps more variables live across a loop with prints than
+// there are registers, forcing the allocator to spill.
+func pressureProgram() string {
+	var sb strings.Builder
+	for i := 0; i < 16; i++ {
+		fmt.Fprintf(&sb, "let v%d = %d;\n", i, i+1)
+	}
+	sb.WriteString("let i = 0;\nwhile (i < 3) {\n")
+	for i := 0; i < 16; i++ {
+		fmt.Fprintf(&sb, "    v%d = v%d * 2 + v%d;\n", i, i, (i+1)%16)
+		fmt.Fprintf(&sb, "    print v%d;\n", i)
+	}
+	sb.WriteString("    i = i + 1;\n}\nreturn v0 + v15;\n")
+	return sb.String()
+}
+
+// checkAllocation walks each block backwards from its live-out set and
+// checks that no instruction writes a location still holding another live
+// register, and that nothing live across a print sits in a caller-saved
+// register.
+func checkAllocation(t *testing.T, fn *ir.Func, a *allocation) {
+	t.Helper()
+	live := ir.ComputeLiveness(fn)
+	for _, b := range fn.Blocks {
+		now := ir.RegSet{}
+		for r := range live.Out[b] {
+			now[r] = true
+		}
+		for _, r := range b.Term.Uses() {
+			now[*r] = true
+		}
+		for i := len(b.Instrs) - 1; i >= 0; i-- {
+			instr := b.Instrs[i]
+			if instr.Dst != ir.NoReg {
+				for r := range now {
+					if r != instr.Dst && a.loc[r] == a.loc[instr.Dst] {
+						t.Fatalf("%s shares %s with live %s in %s\n%s", instr.Dst, a.loc[r], r, b.Label(), fn)
+					}
+				}
+				delete(now, instr.Dst)
+			}
+			if instr.Op == ir.OpPrint {
+				for r := range now {
+					if !isMem(a.loc[r]) && !isCalleeSaved(a.loc[r]) {
+						t.Fatalf("%s is live across a print in caller-saved %s\n%s", r, a.loc[r], fn)
+					}
+				}
+			}
+			for _, arg := range instr.Args {
+				now[arg] = true
+			}
+		}
+	}
+}
+
+func TestAllocationRespectsLiveness(t *testing.T) {
+	r := rand.New(rand.NewPCG(4, 4))
+	sources := []string{pressureProgram()}
+	for i := 0; i < 50; i++ {
+		sources = append(sources, randprog.Generate(r))
+	}
+
+	for _, src := range sources {
+		for level := 0; level <= 2; level++ {
+			fn, err := ir.Lower(parse(t, src))
+			if err != nil {
+				t.Fatalf("lower: %v\n%s", err, src)
+			}
+			if err := ir.Optimize(fn, level, nil); err != nil {
+				t.Fatal(err)
+			}
+			checkAllocation(t, fn, allocate(fn, nil))
+		}
+	}
+
+	fn, err := ir.Lower(parse(t, sources[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := allocate(fn, nil); a.numSlots == 0 {
+		t.Errorf("expected spills under register pressure, got none")
+	}
+}
+
+// TestSpilledProgram runs the high-pressure program natively and compares
+// it with the evaluator, exercising the spill paths of instruction
+// selection.
+func TestSpilledProgram(t *testing.T) {
+	requireTools(t)
+
+	src := pressureProgram()
+	var want bytes.Buffer
+	prog, syms := parse(t, src)
+	wantCode, err := eval.NewEnv(nil, &want, syms).Eval(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for level := 0; level <= 2; level++ {
+		got, gotCode := run(t, t.TempDir(), compile(t, src, level, nil))
+		if got != want.String() || gotCode != wantCode&0xff {
+			t.Fatalf("-O%d: compiled exit %d, output:\n%s\nevaluated exit %d, output:\n%s",
+				level, gotCode, got, wantCode&0xff, want.String())
+		}
+	}
+}
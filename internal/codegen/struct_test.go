@@ -0,0 +1,82 @@
+package codegen
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/eval"
+)
+
+func TestStructs(t *testing.T) {
+	requireTools(t)
+
+	tests := []string{
+		`
+struct Point { x: int, y: int }
+struct Line { from: Point, to: Point, visible: bool }
+
+let p = Point { y: 2, x: 1 };
+let q = p;
+q.x = 10;
+print p.x;
+print q.x;
+p = Point { x: p.y, y: p.x };
+print p.x * 10 + p.y;
+
+let l = Line { from: p, to: q, visible: true };
+l.from.y = l.to.x + l.to.y;
+l.to = l.from;
+let i = 0;
+while (i < 3) {
+    let step = Point { x: i, y: 1 };
+    l.to.x = l.to.x + step.x * step.y;
+    i = i + 1;
+}
+print l.from.y;
+print l.to.x;
+print l.visible;
+print Point { x: 7, y: 8 }.y;
+return l.to.y + p.x;`,
+		// The block held only by a struct field survives the collections
+		// the loop triggers. Were it collected, a later alloc would reuse
+		// it, and freeing it at the end would be a double free. The
+		// garbage allocated after the last collection is reported as
+		// leaked, so only the exit status shows a double free.
+		`
+struct Buffer { data: ptr, size: int }
+
+let b = Buffer { data: alloc(64), size: 64 };
+let reused = 0;
+let i = 0;
+while (i < 100000) {
+    let p = alloc(i % 16);
+    if (p == b.data) { reused = reused + 1; }
+    if (i % 1000 == 0) {
+        let big = alloc(3000000);
+    }
+    i = i + 1;
+}
+print reused;
+free(b.data);
+return b.size;`,
+	}
+
+	dir := t.TempDir()
+	for _, src := range tests {
+		var want bytes.Buffer
+		prog, syms := parse(t, src)
+		wantCode, err := eval.NewEnv(nil, &want, syms).Eval(prog)
+		if err != nil {
+			t.Fatalf("eval: %v\n%s", err, src)
+		}
+
+		for level := 0; level <= 2; level++ {
+			asm := compile(t, src, level, func(cg *CodeGen) { cg.EnableHeapDebug() })
+			stdout, stderr, status := runCmd(t, dir, asm, nil)
+			if stdout != want.String() || status != wantCode {
+				t.Errorf("-O%d on %q: got stdout %q, stderr %q, exit %d; want stdout %q, exit %d",
+					level, src, stdout, stderr, status, want.String(), wantCode)
+			}
+		}
+	}
+}
@@ -1,62 +1,276 @@
 package eval
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"slices"
 	"strconv"
+	"strings"
 
+	"github.com/BergurDavidsen/bingus/internal/heap"
 	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+// Error is a runtime error raised while evaluating a program.
+type Error struct {
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// signal tells enclosing statements how control leaves a statement.
+type signal int
+
+const (
+	sigNone signal = iota
+	sigBreak
+	sigContinue
+	sigReturn
 )
 
 type Env struct {
-	vars map[string]int
+	// Args are the program's command-line arguments, starting with its
+	// name, and Environ its environment as "key=value" strings, as in
+	// os.Args and os.Environ.
+	Args    []string
+	Environ []string
+
+	syms    *resolve.Table
+	vars    map[*resolve.Symbol]int
+	structs map[*resolve.Symbol][]int // the words of struct variables
+	in      *bufio.Reader
+	out     io.Writer
+	heap    heap.Heap
+	retVal  int
+}
+
+// NewEnv returns an environment for running a program whose names have been
+// resolved into syms. Its input expressions read lines from in, which may
+// be nil for a program that reads no input, and its print statements write
+// to out.
+func NewEnv(in io.Reader, out io.Writer, syms *resolve.Table) *Env {
+	if in == nil {
+		in = strings.NewReader("")
+	}
+	return &Env{
+		syms:    syms,
+		vars:    map[*resolve.Symbol]int{},
+		structs: map[*resolve.Symbol][]int{},
+		in:      bufio.NewReader(in),
+		out:     out,
+	}
+}
+
+func (e *Env) errorf(format string, args ...interface{}) {
+	panic(&Error{Msg: fmt.Sprintf(format, args...)})
 }
 
-func NewEnv() *Env {
-	return &Env{vars: make(map[string]int)}
+func (e *Env) symbol(id *parser.IDent) *resolve.Symbol {
+	sym := e.syms.Lookup(id)
+	if sym == nil {
+		e.errorf("unresolved identifier: %s", id.Name)
+	}
+	return sym
 }
 
-func (e *Env) Eval(node parser.Node) int {
+// Eval runs a program, or evaluates a single expression, and returns its
+// value. For a program this is the value of the return statement that ended
+// it, or 0 if it ran off the end, mirroring the compiled exit code.
+func (e *Env) Eval(node parser.Node) (result int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			evalErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			result, err = 0, evalErr
+		}
+	}()
+
 	switch n := node.(type) {
 	case *parser.Program:
-		var result int
-		for _, stmt := range n.Statements {
-			result = e.Eval(stmt)
+		if e.execBlock(n.Statements) == sigReturn {
+			return e.retVal, nil
 		}
-		return result
+		return 0, nil
+	case parser.Expr:
+		return e.evalExpr(n), nil
+	}
+	e.errorf("cannot evaluate %T", node)
+	return 0, nil
+}
+
+// execBlock runs statements in order until one of them transfers control.
+func (e *Env) execBlock(stmts []parser.Stmt) signal {
+	for _, stmt := range stmts {
+		if sig := e.exec(stmt); sig != sigNone {
+			return sig
+		}
+	}
+	return sigNone
+}
 
+func (e *Env) exec(node parser.Stmt) signal {
+	switch n := node.(type) {
 	case *parser.ReturnStmt:
-		return e.Eval(n.Value)
+		e.retVal = e.evalExpr(n.Value)
+		return sigReturn
+
+	case *parser.LetStmt:
+		sym := e.symbol(n.Name)
+		if sym.Struct != nil {
+			e.structs[sym] = slices.Clone(e.evalStruct(n.Value))
+		} else {
+			e.vars[sym] = e.evalExpr(n.Value)
+		}
+
+	case *parser.AssignmentStmt:
+		sym := e.symbol(n.Name)
+		if sym.Struct != nil {
+			copy(e.structs[sym], e.evalStruct(n.Value))
+		} else {
+			e.vars[sym] = e.evalExpr(n.Value)
+		}
+
+	case *parser.FieldAssignStmt:
+		f := e.field(n.Target)
+		if f.Struct != nil {
+			val := e.evalStruct(n.Value)
+			copy(e.evalStruct(n.Target.X)[f.Offset:], val)
+		} else {
+			val := e.evalExpr(n.Value)
+			e.evalStruct(n.Target.X)[f.Offset] = val
+		}
+
+	case *parser.StructDecl:
+		// Structs are laid out by the resolver.
+
+	case *parser.PrintStmt:
+		val := e.evalExpr(n.Value)
+		fmt.Fprintln(e.out, val)
 
+	case *parser.FreeStmt:
+		if err := e.heap.Free(int64(e.evalExpr(n.Value))); err != nil {
+			e.errorf("%v", err)
+		}
+
+	case *parser.IfStmt:
+		if e.evalExpr(n.Guard) != 0 {
+			return e.execBlock(n.Then)
+		}
+		return e.execBlock(n.Else)
+
+	case *parser.WhileStmt:
+		for e.evalExpr(n.Guard) != 0 {
+			sig := e.execBlock(n.Body)
+			if sig == sigBreak {
+				break
+			}
+			if sig == sigReturn {
+				return sig
+			}
+		}
+
+	case *parser.BreakStmt:
+		return sigBreak
+
+	case *parser.ContinueStmt:
+		return sigContinue
+
+	default:
+		e.errorf("unsupported statement: %T", n)
+	}
+	return sigNone
+}
+
+func (e *Env) evalExpr(node parser.Expr) int {
+	switch n := node.(type) {
 	case *parser.NumberLiteral:
-		val, _ := strconv.Atoi(n.Value)
-		return val
+		val, err := strconv.ParseInt(n.Value, 10, 64)
+		if err != nil {
+			e.errorf("invalid integer literal: %s", n.Value)
+		}
+		return int(val)
+
+	case *parser.BoolLit:
+		if n.Value {
+			return 1
+		}
+		return 0
 
 	case *parser.IDent:
-		return e.vars[n.Name]
+		return e.vars[e.symbol(n)]
 
-	case *parser.LetStmt:
-		val := e.Eval(n.Value)
-		e.vars[n.Name.Name] = val
-		return val
+	case *parser.InputExpr:
+		return e.readInt()
+
+	case *parser.ArgcExpr:
+		return len(e.Args)
+
+	case *parser.ArgExpr:
+		i := e.evalExpr(n.Index)
+		if i < 0 || i >= len(e.Args) {
+			e.errorf("argument index %d out of range", i)
+		}
+		val, err := strconv.ParseInt(e.Args[i], 10, 64)
+		if err != nil {
+			e.errorf("invalid argument %d: %q", i, e.Args[i])
+		}
+		return int(val)
+
+	case *parser.EnvExpr:
+		return e.envInt(n.Name)
+
+	case *parser.FieldExpr:
+		return e.evalStruct(n.X)[e.field(n).Offset]
+
+	case *parser.AllocExpr:
+		p, err := e.heap.Alloc(int64(e.evalExpr(n.Size)))
+		if err != nil {
+			e.errorf("%v", err)
+		}
+		return int(p)
 
 	case *parser.BinaryExpr:
-		left := e.Eval(n.Left)
-		right := e.Eval(n.Right)
+		left := e.evalExpr(n.Left)
+		right := e.evalExpr(n.Right)
 		switch n.Operator {
 		case "+":
 			return left + right
 		case "-":
 			return left - right
-		case "/":
-			return left / right
 		case "*":
 			return left * right
+		case "/":
+			if right == 0 {
+				e.errorf("division by zero")
+			}
+			return left / right
+		case "%":
+			if right == 0 {
+				e.errorf("division by zero")
+			}
+			return left % right
+		case "<":
+			return boolToInt(left < right)
+		case ">":
+			return boolToInt(left > right)
+		case "<=":
+			return boolToInt(left <= right)
+		case ">=":
+			return boolToInt(left >= right)
+		case "==":
+			return boolToInt(left == right)
 		default:
-			panic("unknown operator " + n.Operator)
+			e.errorf("unknown operator %s", n.Operator)
 		}
 
 	case *parser.UnaryExpr:
-		right := e.Eval(n.Right)
+		right := e.evalExpr(n.Right)
 
 		switch n.Operator {
 		case "+":
@@ -65,10 +279,97 @@ func (e *Env) Eval(node parser.Node) int {
 			return -right
 
 		default:
-			panic("unknown unary operator " + n.Operator)
+			e.errorf("unknown unary operator %s", n.Operator)
 		}
 
 	default:
-		panic(fmt.Sprintf("unhandled node type: %T", n))
+		e.errorf("unhandled node type: %T", n)
+	}
+	return 0
+}
+
+// evalStruct evaluates an expression that holds a struct to its words. The
+// words of a variable, or of a field of one, are its storage, not a copy.
+func (e *Env) evalStruct(node parser.Expr) []int {
+	switch n := node.(type) {
+	case *parser.IDent:
+		return e.structs[e.symbol(n)]
+
+	case *parser.FieldExpr:
+		f := e.field(n)
+		return e.evalStruct(n.X)[f.Offset : f.Offset+f.Size()]
+
+	case *parser.StructLit:
+		s := e.syms.Struct(n.Type)
+		if s == nil {
+			e.errorf("undefined struct: %s", n.Type.Name)
+		}
+		words := make([]int, s.Size)
+		for _, init := range n.Fields {
+			f := s.Field(init.Name.Name)
+			if f == nil {
+				e.errorf("unknown field %s of %s", init.Name.Name, s.Name)
+			}
+			if f.Struct != nil {
+				copy(words[f.Offset:], e.evalStruct(init.Value))
+			} else {
+				words[f.Offset] = e.evalExpr(init.Value)
+			}
+		}
+		return words
+	}
+	e.errorf("unhandled struct expression: %T", node)
+	return nil
+}
+
+// field returns the field a selector refers to.
+func (e *Env) field(x *parser.FieldExpr) *resolve.Field {
+	f := e.syms.Field(x)
+	if f == nil {
+		e.errorf("unresolved field: %s", x.Field.Name)
+	}
+	return f
+}
+
+// readInt reads a line holding a signed decimal integer. Spaces and tabs may
+// surround it, and a carriage return may end it.
+func (e *Env) readInt() int {
+	line, err := e.in.ReadString('\n')
+	if err == io.EOF && line == "" {
+		e.errorf("unexpected end of input")
+	}
+	if err != nil && err != io.EOF {
+		e.errorf("reading input: %v", err)
+	}
+	text := strings.TrimLeft(strings.TrimRight(line, " \t\r\n"), " \t")
+	val, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		e.errorf("invalid input: %q", text)
+	}
+	return int(val)
+}
+
+// envInt reads the first definition of the environment variable name as an
+// integer.
+func (e *Env) envInt(name string) int {
+	for _, kv := range e.Environ {
+		value, ok := strings.CutPrefix(kv, name+"=")
+		if !ok {
+			continue
+		}
+		val, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			e.errorf("environment variable %s is not an integer: %q", name, value)
+		}
+		return int(val)
+	}
+	e.errorf("environment variable %s is not set", name)
+	return 0
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
 	}
+	return 0
 }
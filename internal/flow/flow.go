@@ -0,0 +1,218 @@
+// Package flow builds a control-flow graph of a program's statements and
+// answers questions about its paths: whether control can run off the end
+// without a return, and which loops can never be left.
+//
+// Conditions that are boolean literals, such as the `true` of `while (true)`
+// or a comparison the constant folder has reduced to one, only have an edge
+// for the branch that is actually taken.
+package flow
+
+import "github.com/BergurDavidsen/bingus/internal/parser"
+
+// Block is a straight-line run of statements.
+type Block struct {
+	ID    int
+	Stmts []parser.Stmt
+	Succs []*Block
+}
+
+// Graph is the control-flow graph of a statement list.
+type Graph struct {
+	Entry  *Block
+	Exit   *Block // reached by running off the end
+	Return *Block // reached by every return statement
+	Blocks []*Block
+
+	headers map[*parser.WhileStmt]*Block
+	exits   map[*parser.WhileStmt]*Block
+}
+
+type loopTargets struct {
+	head, exit *Block
+}
+
+type builder struct {
+	g     *Graph
+	cur   *Block
+	loops []loopTargets
+}
+
+func (b *builder) newBlock() *Block {
+	blk := &Block{ID: len(b.g.Blocks)}
+	b.g.Blocks = append(b.g.Blocks, blk)
+	return blk
+}
+
+func edge(from, to *Block) {
+	from.Succs = append(from.Succs, to)
+}
+
+// Constant returns the value of a condition that is a boolean literal.
+// Lowering to IR uses it to keep only the edges the graph has.
+func Constant(guard parser.Expr) (value, ok bool) {
+	if lit, isLit := guard.(*parser.BoolLit); isLit {
+		return lit.Value, true
+	}
+	return false, false
+}
+
+// Build constructs the graph of a program body.
+func Build(stmts []parser.Stmt) *Graph {
+	b := &builder{g: &Graph{
+		headers: map[*parser.WhileStmt]*Block{},
+		exits:   map[*parser.WhileStmt]*Block{},
+	}}
+	b.g.Entry = b.newBlock()
+	b.g.Exit = b.newBlock()
+	b.g.Return = b.newBlock()
+
+	b.cur = b.g.Entry
+	b.stmts(stmts)
+	edge(b.cur, b.g.Exit)
+	return b.g
+}
+
+func (b *builder) stmts(stmts []parser.Stmt) {
+	for _, stmt := range stmts {
+		b.stmt(stmt)
+	}
+}
+
+// jump ends the current block with an edge to target. What follows starts
+// a new block with no predecessors.
+func (b *builder) jump(target *Block) {
+	edge(b.cur, target)
+	b.cur = b.newBlock()
+}
+
+func (b *builder) stmt(node parser.Stmt) {
+	switch n := node.(type) {
+	case *parser.ReturnStmt:
+		b.cur.Stmts = append(b.cur.Stmts, n)
+		b.jump(b.g.Return)
+
+	case *parser.BreakStmt:
+		if len(b.loops) > 0 {
+			b.jump(b.loops[len(b.loops)-1].exit)
+		}
+
+	case *parser.ContinueStmt:
+		if len(b.loops) > 0 {
+			b.jump(b.loops[len(b.loops)-1].head)
+		}
+
+	case *parser.IfStmt:
+		cond := b.cur
+		then, els, join := b.newBlock(), b.newBlock(), b.newBlock()
+		value, isConst := Constant(n.Guard)
+		if !isConst || value {
+			edge(cond, then)
+		}
+		if !isConst || !value {
+			edge(cond, els)
+		}
+
+		b.cur = then
+		b.stmts(n.Then)
+		edge(b.cur, join)
+		b.cur = els
+		b.stmts(n.Else)
+		edge(b.cur, join)
+		b.cur = join
+
+	case *parser.WhileStmt:
+		head, body, exit := b.newBlock(), b.newBlock(), b.newBlock()
+		b.g.headers[n], b.g.exits[n] = head, exit
+		edge(b.cur, head)
+		value, isConst := Constant(n.Guard)
+		if !isConst || value {
+			edge(head, body)
+		}
+		if !isConst || !value {
+			edge(head, exit)
+		}
+
+		b.loops = append(b.loops, loopTargets{head: head, exit: exit})
+		b.cur = body
+		b.stmts(n.Body)
+		edge(b.cur, head)
+		b.loops = b.loops[:len(b.loops)-1]
+		b.cur = exit
+
+	default:
+		b.cur.Stmts = append(b.cur.Stmts, n)
+	}
+}
+
+// Reachable returns the blocks that can be reached from the entry.
+func (g *Graph) Reachable() map[*Block]bool {
+	seen := map[*Block]bool{}
+	work := []*Block{g.Entry}
+	for len(work) > 0 {
+		blk := work[len(work)-1]
+		work = work[:len(work)-1]
+		if seen[blk] {
+			continue
+		}
+		seen[blk] = true
+		work = append(work, blk.Succs...)
+	}
+	return seen
+}
+
+// FallsOff reports whether some path runs off the end of the program
+// without reaching a return statement.
+func (g *Graph) FallsOff() bool {
+	return g.Reachable()[g.Exit]
+}
+
+// InfiniteLoops returns, in source order, the reachable loops whose exit
+// is never taken and from which no return statement can be reached. A loop
+// that only fails to exit because of an infinite loop nested in it is not
+// reported again.
+func (g *Graph) InfiniteLoops(stmts []parser.Stmt) []*parser.WhileStmt {
+	preds := map[*Block][]*Block{}
+	for _, blk := range g.Blocks {
+		for _, s := range blk.Succs {
+			preds[s] = append(preds[s], blk)
+		}
+	}
+	returns := map[*Block]bool{}
+	work := []*Block{g.Return}
+	for len(work) > 0 {
+		blk := work[len(work)-1]
+		work = work[:len(work)-1]
+		if returns[blk] {
+			continue
+		}
+		returns[blk] = true
+		work = append(work, preds[blk]...)
+	}
+
+	reachable := g.Reachable()
+	var loops []*parser.WhileStmt
+	var visit func(stmts []parser.Stmt) bool
+	visit = func(stmts []parser.Stmt) bool {
+		found := false
+		for _, stmt := range stmts {
+			switch n := stmt.(type) {
+			case *parser.IfStmt:
+				found = visit(n.Then) || found
+				found = visit(n.Else) || found
+			case *parser.WhileStmt:
+				if visit(n.Body) {
+					found = true
+					continue
+				}
+				head := g.headers[n]
+				if reachable[head] && !reachable[g.exits[n]] && !returns[head] {
+					loops = append(loops, n)
+					found = true
+				}
+			}
+		}
+		return found
+	}
+	visit(stmts)
+	return loops
+}
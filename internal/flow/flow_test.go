@@ -0,0 +1,67 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+)
+
+func parse(t *testing.T, src string) []parser.Stmt {
+	t.Helper()
+	tokens, err := lexer.Lex(src)
+	if err != nil {
+		t.Fatalf("lex: %v\n%s", err, src)
+	}
+	p := parser.Parser{Tokens: tokens}
+	prog, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, src)
+	}
+	return prog.Statements
+}
+
+func TestFallsOff(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"", true},
+		{"print 1;", true},
+		{"return 0;", false},
+		{"let x = 1; if (x > 0) { return 1; }", true},
+		{"let x = 1; if (x > 0) { return 1; } else { return 2; }", false},
+		{"if (true) { return 1; }", false},
+		{"while (true) { print 1; }", false},
+		{"while (true) { break; }", true},
+		{"let x = 0; while (true) { x = x + 1; if (x > 3) { return x; } }", false},
+		{"let x = 0; while (x < 3) { x = x + 1; }", true},
+		{"while (false) { return 1; }", true},
+	}
+	for _, tt := range tests {
+		if got := Build(parse(t, tt.src)).FallsOff(); got != tt.want {
+			t.Errorf("%q: FallsOff = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestInfiniteLoops(t *testing.T) {
+	tests := []struct {
+		src  string
+		want int
+	}{
+		{"while (true) { print 1; }", 1},
+		{"while (true) { break; }", 0},
+		{"let x = 0; while (true) { x = x + 1; if (x > 3) { return x; } }", 0},
+		{"let x = 0; while (x < 3) { x = x + 1; }", 0},
+		{"while (true) { while (true) { break; } }", 1},
+		{"while (true) { while (true) { print 1; } break; }", 1},
+		{"return 0; while (true) { print 1; }", 0}, // unreachable
+	}
+	for _, tt := range tests {
+		stmts := parse(t, tt.src)
+		if got := Build(stmts).InfiniteLoops(stmts); len(got) != tt.want {
+			t.Errorf("%q: got %d infinite loops, want %d", tt.src, len(got), tt.want)
+		}
+	}
+}
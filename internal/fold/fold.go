@@ -0,0 +1,190 @@
+// Package fold evaluates constant expressions at compile time.
+//
+// Any BinaryExpr or UnaryExpr whose operands are all literals is replaced by
+// a single literal holding its value, so the backends never see the
+// arithmetic. Folding follows the target's 64-bit wraparound semantics,
+// unless arithmetic is checked, in which case a constant expression that
+// overflows is an error.
+package fold
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+)
+
+// Error is an error in a constant expression, such as a division by a
+// constant zero.
+type Error struct {
+	Pos lexer.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+func errorf(pos lexer.Position, format string, args ...interface{}) {
+	panic(&Error{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// constant is the value of a folded literal. Comparisons and boolean
+// literals produce bools, everything else an int.
+type constant struct {
+	val    int64
+	isBool bool
+}
+
+// node returns a literal for the constant, spanning what the folded
+// expression did.
+func (c constant) node(span parser.Span) parser.Expr {
+	if c.isBool {
+		return &parser.BoolLit{Span: span, Value: c.val != 0}
+	}
+	return &parser.NumberLiteral{Span: span, Value: strconv.FormatInt(c.val, 10)}
+}
+
+// Program folds every constant expression in prog in place.
+func Program(prog *parser.Program) error {
+	return program(prog, false)
+}
+
+// Checked folds like Program for a program compiled with checked
+// arithmetic, where overflow traps at run time. An overflowing constant
+// expression is reported instead of wrapping around.
+func Checked(prog *parser.Program) error {
+	return program(prog, true)
+}
+
+func program(prog *parser.Program, checked bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			foldErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = foldErr
+		}
+	}()
+
+	parser.Rewrite(prog, func(node parser.Node) parser.Node {
+		return fold(node, checked)
+	})
+	return nil
+}
+
+// fold replaces a constant expression whose operands have already been
+// folded by a literal.
+func fold(node parser.Node, checked bool) parser.Node {
+	switch n := node.(type) {
+	case *parser.UnaryExpr:
+		if c, ok := literal(n.Right); ok {
+			switch n.Operator {
+			case "+":
+				return constant{val: c.val}.node(n.Span)
+			case "-":
+				if checked && c.val == math.MinInt64 {
+					errorf(n.Pos(), "constant arithmetic overflow")
+				}
+				return constant{val: -c.val}.node(n.Span)
+			}
+		}
+
+	case *parser.BinaryExpr:
+		left, lok := literal(n.Left)
+		right, rok := literal(n.Right)
+		if rok && right.val == 0 && (n.Operator == "/" || n.Operator == "%") {
+			errorf(n.OpPos, "constant division by zero")
+		}
+		if lok && rok {
+			if checked && overflows(n.Operator, left.val, right.val) {
+				errorf(n.OpPos, "constant arithmetic overflow")
+			}
+			if c, ok := binary(n.Operator, left.val, right.val); ok {
+				return c.node(n.Span)
+			}
+		}
+	}
+	return node
+}
+
+// literal returns the value of a literal node.
+func literal(node parser.Expr) (constant, bool) {
+	switch n := node.(type) {
+	case *parser.NumberLiteral:
+		val, err := strconv.ParseInt(n.Value, 10, 64)
+		if err != nil {
+			return constant{}, false
+		}
+		return constant{val: val}, true
+	case *parser.BoolLit:
+		c := constant{isBool: true}
+		if n.Value {
+			c.val = 1
+		}
+		return c, true
+	}
+	return constant{}, false
+}
+
+// overflows reports whether an arithmetic operator on constants overflows
+// 64 bits.
+func overflows(op string, left, right int64) bool {
+	switch op {
+	case "+":
+		sum := left + right
+		return (left >= 0) == (right >= 0) && (sum >= 0) != (left >= 0)
+	case "-":
+		diff := left - right
+		return (left >= 0) != (right >= 0) && (diff >= 0) != (left >= 0)
+	case "*":
+		return left != 0 && (left*right/left != right || left == -1 && right == math.MinInt64)
+	case "/", "%":
+		return left == math.MinInt64 && right == -1
+	}
+	return false
+}
+
+// binary evaluates a binary operator on constants. It reports false for
+// operations that must be left for run time: unknown operators and
+// divisions that trap on the target.
+func binary(op string, left, right int64) (constant, bool) {
+	b := func(v bool) (constant, bool) {
+		c := constant{isBool: true}
+		if v {
+			c.val = 1
+		}
+		return c, true
+	}
+
+	switch op {
+	case "+":
+		return constant{val: left + right}, true
+	case "-":
+		return constant{val: left - right}, true
+	case "*":
+		return constant{val: left * right}, true
+	case "/", "%":
+		if right == 0 || left == math.MinInt64 && right == -1 {
+			return constant{}, false
+		}
+		if op == "/" {
+			return constant{val: left / right}, true
+		}
+		return constant{val: left % right}, true
+	case "<":
+		return b(left < right)
+	case ">":
+		return b(left > right)
+	case "<=":
+		return b(left <= right)
+	case ">=":
+		return b(left >= right)
+	case "==":
+		return b(left == right)
+	}
+	return constant{}, false
+}
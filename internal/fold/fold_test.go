@@ -0,0 +1,157 @@
+package fold
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/eval"
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/randprog"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+// parse parses a program and resolves its names.
+func parse(t *testing.T, src string) (*parser.Program, *resolve.Table) {
+	t.Helper()
+	tokens, err := lexer.Lex(src)
+	if err != nil {
+		t.Fatalf("lex: %v\n%s", err, src)
+	}
+	p := parser.Parser{Tokens: tokens}
+	prog, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, src)
+	}
+	syms, err := resolve.Resolve(prog)
+	if err != nil {
+		t.Fatalf("resolve: %v\n%s", err, src)
+	}
+	return prog, syms
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		src  string
+		want parser.Node
+	}{
+		{"return 8*2+1;", &parser.NumberLiteral{Value: "17"}},
+		{"return -(3-5);", &parser.NumberLiteral{Value: "2"}},
+		{"return 3 <= 6;", &parser.BoolLit{Value: true}},
+		{"return (1 == 2) == false;", &parser.BoolLit{Value: true}},
+		{"return 9223372036854775807 + 1;", &parser.NumberLiteral{Value: "-9223372036854775808"}},
+		{"return -7 % 3;", &parser.NumberLiteral{Value: "-1"}},
+	}
+	for _, tt := range tests {
+		prog, _ := parse(t, tt.src)
+		if err := Program(prog); err != nil {
+			t.Fatalf("%s: %v", tt.src, err)
+		}
+		got := prog.Statements[0].(*parser.ReturnStmt).Value
+		switch want := tt.want.(type) {
+		case *parser.NumberLiteral:
+			if n, ok := got.(*parser.NumberLiteral); !ok || n.Value != want.Value {
+				t.Errorf("%s: got %#v, want %s", tt.src, got, want.Value)
+			}
+		case *parser.BoolLit:
+			if b, ok := got.(*parser.BoolLit); !ok || b.Value != want.Value {
+				t.Errorf("%s: got %#v, want %v", tt.src, got, want.Value)
+			}
+		}
+	}
+}
+
+func TestFoldLeavesVariables(t *testing.T) {
+	prog, _ := parse(t, "let x = 1; return x + 2 * 3;")
+	if err := Program(prog); err != nil {
+		t.Fatal(err)
+	}
+	sum, ok := prog.Statements[1].(*parser.ReturnStmt).Value.(*parser.BinaryExpr)
+	if !ok {
+		t.Fatalf("got %#v, want x + 6", prog.Statements[1].(*parser.ReturnStmt).Value)
+	}
+	if n, ok := sum.Right.(*parser.NumberLiteral); !ok || n.Value != "6" {
+		t.Errorf("got right operand %#v, want 6", sum.Right)
+	}
+}
+
+func TestFoldDivisionByZero(t *testing.T) {
+	for _, src := range []string{
+		"return 1 / 0;",
+		"let x = 5; while (x > 0) { x = x % (2 - 2); } return x;",
+	} {
+		prog, _ := parse(t, src)
+		err := Program(prog)
+		if _, ok := err.(*Error); !ok {
+			t.Errorf("%s: got %v, want a division by zero error", src, err)
+		}
+	}
+
+	// The overflowing division traps on the target, so it is left alone.
+	prog, _ := parse(t, "return (-9223372036854775807 - 1) / -1;")
+	if err := Program(prog); err != nil {
+		t.Fatal(err)
+	}
+	if v := prog.Statements[0].(*parser.ReturnStmt).Value; v == nil {
+		t.Fatal("missing return value")
+	} else if _, ok := v.(*parser.BinaryExpr); !ok {
+		t.Errorf("got %#v, want the division left in place", v)
+	}
+}
+
+func TestFoldChecked(t *testing.T) {
+	for _, tt := range []struct {
+		src string
+		col int
+	}{
+		{"return 9223372036854775807 + 1;", 28},
+		{"return -9223372036854775807 - 2;", 29},
+		{"return 4611686018427387904 * 2;", 28},
+		{"return -(-9223372036854775807 - 1);", 8},
+		{"return (-9223372036854775807 - 1) / -1;", 35},
+	} {
+		prog, _ := parse(t, tt.src)
+		err := Checked(prog)
+		if e, ok := err.(*Error); !ok || e.Msg != "constant arithmetic overflow" || e.Pos.Col != tt.col {
+			t.Errorf("%s: got %v, want an overflow at column %d", tt.src, err, tt.col)
+		}
+	}
+
+	prog, _ := parse(t, "return 9223372036854775806 + 1;")
+	if err := Checked(prog); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := prog.Statements[0].(*parser.ReturnStmt).Value.(*parser.NumberLiteral); !ok || n.Value != "9223372036854775807" {
+		t.Errorf("got %#v, want 9223372036854775807", prog.Statements[0].(*parser.ReturnStmt).Value)
+	}
+}
+
+// TestFoldAgreement checks that folding never changes what a program does.
+func TestFoldAgreement(t *testing.T) {
+	r := rand.New(rand.NewPCG(5, 5))
+	for i := 0; i < 200; i++ {
+		src := randprog.Generate(r)
+
+		var want bytes.Buffer
+		prog, syms := parse(t, src)
+		wantCode, err := eval.NewEnv(nil, &want, syms).Eval(prog)
+		if err != nil {
+			t.Fatalf("eval: %v\n%s", err, src)
+		}
+
+		prog, syms = parse(t, src)
+		if err := Program(prog); err != nil {
+			t.Fatalf("fold: %v\n%s", err, src)
+		}
+		var got bytes.Buffer
+		gotCode, err := eval.NewEnv(nil, &got, syms).Eval(prog)
+		if err != nil {
+			t.Fatalf("eval folded: %v\n%s", err, src)
+		}
+		if got.String() != want.String() || gotCode != wantCode {
+			t.Fatalf("folding changed the program\n%s\nfolded: exit %d, output:\n%s\noriginal: exit %d, output:\n%s",
+				src, gotCode, got.String(), wantCode, want.String())
+		}
+	}
+}
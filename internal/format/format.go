@@ -0,0 +1,297 @@
+// Package format prints Bingus programs in their canonical layout.
+//
+// The layout is rebuilt from the AST: four-space indentation, opening
+// braces on the line of their statement, one space around binary operators
+// and only the parentheses that precedence requires. Comments are put back
+// where they were, either on a line of their own or after the code on their
+// line, and a single blank line is kept wherever the source had one or more.
+// Formatting formatted source leaves it unchanged.
+package format
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+)
+
+const indentUnit = "    "
+
+// comment is a comment from the trivia of the source.
+type comment struct {
+	text     string
+	offset   int
+	trailing bool // follows a token on the same line
+}
+
+type printer struct {
+	src      string
+	tokens   []lexer.Token
+	comments []comment
+	next     int         // index of the first comment not yet printed
+	closing  map[int]int // offset of each '{' to the offset of its '}'
+
+	lines  []string
+	indent int
+}
+
+// Source formats a program. Lexical and syntax errors are returned as they
+// come from the lexer and parser.
+func Source(src string) (string, error) {
+	tokens, tail, err := lexer.LexLossless(src)
+	if err != nil {
+		return "", err
+	}
+	p := parser.Parser{Tokens: tokens}
+	prog, err := p.ParseProgram()
+	if err != nil {
+		return "", err
+	}
+
+	pr := &printer{src: src, tokens: tokens, closing: map[int]int{}}
+	addComments := func(trivia []lexer.Trivia, trailing bool) {
+		for _, t := range trivia {
+			if t.Kind == lexer.TRIVIA_LINE_COMMENT || t.Kind == lexer.TRIVIA_BLOCK_COMMENT {
+				text := strings.TrimRight(t.Text, " \t\r")
+				pr.comments = append(pr.comments, comment{text: text, offset: t.Pos.Offset, trailing: trailing})
+			}
+		}
+	}
+	var open []int
+	for _, tok := range tokens {
+		addComments(tok.Leading, false)
+		addComments(tok.Trailing, true)
+		switch tok.Type {
+		case lexer.TOKEN_LBRACE:
+			open = append(open, tok.Pos.Offset)
+		case lexer.TOKEN_RBRACE:
+			pr.closing[open[len(open)-1]] = tok.Pos.Offset
+			open = open[:len(open)-1]
+		}
+	}
+	addComments(tail, false)
+
+	pr.stmts(prog.Statements)
+	pr.flushComments(len(src))
+	if len(pr.lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(pr.lines, "\n") + "\n", nil
+}
+
+func (p *printer) line(text string) {
+	p.lines = append(p.lines, strings.Repeat(indentUnit, p.indent)+text)
+}
+
+// blankBefore reports whether the source has an empty line just before
+// offset.
+func (p *printer) blankBefore(offset int) bool {
+	newlines := 0
+	for i := offset - 1; i >= 0; i-- {
+		switch p.src[i] {
+		case '\n':
+			newlines++
+		case ' ', '\t', '\r':
+		default:
+			return newlines >= 2
+		}
+	}
+	return false
+}
+
+// separate starts a new item at offset with a blank line if the source had
+// one there. Nothing is inserted at the start of the file or a block.
+func (p *printer) separate(offset int) {
+	if len(p.lines) == 0 || strings.HasSuffix(p.lines[len(p.lines)-1], "{") {
+		return
+	}
+	if p.blankBefore(offset) {
+		p.lines = append(p.lines, "")
+	}
+}
+
+// flushComments prints the comments that start before offset.
+func (p *printer) flushComments(offset int) {
+	for p.next < len(p.comments) && p.comments[p.next].offset < offset {
+		c := p.comments[p.next]
+		p.next++
+		if c.trailing && len(p.lines) > 0 {
+			p.lines[len(p.lines)-1] += " " + c.text
+			continue
+		}
+		p.separate(c.offset)
+		p.line(c.text)
+	}
+}
+
+func (p *printer) stmts(stmts []parser.Stmt) {
+	for _, stmt := range stmts {
+		offset := stmt.Pos().Offset
+		p.flushComments(offset)
+		p.separate(offset)
+		p.stmt(stmt)
+	}
+}
+
+// braces returns the offsets of the first '{' at or after offset and of
+// its '}'.
+func (p *printer) braces(offset int) (open, close int) {
+	i := sort.Search(len(p.tokens), func(i int) bool {
+		return p.tokens[i].Pos.Offset >= offset
+	})
+	for p.tokens[i].Type != lexer.TOKEN_LBRACE {
+		i++
+	}
+	open = p.tokens[i].Pos.Offset
+	return open, p.closing[open]
+}
+
+// block prints the statements of the block whose '{' is the first one at
+// or after offset, after head. It returns the offset of the block's '}'.
+func (p *printer) block(head string, offset int, stmts []parser.Stmt) int {
+	_, close := p.braces(offset)
+
+	hasComments := p.next < len(p.comments) && p.comments[p.next].offset < close
+	if len(stmts) == 0 && !hasComments {
+		p.line(head + " {}")
+		return close
+	}
+	p.line(head + " {")
+	p.indent++
+	p.stmts(stmts)
+	p.flushComments(close)
+	p.indent--
+	p.line("}")
+	return close
+}
+
+func (p *printer) stmt(node parser.Stmt) {
+	switch n := node.(type) {
+	case *parser.LetStmt:
+		name := n.Name.Name
+		if n.Type != nil {
+			name += ": " + n.Type.Name
+		}
+		p.line("let " + name + " = " + expr(n.Value, 0) + ";")
+
+	case *parser.AssignmentStmt:
+		p.line(n.Name.Name + " = " + expr(n.Value, 0) + ";")
+
+	case *parser.FieldAssignStmt:
+		p.line(expr(n.Target, 0) + " = " + expr(n.Value, 0) + ";")
+
+	case *parser.StructDecl:
+		p.structDecl(n)
+
+	case *parser.PrintStmt:
+		p.line("print " + expr(n.Value, 0) + ";")
+
+	case *parser.FreeStmt:
+		p.line("free(" + expr(n.Value, 0) + ");")
+
+	case *parser.ReturnStmt:
+		p.line("return " + expr(n.Value, 0) + ";")
+
+	case *parser.BreakStmt:
+		p.line("break;")
+
+	case *parser.ContinueStmt:
+		p.line("continue;")
+
+	case *parser.WhileStmt:
+		p.block("while ("+expr(n.Guard, 0)+")", n.Guard.End().Offset, n.Body)
+
+	case *parser.IfStmt:
+		close := p.block("if ("+expr(n.Guard, 0)+")", n.Guard.End().Offset, n.Then)
+		if n.Else != nil {
+			// The else block continues the line that closes the then block.
+			last := len(p.lines) - 1
+			head := strings.TrimLeft(p.lines[last], " ")
+			p.lines = p.lines[:last]
+			p.block(head+" else", close+1, n.Else)
+		}
+	}
+}
+
+// structDecl prints a struct declaration with one field per line, each
+// followed by a comma.
+func (p *printer) structDecl(n *parser.StructDecl) {
+	head := "struct " + n.Name.Name
+	_, close := p.braces(n.Name.End().Offset)
+	hasComments := p.next < len(p.comments) && p.comments[p.next].offset < close
+	if len(n.Fields) == 0 && !hasComments {
+		p.line(head + " {}")
+		return
+	}
+	p.line(head + " {")
+	p.indent++
+	for _, f := range n.Fields {
+		offset := f.Pos().Offset
+		p.flushComments(offset)
+		p.separate(offset)
+		p.line(f.Name.Name + ": " + f.Type.Name + ",")
+	}
+	p.flushComments(close)
+	p.indent--
+	p.line("}")
+}
+
+// expr prints an expression that appears where operators binding less
+// tightly than prec need parentheses.
+func expr(node parser.Expr, prec int) string {
+	switch n := node.(type) {
+	case *parser.NumberLiteral:
+		return n.Value
+	case *parser.IDent:
+		return n.Name
+	case *parser.BoolLit:
+		if n.Value {
+			return "true"
+		}
+		return "false"
+	case *parser.InputExpr:
+		return "input()"
+	case *parser.ArgcExpr:
+		return "argc()"
+	case *parser.ArgExpr:
+		return "arg(" + expr(n.Index, 0) + ")"
+	case *parser.EnvExpr:
+		return `env("` + n.Name + `")`
+	case *parser.AllocExpr:
+		return "alloc(" + expr(n.Size, 0) + ")"
+	case *parser.StructLit:
+		if len(n.Fields) == 0 {
+			return n.Type.Name + " {}"
+		}
+		fields := make([]string, len(n.Fields))
+		for i, f := range n.Fields {
+			fields[i] = f.Name.Name + ": " + expr(f.Value, 0)
+		}
+		return n.Type.Name + " { " + strings.Join(fields, ", ") + " }"
+	case *parser.FieldExpr:
+		// Selectors only follow primary expressions.
+		return expr(n.X, 0) + "." + n.Field.Name
+	case *parser.UnaryExpr:
+		// The operand of a unary operator is a primary expression. Another
+		// unary operator is parenthesized, so that -(-x) does not print as
+		// --x.
+		if _, ok := n.Right.(*parser.UnaryExpr); ok {
+			return n.Operator + "(" + expr(n.Right, 0) + ")"
+		}
+		return n.Operator + expr(n.Right, parser.BinaryPrecedence("u"+n.Operator))
+	case *parser.BinaryExpr:
+		own := parser.BinaryPrecedence(n.Operator)
+		left := own
+		if own == parser.BinaryPrecedence("==") {
+			// Chained comparisons are legal but read badly without them.
+			left++
+		}
+		s := expr(n.Left, left) + " " + n.Operator + " " + expr(n.Right, own+1)
+		if own < prec {
+			return "(" + s + ")"
+		}
+		return s
+	}
+	return ""
+}
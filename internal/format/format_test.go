@@ -0,0 +1,109 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/eval"
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/randprog"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"", ""},
+		{"let x:int=1+2*3;return x ;", "let x: int = 1 + 2 * 3;\nreturn x;\n"},
+		{"print (1+2)*3; print 1-(2-3); print (1-2)-3; print -(1+2); print - -1;",
+			"print (1 + 2) * 3;\nprint 1 - (2 - 3);\nprint 1 - 2 - 3;\nprint -(1 + 2);\nprint -(-1);\n"},
+		{"print (1 < 2) == true;", "print (1 < 2) == true;\n"},
+		{"let x = 0;\n\n\n\nx = 1;", "let x = 0;\n\nx = 1;\n"},
+		{"while(true){break;}if(false){}else{print 1;}",
+			"while (true) {\n    break;\n}\nif (false) {} else {\n    print 1;\n}\n"},
+		{"// a\nlet x = 1; // b\nif (x == 1) { // c\n/* d */ print x;\n// e\n} // f\n// g",
+			"// a\nlet x = 1; // b\nif (x == 1) { // c\n    /* d */\n    print x;\n    // e\n} // f\n// g\n"},
+		{"if (true) {\n  // only\n}", "if (true) {\n    // only\n}\n"},
+		{"let x=input ( )*2;", "let x = input() * 2;\n"},
+		{"let input=input();input=input+1;", "let input = input();\ninput = input + 1;\n"},
+		{"print arg ( argc()-1 )+env( \"HOME\");", "print arg(argc() - 1) + env(\"HOME\");\n"},
+		{"let arg=arg(1);let env=env(\"N\");let argc=argc();", "let arg = arg(1);\nlet env = env(\"N\");\nlet argc = argc();\n"},
+		{"let p:ptr=alloc (8*2);free( p ) ;", "let p: ptr = alloc(8 * 2);\nfree(p);\n"},
+		{"let free=alloc(1);free(free);let alloc=free;", "let free = alloc(1);\nfree(free);\nlet alloc = free;\n"},
+		{"struct E{}struct P{x:int,// x\ny:int,}let p=P{x:1,y:2};p.x=p.y;if(P{x:1,y:E{}.x}.x==1){}",
+			"struct E {}\nstruct P {\n    x: int, // x\n    y: int,\n}\nlet p = P { x: 1, y: 2 };\np.x = p.y;\nif (P { x: 1, y: E {}.x }.x == 1) {}\n"},
+	}
+	for _, tt := range tests {
+		got, err := Source(tt.src)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q:\ngot\n%s\nwant\n%s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func run(t *testing.T, src string) string {
+	t.Helper()
+	tokens, err := lexer.Lex(src)
+	if err != nil {
+		t.Fatalf("lex: %v\n%s", err, src)
+	}
+	p := parser.Parser{Tokens: tokens}
+	prog, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, src)
+	}
+	syms, err := resolve.Resolve(prog)
+	if err != nil {
+		t.Fatalf("resolve: %v\n%s", err, src)
+	}
+	var out bytes.Buffer
+	env := eval.NewEnv(nil, &out, syms)
+	status, err := env.Eval(prog)
+	if err != nil {
+		t.Fatalf("eval: %v\n%s", err, src)
+	}
+	return fmt.Sprintf("%sstatus %d", out.String(), status)
+}
+
+// checkFormat checks that formatting src is idempotent and keeps its
+// behavior.
+func checkFormat(t *testing.T, src string) {
+	t.Helper()
+	once, err := Source(src)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, src)
+	}
+	twice, err := Source(once)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, once)
+	}
+	if twice != once {
+		t.Fatalf("not idempotent:\n%s\nthen\n%s", once, twice)
+	}
+	if got, want := run(t, once), run(t, src); got != want {
+		t.Fatalf("formatted program behaves differently: got %q, want %q\n%s", got, want, once)
+	}
+}
+
+// Formatting programs, hand-written and random, keeps their behavior and
+// is idempotent.
+func TestRandomPrograms(t *testing.T) {
+	for _, src := range []string{
+		"let x = 3; print -(-x); print -(+x); print - - -1; return -(-(2 + 1));",
+		"struct P { x: int } let p = P { x: 3 }; print -(-p.x); print -(+p.x); return -p.x;",
+	} {
+		checkFormat(t, src)
+	}
+	r := rand.New(rand.NewPCG(7, 7))
+	for i := 0; i < 200; i++ {
+		checkFormat(t, randprog.Generate(r))
+	}
+}
@@ -0,0 +1,74 @@
+// Package heap simulates the native runtime's allocator for the evaluator
+// and the bytecode VM.
+//
+// Pointers are plain integers. Like the native allocator, the heap rounds
+// every block up to a multiple of 16 bytes and puts a 16-byte header before
+// it, so pointers are 16-byte aligned and increase as memory is handed out.
+// Freed memory is never reused, so every misuse of a pointer is caught.
+package heap
+
+import "fmt"
+
+// Base is the address of the first block's header.
+const Base = 0x10000
+
+// Error is a misuse of the heap, such as freeing a block twice.
+type Error struct {
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// Heap is a simulated heap. The zero value is an empty heap.
+type Heap struct {
+	next  int64
+	sizes map[int64]int64 // size of each live block
+	freed map[int64]bool
+}
+
+// blockSize is the number of bytes a request for n bytes takes up.
+func blockSize(n int64) int64 {
+	return max(16, (n+15)&^15)
+}
+
+// Alloc returns a pointer to a new block of at least n bytes.
+func (h *Heap) Alloc(n int64) (int64, error) {
+	if n < 0 {
+		return 0, &Error{Msg: fmt.Sprintf("invalid allocation size %d", n)}
+	}
+	if h.sizes == nil {
+		h.next = Base
+		h.sizes = map[int64]int64{}
+		h.freed = map[int64]bool{}
+	}
+	size := blockSize(n)
+	p := h.next + 16
+	h.next = p + size
+	h.sizes[p] = size
+	return p, nil
+}
+
+// Free releases the block at p.
+func (h *Heap) Free(p int64) error {
+	if h.freed[p] {
+		return &Error{Msg: "double free"}
+	}
+	if _, ok := h.sizes[p]; !ok {
+		return &Error{Msg: fmt.Sprintf("invalid free of %#x", p)}
+	}
+	delete(h.sizes, p)
+	h.freed[p] = true
+	return nil
+}
+
+// Live returns the number of blocks that have not been freed and their
+// total size in bytes.
+func (h *Heap) Live() (blocks, bytes int64) {
+	for _, size := range h.sizes {
+		blocks++
+		bytes += size
+	}
+	return blocks, bytes
+}
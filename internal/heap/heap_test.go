@@ -0,0 +1,40 @@
+package heap
+
+import "testing"
+
+func TestHeap(t *testing.T) {
+	var h Heap
+	a, err := h.Alloc(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := h.Alloc(17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != Base+16 || b != a+32 {
+		t.Errorf("pointers %#x, %#x; want %#x, %#x", a, b, Base+16, Base+48)
+	}
+	if blocks, bytes := h.Live(); blocks != 2 || bytes != 48 {
+		t.Errorf("live = %d blocks, %d bytes; want 2, 48", blocks, bytes)
+	}
+
+	if err := h.Free(a); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{h.Free(a), "double free"},
+		{h.Free(a + 1), "invalid free of 0x10011"},
+		{func() error { _, err := h.Alloc(-1); return err }(), "invalid allocation size -1"},
+	} {
+		if tt.err == nil || tt.err.Error() != tt.want {
+			t.Errorf("got error %v, want %q", tt.err, tt.want)
+		}
+	}
+	if blocks, bytes := h.Live(); blocks != 1 || bytes != 32 {
+		t.Errorf("live = %d blocks, %d bytes; want 1, 32", blocks, bytes)
+	}
+}
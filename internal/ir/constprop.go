@@ -0,0 +1,265 @@
+package ir
+
+import "math"
+
+type latticeKind int
+
+const (
+	latTop    latticeKind = iota // no value seen yet
+	latConst                     // a single known constant
+	latBottom                    // varies at run time
+)
+
+type lattice struct {
+	kind latticeKind
+	val  int64
+}
+
+// Fold evaluates a pure operation on constant operands with the target's
+// 64-bit wraparound semantics. It reports false when the operation would
+// trap at run time, which must then be left in place.
+func Fold(op Op, args ...int64) (int64, bool) {
+	b2i := func(b bool) int64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	switch op {
+	case OpCopy:
+		return args[0], true
+	case OpNeg:
+		return -args[0], true
+	case OpAdd:
+		return args[0] + args[1], true
+	case OpSub:
+		return args[0] - args[1], true
+	case OpMul:
+		return args[0] * args[1], true
+	case OpDiv, OpMod:
+		if args[1] == 0 || args[0] == math.MinInt64 && args[1] == -1 {
+			return 0, false
+		}
+		if op == OpDiv {
+			return args[0] / args[1], true
+		}
+		return args[0] % args[1], true
+	case OpLess:
+		return b2i(args[0] < args[1]), true
+	case OpGreater:
+		return b2i(args[0] > args[1]), true
+	case OpLessEq:
+		return b2i(args[0] <= args[1]), true
+	case OpGreaterEq:
+		return b2i(args[0] >= args[1]), true
+	case OpEqual:
+		return b2i(args[0] == args[1]), true
+	}
+	return 0, false
+}
+
+// overflows reports whether an arithmetic operation on constants overflows
+// 64 bits, which traps at run time in checked mode.
+func overflows(op Op, args ...int64) bool {
+	switch op {
+	case OpNeg:
+		return args[0] == math.MinInt64
+	case OpAdd:
+		sum := args[0] + args[1]
+		return (args[0] >= 0) == (args[1] >= 0) && (sum >= 0) != (args[0] >= 0)
+	case OpSub:
+		diff := args[0] - args[1]
+		return (args[0] >= 0) != (args[1] >= 0) && (diff >= 0) != (args[0] >= 0)
+	case OpMul:
+		a, b := args[0], args[1]
+		return a != 0 && (a*b/a != b || a == -1 && b == math.MinInt64)
+	}
+	return false
+}
+
+// ConstProp performs sparse conditional constant propagation (Wegman and
+// Zadeck). Registers proven constant are rewritten to const instructions,
+// branches on constants become jumps, and blocks that can never execute are
+// removed. Operations that would trap at run time are left in place. The
+// function must be in SSA form.
+func ConstProp(fn *Func) {
+	val := map[Reg]lattice{}
+	execEdge := map[[2]*Block]bool{}
+	execBlock := map[*Block]bool{}
+
+	// users maps a register to the blocks whose instructions or terminator
+	// read it.
+	users := map[Reg][]*Block{}
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			for _, arg := range instr.Args {
+				users[arg] = append(users[arg], b)
+			}
+		}
+		for _, r := range b.Term.Uses() {
+			users[*r] = append(users[*r], b)
+		}
+	}
+
+	var blockWork []*Block
+	var regWork []Reg
+
+	lower := func(r Reg, l lattice) {
+		old := val[r]
+		if old.kind == latBottom || old == l {
+			return
+		}
+		if old.kind == latConst && l.kind == latConst {
+			l = lattice{kind: latBottom}
+		}
+		if l.kind < old.kind {
+			return
+		}
+		val[r] = l
+		regWork = append(regWork, r)
+	}
+
+	markEdge := func(from, to *Block) {
+		if execEdge[[2]*Block{from, to}] {
+			return
+		}
+		execEdge[[2]*Block{from, to}] = true
+		blockWork = append(blockWork, to)
+	}
+
+	visitInstr := func(b *Block, instr *Instr) {
+		if instr.Dst == NoReg {
+			return
+		}
+		switch instr.Op {
+		case OpConst:
+			lower(instr.Dst, lattice{kind: latConst, val: instr.Imm})
+		case OpPhi:
+			result := lattice{kind: latTop}
+			for i, arg := range instr.Args {
+				if !execEdge[[2]*Block{instr.From[i], b}] {
+					continue
+				}
+				a := val[arg]
+				switch {
+				case a.kind == latBottom || a.kind == latConst && result.kind == latConst && a.val != result.val:
+					result = lattice{kind: latBottom}
+				case a.kind == latConst && result.kind == latTop:
+					result = a
+				}
+			}
+			lower(instr.Dst, result)
+		default:
+			args := make([]int64, len(instr.Args))
+			for i, arg := range instr.Args {
+				a := val[arg]
+				switch a.kind {
+				case latTop:
+					return
+				case latBottom:
+					lower(instr.Dst, lattice{kind: latBottom})
+					return
+				}
+				args[i] = a.val
+			}
+			if v, ok := Fold(instr.Op, args...); ok && !(fn.Checked && overflows(instr.Op, args...)) {
+				lower(instr.Dst, lattice{kind: latConst, val: v})
+			} else {
+				lower(instr.Dst, lattice{kind: latBottom})
+			}
+		}
+	}
+
+	visitTerm := func(b *Block) {
+		switch b.Term.Kind {
+		case TermJump:
+			markEdge(b, b.Term.Then)
+		case TermBranch:
+			switch c := val[b.Term.Cond]; c.kind {
+			case latConst:
+				if c.val != 0 {
+					markEdge(b, b.Term.Then)
+				} else {
+					markEdge(b, b.Term.Else)
+				}
+			case latBottom:
+				markEdge(b, b.Term.Then)
+				markEdge(b, b.Term.Else)
+			}
+		}
+	}
+
+	visitBlock := func(b *Block) {
+		for _, instr := range b.Instrs {
+			visitInstr(b, instr)
+		}
+		visitTerm(b)
+	}
+
+	entry := fn.Entry()
+	execBlock[entry] = true
+	visitBlock(entry)
+
+	for len(blockWork) > 0 || len(regWork) > 0 {
+		for len(blockWork) > 0 {
+			b := blockWork[len(blockWork)-1]
+			blockWork = blockWork[:len(blockWork)-1]
+			if !execBlock[b] {
+				execBlock[b] = true
+				visitBlock(b)
+			} else {
+				// A new incoming edge can only change the phis.
+				for _, phi := range b.Phis() {
+					visitInstr(b, phi)
+				}
+			}
+		}
+		for len(regWork) > 0 {
+			r := regWork[len(regWork)-1]
+			regWork = regWork[:len(regWork)-1]
+			for _, b := range users[r] {
+				if execBlock[b] {
+					visitBlock(b)
+				}
+			}
+		}
+	}
+
+	// Rewrite with what was learned.
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			if l := val[instr.Dst]; instr.Dst != NoReg && l.kind == latConst {
+				*instr = Instr{Op: OpConst, Dst: instr.Dst, Imm: l.val, Line: instr.Line}
+			}
+		}
+		if b.Term.Kind == TermBranch {
+			if c := val[b.Term.Cond]; c.kind == latConst {
+				target := b.Term.Else
+				if c.val != 0 {
+					target = b.Term.Then
+				}
+				b.Term = Term{Kind: TermJump, Then: target}
+			}
+		}
+	}
+	sortPhisFirst(fn)
+	fn.RemoveUnreachable()
+	mergeBlocks(fn)
+}
+
+// sortPhisFirst moves phis that were rewritten to other instructions below
+// the remaining phis, keeping the phis at the top of each block.
+func sortPhisFirst(fn *Func) {
+	for _, b := range fn.Blocks {
+		var phis, rest []*Instr
+		for _, instr := range b.Instrs {
+			if instr.Op == OpPhi {
+				phis = append(phis, instr)
+			} else {
+				rest = append(rest, instr)
+			}
+		}
+		b.Instrs = append(phis, rest...)
+	}
+}
@@ -0,0 +1,65 @@
+package ir
+
+import "fmt"
+
+// commutative ops have their operands sorted so that a+b and b+a share a
+// value number.
+var commutative = map[Op]bool{
+	OpAdd:   true,
+	OpMul:   true,
+	OpEqual: true,
+}
+
+func valueKey(instr *Instr) string {
+	args := instr.Args
+	if commutative[instr.Op] && args[0] > args[1] {
+		args = []Reg{args[1], args[0]}
+	}
+	return fmt.Sprintf("%d/%d/%q/%v", instr.Op, instr.Imm, instr.Name, args)
+}
+
+// CSE eliminates common subexpressions by dominator-based value numbering:
+// an instruction that recomputes a value already available in a dominating
+// block is replaced by that value. The function must be in SSA form.
+func CSE(fn *Func) {
+	dom := Dominators(fn)
+	subst := map[Reg]Reg{}
+	dead := map[*Instr]bool{}
+
+	var walk func(b *Block, avail map[string]Reg)
+	walk = func(b *Block, avail map[string]Reg) {
+		scope := make(map[string]Reg, len(avail))
+		for k, v := range avail {
+			scope[k] = v
+		}
+
+		for _, instr := range b.Instrs {
+			for i, arg := range instr.Args {
+				if r, ok := subst[arg]; ok {
+					instr.Args[i] = r
+				}
+			}
+			switch instr.Op {
+			case OpPhi, OpPrint, OpInput, OpAlloc, OpFree, OpLoad, OpStore, OpCopy:
+				continue
+			}
+			key := valueKey(instr)
+			if r, ok := scope[key]; ok {
+				subst[instr.Dst] = r
+				dead[instr] = true
+				continue
+			}
+			scope[key] = instr.Dst
+		}
+
+		for _, child := range dom.Children(b) {
+			walk(child, scope)
+		}
+	}
+	walk(fn.Entry(), map[string]Reg{})
+
+	// Phis and terminators can read values defined in blocks visited later,
+	// so finish the substitution over the whole function.
+	replaceUses(fn, subst)
+	removeInstrs(fn, dead)
+}
@@ -0,0 +1,135 @@
+package ir
+
+// DomTree is the dominator tree of a function's control-flow graph.
+type DomTree struct {
+	// Order lists the reachable blocks in reverse postorder, so every block
+	// comes after its immediate dominator.
+	Order []*Block
+
+	idom     map[*Block]*Block
+	children map[*Block][]*Block
+	index    map[*Block]int
+}
+
+// Dominators computes the dominator tree with the iterative algorithm of
+// Cooper, Harvey and Kennedy.
+func Dominators(fn *Func) *DomTree {
+	t := &DomTree{
+		idom:     map[*Block]*Block{},
+		children: map[*Block][]*Block{},
+		index:    map[*Block]int{},
+	}
+
+	// Number the blocks in reverse postorder.
+	seen := map[*Block]bool{}
+	var post []*Block
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		seen[b] = true
+		for _, s := range b.Succs {
+			if !seen[s] {
+				visit(s)
+			}
+		}
+		post = append(post, b)
+	}
+	visit(fn.Entry())
+	for i := len(post) - 1; i >= 0; i-- {
+		t.index[post[i]] = len(t.Order)
+		t.Order = append(t.Order, post[i])
+	}
+
+	entry := fn.Entry()
+	t.idom[entry] = entry
+
+	intersect := func(a, b *Block) *Block {
+		for a != b {
+			for t.index[a] > t.index[b] {
+				a = t.idom[a]
+			}
+			for t.index[b] > t.index[a] {
+				b = t.idom[b]
+			}
+		}
+		return a
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, b := range t.Order[1:] {
+			var idom *Block
+			for _, p := range b.Preds {
+				if _, done := t.idom[p]; !done {
+					continue
+				}
+				if idom == nil {
+					idom = p
+				} else {
+					idom = intersect(p, idom)
+				}
+			}
+			if t.idom[b] != idom {
+				t.idom[b] = idom
+				changed = true
+			}
+		}
+	}
+
+	for _, b := range t.Order[1:] {
+		t.children[t.idom[b]] = append(t.children[t.idom[b]], b)
+	}
+	delete(t.idom, entry)
+	return t
+}
+
+// Idom returns the immediate dominator of b, or nil for the entry block.
+func (t *DomTree) Idom(b *Block) *Block {
+	return t.idom[b]
+}
+
+// Children returns the blocks that b immediately dominates.
+func (t *DomTree) Children(b *Block) []*Block {
+	return t.children[b]
+}
+
+// Dominates reports whether a dominates b. Every block dominates itself.
+func (t *DomTree) Dominates(a, b *Block) bool {
+	for b != nil {
+		if a == b {
+			return true
+		}
+		b = t.idom[b]
+	}
+	return false
+}
+
+// Frontiers computes the dominance frontier of every block: the blocks where
+// its dominance ends, which is where SSA construction places phis.
+func (t *DomTree) Frontiers() map[*Block][]*Block {
+	df := map[*Block][]*Block{}
+	for _, b := range t.Order {
+		if len(b.Preds) < 2 {
+			continue
+		}
+		for _, p := range b.Preds {
+			if _, ok := t.index[p]; !ok {
+				continue
+			}
+			for runner := p; runner != t.idom[b]; runner = t.idom[runner] {
+				if !containsBlock(df[runner], b) {
+					df[runner] = append(df[runner], b)
+				}
+			}
+		}
+	}
+	return df
+}
+
+func containsBlock(blocks []*Block, b *Block) bool {
+	for _, x := range blocks {
+		if x == b {
+			return true
+		}
+	}
+	return false
+}
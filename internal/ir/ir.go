@@ -0,0 +1,394 @@
+// Package ir defines a three-address intermediate representation that sits
+// between the parser's AST and the backends.
+//
+// A Func is a control-flow graph of basic blocks. Each block holds a list of
+// instructions over an unbounded set of virtual registers and ends in a
+// single terminator that names its successors explicitly.
+//
+// Struct variables are not held in registers. Each is an Object, a run of
+// words in memory that load and store instructions read and write one word
+// at a time.
+package ir
+
+import "fmt"
+
+// Reg is a virtual register.
+type Reg int
+
+// NoReg marks an unused register operand.
+const NoReg Reg = -1
+
+func (r Reg) String() string {
+	return fmt.Sprintf("%%%d", int(r))
+}
+
+type Op int
+
+const (
+	OpConst Op = iota // Dst = Imm
+	OpCopy            // Dst = Args[0]
+	OpAdd             // Dst = Args[0] + Args[1]
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpNeg // Dst = -Args[0]
+	OpLess
+	OpGreater
+	OpLessEq
+	OpGreaterEq
+	OpEqual
+	OpPrint // print Args[0]
+	OpInput // Dst = an integer read from standard input
+	OpArgc  // Dst = the number of command-line arguments
+	OpArg   // Dst = command-line argument Args[0] as an integer
+	OpEnv   // Dst = environment variable Name as an integer
+	OpAlloc // Dst = a pointer to a new heap block of Args[0] bytes
+	OpFree  // free the heap block at Args[0]
+	OpLoad  // Dst = word Imm of Obj
+	OpStore // word Imm of Obj = Args[0]
+	OpPhi   // Dst = Args[i] when control arrived from From[i]
+)
+
+var opNames = map[Op]string{
+	OpConst:     "const",
+	OpCopy:      "copy",
+	OpAdd:       "add",
+	OpSub:       "sub",
+	OpMul:       "mul",
+	OpDiv:       "div",
+	OpMod:       "mod",
+	OpNeg:       "neg",
+	OpLess:      "lt",
+	OpGreater:   "gt",
+	OpLessEq:    "le",
+	OpGreaterEq: "ge",
+	OpEqual:     "eq",
+	OpPrint:     "print",
+	OpInput:     "input",
+	OpArgc:      "argc",
+	OpArg:       "arg",
+	OpEnv:       "env",
+	OpAlloc:     "alloc",
+	OpFree:      "free",
+	OpLoad:      "load",
+	OpStore:     "store",
+	OpPhi:       "phi",
+}
+
+func (op Op) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("op(%d)", int(op))
+}
+
+// IsBinary reports whether op takes two register operands.
+func (op Op) IsBinary() bool {
+	return op >= OpAdd && op <= OpMod || op >= OpLess && op <= OpEqual
+}
+
+// IsCompare reports whether op produces a 0/1 comparison result.
+func (op Op) IsCompare() bool {
+	return op >= OpLess && op <= OpEqual
+}
+
+type Instr struct {
+	Op   Op
+	Dst  Reg // NoReg for instructions without a result
+	Args []Reg
+	Imm  int64
+	From []*Block // for phis, the predecessor each argument flows in from
+	Name string   // for env, the variable's name
+	Obj  *Object  // for load and store, the object accessed
+	Line int      // source line the instruction came from; 0 if none
+}
+
+// isPure reports whether the instruction can be removed, duplicated or
+// moved without changing what the program does. Division is pure only when
+// the divisor is a constant that cannot trap. With checked arithmetic, the
+// other arithmetic is pure only on constants that do not overflow. defs
+// maps each register to its defining instruction, so the function must be
+// in SSA form.
+func (instr *Instr) isPure(defs map[Reg]*Instr, checked bool) bool {
+	switch instr.Op {
+	case OpPrint, OpInput, OpArg, OpEnv, OpAlloc, OpFree, OpLoad, OpStore, OpPhi:
+		return false
+	case OpDiv, OpMod:
+		d := defs[instr.Args[1]]
+		return d != nil && d.Op == OpConst && d.Imm != 0 && d.Imm != -1
+	case OpNeg, OpAdd, OpSub, OpMul:
+		if !checked {
+			return true
+		}
+		args := make([]int64, len(instr.Args))
+		for i, arg := range instr.Args {
+			d := defs[arg]
+			if d == nil || d.Op != OpConst {
+				return false
+			}
+			args[i] = d.Imm
+		}
+		return !overflows(instr.Op, args...)
+	default:
+		return true
+	}
+}
+
+type TermKind int
+
+const (
+	TermNone   TermKind = iota // block not yet terminated
+	TermJump                   // jump Then
+	TermBranch                 // if Cond != 0 jump Then else jump Else
+	TermReturn                 // exit the program with status Value
+)
+
+// Term is the control transfer that ends a block.
+type Term struct {
+	Kind  TermKind
+	Cond  Reg
+	Value Reg
+	Then  *Block
+	Else  *Block
+	Line  int // source line of the statement that transfers control
+}
+
+type Block struct {
+	ID     int
+	Name   string // describes the construct the block came from, e.g. "while_start"
+	Line   int    // source line of that construct; 0 if none
+	Instrs []*Instr
+	Term   Term
+	Preds  []*Block
+	Succs  []*Block
+}
+
+// Label is the block's unique name, used in dumps and by backends.
+func (b *Block) Label() string {
+	return fmt.Sprintf("%s_%d", b.Name, b.ID)
+}
+
+func (b *Block) add(instr *Instr) {
+	b.Instrs = append(b.Instrs, instr)
+}
+
+// Phis returns the block's leading phi instructions.
+func (b *Block) Phis() []*Instr {
+	n := 0
+	for n < len(b.Instrs) && b.Instrs[n].Op == OpPhi {
+		n++
+	}
+	return b.Instrs[:n]
+}
+
+// Uses returns the registers the terminator reads.
+func (t *Term) Uses() []*Reg {
+	switch t.Kind {
+	case TermBranch:
+		return []*Reg{&t.Cond}
+	case TermReturn:
+		return []*Reg{&t.Value}
+	}
+	return nil
+}
+
+// Object is a struct variable, kept in memory as Size consecutive words.
+type Object struct {
+	ID   int // index in Func.Objects
+	Name string
+	Size int
+}
+
+func (o *Object) String() string {
+	return fmt.Sprintf("@%d(%s)", o.ID, o.Name)
+}
+
+// Func is a function in IR form. Blocks[0] is the entry block.
+type Func struct {
+	Name    string
+	Blocks  []*Block
+	NumRegs int
+	Objects []*Object
+
+	// VarNames maps the registers that hold source variables to the
+	// variable's name.
+	VarNames map[Reg]string
+
+	// Checked is set when the backend traps on arithmetic overflow and
+	// division by zero instead of wrapping around or faulting.
+	Checked bool
+
+	// SSA is set while the function is in SSA form: every register has
+	// exactly one definition and blocks may start with phis.
+	SSA bool
+
+	nextBlock int
+}
+
+func NewFunc(name string) *Func {
+	return &Func{Name: name, VarNames: map[Reg]string{}}
+}
+
+// NewReg allocates a fresh virtual register.
+func (f *Func) NewReg() Reg {
+	r := Reg(f.NumRegs)
+	f.NumRegs++
+	return r
+}
+
+// NewObject allocates an object of size words for the variable name.
+func (f *Func) NewObject(name string, size int) *Object {
+	o := &Object{ID: len(f.Objects), Name: name, Size: size}
+	f.Objects = append(f.Objects, o)
+	return o
+}
+
+// NewBlock creates a block and appends it to the function.
+func (f *Func) NewBlock(name string) *Block {
+	b := &Block{ID: f.nextBlock, Name: name}
+	f.nextBlock++
+	f.Blocks = append(f.Blocks, b)
+	return b
+}
+
+func (f *Func) Entry() *Block {
+	return f.Blocks[0]
+}
+
+// defs maps every register to its defining instruction. In SSA form each
+// register has exactly one.
+func (f *Func) defs() map[Reg]*Instr {
+	defs := map[Reg]*Instr{}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Dst != NoReg {
+				defs[instr.Dst] = instr
+			}
+		}
+	}
+	return defs
+}
+
+// RebuildEdges recomputes every block's Preds and Succs from the
+// terminators. Passes that rewrite terminators must call it afterwards.
+func (f *Func) RebuildEdges() {
+	for _, b := range f.Blocks {
+		b.Preds, b.Succs = nil, nil
+	}
+	for _, b := range f.Blocks {
+		switch b.Term.Kind {
+		case TermJump:
+			b.Succs = []*Block{b.Term.Then}
+		case TermBranch:
+			b.Succs = []*Block{b.Term.Then, b.Term.Else}
+			if b.Term.Then == b.Term.Else {
+				b.Succs = b.Succs[:1]
+			}
+		}
+		for _, s := range b.Succs {
+			s.Preds = append(s.Preds, b)
+		}
+	}
+}
+
+// RemoveUnreachable deletes blocks that cannot be reached from the entry
+// block and rebuilds the edges.
+func (f *Func) RemoveUnreachable() {
+	seen := map[*Block]bool{}
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		if seen[b] {
+			return
+		}
+		seen[b] = true
+		switch b.Term.Kind {
+		case TermJump:
+			visit(b.Term.Then)
+		case TermBranch:
+			visit(b.Term.Then)
+			visit(b.Term.Else)
+		}
+	}
+	visit(f.Entry())
+
+	kept := f.Blocks[:0]
+	for _, b := range f.Blocks {
+		if seen[b] {
+			kept = append(kept, b)
+		}
+	}
+	f.Blocks = kept
+	f.RebuildEdges()
+
+	for _, b := range f.Blocks {
+		b.prunePhis()
+	}
+}
+
+// prunePhis drops phi arguments that flow in from blocks that are no longer
+// predecessors.
+func (b *Block) prunePhis() {
+	isPred := map[*Block]bool{}
+	for _, p := range b.Preds {
+		isPred[p] = true
+	}
+	for _, phi := range b.Phis() {
+		args, from := phi.Args[:0], phi.From[:0]
+		for i, p := range phi.From {
+			if isPred[p] {
+				args = append(args, phi.Args[i])
+				from = append(from, p)
+			}
+		}
+		phi.Args, phi.From = args, from
+	}
+}
+
+// mergeBlocks folds each block that is the only successor of its only
+// predecessor into that predecessor, removing the jump between them.
+func mergeBlocks(fn *Func) {
+	merged := map[*Block]bool{}
+	for _, b := range fn.Blocks {
+		if merged[b] {
+			continue
+		}
+		for b.Term.Kind == TermJump {
+			s := b.Term.Then
+			if s == b || s == fn.Entry() || len(s.Preds) != 1 {
+				break
+			}
+			// With a single predecessor, phis are plain copies.
+			for _, phi := range s.Phis() {
+				phi.Op, phi.From = OpCopy, nil
+			}
+			b.Instrs = append(b.Instrs, s.Instrs...)
+			b.Term = s.Term
+			b.Succs = s.Succs
+			for _, succ := range s.Succs {
+				for i, p := range succ.Preds {
+					if p == s {
+						succ.Preds[i] = b
+					}
+				}
+				for _, phi := range succ.Phis() {
+					for i, p := range phi.From {
+						if p == s {
+							phi.From[i] = b
+						}
+					}
+				}
+			}
+			merged[s] = true
+		}
+	}
+
+	kept := fn.Blocks[:0]
+	for _, b := range fn.Blocks {
+		if !merged[b] {
+			kept = append(kept, b)
+		}
+	}
+	fn.Blocks = kept
+	fn.RebuildEdges()
+}
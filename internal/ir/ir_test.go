@@ -0,0 +1,455 @@
+package ir
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/eval"
+	"github.com/BergurDavidsen/bingus/internal/heap"
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/randprog"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+// parse parses a program and resolves its names.
+func parse(t *testing.T, src string) (*parser.Program, *resolve.Table) {
+	t.Helper()
+	tokens, err := lexer.Lex(src)
+	if err != nil {
+		t.Fatalf("lex: %v\n%s", err, src)
+	}
+	p := parser.Parser{Tokens: tokens}
+	prog, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, src)
+	}
+	syms, err := resolve.Resolve(prog)
+	if err != nil {
+		t.Fatalf("resolve: %v\n%s", err, src)
+	}
+	return prog, syms
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// interp executes a function directly, so IR passes can be checked without
+// a backend. Each object gets its own words, and the heap is simulated like
+// the evaluator's.
+func interp(fn *Func, out io.Writer) (int, error) {
+	regs := make([]int64, fn.NumRegs)
+	mem := make([][]int64, len(fn.Objects))
+	for i, o := range fn.Objects {
+		mem[i] = make([]int64, o.Size)
+	}
+	var h heap.Heap
+	b := fn.Entry()
+	var prev *Block
+
+	for {
+		// Phis read their arguments simultaneously on entry to the block.
+		phis := b.Phis()
+		vals := make([]int64, len(phis))
+		for i, phi := range phis {
+			found := false
+			for j, from := range phi.From {
+				if from == prev {
+					vals[i] = regs[phi.Args[j]]
+					found = true
+				}
+			}
+			if !found {
+				return 0, fmt.Errorf("phi %s in %s has no argument for the edge taken", phi.Dst, b.Label())
+			}
+		}
+		for i, phi := range phis {
+			regs[phi.Dst] = vals[i]
+		}
+
+		for _, instr := range b.Instrs[len(phis):] {
+			arg := func(i int) int64 { return regs[instr.Args[i]] }
+			var v int64
+			switch op := instr.Op; {
+			case op == OpConst:
+				v = instr.Imm
+			case op == OpCopy:
+				v = arg(0)
+			case op == OpNeg:
+				v = -arg(0)
+			case op == OpAdd:
+				v = arg(0) + arg(1)
+			case op == OpSub:
+				v = arg(0) - arg(1)
+			case op == OpMul:
+				v = arg(0) * arg(1)
+			case op == OpDiv || op == OpMod:
+				if arg(1) == 0 {
+					return 0, fmt.Errorf("division by zero")
+				}
+				if op == OpDiv {
+					v = arg(0) / arg(1)
+				} else {
+					v = arg(0) % arg(1)
+				}
+			case op == OpLess:
+				v = boolToInt(arg(0) < arg(1))
+			case op == OpGreater:
+				v = boolToInt(arg(0) > arg(1))
+			case op == OpLessEq:
+				v = boolToInt(arg(0) <= arg(1))
+			case op == OpGreaterEq:
+				v = boolToInt(arg(0) >= arg(1))
+			case op == OpEqual:
+				v = boolToInt(arg(0) == arg(1))
+			case op == OpPrint:
+				fmt.Fprintln(out, arg(0))
+				continue
+			case op == OpAlloc:
+				p, err := h.Alloc(arg(0))
+				if err != nil {
+					return 0, err
+				}
+				v = p
+			case op == OpFree:
+				if err := h.Free(arg(0)); err != nil {
+					return 0, err
+				}
+				continue
+			case op == OpLoad:
+				v = mem[instr.Obj.ID][instr.Imm]
+			case op == OpStore:
+				mem[instr.Obj.ID][instr.Imm] = arg(0)
+				continue
+			default:
+				return 0, fmt.Errorf("unknown op %s", op)
+			}
+			regs[instr.Dst] = v
+		}
+
+		prev = b
+		switch b.Term.Kind {
+		case TermJump:
+			b = b.Term.Then
+		case TermBranch:
+			if regs[b.Term.Cond] != 0 {
+				b = b.Term.Then
+			} else {
+				b = b.Term.Else
+			}
+		case TermReturn:
+			return int(regs[b.Term.Value]), nil
+		default:
+			return 0, fmt.Errorf("block %s is not terminated", b.Label())
+		}
+	}
+}
+
+func TestLowerAgreement(t *testing.T) {
+	r := rand.New(rand.NewPCG(7, 7))
+
+	for i := 0; i < 300; i++ {
+		src := randprog.Generate(r)
+
+		var want bytes.Buffer
+		prog, syms := parse(t, src)
+		wantCode, err := eval.NewEnv(nil, &want, syms).Eval(prog)
+		if err != nil {
+			t.Fatalf("eval: %v\n%s", err, src)
+		}
+
+		fn, err := Lower(parse(t, src))
+		if err != nil {
+			t.Fatalf("lower: %v\n%s", err, src)
+		}
+		var got bytes.Buffer
+		gotCode, err := interp(fn, &got)
+		if err != nil {
+			t.Fatalf("interp: %v\n%s\n%s", err, src, fn)
+		}
+
+		if got.String() != want.String() || gotCode != wantCode {
+			t.Fatalf("IR disagrees with evaluator\n%s\n%s\nir: exit %d, output:\n%s\neval: exit %d, output:\n%s",
+				src, fn, gotCode, got.String(), wantCode, want.String())
+		}
+	}
+}
+
+func TestLowerControlFlow(t *testing.T) {
+	fn, err := Lower(parse(t, "let i = 0; while (i < 3) { i = i + 1; if (i == 2) { break; } } return i;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range fn.Blocks {
+		if b.Term.Kind == TermNone {
+			t.Errorf("block %s is not terminated", b.Label())
+		}
+		if b != fn.Entry() && len(b.Preds) == 0 {
+			t.Errorf("block %s is unreachable", b.Label())
+		}
+		for _, s := range b.Succs {
+			found := false
+			for _, p := range s.Preds {
+				found = found || p == b
+			}
+			if !found {
+				t.Errorf("edge %s -> %s missing from predecessors", b.Label(), s.Label())
+			}
+		}
+	}
+}
+
+// The implicit return 0 is added exactly when the flow graph has a path
+// that runs off the end.
+func TestLowerImplicitReturn(t *testing.T) {
+	tests := []struct {
+		src     string
+		returns int
+	}{
+		{"", 1},
+		{"while (true) { print 1; }", 0},
+		{"if (true) { return 1; }", 1},
+		{"if (false) {} else { return 2; }", 1},
+		{"let x = 1; if (x == 1) { return 1; }", 2},
+		{"let x = 1; while (true) { if (x == 1) { break; } }", 1},
+	}
+	for _, tt := range tests {
+		fn, err := Lower(parse(t, tt.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		returns := 0
+		for _, b := range fn.Blocks {
+			if b.Term.Kind == TermNone {
+				t.Errorf("%q: block %s is not terminated", tt.src, b.Label())
+			}
+			if b.Term.Kind == TermReturn {
+				returns++
+			}
+		}
+		if returns != tt.returns {
+			t.Errorf("%q: %d returns, want %d\n%s", tt.src, returns, tt.returns, fn)
+		}
+	}
+}
+
+// checkSSA verifies that every register is defined once and that each
+// definition dominates its uses.
+func checkSSA(t *testing.T, fn *Func) {
+	t.Helper()
+	dom := Dominators(fn)
+	defBlock := map[Reg]*Block{}
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Dst == NoReg {
+				continue
+			}
+			if _, dup := defBlock[instr.Dst]; dup {
+				t.Fatalf("%s defined twice\n%s", instr.Dst, fn)
+			}
+			defBlock[instr.Dst] = b
+		}
+	}
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			for i, arg := range instr.Args {
+				use := b
+				if instr.Op == OpPhi {
+					use = instr.From[i]
+				}
+				if d, ok := defBlock[arg]; !ok || !dom.Dominates(d, use) {
+					t.Fatalf("use of %s in %s is not dominated by its definition\n%s", arg, b.Label(), fn)
+				}
+			}
+		}
+	}
+}
+
+func TestOptimizeAgreement(t *testing.T) {
+	r := rand.New(rand.NewPCG(8, 8))
+
+	for i := 0; i < 200; i++ {
+		src := randprog.Generate(r)
+
+		var want bytes.Buffer
+		prog, syms := parse(t, src)
+		wantCode, err := eval.NewEnv(nil, &want, syms).Eval(prog)
+		if err != nil {
+			t.Fatalf("eval: %v\n%s", err, src)
+		}
+
+		for level := 1; level <= 2; level++ {
+			fn, err := Lower(parse(t, src))
+			if err != nil {
+				t.Fatalf("lower: %v\n%s", err, src)
+			}
+
+			err = Optimize(fn, level, func(pass string, fn *Func) {
+				if fn.SSA {
+					checkSSA(t, fn)
+				}
+				var got bytes.Buffer
+				gotCode, err := interp(fn, &got)
+				if err != nil {
+					t.Fatalf("-O%d after %s: %v\n%s\n%s", level, pass, err, src, fn)
+				}
+				if got.String() != want.String() || gotCode != wantCode {
+					t.Fatalf("-O%d after %s disagrees with evaluator\n%s\n%s\nir: exit %d, output:\n%s\neval: exit %d, output:\n%s",
+						level, pass, src, fn, gotCode, got.String(), wantCode, want.String())
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// Struct programs keep their fields in objects, which the passes must not
+// reorder or drop loads and stores of.
+func TestStructAgreement(t *testing.T) {
+	tests := []string{
+		// Copies are independent of the original.
+		`struct P { x: int, y: int }
+let p = P { x: 1, y: 2 };
+let q = p;
+q.x = 10;
+p = P { x: p.y, y: p.x };
+print p.x;
+print p.y;
+print q.x;
+return q.x + q.y;`,
+		// Nested fields are read and written through the outer struct.
+		`struct P { x: int, y: int }
+struct L { from: P, to: P, on: bool }
+let l = L { from: P { x: 1, y: 2 }, to: P { x: 3, y: 4 }, on: true };
+l.from.y = l.to.x + l.to.y;
+let m = l;
+l.to = l.from;
+m.to.x = 0;
+print l.to.y;
+print m.to.x + m.to.y;
+print l.on;
+print P { x: 7, y: 8 }.y;
+return l.from.y;`,
+		// Field writes inside a loop and after continue.
+		`struct C { n: int, odd: int, last: int }
+let c = C { n: 0, odd: 0, last: 0 };
+let i = 0;
+while (i < 10) {
+    i = i + 1;
+    c.n = c.n + 1;
+    if (i % 2 == 0) {
+        continue;
+    }
+    c.odd = c.odd + i;
+    c.last = i;
+}
+print c.n;
+print c.odd;
+return c.last;`,
+		`struct P { x: int, y: int }
+let p = P { x: 0, y: 0 };
+let i = 0;
+while (i < 6) {
+    i = i + 1;
+    let q = p;
+    if (i == 3) {
+        p.y = 100;
+        continue;
+    }
+    p.x = q.x + i;
+    print p.x + q.y;
+}
+return p.x + p.y;`,
+		// Pointers stored in fields keep their identity.
+		`struct B { data: ptr, size: int }
+let b = B { data: alloc(8), size: 8 };
+let c = b;
+let p = alloc(8);
+print c.data == b.data;
+print p == b.data;
+free(c.data);
+free(p);
+return b.size;`,
+	}
+
+	for _, src := range tests {
+		var want bytes.Buffer
+		prog, syms := parse(t, src)
+		wantCode, err := eval.NewEnv(nil, &want, syms).Eval(prog)
+		if err != nil {
+			t.Fatalf("eval: %v\n%s", err, src)
+		}
+
+		for level := 0; level <= 2; level++ {
+			fn, err := Lower(parse(t, src))
+			if err != nil {
+				t.Fatalf("lower: %v\n%s", err, src)
+			}
+			check := func(pass string, fn *Func) {
+				var got bytes.Buffer
+				gotCode, err := interp(fn, &got)
+				if err != nil {
+					t.Fatalf("-O%d after %s: %v\n%s\n%s", level, pass, err, src, fn)
+				}
+				if got.String() != want.String() || gotCode != wantCode {
+					t.Fatalf("-O%d after %s disagrees with evaluator\n%s\n%s\nir: exit %d, output:\n%s\neval: exit %d, output:\n%s",
+						level, pass, src, fn, gotCode, got.String(), wantCode, want.String())
+				}
+			}
+			check("lowering", fn)
+			if err := Optimize(fn, level, check); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestOptimizeFoldsConstants(t *testing.T) {
+	fn, err := Lower(parse(t, "let x = 3; let y = x * 4; if (y > 10) { print y; } else { print 0; } return y + 1;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Optimize(fn, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fn.Blocks) != 1 {
+		t.Errorf("want the branch folded into a single block, got %d blocks\n%s", len(fn.Blocks), fn)
+	}
+	for _, instr := range fn.Entry().Instrs {
+		if instr.Op != OpConst && instr.Op != OpPrint {
+			t.Errorf("want only constants and prints, got %s\n%s", instr.Op, fn)
+		}
+	}
+}
+
+func TestLICMHoistsInvariants(t *testing.T) {
+	fn, err := Lower(parse(t, "let a = 0; let n = 0; while (n < 10) { n = n + 1; a = a + n; } let i = 0; while (i < 5) { i = i + 1; print a * 7; } return 0;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Optimize(fn, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dom := Dominators(fn)
+	for _, l := range FindLoops(fn, dom) {
+		for b := range l.Blocks {
+			for _, instr := range b.Instrs {
+				if instr.Op == OpMul {
+					t.Errorf("a * 7 was not hoisted out of loop %s\n%s", l.Header.Label(), fn)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package ir
+
+import "sort"
+
+// Loop is a natural loop: a header block and the blocks that can reach one
+// of its back edges without passing through the header.
+type Loop struct {
+	Header *Block
+	Blocks map[*Block]bool
+}
+
+// FindLoops returns the natural loops of a function, innermost first.
+// Back edges that share a header are merged into one loop.
+func FindLoops(fn *Func, dom *DomTree) []*Loop {
+	byHeader := map[*Block]*Loop{}
+	var loops []*Loop
+
+	for _, b := range dom.Order {
+		for _, h := range b.Succs {
+			if !dom.Dominates(h, b) {
+				continue
+			}
+			l := byHeader[h]
+			if l == nil {
+				l = &Loop{Header: h, Blocks: map[*Block]bool{h: true}}
+				byHeader[h] = l
+				loops = append(loops, l)
+			}
+			work := []*Block{b}
+			for len(work) > 0 {
+				x := work[len(work)-1]
+				work = work[:len(work)-1]
+				if l.Blocks[x] {
+					continue
+				}
+				l.Blocks[x] = true
+				work = append(work, x.Preds...)
+			}
+		}
+	}
+
+	sort.SliceStable(loops, func(i, j int) bool {
+		return len(loops[i].Blocks) < len(loops[j].Blocks)
+	})
+	return loops
+}
+
+// ensurePreheader gives a loop a block outside it that is the header's only
+// predecessor from outside and has the header as its only successor, so
+// hoisted code runs exactly once before the loop is entered.
+func ensurePreheader(fn *Func, l *Loop) bool {
+	var outside []*Block
+	for _, p := range l.Header.Preds {
+		if !l.Blocks[p] {
+			outside = append(outside, p)
+		}
+	}
+	if len(outside) == 0 || len(outside) == 1 && len(outside[0].Succs) == 1 {
+		return false
+	}
+
+	pre := &Block{ID: fn.nextBlock, Name: "preheader"}
+	fn.nextBlock++
+	for i, b := range fn.Blocks {
+		if b == l.Header {
+			fn.Blocks = append(fn.Blocks[:i], append([]*Block{pre}, fn.Blocks[i:]...)...)
+			break
+		}
+	}
+
+	for _, p := range outside {
+		if p.Term.Then == l.Header {
+			p.Term.Then = pre
+		}
+		if p.Term.Kind == TermBranch && p.Term.Else == l.Header {
+			p.Term.Else = pre
+		}
+	}
+	pre.Term = Term{Kind: TermJump, Then: l.Header}
+
+	// Incoming phi values from outside now arrive through the preheader,
+	// merged by a phi there when there is more than one outside edge.
+	isOutside := map[*Block]bool{}
+	for _, p := range outside {
+		isOutside[p] = true
+	}
+	for _, phi := range l.Header.Phis() {
+		var inner, outer []Reg
+		var innerFrom, outerFrom []*Block
+		for i, p := range phi.From {
+			if isOutside[p] {
+				outer, outerFrom = append(outer, phi.Args[i]), append(outerFrom, p)
+			} else {
+				inner, innerFrom = append(inner, phi.Args[i]), append(innerFrom, p)
+			}
+		}
+		if len(outer) == 0 {
+			continue
+		}
+		in := outer[0]
+		if len(outer) > 1 {
+			in = fn.NewReg()
+			if name, ok := fn.VarNames[phi.Dst]; ok {
+				fn.VarNames[in] = name
+			}
+			pre.add(&Instr{Op: OpPhi, Dst: in, Args: outer, From: outerFrom})
+		}
+		phi.Args = append(inner, in)
+		phi.From = append(innerFrom, pre)
+	}
+
+	fn.RebuildEdges()
+	return true
+}
+
+// LICM hoists loop-invariant computations into each loop's preheader. An
+// instruction is invariant when it is pure and all of its operands are
+// defined outside the loop. The function must be in SSA form.
+func LICM(fn *Func) {
+	dom := Dominators(fn)
+	inserted := false
+	for _, l := range FindLoops(fn, dom) {
+		if ensurePreheader(fn, l) {
+			inserted = true
+		}
+	}
+	if inserted {
+		dom = Dominators(fn)
+	}
+
+	defs := fn.defs()
+	defBlock := map[Reg]*Block{}
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Dst != NoReg {
+				defBlock[instr.Dst] = b
+			}
+		}
+	}
+
+	for _, l := range FindLoops(fn, dom) {
+		var pre *Block
+		for _, p := range l.Header.Preds {
+			if !l.Blocks[p] {
+				pre = p
+			}
+		}
+		if pre == nil {
+			continue
+		}
+
+		for changed := true; changed; {
+			changed = false
+			for _, b := range dom.Order {
+				if !l.Blocks[b] {
+					continue
+				}
+				kept := b.Instrs[:0]
+				for _, instr := range b.Instrs {
+					if instr.Dst != NoReg && instr.isPure(defs, fn.Checked) && invariant(instr, l, defBlock) {
+						pre.add(instr)
+						defBlock[instr.Dst] = pre
+						changed = true
+						continue
+					}
+					kept = append(kept, instr)
+				}
+				b.Instrs = kept
+			}
+		}
+	}
+}
+
+func invariant(instr *Instr, l *Loop, defBlock map[Reg]*Block) bool {
+	for _, arg := range instr.Args {
+		if l.Blocks[defBlock[arg]] {
+			return false
+		}
+	}
+	return true
+}
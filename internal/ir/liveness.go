@@ -0,0 +1,86 @@
+package ir
+
+// RegSet is a set of virtual registers.
+type RegSet map[Reg]bool
+
+// Liveness records which registers hold a value that may still be read on
+// entry to and exit from each block.
+//
+// A phi's arguments are live out of the predecessor they flow in from, not
+// live into the phi's block, and the phi defines its destination at the top
+// of the block.
+type Liveness struct {
+	In  map[*Block]RegSet
+	Out map[*Block]RegSet
+}
+
+// ComputeLiveness solves the backward liveness equations by iterating to a
+// fixed point.
+func ComputeLiveness(fn *Func) *Liveness {
+	live := &Liveness{In: map[*Block]RegSet{}, Out: map[*Block]RegSet{}}
+
+	use := map[*Block]RegSet{}
+	def := map[*Block]RegSet{}
+	for _, b := range fn.Blocks {
+		u, d := RegSet{}, RegSet{}
+		for _, instr := range b.Instrs {
+			if instr.Op != OpPhi {
+				for _, arg := range instr.Args {
+					if !d[arg] {
+						u[arg] = true
+					}
+				}
+			}
+			if instr.Dst != NoReg {
+				d[instr.Dst] = true
+			}
+		}
+		for _, r := range b.Term.Uses() {
+			if !d[*r] {
+				u[*r] = true
+			}
+		}
+		use[b], def[b] = u, d
+		live.In[b], live.Out[b] = RegSet{}, RegSet{}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := len(fn.Blocks) - 1; i >= 0; i-- {
+			b := fn.Blocks[i]
+
+			out := live.Out[b]
+			for _, s := range b.Succs {
+				for r := range live.In[s] {
+					if !out[r] {
+						out[r] = true
+						changed = true
+					}
+				}
+				for _, phi := range s.Phis() {
+					for j, p := range phi.From {
+						if p == b && !out[phi.Args[j]] {
+							out[phi.Args[j]] = true
+							changed = true
+						}
+					}
+				}
+			}
+
+			in := live.In[b]
+			for r := range use[b] {
+				if !in[r] {
+					in[r] = true
+					changed = true
+				}
+			}
+			for r := range out {
+				if !def[b][r] && !in[r] {
+					in[r] = true
+					changed = true
+				}
+			}
+		}
+	}
+	return live
+}
@@ -0,0 +1,415 @@
+package ir
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/BergurDavidsen/bingus/internal/flow"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+// Error is a semantic error found while lowering the AST.
+type Error struct {
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+type loopTargets struct {
+	cont *Block // where continue jumps: the loop guard
+	brk  *Block // where break jumps: the block after the loop
+}
+
+type builder struct {
+	fn      *Func
+	cur     *Block
+	syms    *resolve.Table
+	vars    map[*resolve.Symbol]Reg
+	objects map[*resolve.Symbol]*Object // struct variables
+	loops   []loopTargets
+	line    int // source line of the statement being lowered
+}
+
+func (b *builder) errorf(format string, args ...interface{}) {
+	panic(&Error{Msg: fmt.Sprintf(format, args...)})
+}
+
+// Lower translates a program whose names have been resolved into syms into
+// a single IR function named "main". Semantic errors such as a break outside
+// a loop are returned as *Error.
+func Lower(prog *parser.Program, syms *resolve.Table) (fn *Func, err error) {
+	b := &builder{
+		fn:      NewFunc("main"),
+		syms:    syms,
+		vars:    map[*resolve.Symbol]Reg{},
+		objects: map[*resolve.Symbol]*Object{},
+	}
+	b.cur = b.fn.NewBlock("entry")
+
+	defer func() {
+		if r := recover(); r != nil {
+			irErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			fn, err = nil, irErr
+		}
+	}()
+
+	for _, stmt := range prog.Statements {
+		b.lowerStmt(stmt)
+	}
+	// Paths that run off the end exit with 0. Whether any do is decided
+	// on the flow graph, which the missing-return lint check also uses.
+	// Otherwise the current block is unreachable and is removed below.
+	if flow.Build(prog.Statements).FallsOff() {
+		b.cur.Term = Term{Kind: TermReturn, Value: b.constant(0), Line: b.line}
+	}
+
+	b.fn.RemoveUnreachable()
+	return b.fn, nil
+}
+
+func (b *builder) symbol(id *parser.IDent) *resolve.Symbol {
+	sym := b.syms.Lookup(id)
+	if sym == nil {
+		b.errorf("unresolved identifier: %s", id.Name)
+	}
+	return sym
+}
+
+// declareVar gives the variable a let declares a fresh register.
+func (b *builder) declareVar(id *parser.IDent) Reg {
+	r := b.fn.NewReg()
+	b.fn.VarNames[r] = id.Name
+	b.vars[b.symbol(id)] = r
+	return r
+}
+
+func (b *builder) lookupVar(id *parser.IDent) Reg {
+	return b.vars[b.symbol(id)]
+}
+
+// newBlock creates a block for the construct on the current line.
+func (b *builder) newBlock(name string) *Block {
+	blk := b.fn.NewBlock(name)
+	blk.Line = b.line
+	return blk
+}
+
+func (b *builder) emit(op Op, args ...Reg) Reg {
+	dst := b.fn.NewReg()
+	b.cur.add(&Instr{Op: op, Dst: dst, Args: args, Line: b.line})
+	return dst
+}
+
+func (b *builder) constant(val int64) Reg {
+	dst := b.fn.NewReg()
+	b.cur.add(&Instr{Op: OpConst, Dst: dst, Imm: val, Line: b.line})
+	return dst
+}
+
+func (b *builder) copyTo(dst, src Reg) {
+	b.cur.add(&Instr{Op: OpCopy, Dst: dst, Args: []Reg{src}, Line: b.line})
+}
+
+// terminate ends the current block. Statements that follow an unconditional
+// transfer are lowered into a fresh block with no predecessors, which
+// RemoveUnreachable later discards.
+func (b *builder) terminate(t Term) {
+	t.Line = b.line
+	b.cur.Term = t
+	b.cur = b.fn.NewBlock("dead")
+}
+
+func (b *builder) jump(target *Block) {
+	if b.cur.Term.Kind == TermNone {
+		b.cur.Term = Term{Kind: TermJump, Then: target, Line: b.line}
+	}
+}
+
+// branch ends the current block with a branch on guard. A guard that is a
+// boolean literal becomes a jump to the side it always takes, so the blocks
+// match the flow graph.
+func (b *builder) branch(guard parser.Expr, then, els *Block) {
+	if value, ok := flow.Constant(guard); ok {
+		target := els
+		if value {
+			target = then
+		}
+		b.cur.Term = Term{Kind: TermJump, Then: target, Line: b.line}
+		return
+	}
+	cond := b.lowerExpr(guard)
+	b.cur.Term = Term{Kind: TermBranch, Cond: cond, Then: then, Else: els, Line: b.line}
+}
+
+func (b *builder) lowerBlock(stmts []parser.Stmt) {
+	for _, stmt := range stmts {
+		b.lowerStmt(stmt)
+	}
+}
+
+func (b *builder) lowerStmt(node parser.Stmt) {
+	b.line = node.Pos().Line
+	switch n := node.(type) {
+	case *parser.ReturnStmt:
+		val := b.lowerExpr(n.Value)
+		b.terminate(Term{Kind: TermReturn, Value: val})
+
+	case *parser.LetStmt:
+		if sym := b.symbol(n.Name); sym.Struct != nil {
+			words := b.lowerStruct(n.Value)
+			obj := b.fn.NewObject(n.Name.Name, sym.Struct.Size)
+			b.objects[sym] = obj
+			b.storeWords(obj, 0, words)
+		} else {
+			val := b.lowerExpr(n.Value)
+			b.copyTo(b.declareVar(n.Name), val)
+		}
+
+	case *parser.AssignmentStmt:
+		if sym := b.symbol(n.Name); sym.Struct != nil {
+			b.storeWords(b.objects[sym], 0, b.lowerStruct(n.Value))
+		} else {
+			val := b.lowerExpr(n.Value)
+			b.copyTo(b.lookupVar(n.Name), val)
+		}
+
+	case *parser.FieldAssignStmt:
+		var words []Reg
+		if b.field(n.Target).Struct != nil {
+			words = b.lowerStruct(n.Value)
+		} else {
+			words = []Reg{b.lowerExpr(n.Value)}
+		}
+		obj, off, ok := b.place(n.Target)
+		if !ok {
+			b.errorf("cannot assign to field %s of a struct literal", n.Target.Field.Name)
+		}
+		b.storeWords(obj, off, words)
+
+	case *parser.StructDecl:
+		// Structs are laid out by the resolver.
+
+	case *parser.PrintStmt:
+		val := b.lowerExpr(n.Value)
+		b.cur.add(&Instr{Op: OpPrint, Dst: NoReg, Args: []Reg{val}, Line: b.line})
+
+	case *parser.FreeStmt:
+		val := b.lowerExpr(n.Value)
+		b.cur.add(&Instr{Op: OpFree, Dst: NoReg, Args: []Reg{val}, Line: b.line})
+
+	case *parser.IfStmt:
+		thenBlock := b.newBlock("then")
+		endBlock := b.newBlock("endif")
+		elseBlock := endBlock
+		if len(n.Else) > 0 {
+			elseBlock = b.newBlock("else")
+		}
+		b.branch(n.Guard, thenBlock, elseBlock)
+
+		b.cur = thenBlock
+		b.lowerBlock(n.Then)
+		b.jump(endBlock)
+
+		if len(n.Else) > 0 {
+			b.cur = elseBlock
+			b.lowerBlock(n.Else)
+			b.jump(endBlock)
+		}
+
+		b.cur = endBlock
+
+	case *parser.WhileStmt:
+		startBlock := b.newBlock("while_start")
+		bodyBlock := b.newBlock("while_body")
+		endBlock := b.newBlock("while_end")
+
+		b.jump(startBlock)
+		b.cur = startBlock
+		b.branch(n.Guard, bodyBlock, endBlock)
+
+		b.loops = append(b.loops, loopTargets{cont: startBlock, brk: endBlock})
+		b.cur = bodyBlock
+		b.lowerBlock(n.Body)
+		b.line = n.Pos().Line // the jump back belongs to the loop
+		b.jump(startBlock)
+		b.loops = b.loops[:len(b.loops)-1]
+
+		b.cur = endBlock
+
+	case *parser.BreakStmt:
+		if len(b.loops) == 0 {
+			b.errorf("break statement not inside loop")
+		}
+		b.terminate(Term{Kind: TermJump, Then: b.loops[len(b.loops)-1].brk})
+
+	case *parser.ContinueStmt:
+		if len(b.loops) == 0 {
+			b.errorf("continue statement not inside loop")
+		}
+		b.terminate(Term{Kind: TermJump, Then: b.loops[len(b.loops)-1].cont})
+
+	default:
+		b.errorf("unsupported statement: %T", n)
+	}
+}
+
+var binaryOps = map[string]Op{
+	"+":  OpAdd,
+	"-":  OpSub,
+	"*":  OpMul,
+	"/":  OpDiv,
+	"%":  OpMod,
+	"<":  OpLess,
+	">":  OpGreater,
+	"<=": OpLessEq,
+	">=": OpGreaterEq,
+	"==": OpEqual,
+}
+
+func (b *builder) lowerExpr(node parser.Expr) Reg {
+	switch n := node.(type) {
+	case *parser.NumberLiteral:
+		val, err := strconv.ParseInt(n.Value, 10, 64)
+		if err != nil {
+			b.errorf("invalid integer literal: %s", n.Value)
+		}
+		return b.constant(val)
+
+	case *parser.BoolLit:
+		if n.Value {
+			return b.constant(1)
+		}
+		return b.constant(0)
+
+	case *parser.IDent:
+		return b.lookupVar(n)
+
+	case *parser.InputExpr:
+		return b.emit(OpInput)
+
+	case *parser.ArgcExpr:
+		return b.emit(OpArgc)
+
+	case *parser.ArgExpr:
+		return b.emit(OpArg, b.lowerExpr(n.Index))
+
+	case *parser.AllocExpr:
+		return b.emit(OpAlloc, b.lowerExpr(n.Size))
+
+	case *parser.EnvExpr:
+		dst := b.fn.NewReg()
+		b.cur.add(&Instr{Op: OpEnv, Dst: dst, Name: n.Name, Line: b.line})
+		return dst
+
+	case *parser.FieldExpr:
+		if obj, off, ok := b.place(n); ok {
+			return b.load(obj, off)
+		}
+		return b.lowerStruct(n.X)[b.field(n).Offset]
+
+	case *parser.UnaryExpr:
+		right := b.lowerExpr(n.Right)
+		switch n.Operator {
+		case "+":
+			return right
+		case "-":
+			return b.emit(OpNeg, right)
+		default:
+			b.errorf("unknown unary operator %s", n.Operator)
+		}
+
+	case *parser.BinaryExpr:
+		op, ok := binaryOps[n.Operator]
+		if !ok {
+			b.errorf("unknown operator %s", n.Operator)
+		}
+		left := b.lowerExpr(n.Left)
+		right := b.lowerExpr(n.Right)
+		return b.emit(op, left, right)
+
+	default:
+		b.errorf("unsupported expression: %T", n)
+	}
+	return NoReg
+}
+
+// field returns the field a selector refers to.
+func (b *builder) field(x *parser.FieldExpr) *resolve.Field {
+	f := b.syms.Field(x)
+	if f == nil {
+		b.errorf("unresolved field: %s", x.Field.Name)
+	}
+	return f
+}
+
+// place returns the object and the offset of the first word of a struct
+// variable or of a field of one. It reports false for a struct literal
+// and its fields, which are not kept in memory.
+func (b *builder) place(node parser.Expr) (*Object, int, bool) {
+	switch n := node.(type) {
+	case *parser.IDent:
+		obj, ok := b.objects[b.symbol(n)]
+		return obj, 0, ok
+	case *parser.FieldExpr:
+		obj, off, ok := b.place(n.X)
+		return obj, off + b.field(n).Offset, ok
+	}
+	return nil, 0, false
+}
+
+// lowerStruct computes the words of a struct value into registers.
+func (b *builder) lowerStruct(node parser.Expr) []Reg {
+	s := b.syms.StructOf(node)
+	if s == nil {
+		b.errorf("unsupported struct expression: %T", node)
+	}
+	if obj, off, ok := b.place(node); ok {
+		words := make([]Reg, s.Size)
+		for i := range words {
+			words[i] = b.load(obj, off+i)
+		}
+		return words
+	}
+
+	switch n := node.(type) {
+	case *parser.FieldExpr:
+		f := b.field(n)
+		return b.lowerStruct(n.X)[f.Offset : f.Offset+f.Size()]
+
+	case *parser.StructLit:
+		words := make([]Reg, s.Size)
+		for _, init := range n.Fields {
+			f := s.Field(init.Name.Name)
+			if f == nil {
+				b.errorf("unknown field %s of %s", init.Name.Name, s.Name)
+			}
+			if f.Struct != nil {
+				copy(words[f.Offset:], b.lowerStruct(init.Value))
+			} else {
+				words[f.Offset] = b.lowerExpr(init.Value)
+			}
+		}
+		return words
+	}
+	b.errorf("unsupported struct expression: %T", node)
+	return nil
+}
+
+func (b *builder) load(obj *Object, off int) Reg {
+	dst := b.fn.NewReg()
+	b.cur.add(&Instr{Op: OpLoad, Dst: dst, Obj: obj, Imm: int64(off), Line: b.line})
+	return dst
+}
+
+// storeWords stores words into obj from word off on.
+func (b *builder) storeWords(obj *Object, off int, words []Reg) {
+	for i, w := range words {
+		b.cur.add(&Instr{Op: OpStore, Dst: NoReg, Args: []Reg{w}, Obj: obj, Imm: int64(off + i), Line: b.line})
+	}
+}
@@ -0,0 +1,59 @@
+package ir
+
+import "fmt"
+
+// Pass is a named transformation of a function.
+type Pass struct {
+	Name string
+	Run  func(fn *Func)
+}
+
+// Passes returns the pass pipeline for an optimization level:
+//
+//	-O0  none; the function is compiled as lowered
+//	-O1  SSA, constant propagation, copy propagation, dead code elimination
+//	-O2  -O1 plus common subexpression elimination and loop-invariant
+//	     code motion
+//
+// Every pipeline that builds SSA ends by destructing it again, since the
+// backends expect phi-free code.
+func Passes(level int) ([]Pass, error) {
+	ssa := Pass{"ssa", BuildSSA}
+	constProp := Pass{"constprop", ConstProp}
+	copyProp := Pass{"copyprop", CopyProp}
+	dce := Pass{"dce", DCE}
+	destruct := Pass{"destruct-ssa", DestructSSA}
+
+	switch level {
+	case 0:
+		return nil, nil
+	case 1:
+		return []Pass{ssa, constProp, copyProp, dce, destruct}, nil
+	case 2:
+		return []Pass{
+			ssa, constProp, copyProp,
+			{"cse", CSE},
+			{"licm", LICM},
+			constProp, copyProp, dce,
+			destruct,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown optimization level %d", level)
+	}
+}
+
+// Optimize runs the pipeline for the given level. If dump is not nil it is
+// called after every pass with the pass name, for debugging.
+func Optimize(fn *Func, level int, dump func(pass string, fn *Func)) error {
+	passes, err := Passes(level)
+	if err != nil {
+		return err
+	}
+	for _, pass := range passes {
+		pass.Run(fn)
+		if dump != nil {
+			dump(pass.Name, fn)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package ir
+
+// replaceUses rewrites every read of a register in subst with its
+// replacement, following chains of replacements.
+func replaceUses(fn *Func, subst map[Reg]Reg) {
+	if len(subst) == 0 {
+		return
+	}
+	resolve := func(r Reg) Reg {
+		for {
+			next, ok := subst[r]
+			if !ok || next == r {
+				return r
+			}
+			r = next
+		}
+	}
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			for i, arg := range instr.Args {
+				instr.Args[i] = resolve(arg)
+			}
+		}
+		for _, r := range b.Term.Uses() {
+			*r = resolve(*r)
+		}
+	}
+}
+
+// removeInstrs deletes the marked instructions from every block.
+func removeInstrs(fn *Func, dead map[*Instr]bool) {
+	if len(dead) == 0 {
+		return
+	}
+	for _, b := range fn.Blocks {
+		kept := b.Instrs[:0]
+		for _, instr := range b.Instrs {
+			if !dead[instr] {
+				kept = append(kept, instr)
+			}
+		}
+		b.Instrs = kept
+	}
+}
+
+// CopyProp replaces uses of copies with their source and removes the
+// copies. Phis whose arguments are all the same register, ignoring the phi
+// itself, are treated as copies of that register. The function must be in
+// SSA form.
+func CopyProp(fn *Func) {
+	subst := map[Reg]Reg{}
+	dead := map[*Instr]bool{}
+
+	for changed := true; changed; {
+		changed = false
+		for _, b := range fn.Blocks {
+			for _, instr := range b.Instrs {
+				if dead[instr] {
+					continue
+				}
+				src := NoReg
+				switch instr.Op {
+				case OpCopy:
+					src = instr.Args[0]
+				case OpPhi:
+					src = uniquePhiArg(instr, subst)
+				}
+				if src == NoReg {
+					continue
+				}
+				if name, ok := fn.VarNames[instr.Dst]; ok {
+					if _, named := fn.VarNames[src]; !named {
+						fn.VarNames[src] = name
+					}
+				}
+				subst[instr.Dst] = src
+				dead[instr] = true
+				changed = true
+			}
+		}
+	}
+
+	replaceUses(fn, subst)
+	removeInstrs(fn, dead)
+}
+
+// uniquePhiArg returns the single register a phi merges, or NoReg if it
+// merges more than one.
+func uniquePhiArg(phi *Instr, subst map[Reg]Reg) Reg {
+	resolve := func(r Reg) Reg {
+		for {
+			next, ok := subst[r]
+			if !ok {
+				return r
+			}
+			r = next
+		}
+	}
+	only := NoReg
+	for _, arg := range phi.Args {
+		arg = resolve(arg)
+		if arg == phi.Dst || arg == only {
+			continue
+		}
+		if only != NoReg {
+			return NoReg
+		}
+		only = arg
+	}
+	return only
+}
+
+// DCE removes instructions whose results are never used and that have no
+// side effects. The function must be in SSA form.
+func DCE(fn *Func) {
+	defs := fn.defs()
+	live := map[*Instr]bool{}
+	var work []Reg
+
+	markReg := func(r Reg) {
+		if d := defs[r]; d != nil && !live[d] {
+			live[d] = true
+			work = append(work, d.Args...)
+		}
+	}
+
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Op != OpPhi && !instr.isPure(defs, fn.Checked) {
+				live[instr] = true
+				work = append(work, instr.Args...)
+			}
+		}
+		for _, r := range b.Term.Uses() {
+			markReg(*r)
+		}
+	}
+	for len(work) > 0 {
+		r := work[len(work)-1]
+		work = work[:len(work)-1]
+		markReg(r)
+	}
+
+	dead := map[*Instr]bool{}
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			if !live[instr] {
+				dead[instr] = true
+			}
+		}
+	}
+	removeInstrs(fn, dead)
+}
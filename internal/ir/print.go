@@ -0,0 +1,91 @@
+package ir
+
+import (
+	"fmt"
+	"strings"
+)
+
+func (f *Func) regName(r Reg) string {
+	if name, ok := f.VarNames[r]; ok {
+		return fmt.Sprintf("%s(%s)", r, name)
+	}
+	return r.String()
+}
+
+func (f *Func) formatInstr(instr *Instr) string {
+	var sb strings.Builder
+	if instr.Dst != NoReg {
+		fmt.Fprintf(&sb, "%s = ", f.regName(instr.Dst))
+	}
+	sb.WriteString(instr.Op.String())
+	if instr.Op == OpConst {
+		fmt.Fprintf(&sb, " %d", instr.Imm)
+	}
+	if instr.Op == OpEnv {
+		fmt.Fprintf(&sb, " %q", instr.Name)
+	}
+	if instr.Obj != nil {
+		fmt.Fprintf(&sb, " %s+%d", instr.Obj, instr.Imm)
+		if len(instr.Args) > 0 {
+			sb.WriteString(",")
+		}
+	}
+	if instr.Op == OpPhi {
+		for i, arg := range instr.Args {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			fmt.Fprintf(&sb, " [%s, %s]", f.regName(arg), instr.From[i].Label())
+		}
+		return sb.String()
+	}
+	for i, arg := range instr.Args {
+		if i == 0 {
+			sb.WriteString(" ")
+		} else {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(f.regName(arg))
+	}
+	return sb.String()
+}
+
+func (f *Func) formatTerm(t Term) string {
+	switch t.Kind {
+	case TermJump:
+		return "jmp " + t.Then.Label()
+	case TermBranch:
+		return fmt.Sprintf("br %s, %s, %s", f.regName(t.Cond), t.Then.Label(), t.Else.Label())
+	case TermReturn:
+		return "ret " + f.regName(t.Value)
+	default:
+		return "<unterminated>"
+	}
+}
+
+// String renders the function as text, one block per paragraph, with each
+// block's predecessors noted next to its label.
+func (f *Func) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "func %s {\n", f.Name)
+
+	for _, b := range f.Blocks {
+		fmt.Fprintf(&sb, "%s:", b.Label())
+		if len(b.Preds) > 0 {
+			preds := make([]string, len(b.Preds))
+			for i, p := range b.Preds {
+				preds[i] = p.Label()
+			}
+			fmt.Fprintf(&sb, "\t\t; preds: %s", strings.Join(preds, ", "))
+		}
+		sb.WriteString("\n")
+
+		for _, instr := range b.Instrs {
+			fmt.Fprintf(&sb, "    %s\n", f.formatInstr(instr))
+		}
+		fmt.Fprintf(&sb, "    %s\n", f.formatTerm(b.Term))
+	}
+
+	sb.WriteString("}\n")
+	return sb.String()
+}
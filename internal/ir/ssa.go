@@ -0,0 +1,164 @@
+package ir
+
+// BuildSSA converts a function to pruned SSA form. Registers that are
+// assigned more than once, which are the source variables, get a phi at
+// each dominance frontier where they are live and every definition is given
+// a fresh register.
+func BuildSSA(fn *Func) {
+	if fn.SSA {
+		return
+	}
+
+	// Find the multiply-assigned registers and where they are assigned.
+	defCount := map[Reg]int{}
+	defBlocks := map[Reg][]*Block{}
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Dst == NoReg {
+				continue
+			}
+			defCount[instr.Dst]++
+			if !containsBlock(defBlocks[instr.Dst], b) {
+				defBlocks[instr.Dst] = append(defBlocks[instr.Dst], b)
+			}
+		}
+	}
+	vars := map[Reg]bool{}
+	for r, n := range defCount {
+		if n > 1 {
+			vars[r] = true
+		}
+	}
+
+	dom := Dominators(fn)
+	df := dom.Frontiers()
+	live := ComputeLiveness(fn)
+
+	// Place phis at the iterated dominance frontier of each variable's
+	// definitions, wherever the variable is live on entry.
+	phiVar := map[*Instr]Reg{}
+	for v := range vars {
+		hasPhi := map[*Block]bool{}
+		work := append([]*Block(nil), defBlocks[v]...)
+		for len(work) > 0 {
+			b := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, f := range df[b] {
+				if hasPhi[f] || !live.In[f][v] {
+					continue
+				}
+				hasPhi[f] = true
+				phi := &Instr{
+					Op:   OpPhi,
+					Dst:  v,
+					Args: make([]Reg, len(f.Preds)),
+					From: append([]*Block(nil), f.Preds...),
+				}
+				phiVar[phi] = v
+				f.Instrs = append([]*Instr{phi}, f.Instrs...)
+				work = append(work, f)
+			}
+		}
+	}
+
+	// Rename along the dominator tree, keeping a stack of the current
+	// register for each variable.
+	stack := map[Reg][]Reg{}
+	undef := NoReg
+	current := func(v Reg) Reg {
+		if s := stack[v]; len(s) > 0 {
+			return s[len(s)-1]
+		}
+		// Scoping guarantees a declaration dominates every use, so this
+		// only happens for phi arguments on paths where the value is dead.
+		if undef == NoReg {
+			undef = fn.NewReg()
+			entry := fn.Entry()
+			entry.Instrs = append([]*Instr{{Op: OpConst, Dst: undef}}, entry.Instrs...)
+		}
+		return undef
+	}
+	define := func(v Reg) Reg {
+		r := fn.NewReg()
+		if name, ok := fn.VarNames[v]; ok {
+			fn.VarNames[r] = name
+		}
+		stack[v] = append(stack[v], r)
+		return r
+	}
+
+	var rename func(b *Block)
+	rename = func(b *Block) {
+		var pushed []Reg
+
+		for _, instr := range b.Instrs {
+			if instr.Op != OpPhi {
+				for i, arg := range instr.Args {
+					if vars[arg] {
+						instr.Args[i] = current(arg)
+					}
+				}
+			}
+			if vars[instr.Dst] {
+				v := instr.Dst
+				instr.Dst = define(v)
+				pushed = append(pushed, v)
+			}
+		}
+		for _, r := range b.Term.Uses() {
+			if vars[*r] {
+				*r = current(*r)
+			}
+		}
+
+		for _, s := range b.Succs {
+			for _, phi := range s.Phis() {
+				v, ok := phiVar[phi]
+				if !ok {
+					continue
+				}
+				for i, p := range phi.From {
+					if p == b {
+						phi.Args[i] = current(v)
+					}
+				}
+			}
+		}
+
+		for _, child := range dom.Children(b) {
+			rename(child)
+		}
+
+		for _, v := range pushed {
+			stack[v] = stack[v][:len(stack[v])-1]
+		}
+	}
+	rename(fn.Entry())
+
+	for v := range vars {
+		delete(fn.VarNames, v)
+	}
+	fn.SSA = true
+}
+
+// DestructSSA replaces phis with copies so the function can be handed to a
+// backend. Each phi gets a private register that every predecessor assigns
+// just before its terminator, which sidesteps the lost-copy and swap
+// problems without splitting critical edges.
+func DestructSSA(fn *Func) {
+	if !fn.SSA {
+		return
+	}
+
+	for _, b := range fn.Blocks {
+		phis := b.Phis()
+		for _, phi := range phis {
+			tmp := fn.NewReg()
+			for i, p := range phi.From {
+				p.add(&Instr{Op: OpCopy, Dst: tmp, Args: []Reg{phi.Args[i]}})
+			}
+			phi.Op, phi.Args, phi.From = OpCopy, []Reg{tmp}, nil
+		}
+	}
+	fn.SSA = false
+}
@@ -0,0 +1,61 @@
+package lexer
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzLex(f *testing.F) {
+	seeds := []string{
+		"",
+		"let x = 5;\nprint x;\nreturn x;",
+		"while(i<=100){ print i*i; i = i+1; }",
+		"if (3 >= 5) { print 3; } else { print 4; }",
+		"// comment\n/* multi\n   line */ return 0;",
+		"/* unterminated",
+		"\"unterminated string",
+		"let s = \"a string\";",
+		"let my_var2 = 1;",
+		"@",
+		"=",
+		"==<=>=",
+		"99999999999999999999999",
+		"\xff\xfe",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		tokens, err := Lex(input)
+		if err != nil {
+			if _, ok := err.(*Error); !ok {
+				t.Fatalf("Lex returned %T, want *Error", err)
+			}
+			return
+		}
+
+		for _, tok := range tokens {
+			if tok.Pos.Offset < 0 || tok.Pos.Offset >= len(input) {
+				t.Fatalf("token %q has offset %d outside input of length %d", tok.Literal, tok.Pos.Offset, len(input))
+			}
+			if tok.Type == TOKEN_STRING {
+				continue
+			}
+			if !strings.HasPrefix(input[tok.Pos.Offset:], tok.Literal) {
+				t.Fatalf("token %q does not match source at %s", tok.Literal, tok.Pos)
+			}
+		}
+
+		lossless, tail, err := LexLossless(input)
+		if err != nil {
+			t.Fatalf("LexLossless failed where Lex did not: %v", err)
+		}
+		if len(lossless) != len(tokens) {
+			t.Fatalf("LexLossless returned %d tokens, Lex %d", len(lossless), len(tokens))
+		}
+		if got := Source(lossless, tail); got != input {
+			t.Fatalf("round trip changed the input: got %q", got)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package lexer
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type jsonTrivia struct {
+	Kind string   `json:"kind"`
+	Text string   `json:"text"`
+	Pos  Position `json:"pos"`
+}
+
+type jsonToken struct {
+	Type     string       `json:"type"`
+	Literal  string       `json:"literal"`
+	Pos      Position     `json:"pos"`
+	End      Position     `json:"end"`
+	Leading  []jsonTrivia `json:"leading,omitempty"`
+	Trailing []jsonTrivia `json:"trailing,omitempty"`
+}
+
+type jsonFile struct {
+	Tokens []jsonToken  `json:"tokens"`
+	Tail   []jsonTrivia `json:"tail,omitempty"`
+}
+
+func encodeTrivia(trivia []Trivia) []jsonTrivia {
+	var out []jsonTrivia
+	for _, t := range trivia {
+		out = append(out, jsonTrivia{Kind: triviaNames[t.Kind], Text: t.Text, Pos: t.Pos})
+	}
+	return out
+}
+
+// EncodeJSON serializes tokens and the trivia after them as
+//
+//	{"tokens": [{"type", "literal", "pos", "end", "leading", "trailing"}], "tail": [...]}
+//
+// where positions are {"offset", "line", "col"} and each trivia is
+// {"kind", "text", "pos"}. Empty trivia lists are left out.
+func EncodeJSON(tokens []Token, tail []Trivia) ([]byte, error) {
+	file := jsonFile{Tokens: []jsonToken{}, Tail: encodeTrivia(tail)}
+	for _, tok := range tokens {
+		file.Tokens = append(file.Tokens, jsonToken{
+			Type:     TypeName(tok.Type),
+			Literal:  tok.Literal,
+			Pos:      tok.Pos,
+			End:      tok.End(),
+			Leading:  encodeTrivia(tok.Leading),
+			Trailing: encodeTrivia(tok.Trailing),
+		})
+	}
+	return json.MarshalIndent(file, "", "  ")
+}
+
+// lookup finds a name in a table of names.
+func lookup(names []string, name, what string) (int, error) {
+	for i, n := range names {
+		if n == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown %s %q", what, name)
+}
+
+func decodeTrivia(in []jsonTrivia) ([]Trivia, error) {
+	var out []Trivia
+	for _, t := range in {
+		kind, err := lookup(triviaNames, t.Kind, "trivia kind")
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Trivia{Kind: kind, Text: t.Text, Pos: t.Pos})
+	}
+	return out, nil
+}
+
+// DecodeJSON reads tokens written by EncodeJSON.
+func DecodeJSON(data []byte) ([]Token, []Trivia, error) {
+	var file jsonFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, err
+	}
+	var tokens []Token
+	for _, t := range file.Tokens {
+		typ, err := lookup(tokenNames, t.Type, "token type")
+		if err != nil {
+			return nil, nil, err
+		}
+		tok := Token{Type: typ, Literal: t.Literal, Pos: t.Pos}
+		if tok.Leading, err = decodeTrivia(t.Leading); err != nil {
+			return nil, nil, err
+		}
+		if tok.Trailing, err = decodeTrivia(t.Trailing); err != nil {
+			return nil, nil, err
+		}
+		tokens = append(tokens, tok)
+	}
+	tail, err := decodeTrivia(file.Tail)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokens, tail, nil
+}
@@ -2,20 +2,118 @@ package lexer
 
 import (
 	"fmt"
-	"unicode"
+	"strings"
 )
 
-func Lex(input string) []Token {
+// Error is a lexical error at a position in the source.
+type Error struct {
+	Pos Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+// Lex splits the input into tokens. Comments and whitespace are skipped.
+func Lex(input string) ([]Token, error) {
+	tokens, _, err := lex(input, false)
+	return tokens, err
+}
+
+// LexLossless is like Lex but keeps comments and whitespace as trivia on the
+// tokens. The trivia after the last token is returned separately, and
+// Source turns the result back into the input byte for byte.
+func LexLossless(input string) ([]Token, []Trivia, error) {
+	return lex(input, true)
+}
+
+// Source reconstructs the text that tokens and their trivia were lexed
+// from. tail is the trivia after the last token.
+func Source(tokens []Token, tail []Trivia) string {
+	var sb strings.Builder
+	for _, tok := range tokens {
+		for _, t := range tok.Leading {
+			sb.WriteString(t.Text)
+		}
+		if tok.Type == TOKEN_STRING {
+			sb.WriteString(`"` + tok.Literal + `"`)
+		} else {
+			sb.WriteString(tok.Literal)
+		}
+		for _, t := range tok.Trailing {
+			sb.WriteString(t.Text)
+		}
+	}
+	for _, t := range tail {
+		sb.WriteString(t.Text)
+	}
+	return sb.String()
+}
+
+func lex(input string, lossless bool) ([]Token, []Trivia, error) {
 	var tokens []Token
+	var pending []Trivia // leading trivia of the next token
+	trailing := false    // whether trivia still belongs to the previous token
 
 	i := 0
+	line, lineStart := 1, 0
+
+	pos := func(offset int) Position {
+		return Position{Offset: offset, Line: line, Col: offset - lineStart + 1}
+	}
+
+	// trivia records input[start:i] when lexing losslessly. Everything up
+	// to the end of a token's line trails it; the rest leads the next one.
+	trivia := func(kind int, start Position) {
+		if !lossless {
+			return
+		}
+		t := Trivia{Kind: kind, Text: input[start.Offset:i], Pos: start}
+		if kind == TRIVIA_NEWLINE {
+			trailing = false
+		}
+		if trailing {
+			last := &tokens[len(tokens)-1]
+			last.Trailing = append(last.Trailing, t)
+			return
+		}
+		pending = append(pending, t)
+	}
+
+	emit := func(tok Token) {
+		tok.Leading = pending
+		pending = nil
+		tokens = append(tokens, tok)
+		trailing = lossless
+	}
 
 	for i < len(input) {
 		c := input[i]
 
-		// Skip whitespace
-		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+		if c == '\n' {
+			start := pos(i)
 			i++
+			trivia(TRIVIA_NEWLINE, start)
+			line++
+			lineStart = i
+			continue
+		}
+
+		if c == ' ' || c == '\t' || c == '\r' {
+			start := pos(i)
+			for i < len(input) && (input[i] == ' ' || input[i] == '\t' || input[i] == '\r') {
+				i++
+			}
+			trivia(TRIVIA_SPACE, start)
 			continue
 		}
 
@@ -24,23 +122,31 @@ func Lex(input string) []Token {
 
 			// Single-line comment //
 			if next == '/' {
+				start := pos(i)
 				i += 2
 				for i < len(input) && input[i] != '\n' {
 					i++
 				}
+				trivia(TRIVIA_LINE_COMMENT, start)
 				continue
 			}
 
 			// Multi-line comment /* ... */
 			if next == '*' {
+				start := pos(i)
 				i += 2
 				for i+1 < len(input) && !(input[i] == '*' && input[i+1] == '/') {
+					if input[i] == '\n' {
+						line++
+						lineStart = i + 1
+					}
 					i++
 				}
 				if i+1 >= len(input) {
-					panic("Unterminated multi-line comment")
+					return nil, nil, &Error{Pos: start, Msg: "unterminated multi-line comment"}
 				}
 				i += 2
+				trivia(TRIVIA_BLOCK_COMMENT, start)
 				continue
 			}
 		}
@@ -48,61 +154,66 @@ func Lex(input string) []Token {
 		if i+1 < len(input) {
 			twoChar := input[i : i+2]
 			if tokType, ok := multiCharTokens[twoChar]; ok {
-				tokens = append(tokens, Token{Type: tokType, Literal: twoChar})
+				emit(Token{Type: tokType, Literal: twoChar, Pos: pos(i)})
 				i += 2
 				continue
 			}
 		}
 
 		if tokType, ok := singleCharTokens[c]; ok {
-			tokens = append(tokens, Token{Type: tokType, Literal: string(c)})
+			emit(Token{Type: tokType, Literal: string(c), Pos: pos(i)})
 			i++
 			continue
 		}
 		if c == '"' {
 			j := i + 1
+			start := pos(i)
 			for j < len(input) && input[j] != '"' {
+				if input[j] == '\n' {
+					line++
+					lineStart = j + 1
+				}
 				j++
 			}
 			if j >= len(input) {
-				panic("Unterminated string literal")
+				return nil, nil, &Error{Pos: start, Msg: "unterminated string literal"}
 			}
 
 			str := input[i+1 : j]
-			tokens = append(tokens, Token{Type: TOKEN_STRING, Literal: str})
+			emit(Token{Type: TOKEN_STRING, Literal: str, Pos: start})
 			i = j + 1
 			continue
 		}
 
-		if unicode.IsDigit(rune(c)) {
+		if isDigit(c) {
 			j := i
-			for j < len(input) && unicode.IsDigit(rune(input[j])) {
+			for j < len(input) && isDigit(input[j]) {
 				j++
 			}
 			num := input[i:j]
-			tokens = append(tokens, Token{Type: TOKEN_NUMBER, Literal: num})
+			emit(Token{Type: TOKEN_NUMBER, Literal: num, Pos: pos(i)})
 			i = j
 			continue
 		}
 
-		if unicode.IsLetter(rune(c)) {
+		if isLetter(c) {
 			j := i
-			for j < len(input) && (unicode.IsLetter(rune(input[j])) || unicode.IsDigit(rune(input[j])) || unicode.IsLetter('_')) {
+			for j < len(input) && (isLetter(input[j]) || isDigit(input[j])) {
 				j++
 			}
 			word := input[i:j]
 
 			if tokType, ok := keywords[word]; ok {
-				tokens = append(tokens, Token{Type: tokType, Literal: word})
+				emit(Token{Type: tokType, Literal: word, Pos: pos(i)})
 			} else {
-				tokens = append(tokens, Token{Type: TOKEN_IDENT, Literal: word})
+				emit(Token{Type: TOKEN_IDENT, Literal: word, Pos: pos(i)})
 			}
 
 			i = j
 			continue
 		}
 
-		panic(fmt.Sprintf("Unexpected character: %c", c))
+		return nil, nil, &Error{Pos: pos(i), Msg: fmt.Sprintf("unexpected character %q", c)}
 	}
-	return tokens
+	return tokens, pending, nil
 }
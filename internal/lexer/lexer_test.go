@@ -0,0 +1,83 @@
+package lexer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLexLossless(t *testing.T) {
+	src := "// header\n\nlet x = 1; // one\n/* two */ print x;\n// end\n"
+	tokens, tail, err := LexLossless(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Source(tokens, tail); got != src {
+		t.Fatalf("round trip: got %q", got)
+	}
+
+	texts := func(trivia []Trivia) string {
+		var parts []string
+		for _, tr := range trivia {
+			parts = append(parts, tr.Text)
+		}
+		return strings.Join(parts, "|")
+	}
+	tests := []struct {
+		tok               int
+		leading, trailing string
+	}{
+		{0, "// header|\n|\n", " "}, // let
+		{4, "", " |// one"},         // ;
+		{5, "\n|/* two */| ", " "},  // print
+		{7, "", ""},                 // ;
+	}
+	for _, tt := range tests {
+		tok := tokens[tt.tok]
+		if got := texts(tok.Leading); got != tt.leading {
+			t.Errorf("token %d %q: leading %q, want %q", tt.tok, tok.Literal, got, tt.leading)
+		}
+		if got := texts(tok.Trailing); got != tt.trailing {
+			t.Errorf("token %d %q: trailing %q, want %q", tt.tok, tok.Literal, got, tt.trailing)
+		}
+	}
+	if got := texts(tail); got != "\n|// end|\n" {
+		t.Errorf("tail %q", got)
+	}
+
+	plain, err := Lex(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tok := range plain {
+		if tok.Leading != nil || tok.Trailing != nil {
+			t.Fatalf("Lex attached trivia to %q", tok.Literal)
+		}
+	}
+}
+
+func TestTokensJSON(t *testing.T) {
+	src := "let x = 1; // one\n/* two */ print \"s\";\n"
+	tokens, tail, err := LexLossless(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := EncodeJSON(tokens, tail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotTokens, gotTail, err := DecodeJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotTokens, tokens) || !reflect.DeepEqual(gotTail, tail) {
+		t.Fatalf("round trip changed the tokens:\n%s", data)
+	}
+	if !strings.Contains(string(data), `"type": "SEMICOLON"`) {
+		t.Errorf("token types are not named:\n%s", data)
+	}
+
+	if _, _, err := DecodeJSON([]byte(`{"tokens": [{"type": "BOGUS"}]}`)); err == nil {
+		t.Error("decoding an unknown token type succeeded")
+	}
+}
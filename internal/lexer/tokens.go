@@ -1,5 +1,7 @@
 package lexer
 
+import "fmt"
+
 const (
 	TOKEN_IF = iota
 	TOKEN_ELSE
@@ -31,8 +33,58 @@ const (
 	TOKEN_LE
 	TOKEN_GE
 	TOKEN_EQ
+	TOKEN_COLON
+	TOKEN_STRUCT
+	TOKEN_DOT
+	TOKEN_COMMA
 )
 
+// tokenNames are the names of the token types in JSON output.
+var tokenNames = []string{
+	TOKEN_IF:        "IF",
+	TOKEN_ELSE:      "ELSE",
+	TOKEN_WHILE:     "WHILE",
+	TOKEN_BREAK:     "BREAK",
+	TOKEN_CONTINUE:  "CONTINUE",
+	TOKEN_FOR:       "FOR",
+	TOKEN_RETURN:    "RETURN",
+	TOKEN_LET:       "LET",
+	TOKEN_IDENT:     "IDENT",
+	TOKEN_NUMBER:    "NUMBER",
+	TOKEN_PRINT:     "PRINT",
+	TOKEN_STRING:    "STRING",
+	TOKEN_EQUAL:     "EQUAL",
+	TOKEN_LPAREN:    "LPAREN",
+	TOKEN_RPAREN:    "RPAREN",
+	TOKEN_LBRACE:    "LBRACE",
+	TOKEN_RBRACE:    "RBRACE",
+	TOKEN_SEMICOLON: "SEMICOLON",
+	TOKEN_PLUS:      "PLUS",
+	TOKEN_MINUS:     "MINUS",
+	TOKEN_MULTIPLY:  "MULTIPLY",
+	TOKEN_DIVIDE:    "DIVIDE",
+	TOKEN_MODUlO:    "MODULO",
+	TOKEN_TRUE:      "TRUE",
+	TOKEN_FALSE:     "FALSE",
+	TOKEN_LT:        "LT",
+	TOKEN_GT:        "GT",
+	TOKEN_LE:        "LE",
+	TOKEN_GE:        "GE",
+	TOKEN_EQ:        "EQ",
+	TOKEN_COLON:     "COLON",
+	TOKEN_STRUCT:    "STRUCT",
+	TOKEN_DOT:       "DOT",
+	TOKEN_COMMA:     "COMMA",
+}
+
+// TypeName returns the name of a token type, as used in JSON output.
+func TypeName(typ int) string {
+	if typ < 0 || typ >= len(tokenNames) {
+		return fmt.Sprintf("TOKEN(%d)", typ)
+	}
+	return tokenNames[typ]
+}
+
 var keywords = map[string]int{
 	"if":       TOKEN_IF,
 	"else":     TOKEN_ELSE,
@@ -45,6 +97,7 @@ var keywords = map[string]int{
 	"false":    TOKEN_FALSE,
 	"print":    TOKEN_PRINT,
 	"return":   TOKEN_RETURN,
+	"struct":   TOKEN_STRUCT,
 }
 
 var multiCharTokens = map[string]int{
@@ -67,9 +120,66 @@ var singleCharTokens = map[byte]int{
 	'}': TOKEN_RBRACE,
 	'<': TOKEN_LT,
 	'>': TOKEN_GT,
+	':': TOKEN_COLON,
+	'.': TOKEN_DOT,
+	',': TOKEN_COMMA,
+}
+
+// Position is a location in the source text. Line and Col are 1-based,
+// Offset is the 0-based byte offset.
+type Position struct {
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Col    int `json:"col"`
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
 }
 
+// Trivia kinds.
+const (
+	TRIVIA_SPACE         = iota // a run of spaces, tabs and carriage returns
+	TRIVIA_NEWLINE              // a single '\n'
+	TRIVIA_LINE_COMMENT         // a // comment, without its newline
+	TRIVIA_BLOCK_COMMENT        // a /* */ comment
+)
+
+// triviaNames are the names of the trivia kinds in JSON output.
+var triviaNames = []string{
+	TRIVIA_SPACE:         "SPACE",
+	TRIVIA_NEWLINE:       "NEWLINE",
+	TRIVIA_LINE_COMMENT:  "LINE_COMMENT",
+	TRIVIA_BLOCK_COMMENT: "BLOCK_COMMENT",
+}
+
+// Trivia is source text between tokens that does not affect the program.
+type Trivia struct {
+	Kind int
+	Text string
+	Pos  Position
+}
+
+// Token is a lexed token. Leading and Trailing are only filled in by
+// LexLossless: Trailing holds the trivia after the token up to the end of
+// its line, and Leading holds the trivia before it that did not trail the
+// previous token.
 type Token struct {
-	Type    int
-	Literal string
+	Type     int
+	Literal  string
+	Pos      Position
+	Leading  []Trivia
+	Trailing []Trivia
+}
+
+// End returns the position just past the token.
+func (t Token) End() Position {
+	n := len(t.Literal)
+	if t.Type == TOKEN_STRING {
+		n += 2 // the quotes
+	}
+	end := t.Pos
+	end.Offset += n
+	end.Col += n
+	return end
 }
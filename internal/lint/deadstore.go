@@ -0,0 +1,180 @@
+package lint
+
+import (
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+// liveSet holds the variables whose current value may still be read.
+type liveSet map[*resolve.Symbol]bool
+
+func (s liveSet) copy() liveSet {
+	c := make(liveSet, len(s))
+	for sym := range s {
+		c[sym] = true
+	}
+	return c
+}
+
+func (s liveSet) union(o liveSet) liveSet {
+	c := s.copy()
+	for sym := range o {
+		c[sym] = true
+	}
+	return c
+}
+
+func (s liveSet) equal(o liveSet) bool {
+	if len(s) != len(o) {
+		return false
+	}
+	for sym := range s {
+		if !o[sym] {
+			return false
+		}
+	}
+	return true
+}
+
+// loopLive is what is live where a break or continue jumps to.
+type loopLive struct {
+	brk, cont liveSet
+}
+
+// deadStores finds assignments whose value is never read with a backward
+// liveness analysis over the AST. Loops are iterated to a fixed point before
+// anything inside them is reported.
+type deadStores struct {
+	l      *linter
+	unread map[*resolve.Symbol]bool // already reported as never read at all
+}
+
+// block returns the variables live on entry to stmts, given those live
+// after them.
+func (d *deadStores) block(stmts []parser.Stmt, out liveSet, loop *loopLive, report bool) liveSet {
+	live := out
+	for i := len(stmts) - 1; i >= 0; i-- {
+		live = d.stmt(stmts[i], live, loop, report)
+	}
+	return live
+}
+
+func (d *deadStores) stmt(node parser.Stmt, out liveSet, loop *loopLive, report bool) liveSet {
+	switch n := node.(type) {
+	case *parser.LetStmt:
+		live := out.copy()
+		delete(live, d.l.syms.Lookup(n.Name))
+		return d.uses(n.Value, live)
+
+	case *parser.AssignmentStmt:
+		sym := d.l.syms.Lookup(n.Name)
+		if report && !out[sym] && !d.unread[sym] {
+			d.l.warn("unused-assign", n.Pos(), "value assigned to %s is never read", n.Name.Name)
+		}
+		live := out.copy()
+		delete(live, sym)
+		return d.uses(n.Value, live)
+
+	case *parser.FieldAssignStmt:
+		// Assigning a field leaves the rest of the variable as it was.
+		root := fieldRoot(n.Target)
+		sym := d.l.syms.Lookup(root)
+		if report && !out[sym] && !d.unread[sym] {
+			d.l.warn("unused-assign", n.Pos(), "value assigned to %s is never read", fieldPath(n.Target))
+		}
+		return d.uses(n.Value, out.copy())
+
+	case *parser.PrintStmt:
+		return d.uses(n.Value, out.copy())
+
+	case *parser.FreeStmt:
+		return d.uses(n.Value, out.copy())
+
+	case *parser.ReturnStmt:
+		return d.uses(n.Value, liveSet{})
+
+	case *parser.BreakStmt:
+		if loop == nil {
+			return liveSet{}
+		}
+		return loop.brk.copy()
+
+	case *parser.ContinueStmt:
+		if loop == nil {
+			return liveSet{}
+		}
+		return loop.cont.copy()
+
+	case *parser.IfStmt:
+		then := d.block(n.Then, out, loop, report)
+		els := d.block(n.Else, out, loop, report)
+		return d.uses(n.Guard, then.union(els))
+
+	case *parser.WhileStmt:
+		// The guard is entered from before the loop and from the end of
+		// the body, and exits to out.
+		head := d.uses(n.Guard, out.copy())
+		for {
+			inner := &loopLive{brk: out, cont: head}
+			body := d.block(n.Body, head, inner, false)
+			next := d.uses(n.Guard, out.union(body))
+			if next.equal(head) {
+				break
+			}
+			head = next
+		}
+		if report {
+			d.block(n.Body, head, &loopLive{brk: out, cont: head}, true)
+		}
+		return head
+	}
+	return out
+}
+
+// uses adds the variables an expression reads to live.
+func (d *deadStores) uses(node parser.Expr, live liveSet) liveSet {
+	switch n := node.(type) {
+	case *parser.IDent:
+		if sym := d.l.syms.Lookup(n); sym != nil {
+			live[sym] = true
+		}
+	case *parser.UnaryExpr:
+		d.uses(n.Right, live)
+	case *parser.ArgExpr:
+		d.uses(n.Index, live)
+	case *parser.AllocExpr:
+		d.uses(n.Size, live)
+	case *parser.BinaryExpr:
+		d.uses(n.Left, live)
+		d.uses(n.Right, live)
+	case *parser.FieldExpr:
+		d.uses(n.X, live)
+	case *parser.StructLit:
+		for _, field := range n.Fields {
+			d.uses(field.Value, live)
+		}
+	}
+	return live
+}
+
+// fieldRoot returns the variable a field assignment writes to.
+func fieldRoot(x *parser.FieldExpr) *parser.IDent {
+	for {
+		switch n := x.X.(type) {
+		case *parser.IDent:
+			return n
+		case *parser.FieldExpr:
+			x = n
+		default:
+			return nil
+		}
+	}
+}
+
+// fieldPath renders the target of a field assignment, as in p.a.x.
+func fieldPath(x *parser.FieldExpr) string {
+	if inner, ok := x.X.(*parser.FieldExpr); ok {
+		return fieldPath(inner) + "." + x.Field.Name
+	}
+	return fieldRoot(x).Name + "." + x.Field.Name
+}
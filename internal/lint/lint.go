@@ -0,0 +1,163 @@
+// Package lint finds code that is legal but probably not what was meant.
+//
+// Each kind of warning belongs to a named check that can be switched on or
+// off on its own:
+//
+//	unused              a variable that is never read
+//	unused-assign       an assignment whose value is never read
+//	unreachable         statements after return, break or continue
+//	shadow              a variable hiding one of an enclosing scope
+//	constant-condition  a loop whose condition is always true or false
+//	missing-return      a path that runs off the end of the program
+//	infinite-loop       a loop that can never be left
+package lint
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/BergurDavidsen/bingus/internal/flow"
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+// Checks lists the names of all checks.
+var Checks = []string{"unused", "unused-assign", "unreachable", "shadow", "constant-condition", "missing-return", "infinite-loop"}
+
+// Warning is a finding of one check.
+type Warning struct {
+	Pos   lexer.Position
+	Check string
+	Msg   string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: warning: %s [-W%s]", w.Pos, w.Msg, w.Check)
+}
+
+type linter struct {
+	syms     *resolve.Table
+	enabled  map[string]bool
+	warnings []Warning
+	seen     map[Warning]bool
+}
+
+func (l *linter) warn(check string, pos lexer.Position, format string, args ...interface{}) {
+	if l.enabled != nil && !l.enabled[check] {
+		return
+	}
+	w := Warning{Pos: pos, Check: check, Msg: fmt.Sprintf(format, args...)}
+	if !l.seen[w] {
+		l.seen[w] = true
+		l.warnings = append(l.warnings, w)
+	}
+}
+
+// Lint runs the enabled checks over a resolved program and returns their
+// warnings in source order. A nil enabled map runs every check.
+func Lint(prog *parser.Program, syms *resolve.Table, enabled map[string]bool) []Warning {
+	l := &linter{syms: syms, enabled: enabled, seen: map[Warning]bool{}}
+
+	assigned := map[*parser.IDent]bool{}
+	parser.Inspect(prog, func(node parser.Node) bool {
+		switch a := node.(type) {
+		case *parser.AssignmentStmt:
+			assigned[a.Name] = true
+		case *parser.FieldAssignStmt:
+			assigned[fieldRoot(a.Target)] = true
+		}
+		return true
+	})
+
+	unread := map[*resolve.Symbol]bool{}
+	for _, sym := range syms.Symbols {
+		read := false
+		for _, use := range sym.Uses {
+			if !assigned[use] {
+				read = true
+			}
+		}
+		if !read {
+			unread[sym] = true
+			l.warn("unused", sym.Decl.Pos(), "variable %s is never read", sym.Name)
+		}
+		if sym.Shadows != nil {
+			l.warn("shadow", sym.Decl.Pos(), "%s shadows the variable declared at %s", sym.Name, sym.Shadows.Decl.Pos())
+		}
+	}
+
+	l.unreachable(prog.Statements)
+	parser.Inspect(prog, func(node parser.Node) bool {
+		if w, ok := node.(*parser.WhileStmt); ok {
+			if b, ok := w.Guard.(*parser.BoolLit); ok {
+				l.warn("constant-condition", b.Pos(), "loop condition is always %v", b.Value)
+			}
+		}
+		return true
+	})
+
+	d := &deadStores{l: l, unread: unread}
+	d.block(prog.Statements, liveSet{}, nil, true)
+
+	g := flow.Build(prog.Statements)
+	if g.FallsOff() {
+		pos := lexer.Position{Line: 1, Col: 1}
+		if n := len(prog.Statements); n > 0 {
+			pos = prog.Statements[n-1].Pos()
+		}
+		l.warn("missing-return", pos, "program can end without a return statement; it exits with status 0")
+	}
+	for _, loop := range g.InfiniteLoops(prog.Statements) {
+		l.warn("infinite-loop", loop.Pos(), "loop never exits")
+	}
+
+	sort.SliceStable(l.warnings, func(i, j int) bool {
+		return l.warnings[i].Pos.Offset < l.warnings[j].Pos.Offset
+	})
+	return l.warnings
+}
+
+// terminates reports whether control never continues past a statement.
+func terminates(stmt parser.Stmt) bool {
+	switch n := stmt.(type) {
+	case *parser.ReturnStmt, *parser.BreakStmt, *parser.ContinueStmt:
+		return true
+	case *parser.IfStmt:
+		return len(n.Else) > 0 && blockTerminates(n.Then) && blockTerminates(n.Else)
+	}
+	return false
+}
+
+func blockTerminates(stmts []parser.Stmt) bool {
+	for _, stmt := range stmts {
+		if terminates(stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+// unreachable warns once per block, at the first statement that follows
+// one that never completes. Struct declarations do not run, so they are
+// passed over.
+func (l *linter) unreachable(stmts []parser.Stmt) {
+	for i, stmt := range stmts {
+		switch n := stmt.(type) {
+		case *parser.IfStmt:
+			l.unreachable(n.Then)
+			l.unreachable(n.Else)
+		case *parser.WhileStmt:
+			l.unreachable(n.Body)
+		}
+		if terminates(stmt) {
+			for _, next := range stmts[i+1:] {
+				if _, ok := next.(*parser.StructDecl); !ok {
+					l.warn("unreachable", next.Pos(), "unreachable code")
+					break
+				}
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package lint
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+func lint(t *testing.T, src string, enabled map[string]bool) []string {
+	t.Helper()
+	tokens, err := lexer.Lex(src)
+	if err != nil {
+		t.Fatalf("lex: %v\n%s", err, src)
+	}
+	p := parser.Parser{Tokens: tokens}
+	prog, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, src)
+	}
+	syms, err := resolve.Resolve(prog)
+	if err != nil {
+		t.Fatalf("resolve: %v\n%s", err, src)
+	}
+	var got []string
+	for _, w := range Lint(prog, syms, enabled) {
+		got = append(got, w.String())
+	}
+	return got
+}
+
+func TestLint(t *testing.T) {
+	src := `let unused = 1;
+let x = 1;
+x = 2;
+x = 3;
+print x;
+if (x > 1) {
+    let x = 5;
+    print x;
+}
+let i = 0;
+while (true) {
+    i = i + 1;
+    if (i > 3) {
+        break;
+        print i;
+    }
+}
+return 0;`
+	want := []string{
+		"1:5: warning: variable unused is never read [-Wunused]",
+		"3:1: warning: value assigned to x is never read [-Wunused-assign]",
+		"7:9: warning: x shadows the variable declared at 2:5 [-Wshadow]",
+		"11:8: warning: loop condition is always true [-Wconstant-condition]",
+		"15:9: warning: unreachable code [-Wunreachable]",
+	}
+	if got := lint(t, src, nil); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	only := lint(t, src, map[string]bool{"shadow": true})
+	if len(only) != 1 || !strings.Contains(only[0], "[-Wshadow]") {
+		t.Errorf("with only -Wshadow enabled got %q", only)
+	}
+}
+
+func TestLintPaths(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"", []string{"1:1: warning: program can end without a return statement; it exits with status 0 [-Wmissing-return]"}},
+		{"let x = 1;\nif (x > 0) { return 1; }", []string{"2:1: warning: program can end without a return statement; it exits with status 0 [-Wmissing-return]"}},
+		{"let x = 0;\nwhile (x < 1) { x = 0; }\nreturn x;", nil},
+		{"while (true) {\n    print 1;\n}", []string{
+			"1:1: warning: loop never exits [-Winfinite-loop]",
+			"1:8: warning: loop condition is always true [-Wconstant-condition]",
+		}},
+		{"return 0;\nstruct P {}", nil},
+		{"struct P { x: int }\nlet p = P { x: 1 };\np.x = 2;\nreturn 0;", []string{"2:5: warning: variable p is never read [-Wunused]"}},
+		{"struct P { x: int }\nlet p = P { x: 1 };\nprint p.x;\np.x = 2;\nreturn 0;", []string{
+			"4:1: warning: value assigned to p.x is never read [-Wunused-assign]",
+		}},
+		{"struct P { x: int }\nlet p = P { x: 1 };\np = P { x: p.x + 1 };\nreturn p.x;", nil},
+	}
+	for _, tt := range tests {
+		got := lint(t, tt.src, nil)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%q: got\n%s\nwant\n%s", tt.src, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestLintClean(t *testing.T) {
+	// Values carried around a loop, read after it, or read on only one
+	// path are all used.
+	srcs := []string{
+		"let a = 0; let b = 1; let n = 0; while (n < 5) { let t = a + b; a = b; b = t; n = n + 1; } return a;",
+		"let x = 0; let c = 3 < 4; if (c) { x = 1; } else { x = 2; } return x;",
+		"let x = 0; let n = 0; while (n < 3) { n = n + 1; if (n == 2) { x = n; continue; } print x; } return 0;",
+		"let done = false; let n = 0; while (done == false) { n = n + 1; done = n >= 3; } return n;",
+	}
+	for _, src := range srcs {
+		if got := lint(t, src, nil); len(got) > 0 {
+			t.Errorf("%s\ngot warnings:\n%s", src, strings.Join(got, "\n"))
+		}
+	}
+}
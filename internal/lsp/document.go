@@ -0,0 +1,174 @@
+package lsp
+
+import (
+	"sort"
+	"unicode/utf8"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/lint"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+	"github.com/BergurDavidsen/bingus/internal/types"
+)
+
+// document is an open file and what the compiler front end made of it.
+// Each stage only runs if the ones before it succeeded, so prog, syms and
+// vars may be nil.
+type document struct {
+	uri   string
+	text  string
+	lines []int // byte offset at which each line starts
+
+	tokens      []lexer.Token
+	tail        []lexer.Trivia
+	prog        *parser.Program
+	syms        *resolve.Table
+	vars        map[*resolve.Symbol]types.Type
+	diagnostics []Diagnostic
+}
+
+func newDocument(uri, text string) *document {
+	d := &document{uri: uri, text: text, lines: []int{0}}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			d.lines = append(d.lines, i+1)
+		}
+	}
+	d.analyze()
+	return d
+}
+
+// analyze runs the front end up to the first error and collects the
+// diagnostics: that error, or the lint warnings of a program without one.
+func (d *document) analyze() {
+	var err error
+	if d.tokens, d.tail, err = lexer.LexLossless(d.text); err != nil {
+		d.fail(err)
+		return
+	}
+	p := parser.Parser{Tokens: d.tokens}
+	if d.prog, err = p.ParseProgram(); err != nil {
+		d.fail(err)
+		return
+	}
+	if d.syms, err = resolve.Resolve(d.prog); err != nil {
+		d.fail(err)
+		return
+	}
+	if d.vars, err = types.Infer(d.prog, d.syms); err != nil {
+		d.fail(err)
+		return
+	}
+	for _, w := range lint.Lint(d.prog, d.syms, nil) {
+		d.diagnostics = append(d.diagnostics, Diagnostic{
+			Range:    d.tokenRange(w.Pos),
+			Severity: SeverityWarning,
+			Code:     w.Check,
+			Source:   "bingus",
+			Message:  w.Msg,
+		})
+	}
+}
+
+// fail records a front end error as a diagnostic.
+func (d *document) fail(err error) {
+	var pos lexer.Position
+	var msg string
+	switch e := err.(type) {
+	case *lexer.Error:
+		pos, msg = e.Pos, e.Msg
+	case *parser.Error:
+		pos, msg = e.Pos, e.Msg
+	case *resolve.Error:
+		pos, msg = e.Pos, e.Msg
+	case *types.Error:
+		pos, msg = e.Pos, e.Msg
+	default:
+		msg = err.Error()
+	}
+	d.diagnostics = append(d.diagnostics, Diagnostic{
+		Range:    d.tokenRange(pos),
+		Severity: SeverityError,
+		Source:   "bingus",
+		Message:  msg,
+	})
+}
+
+// tokenRange returns the range of the token that starts at pos, or an
+// empty range at pos if there is none.
+func (d *document) tokenRange(pos lexer.Position) Range {
+	i := sort.Search(len(d.tokens), func(i int) bool {
+		return d.tokens[i].Pos.Offset >= pos.Offset
+	})
+	if i < len(d.tokens) && d.tokens[i].Pos.Offset == pos.Offset {
+		return d.span(pos.Offset, d.tokens[i].End().Offset)
+	}
+	return d.span(pos.Offset, pos.Offset)
+}
+
+// position converts a byte offset to an LSP position.
+func (d *document) position(offset int) Position {
+	line := sort.Search(len(d.lines), func(i int) bool { return d.lines[i] > offset }) - 1
+	char := 0
+	for _, r := range d.text[d.lines[line]:offset] {
+		char += utf16Len(r)
+	}
+	return Position{Line: line, Character: char}
+}
+
+// offset converts an LSP position to a byte offset, clamped to its line.
+func (d *document) offset(pos Position) int {
+	if pos.Line < 0 {
+		return 0
+	}
+	if pos.Line >= len(d.lines) {
+		return len(d.text)
+	}
+	i, char := d.lines[pos.Line], 0
+	for i < len(d.text) && d.text[i] != '\n' && char < pos.Character {
+		r, size := utf8.DecodeRuneInString(d.text[i:])
+		char += utf16Len(r)
+		i += size
+	}
+	return i
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+func (d *document) span(start, end int) Range {
+	return Range{Start: d.position(start), End: d.position(end)}
+}
+
+func (d *document) nodeRange(n parser.Node) Range {
+	return d.span(n.Pos().Offset, n.End().Offset)
+}
+
+// identAt returns the variable name at an LSP position, and its symbol.
+// A position just past the name counts as on it.
+func (d *document) identAt(pos Position) (*parser.IDent, *resolve.Symbol) {
+	if d.prog == nil || d.syms == nil {
+		return nil, nil
+	}
+	offset := d.offset(pos)
+	var found *parser.IDent
+	parser.Inspect(d.prog, func(n parser.Node) bool {
+		if n == nil || found != nil {
+			return false
+		}
+		if id, ok := n.(*parser.IDent); ok && id.Pos().Offset <= offset && offset <= id.End().Offset {
+			if d.syms.Lookup(id) != nil {
+				found = id
+			}
+		}
+		return n.Pos().Offset <= offset && offset <= n.End().Offset
+	})
+	if found == nil {
+		return nil, nil
+	}
+	return found, d.syms.Lookup(found)
+}
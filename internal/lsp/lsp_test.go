@@ -0,0 +1,289 @@
+package lsp
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// client drives a server over in-process pipes, as an editor would over
+// stdio.
+type client struct {
+	t     *testing.T
+	conn  *Conn
+	id    int
+	notes []*Message
+	done  chan error
+}
+
+func newClient(t *testing.T) *client {
+	t.Helper()
+	toServer, fromClient := io.Pipe()
+	toClient, fromServer := io.Pipe()
+	c := &client{t: t, conn: NewConn(toClient, fromClient), done: make(chan error, 1)}
+	go func() {
+		c.done <- NewServer(toServer, fromServer).Run()
+		fromServer.Close()
+	}()
+	return c
+}
+
+// call sends a request and decodes the result of its response into
+// result. Notifications that arrive first are kept in notes.
+func (c *client) call(method string, params, result interface{}) *ResponseError {
+	c.t.Helper()
+	c.id++
+	if err := c.conn.Write(&Message{ID: rawJSON(c.id), Method: method, Params: *rawJSON(params)}); err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+	for {
+		msg, err := c.conn.Read()
+		if err != nil {
+			c.t.Fatalf("%s: %v", method, err)
+		}
+		if msg.ID == nil {
+			c.notes = append(c.notes, msg)
+			continue
+		}
+		if string(*msg.ID) != string(*rawJSON(c.id)) {
+			c.t.Fatalf("%s: response id %s, want %d", method, *msg.ID, c.id)
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil && msg.Result != nil {
+			if err := json.Unmarshal(*msg.Result, result); err != nil {
+				c.t.Fatalf("%s: %v", method, err)
+			}
+		}
+		return nil
+	}
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.t.Helper()
+	if err := c.conn.Notify(method, params); err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+}
+
+// diagnostics reads the next notification, which must publish diagnostics.
+func (c *client) diagnostics() PublishDiagnosticsParams {
+	c.t.Helper()
+	msg, err := c.conn.Read()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if msg.Method != "textDocument/publishDiagnostics" {
+		c.t.Fatalf("got %q, want publishDiagnostics", msg.Method)
+	}
+	var params PublishDiagnosticsParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		c.t.Fatal(err)
+	}
+	return params
+}
+
+func (c *client) open(uri, text string) PublishDiagnosticsParams {
+	c.t.Helper()
+	c.notify("textDocument/didOpen", DidOpenTextDocumentParams{TextDocument: TextDocumentItem{URI: uri, LanguageID: "bingus", Version: 1, Text: text}})
+	return c.diagnostics()
+}
+
+func (c *client) exit() {
+	c.t.Helper()
+	if err := c.call("shutdown", nil, nil); err != nil {
+		c.t.Fatal(err)
+	}
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		c.t.Fatalf("Run: %v", err)
+	}
+}
+
+func at(uri string, line, char int) TextDocumentPositionParams {
+	return TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: uri}, Position: Position{Line: line, Character: char}}
+}
+
+func rng(line, start, end int) Range {
+	return Range{Start: Position{Line: line, Character: start}, End: Position{Line: line, Character: end}}
+}
+
+const uri = "file:///test.bng"
+
+const src = `let x: int = 1; // one
+let y = x > 0;
+if (y) {
+    x = x + 2;
+}
+return x;
+`
+
+func TestInitialize(t *testing.T) {
+	c := newClient(t)
+	var result InitializeResult
+	if err := c.call("initialize", map[string]interface{}{"capabilities": map[string]interface{}{}}, &result); err != nil {
+		t.Fatal(err)
+	}
+	c.notify("initialized", struct{}{})
+	caps := result.Capabilities
+	if !caps.DefinitionProvider || !caps.ReferencesProvider || !caps.HoverProvider || !caps.DocumentSymbolProvider || !caps.DocumentFormattingProvider {
+		t.Errorf("missing capabilities: %+v", caps)
+	}
+	if !reflect.DeepEqual(caps.SemanticTokensProvider.Legend.TokenTypes, semanticTypes) {
+		t.Errorf("legend = %v", caps.SemanticTokensProvider.Legend.TokenTypes)
+	}
+	if err := c.call("bingus/unknown", nil, nil); err == nil || err.Code != codeMethodNotFound {
+		t.Errorf("unknown method: %v", err)
+	}
+	c.exit()
+}
+
+func TestDiagnostics(t *testing.T) {
+	c := newClient(t)
+	if d := c.open(uri, src); len(d.Diagnostics) != 0 || d.URI != uri {
+		t.Errorf("clean program: %+v", d)
+	}
+
+	c.notify("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument:   TextDocumentIdentifier{URI: uri},
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: "let a = 1;\nprint b;\nreturn a;\n"}},
+	})
+	d := c.diagnostics()
+	want := []Diagnostic{{Range: rng(1, 6, 7), Severity: SeverityError, Source: "bingus", Message: "undefined variable: b"}}
+	if !reflect.DeepEqual(d.Diagnostics, want) {
+		t.Errorf("undefined variable:\n got %+v\nwant %+v", d.Diagnostics, want)
+	}
+
+	c.notify("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument:   TextDocumentIdentifier{URI: uri},
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: "let a = 1;\nlet b = 2;\nreturn a;\n"}},
+	})
+	d = c.diagnostics()
+	if len(d.Diagnostics) != 1 || d.Diagnostics[0].Code != "unused" || d.Diagnostics[0].Severity != SeverityWarning || d.Diagnostics[0].Range != rng(1, 4, 5) {
+		t.Errorf("unused variable: %+v", d.Diagnostics)
+	}
+
+	c.notify("textDocument/didClose", DidCloseTextDocumentParams{TextDocument: TextDocumentIdentifier{URI: uri}})
+	if d := c.diagnostics(); len(d.Diagnostics) != 0 {
+		t.Errorf("closed document: %+v", d)
+	}
+	if err := c.call("textDocument/hover", at(uri, 0, 4), nil); err == nil || err.Code != codeInvalidParams {
+		t.Errorf("hover on closed document: %v", err)
+	}
+	c.exit()
+}
+
+func TestNavigation(t *testing.T) {
+	c := newClient(t)
+	c.open(uri, src)
+
+	var def Location
+	if err := c.call("textDocument/definition", at(uri, 3, 9), &def); err != nil {
+		t.Fatal(err)
+	}
+	if def.URI != uri || def.Range != rng(0, 4, 5) {
+		t.Errorf("definition = %+v", def)
+	}
+
+	var refs []Location
+	params := ReferenceParams{TextDocumentPositionParams: at(uri, 0, 4)}
+	params.Context.IncludeDeclaration = true
+	if err := c.call("textDocument/references", params, &refs); err != nil {
+		t.Fatal(err)
+	}
+	var got []Range
+	for _, ref := range refs {
+		got = append(got, ref.Range)
+	}
+	want := []Range{rng(0, 4, 5), rng(1, 8, 9), rng(3, 4, 5), rng(3, 8, 9), rng(5, 7, 8)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("references:\n got %v\nwant %v", got, want)
+	}
+
+	var hover Hover
+	if err := c.call("textDocument/hover", at(uri, 1, 5), &hover); err != nil {
+		t.Fatal(err)
+	}
+	if hover.Contents.Value != "```bingus\nlet y: bool\n```" || hover.Range != rng(1, 4, 5) {
+		t.Errorf("hover = %+v", hover)
+	}
+
+	var none *Hover
+	if err := c.call("textDocument/hover", at(uri, 0, 17), &none); err != nil || none != nil {
+		t.Errorf("hover on a comment = %+v, %v", none, err)
+	}
+	c.exit()
+}
+
+func TestDocumentSymbols(t *testing.T) {
+	c := newClient(t)
+	c.open(uri, src)
+	var symbols []DocumentSymbol
+	if err := c.call("textDocument/documentSymbol", TextDocumentParams{TextDocument: TextDocumentIdentifier{URI: uri}}, &symbols); err != nil {
+		t.Fatal(err)
+	}
+	want := []DocumentSymbol{
+		{Name: "x", Detail: "int", Kind: SymbolKindVariable, Range: rng(0, 0, 15), SelectionRange: rng(0, 4, 5)},
+		{Name: "y", Detail: "bool", Kind: SymbolKindVariable, Range: rng(1, 0, 14), SelectionRange: rng(1, 4, 5)},
+	}
+	if !reflect.DeepEqual(symbols, want) {
+		t.Errorf("symbols:\n got %+v\nwant %+v", symbols, want)
+	}
+	c.exit()
+}
+
+func TestSemanticTokens(t *testing.T) {
+	c := newClient(t)
+	c.open(uri, "let x: int = 1; // one\nprint x;\n")
+	var tokens SemanticTokens
+	if err := c.call("textDocument/semanticTokens/full", TextDocumentParams{TextDocument: TextDocumentIdentifier{URI: uri}}, &tokens); err != nil {
+		t.Fatal(err)
+	}
+	want := []int{
+		0, 0, 3, semKeyword, 0,
+		0, 4, 1, semVariable, modDeclaration,
+		0, 3, 3, semType, 0,
+		0, 4, 1, semOperator, 0,
+		0, 2, 1, semNumber, 0,
+		0, 3, 6, semComment, 0,
+		1, 0, 5, semKeyword, 0,
+		0, 6, 1, semVariable, 0,
+	}
+	if !reflect.DeepEqual(tokens.Data, want) {
+		t.Errorf("semantic tokens:\n got %v\nwant %v", tokens.Data, want)
+	}
+	c.exit()
+}
+
+func TestFormatting(t *testing.T) {
+	c := newClient(t)
+	c.open(uri, "let  x=1;\nif(x>0){print x;}\nreturn x;")
+	var edits []TextEdit
+	params := TextDocumentParams{TextDocument: TextDocumentIdentifier{URI: uri}}
+	if err := c.call("textDocument/formatting", params, &edits); err != nil {
+		t.Fatal(err)
+	}
+	want := []TextEdit{{
+		Range:   Range{End: Position{Line: 2, Character: 9}},
+		NewText: "let x = 1;\nif (x > 0) {\n    print x;\n}\nreturn x;\n",
+	}}
+	if !reflect.DeepEqual(edits, want) {
+		t.Errorf("edits:\n got %+v\nwant %+v", edits, want)
+	}
+
+	c.open(uri, want[0].NewText)
+	if err := c.call("textDocument/formatting", params, &edits); err != nil || len(edits) != 0 {
+		t.Errorf("formatted document: %+v, %v", edits, err)
+	}
+	c.exit()
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	c := newClient(t)
+	c.notify("exit", nil)
+	if err := <-c.done; err == nil {
+		t.Error("Run returned nil after exit without shutdown")
+	}
+}
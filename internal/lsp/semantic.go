@@ -0,0 +1,132 @@
+package lsp
+
+import (
+	"strings"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+)
+
+// The semantic token legend. Token types and modifiers are sent as indices
+// into these lists.
+var (
+	semanticTypes     = []string{"keyword", "variable", "number", "operator", "comment", "type", "function"}
+	semanticModifiers = []string{"declaration"}
+)
+
+const (
+	semKeyword = iota
+	semVariable
+	semNumber
+	semOperator
+	semComment
+	semType
+	semFunction
+)
+
+const modDeclaration = 1 << 0
+
+var semanticTokenTypes = map[int]int{
+	lexer.TOKEN_IF:       semKeyword,
+	lexer.TOKEN_ELSE:     semKeyword,
+	lexer.TOKEN_WHILE:    semKeyword,
+	lexer.TOKEN_BREAK:    semKeyword,
+	lexer.TOKEN_CONTINUE: semKeyword,
+	lexer.TOKEN_FOR:      semKeyword,
+	lexer.TOKEN_RETURN:   semKeyword,
+	lexer.TOKEN_LET:      semKeyword,
+	lexer.TOKEN_PRINT:    semKeyword,
+	lexer.TOKEN_TRUE:     semKeyword,
+	lexer.TOKEN_FALSE:    semKeyword,
+	lexer.TOKEN_STRUCT:   semKeyword,
+	lexer.TOKEN_IDENT:    semVariable,
+	lexer.TOKEN_NUMBER:   semNumber,
+	lexer.TOKEN_EQUAL:    semOperator,
+	lexer.TOKEN_PLUS:     semOperator,
+	lexer.TOKEN_MINUS:    semOperator,
+	lexer.TOKEN_MULTIPLY: semOperator,
+	lexer.TOKEN_DIVIDE:   semOperator,
+	lexer.TOKEN_MODUlO:   semOperator,
+	lexer.TOKEN_LT:       semOperator,
+	lexer.TOKEN_GT:       semOperator,
+	lexer.TOKEN_LE:       semOperator,
+	lexer.TOKEN_GE:       semOperator,
+	lexer.TOKEN_EQ:       semOperator,
+}
+
+// semanticEncoder builds the relative encoding of semantic tokens: for
+// each token its line and start relative to the previous token, its
+// length, type and modifiers.
+type semanticEncoder struct {
+	d                  *document
+	data               []int
+	prevLine, prevChar int
+}
+
+// add encodes the source text starting at offset. Tokens must not span
+// lines.
+func (e *semanticEncoder) add(offset int, text string, typ, mods int) {
+	pos := e.d.position(offset)
+	length := 0
+	for _, r := range text {
+		length += utf16Len(r)
+	}
+	char := pos.Character
+	if pos.Line == e.prevLine {
+		char -= e.prevChar
+	}
+	e.data = append(e.data, pos.Line-e.prevLine, char, length, typ, mods)
+	e.prevLine, e.prevChar = pos.Line, pos.Character
+}
+
+// comments encodes the comments among trivia, one token per line.
+func (e *semanticEncoder) comments(trivia []lexer.Trivia) {
+	for _, t := range trivia {
+		if t.Kind != lexer.TRIVIA_LINE_COMMENT && t.Kind != lexer.TRIVIA_BLOCK_COMMENT {
+			continue
+		}
+		offset := t.Pos.Offset
+		for _, line := range strings.Split(t.Text, "\n") {
+			if line != "" {
+				e.add(offset, line, semComment, 0)
+			}
+			offset += len(line) + 1
+		}
+	}
+}
+
+// semanticTokens classifies the document's tokens and comments. A name
+// after ':' or 'struct', or before the '{' of a struct literal, is a type;
+// one before '(' is a built-in function; a variable name in a let is a
+// declaration.
+func (d *document) semanticTokens() []int {
+	decls := map[int]bool{}
+	if d.syms != nil {
+		for _, sym := range d.syms.Symbols {
+			decls[sym.Decl.Pos().Offset] = true
+		}
+	}
+
+	e := &semanticEncoder{d: d, data: []int{}}
+	for i, tok := range d.tokens {
+		e.comments(tok.Leading)
+		if typ, ok := semanticTokenTypes[tok.Type]; ok {
+			mods := 0
+			if tok.Type == lexer.TOKEN_IDENT {
+				if i > 0 && d.tokens[i-1].Type == lexer.TOKEN_STRUCT {
+					typ, mods = semType, modDeclaration
+				} else if i > 0 && d.tokens[i-1].Type == lexer.TOKEN_COLON ||
+					i+1 < len(d.tokens) && d.tokens[i+1].Type == lexer.TOKEN_LBRACE {
+					typ = semType
+				} else if i+1 < len(d.tokens) && d.tokens[i+1].Type == lexer.TOKEN_LPAREN {
+					typ = semFunction
+				} else if decls[tok.Pos.Offset] {
+					mods = modDeclaration
+				}
+			}
+			e.add(tok.Pos.Offset, tok.Literal, typ, mods)
+		}
+		e.comments(tok.Trailing)
+	}
+	e.comments(d.tail)
+	return e.data
+}
@@ -0,0 +1,284 @@
+// Package lsp implements a Language Server Protocol server for Bingus.
+//
+// The server keeps every open document analyzed by the compiler front end
+// and publishes its errors and lint warnings whenever it changes. On top of
+// that it answers go-to-definition, find-references, hover, document
+// symbol, semantic token and formatting requests. Documents are synced in
+// full on every change.
+package lsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/BergurDavidsen/bingus/internal/format"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+)
+
+// Server is a language server speaking over one connection.
+type Server struct {
+	conn     *Conn
+	docs     map[string]*document
+	shutdown bool
+}
+
+// NewServer returns a server that reads requests from r and writes
+// responses and notifications to w.
+func NewServer(r io.Reader, w io.Writer) *Server {
+	return &Server{conn: NewConn(r, w), docs: map[string]*document{}}
+}
+
+// Run serves requests until the client sends exit or closes the
+// connection. The error is nil only after an orderly shutdown and exit.
+func (s *Server) Run() error {
+	for {
+		msg, err := s.conn.Read()
+		if err != nil {
+			if rpcErr, ok := err.(*ResponseError); ok {
+				s.conn.Write(&Message{ID: rawJSON(nil), Error: rpcErr})
+				continue
+			}
+			if err == io.EOF {
+				return fmt.Errorf("connection closed before exit")
+			}
+			return err
+		}
+
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return fmt.Errorf("exit without shutdown")
+			}
+			return nil
+		}
+		if msg.ID == nil {
+			s.notification(msg)
+			continue
+		}
+
+		result, rpcErr := s.request(msg)
+		reply := &Message{ID: msg.ID, Error: rpcErr}
+		if rpcErr == nil {
+			reply.Result = rawJSON(result)
+		}
+		if err := s.conn.Write(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// handler answers a request with its raw params.
+type handler func(s *Server, params json.RawMessage) (interface{}, *ResponseError)
+
+// decode turns a method taking params of type P into a handler.
+func decode[P any](f func(s *Server, params *P) (interface{}, *ResponseError)) handler {
+	return func(s *Server, raw json.RawMessage) (interface{}, *ResponseError) {
+		params := new(P)
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, params); err != nil {
+				return nil, &ResponseError{Code: codeInvalidParams, Message: err.Error()}
+			}
+		}
+		return f(s, params)
+	}
+}
+
+// handlers are the supported requests.
+var handlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"initialize":                       decode((*Server).initialize),
+		"shutdown":                         decode((*Server).shutdownRequest),
+		"textDocument/definition":          decode((*Server).definition),
+		"textDocument/references":          decode((*Server).references),
+		"textDocument/hover":               decode((*Server).hover),
+		"textDocument/documentSymbol":      decode((*Server).documentSymbols),
+		"textDocument/semanticTokens/full": decode((*Server).semanticTokens),
+		"textDocument/formatting":          decode((*Server).formatting),
+	}
+}
+
+func (s *Server) request(msg *Message) (interface{}, *ResponseError) {
+	if s.shutdown {
+		return nil, &ResponseError{Code: codeInvalidRequest, Message: "server is shut down"}
+	}
+	h, ok := handlers[msg.Method]
+	if !ok {
+		return nil, &ResponseError{Code: codeMethodNotFound, Message: "method not found: " + msg.Method}
+	}
+	return h(s, msg.Params)
+}
+
+// notification handles document sync. Other notifications, such as
+// initialized, are ignored.
+func (s *Server) notification(msg *Message) {
+	switch msg.Method {
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if json.Unmarshal(msg.Params, &params) == nil {
+			s.update(params.TextDocument.URI, params.TextDocument.Text)
+		}
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if json.Unmarshal(msg.Params, &params) == nil && len(params.ContentChanges) > 0 {
+			last := params.ContentChanges[len(params.ContentChanges)-1]
+			s.update(params.TextDocument.URI, last.Text)
+		}
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if json.Unmarshal(msg.Params, &params) == nil {
+			delete(s.docs, params.TextDocument.URI)
+			s.conn.Notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []Diagnostic{}})
+		}
+	}
+}
+
+// update analyzes a document's new text and publishes its diagnostics.
+func (s *Server) update(uri, text string) {
+	doc := newDocument(uri, text)
+	s.docs[uri] = doc
+	diags := doc.diagnostics
+	if diags == nil {
+		diags = []Diagnostic{}
+	}
+	s.conn.Notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: uri, Diagnostics: diags})
+}
+
+func (s *Server) document(uri string) (*document, *ResponseError) {
+	doc, ok := s.docs[uri]
+	if !ok {
+		return nil, &ResponseError{Code: codeInvalidParams, Message: "document is not open: " + uri}
+	}
+	return doc, nil
+}
+
+func (s *Server) initialize(*struct{}) (interface{}, *ResponseError) {
+	var result InitializeResult
+	caps := &result.Capabilities
+	caps.TextDocumentSync = 1
+	caps.DefinitionProvider = true
+	caps.ReferencesProvider = true
+	caps.HoverProvider = true
+	caps.DocumentSymbolProvider = true
+	caps.DocumentFormattingProvider = true
+	caps.SemanticTokensProvider.Legend = SemanticTokensLegend{TokenTypes: semanticTypes, TokenModifiers: semanticModifiers}
+	caps.SemanticTokensProvider.Full = true
+	result.ServerInfo.Name = "bingus"
+	return result, nil
+}
+
+// shutdownRequest makes the server refuse further requests and wait for
+// exit.
+func (s *Server) shutdownRequest(*struct{}) (interface{}, *ResponseError) {
+	s.shutdown = true
+	return nil, nil
+}
+
+func (s *Server) definition(params *TextDocumentPositionParams) (interface{}, *ResponseError) {
+	doc, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	_, sym := doc.identAt(params.Position)
+	if sym == nil {
+		return nil, nil
+	}
+	return Location{URI: doc.uri, Range: doc.nodeRange(sym.Decl)}, nil
+}
+
+func (s *Server) references(params *ReferenceParams) (interface{}, *ResponseError) {
+	doc, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	_, sym := doc.identAt(params.Position)
+	if sym == nil {
+		return nil, nil
+	}
+	var ids []*parser.IDent
+	if params.Context.IncludeDeclaration {
+		ids = append(ids, sym.Decl)
+	}
+	ids = append(ids, sym.Uses...)
+	// An assignment's value is resolved before its target, so sort to
+	// report the uses in source order.
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Pos().Offset < ids[j].Pos().Offset })
+	locs := []Location{}
+	for _, id := range ids {
+		locs = append(locs, Location{URI: doc.uri, Range: doc.nodeRange(id)})
+	}
+	return locs, nil
+}
+
+func (s *Server) hover(params *TextDocumentPositionParams) (interface{}, *ResponseError) {
+	doc, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	id, sym := doc.identAt(params.Position)
+	if sym == nil {
+		return nil, nil
+	}
+	signature := "let " + sym.Name
+	if t, ok := doc.vars[sym]; ok {
+		signature += ": " + t.String()
+	}
+	return Hover{
+		Contents: MarkupContent{Kind: "markdown", Value: "```bingus\n" + signature + "\n```"},
+		Range:    doc.nodeRange(id),
+	}, nil
+}
+
+func (s *Server) documentSymbols(params *TextDocumentParams) (interface{}, *ResponseError) {
+	doc, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	symbols := []DocumentSymbol{}
+	if doc.prog == nil {
+		return symbols, nil
+	}
+	parser.Inspect(doc.prog, func(n parser.Node) bool {
+		if let, ok := n.(*parser.LetStmt); ok {
+			sym := DocumentSymbol{
+				Name:           let.Name.Name,
+				Kind:           SymbolKindVariable,
+				Range:          doc.nodeRange(let),
+				SelectionRange: doc.nodeRange(let.Name),
+			}
+			if doc.syms != nil {
+				if t, ok := doc.vars[doc.syms.Lookup(let.Name)]; ok {
+					sym.Detail = t.String()
+				}
+			}
+			symbols = append(symbols, sym)
+		}
+		return true
+	})
+	return symbols, nil
+}
+
+func (s *Server) semanticTokens(params *TextDocumentParams) (interface{}, *ResponseError) {
+	doc, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	return SemanticTokens{Data: doc.semanticTokens()}, nil
+}
+
+// formatting replaces the whole document with its formatted source. A
+// document that does not parse is left alone.
+func (s *Server) formatting(params *TextDocumentParams) (interface{}, *ResponseError) {
+	doc, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	formatted, ferr := format.Source(doc.text)
+	if ferr != nil || formatted == doc.text {
+		return []TextEdit{}, nil
+	}
+	whole := Range{End: doc.position(len(doc.text))}
+	return []TextEdit{{Range: whole, NewText: formatted}}, nil
+}
@@ -1,63 +1,213 @@
 package parser
 
-type Node interface{}
+import "github.com/BergurDavidsen/bingus/internal/lexer"
+
+// Node is any node of the syntax tree.
+type Node interface {
+	Pos() lexer.Position // the position of the node's first token
+	End() lexer.Position // the position just past the node's last token
+	node()
+}
+
+// Stmt is a statement node.
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+// Expr is an expression node.
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// Span is the source range of a node. A parenthesized expression does not
+// include its parentheses.
+type Span struct {
+	Start lexer.Position
+	Stop  lexer.Position
+}
+
+func (s Span) Pos() lexer.Position { return s.Start }
+func (s Span) End() lexer.Position { return s.Stop }
+func (Span) node()                 {}
 
 type Program struct {
-	Statements []Node
+	Span
+	Statements []Stmt
 }
 
 type ReturnStmt struct {
-	Value Node
+	Span
+	Value Expr
 }
 
 type NumberLiteral struct {
+	Span
 	Value string
 }
 
 type IDent struct {
+	Span
 	Name string
 }
 
 type AssignmentStmt struct {
+	Span
 	Name  *IDent
-	Value Node
+	Value Expr
 }
 
 type PrintStmt struct {
-	Value Node
+	Span
+	Value Expr
 }
 
 type LetStmt struct {
+	Span
 	Name  *IDent
-	Value Node
+	Type  *IDent // declared type, or nil if it is inferred from Value
+	Value Expr
+}
+
+// FreeStmt releases a heap block.
+type FreeStmt struct {
+	Span
+	Value Expr
 }
 
 type WhileStmt struct {
-	Guard Node
-	Body  []Node
+	Span
+	Guard Expr
+	Body  []Stmt
 }
 
 type BoolLit struct {
+	Span
 	Value bool
 }
 
 type IfStmt struct {
-	Guard Node
-	Then  []Node
-	Else  []Node
+	Span
+	Guard Expr
+	Then  []Stmt
+	Else  []Stmt // nil without an else block
 }
 
 type BinaryExpr struct {
-	Left     Node
+	Span
+	OpPos    lexer.Position // position of Operator
+	Left     Expr
 	Operator string
-	Right    Node
+	Right    Expr
 }
 
 type UnaryExpr struct {
+	Span
 	Operator string
-	Right    Node
+	Right    Expr
+}
+
+// InputExpr reads an integer from standard input.
+type InputExpr struct {
+	Span
+}
+
+// ArgcExpr is the number of command-line arguments, counting the program's
+// name.
+type ArgcExpr struct {
+	Span
+}
+
+// ArgExpr reads a command-line argument as an integer.
+type ArgExpr struct {
+	Span
+	Index Expr
+}
+
+// EnvExpr reads an environment variable as an integer.
+type EnvExpr struct {
+	Span
+	Name string
+}
+
+// AllocExpr allocates a heap block of Size bytes.
+type AllocExpr struct {
+	Span
+	Size Expr
+}
+
+// StructDecl declares a struct type. It may only appear at the top level.
+type StructDecl struct {
+	Span
+	Name   *IDent
+	Fields []*FieldDecl
+}
+
+// FieldDecl is a field of a struct declaration.
+type FieldDecl struct {
+	Span
+	Name *IDent
+	Type *IDent
+}
+
+// StructLit builds a struct value field by field.
+type StructLit struct {
+	Span
+	Type   *IDent
+	Fields []*FieldInit // in source order
+}
+
+// FieldInit gives a field its value in a struct literal.
+type FieldInit struct {
+	Span
+	Name  *IDent
+	Value Expr
+}
+
+// FieldExpr selects a field of a struct value.
+type FieldExpr struct {
+	Span
+	X     Expr
+	Field *IDent
+}
+
+// FieldAssignStmt assigns to a field of a struct variable.
+type FieldAssignStmt struct {
+	Span
+	Target *FieldExpr
+	Value  Expr
+}
+
+type BreakStmt struct {
+	Span
+}
+
+type ContinueStmt struct {
+	Span
 }
 
-type BreakStmt struct{}
+func (*ReturnStmt) stmtNode()      {}
+func (*AssignmentStmt) stmtNode()  {}
+func (*PrintStmt) stmtNode()       {}
+func (*FreeStmt) stmtNode()        {}
+func (*LetStmt) stmtNode()         {}
+func (*WhileStmt) stmtNode()       {}
+func (*IfStmt) stmtNode()          {}
+func (*BreakStmt) stmtNode()       {}
+func (*ContinueStmt) stmtNode()    {}
+func (*StructDecl) stmtNode()      {}
+func (*FieldAssignStmt) stmtNode() {}
 
-type ContinueStmt struct{}
+func (*NumberLiteral) exprNode() {}
+func (*IDent) exprNode()         {}
+func (*BoolLit) exprNode()       {}
+func (*BinaryExpr) exprNode()    {}
+func (*UnaryExpr) exprNode()     {}
+func (*InputExpr) exprNode()     {}
+func (*ArgcExpr) exprNode()      {}
+func (*ArgExpr) exprNode()       {}
+func (*EnvExpr) exprNode()       {}
+func (*AllocExpr) exprNode()     {}
+func (*StructLit) exprNode()     {}
+func (*FieldExpr) exprNode()     {}
@@ -0,0 +1,59 @@
+package parser
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/randprog"
+)
+
+func FuzzParse(f *testing.F) {
+	seeds := []string{
+		"return 0;",
+		"let x = 3 <= 6; print x;",
+		"let i = 1; while (i <= 10) { if (i == 5) { break; } i = i + 1; }",
+		"if (1) { } else { }",
+		"return -(-5) * +3 % 2;",
+		"let",
+		"let x",
+		"let x =",
+		"let x = ;",
+		"print (1 + 2;",
+		"+",
+		"}",
+		"while (",
+		"print 1 \"+\" 2;",
+		"return 99999999999999999999;",
+		"((((((((((((((((((((1))))))))))))))))))))",
+		"struct P { x: int, y: P } let p = P { x: 1, y: p }; p.y.x = p.x;",
+		"struct P { x: int",
+		"let p = P { x: };",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+	r := rand.New(rand.NewPCG(1, 1))
+	for i := 0; i < 4; i++ {
+		f.Add(randprog.Generate(r))
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		tokens, err := lexer.Lex(input)
+		if err != nil {
+			return
+		}
+
+		p := Parser{Tokens: tokens}
+		prog, err := p.ParseProgram()
+		if err != nil {
+			if _, ok := err.(*Error); !ok {
+				t.Fatalf("ParseProgram returned %T, want *Error", err)
+			}
+			return
+		}
+		if prog == nil {
+			t.Fatal("ParseProgram returned neither a program nor an error")
+		}
+	})
+}
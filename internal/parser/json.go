@@ -0,0 +1,212 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+)
+
+// nodeTypes maps node kinds, the names of the node structs, to their types.
+var nodeTypes = map[string]reflect.Type{}
+
+func init() {
+	for _, n := range []Node{
+		&Program{}, &ReturnStmt{}, &NumberLiteral{}, &IDent{}, &AssignmentStmt{},
+		&PrintStmt{}, &LetStmt{}, &WhileStmt{}, &BoolLit{}, &IfStmt{},
+		&BinaryExpr{}, &UnaryExpr{}, &BreakStmt{}, &ContinueStmt{}, &InputExpr{}, &ArgcExpr{}, &ArgExpr{},
+		&EnvExpr{}, &AllocExpr{}, &FreeStmt{}, &StructDecl{}, &FieldDecl{}, &StructLit{}, &FieldInit{},
+		&FieldExpr{}, &FieldAssignStmt{},
+	} {
+		t := reflect.TypeOf(n).Elem()
+		nodeTypes[t.Name()] = t
+	}
+}
+
+var (
+	positionType = reflect.TypeOf(lexer.Position{})
+	spanType     = reflect.TypeOf(Span{})
+)
+
+// jsonName is the JSON key of a node field: its name with a lowercase first
+// letter.
+func jsonName(field string) string {
+	r, n := utf8.DecodeRuneInString(field)
+	return string(unicode.ToLower(r)) + field[n:]
+}
+
+// EncodeJSON serializes a syntax tree. Every node becomes an object with
+// its "kind", the name of its type, then its span as "pos" and "end",
+// followed by its other fields in declaration order. Positions are
+// {"offset", "line", "col"}. A missing child or block is null, which keeps
+// an absent else apart from an empty one.
+func EncodeJSON(node Node) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeValue(&buf, reflect.ValueOf(node)); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	switch {
+	case v.Type() == positionType:
+		return encodeJSONValue(buf, v.Interface())
+	case v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		return encodeValue(buf, v.Elem())
+	case v.Kind() == reflect.Struct:
+		t := v.Type()
+		if _, ok := nodeTypes[t.Name()]; !ok {
+			return fmt.Errorf("cannot encode %s: not a node", t)
+		}
+		buf.WriteString(`{"kind":`)
+		encodeJSONValue(buf, t.Name())
+		for i := 0; i < t.NumField(); i++ {
+			buf.WriteString(",")
+			if t.Field(i).Type == spanType {
+				span := v.Field(i).Interface().(Span)
+				buf.WriteString(`"pos":`)
+				encodeJSONValue(buf, span.Start)
+				buf.WriteString(`,"end":`)
+				encodeJSONValue(buf, span.Stop)
+				continue
+			}
+			encodeJSONValue(buf, jsonName(t.Field(i).Name))
+			buf.WriteString(":")
+			if err := encodeValue(buf, v.Field(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+		return nil
+	case v.Kind() == reflect.Slice:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		buf.WriteString("[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			if err := encodeValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("]")
+		return nil
+	case v.Kind() == reflect.String || v.Kind() == reflect.Bool:
+		return encodeJSONValue(buf, v.Interface())
+	}
+	return fmt.Errorf("cannot encode field of type %s", v.Type())
+}
+
+func encodeJSONValue(buf *bytes.Buffer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	return nil
+}
+
+// DecodeJSON reads a program written by EncodeJSON.
+func DecodeJSON(data []byte) (*Program, error) {
+	node, err := decodeNode(data)
+	if err != nil {
+		return nil, err
+	}
+	prog, ok := node.(*Program)
+	if !ok {
+		return nil, fmt.Errorf("expected a Program, got %T", node)
+	}
+	return prog, nil
+}
+
+// decodeNode decodes a node object, or null into a nil Node.
+func decodeNode(data []byte) (Node, error) {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	var kind string
+	if err := json.Unmarshal(fields["kind"], &kind); err != nil {
+		return nil, fmt.Errorf("node without a kind")
+	}
+	t, ok := nodeTypes[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown node kind %q", kind)
+	}
+
+	v := reflect.New(t)
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type == spanType {
+			span := v.Elem().Field(i).Addr().Interface().(*Span)
+			for name, pos := range map[string]*lexer.Position{"pos": &span.Start, "end": &span.Stop} {
+				if raw, ok := fields[name]; ok {
+					if err := json.Unmarshal(raw, pos); err != nil {
+						return nil, fmt.Errorf("%s.%s: %v", kind, name, err)
+					}
+				}
+			}
+			continue
+		}
+		name := jsonName(t.Field(i).Name)
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if err := decodeValue(raw, v.Elem().Field(i)); err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", kind, name, err)
+		}
+	}
+	return v.Interface().(Node), nil
+}
+
+func decodeValue(data []byte, field reflect.Value) error {
+	switch field.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		node, err := decodeNode(data)
+		if err != nil || node == nil {
+			return err
+		}
+		v := reflect.ValueOf(node)
+		if !v.Type().AssignableTo(field.Type()) {
+			return fmt.Errorf("cannot use %s as %s", v.Elem().Type().Name(), field.Type())
+		}
+		field.Set(v)
+		return nil
+	case reflect.Slice:
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return err
+		}
+		if elems == nil {
+			return nil
+		}
+		slice := reflect.MakeSlice(field.Type(), len(elems), len(elems))
+		for i, elem := range elems {
+			if err := decodeValue(elem, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+	return json.Unmarshal(data, field.Addr().Interface())
+}
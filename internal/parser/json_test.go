@@ -0,0 +1,89 @@
+package parser
+
+import (
+	"math/rand/v2"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/randprog"
+)
+
+func parse(t *testing.T, src string) *Program {
+	t.Helper()
+	tokens, err := lexer.Lex(src)
+	if err != nil {
+		t.Fatalf("lex: %v\n%s", err, src)
+	}
+	p := Parser{Tokens: tokens}
+	prog, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, src)
+	}
+	return prog
+}
+
+func roundTrip(t *testing.T, prog *Program) []byte {
+	t.Helper()
+	data, err := EncodeJSON(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeJSON(data)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, data)
+	}
+	if !reflect.DeepEqual(got, prog) {
+		t.Fatalf("round trip changed the program:\n%s", data)
+	}
+	return data
+}
+
+func TestASTJSON(t *testing.T) {
+	prog := parse(t, "let x: int = -(1 + 2);\nif (x < 0) { print x; } else {}\nif (true) { x = 1; }")
+	data := string(roundTrip(t, prog))
+
+	for _, want := range []string{
+		`"kind": "UnaryExpr"`,
+		`"type": {`,
+		`"else": []`,
+		`"else": null`,
+	} {
+		if !strings.Contains(data, want) {
+			t.Errorf("JSON lacks %s:\n%s", want, data)
+		}
+	}
+
+	let := prog.Statements[0].(*LetStmt)
+	if let.End().Offset != len("let x: int = -(1 + 2);") {
+		t.Errorf("let ends at offset %d", let.End().Offset)
+	}
+	if sum := let.Value.(*UnaryExpr).Right.(*BinaryExpr); sum.End().Col != 21 {
+		t.Errorf("1 + 2 ends at %s, want 1:21", sum.End())
+	}
+
+	roundTrip(t, parse(t, "struct P { x: int, y: bool } struct E {} let p = P { y: true, x: 1 }; p.x = E {}.x;"))
+
+	r := rand.New(rand.NewPCG(8, 8))
+	for i := 0; i < 100; i++ {
+		roundTrip(t, parse(t, randprog.Generate(r)))
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	tests := []struct {
+		data, want string
+	}{
+		{`{"kind": "Nope"}`, `unknown node kind "Nope"`},
+		{`{"kind": "IDent", "name": "x"}`, "expected a Program, got *parser.IDent"},
+		{`{"kind": "Program", "statements": [{"kind": "LetStmt", "name": {"kind": "BoolLit"}}]}`,
+			"LetStmt.name: cannot use BoolLit as *parser.IDent"},
+	}
+	for _, tt := range tests {
+		_, err := DecodeJSON([]byte(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.data, err, tt.want)
+		}
+	}
+}
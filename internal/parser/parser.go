@@ -3,6 +3,8 @@ package parser
 import (
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/BergurDavidsen/bingus/internal/lexer"
 )
@@ -10,6 +12,50 @@ import (
 type Parser struct {
 	Tokens []lexer.Token
 	pos    int
+	depth  int
+}
+
+// maxDepth bounds how deeply blocks and expressions may nest, so that
+// pathological inputs are reported as errors instead of exhausting the stack.
+const maxDepth = 1000
+
+// Error is a syntax error at a position in the source.
+type Error struct {
+	Pos lexer.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// errorf aborts parsing with an *Error at the current token. It is recovered
+// by ParseProgram.
+func (p *Parser) errorf(format string, args ...interface{}) {
+	panic(&Error{Pos: p.currentToken().Pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *Parser) enter() {
+	p.depth++
+	if p.depth > maxDepth {
+		p.errorf("nesting exceeds maximum depth of %d", maxDepth)
+	}
+}
+
+func (p *Parser) leave() {
+	p.depth--
+}
+
+// describe renders a token for use in error messages.
+func describe(tok lexer.Token) string {
+	switch tok.Type {
+	case -1:
+		return "end of input"
+	case lexer.TOKEN_STRING:
+		return fmt.Sprintf("string %q", tok.Literal)
+	default:
+		return fmt.Sprintf("%q", tok.Literal)
+	}
 }
 
 var precedences = map[string]int{
@@ -28,7 +74,16 @@ var precedences = map[string]int{
 	"u-": 4,
 }
 
+// BinaryPrecedence returns how tightly a binary operator binds. All binary
+// operators are left-associative.
+func BinaryPrecedence(op string) int {
+	return precedences[op]
+}
+
 func getPrecedence(tok lexer.Token) int {
+	if tok.Type == lexer.TOKEN_STRING {
+		return 0
+	}
 	if prec, ok := precedences[tok.Literal]; ok {
 		return prec
 	}
@@ -61,7 +116,9 @@ func PrintNodeReflect(node interface{}, indent string) {
 			val := v.Field(i).Interface()
 			fmt.Printf("%s  %s: ", indent, field.Name)
 			kind := reflect.ValueOf(val).Kind()
-			if kind == reflect.Struct || kind == reflect.Ptr || kind == reflect.Slice {
+			if pos, ok := val.(lexer.Position); ok {
+				fmt.Println(pos)
+			} else if kind == reflect.Struct || kind == reflect.Ptr || kind == reflect.Slice {
 				fmt.Println()
 				PrintNodeReflect(val, indent+"    ")
 			} else {
@@ -81,15 +138,33 @@ func PrintNodeReflect(node interface{}, indent string) {
 
 func (p *Parser) currentToken() lexer.Token {
 	if p.pos >= len(p.Tokens) {
-		return lexer.Token{Type: -1, Literal: ""}
+		return lexer.Token{Type: -1, Literal: "", Pos: p.endPos()}
 	}
 
 	return p.Tokens[p.pos]
 }
 
+// endPos is the position reported for errors at end of input.
+func (p *Parser) endPos() lexer.Position {
+	if len(p.Tokens) == 0 {
+		return lexer.Position{Line: 1, Col: 1}
+	}
+	return p.Tokens[len(p.Tokens)-1].End()
+}
+
+// lastEnd returns the position just past the last consumed token.
+func (p *Parser) lastEnd() lexer.Position {
+	return p.Tokens[p.pos-1].End()
+}
+
+// span returns the span from start to the end of the last consumed token.
+func (p *Parser) span(start lexer.Position) Span {
+	return Span{Start: start, Stop: p.lastEnd()}
+}
+
 func (p *Parser) peek() lexer.Token {
 	if p.pos+1 >= len(p.Tokens) {
-		return lexer.Token{Type: -1, Literal: ""}
+		return lexer.Token{Type: -1, Literal: "", Pos: p.endPos()}
 	}
 	return p.Tokens[p.pos+1]
 }
@@ -102,30 +177,37 @@ func (p *Parser) parseNumber() *NumberLiteral {
 	tok := p.currentToken()
 
 	if tok.Type != lexer.TOKEN_NUMBER {
-		panic(fmt.Sprintf("Expected number, got: %v", tok))
+		p.errorf("expected number, got %s", describe(tok))
+	}
+
+	if _, err := strconv.ParseInt(tok.Literal, 10, 64); err != nil {
+		p.errorf("integer literal %s out of range", tok.Literal)
 	}
 
 	p.advance()
-	return &NumberLiteral{Value: tok.Literal}
+	return &NumberLiteral{Span: p.span(tok.Pos), Value: tok.Literal}
 }
 
 func (p *Parser) parseIdent() *IDent {
 	tok := p.currentToken()
 
 	if tok.Type != lexer.TOKEN_IDENT {
-		panic("Expected identifier after let")
+		p.errorf("expected identifier, got %s", describe(tok))
 	}
 	p.advance()
 
-	return &IDent{Name: tok.Literal}
+	return &IDent{Span: p.span(tok.Pos), Name: tok.Literal}
 }
 
-func (p *Parser) parseAssignmentStmt() *AssignmentStmt {
+// parseAssignmentStmt parses an assignment to a variable or, when the name
+// is followed by field selectors, to a field of a struct variable.
+func (p *Parser) parseAssignmentStmt() Stmt {
 	// Parse the left-hand side identifier
 	id := p.parseIdent()
+	target := p.parseSelectors(id)
 
 	if p.currentToken().Type != lexer.TOKEN_EQUAL {
-		panic("Expected '=' in assignment")
+		p.errorf("expected '=' in assignment, got %s", describe(p.currentToken()))
 	}
 	p.advance() // consume '='
 
@@ -133,11 +215,15 @@ func (p *Parser) parseAssignmentStmt() *AssignmentStmt {
 	value := p.parserExpression(1)
 
 	if p.currentToken().Type != lexer.TOKEN_SEMICOLON {
-		panic("Expected ';' after assignment")
+		p.errorf("expected ';' after assignment, got %s", describe(p.currentToken()))
 	}
 	p.advance() // consume ';'
 
+	if field, ok := target.(*FieldExpr); ok {
+		return &FieldAssignStmt{Span: p.span(id.Pos()), Target: field, Value: value}
+	}
 	return &AssignmentStmt{
+		Span:  p.span(id.Pos()),
 		Name:  id,
 		Value: value,
 	}
@@ -146,55 +232,84 @@ func (p *Parser) parseAssignmentStmt() *AssignmentStmt {
 func (p *Parser) parseReturnStmt() *ReturnStmt {
 	tok := p.currentToken()
 	if tok.Type != lexer.TOKEN_RETURN {
-		panic(fmt.Sprintf("Expected 'return', got: %v", tok))
+		p.errorf("expected 'return', got %s", describe(tok))
 	}
 	p.advance()
 
 	value := p.parserExpression(1)
 
 	if p.currentToken().Type != lexer.TOKEN_SEMICOLON {
-		panic(fmt.Sprintf("Expected ';', got: %v", p.currentToken()))
+		p.errorf("expected ';', got %s", describe(p.currentToken()))
 	}
 	p.advance()
 
-	return &ReturnStmt{Value: value}
+	return &ReturnStmt{Span: p.span(tok.Pos), Value: value}
 }
 
 func (p *Parser) parsePrint() *PrintStmt {
 	tok := p.currentToken()
 
 	if tok.Type != lexer.TOKEN_PRINT {
-		panic(fmt.Sprintf("Expected 'print', got: %v", tok))
+		p.errorf("expected 'print', got %s", describe(tok))
 	}
 	p.advance()
 
 	value := p.parserExpression(1)
 
 	if p.currentToken().Type != lexer.TOKEN_SEMICOLON {
-		panic(fmt.Sprintf("Expected ';', got: %v", p.currentToken()))
+		p.errorf("expected ';', got %s", describe(p.currentToken()))
 	}
 	p.advance()
 
-	return &PrintStmt{Value: value}
+	return &PrintStmt{Span: p.span(tok.Pos), Value: value}
+}
+
+// parseIdentStmt parses a statement that starts with a name: a call of
+// free, or an assignment.
+func (p *Parser) parseIdentStmt() Stmt {
+	if p.currentToken().Literal == "free" && p.peek().Type == lexer.TOKEN_LPAREN {
+		return p.parseFree()
+	}
+	return p.parseAssignmentStmt()
+}
+
+func (p *Parser) parseFree() *FreeStmt {
+	tok := p.currentToken()
+	p.advance()
+	p.expect(lexer.TOKEN_LPAREN, "'('")
+	value := p.parserExpression(1)
+	p.expect(lexer.TOKEN_RPAREN, "')'")
+	p.expect(lexer.TOKEN_SEMICOLON, "';'")
+	return &FreeStmt{Span: p.span(tok.Pos), Value: value}
 }
 
 func (p *Parser) parseLetStmt() *LetStmt {
 	tok := p.currentToken()
 
 	if tok.Type != lexer.TOKEN_LET {
-		panic(fmt.Sprintf("Expected 'let', got: %v", tok))
+		p.errorf("expected 'let', got %s", describe(tok))
 	}
 
 	p.advance() // ignore let
 
 	if p.currentToken().Type != lexer.TOKEN_IDENT {
-		panic("Expected identifier after let")
+		p.errorf("expected identifier after let, got %s", describe(p.currentToken()))
 	}
 
 	id := p.parseIdent()
 
+	// An optional type annotation: let x: int = 1;
+	var typ *IDent
+	if p.currentToken().Type == lexer.TOKEN_COLON {
+		p.advance()
+		if p.currentToken().Type != lexer.TOKEN_IDENT {
+			p.errorf("expected type name after ':', got %s", describe(p.currentToken()))
+		}
+		typ = p.parseIdent()
+	}
+
 	if p.currentToken().Type != lexer.TOKEN_EQUAL {
-		panic("Expected '=' after identifier in let statement")
+		p.errorf("expected '=' after identifier in let statement, got %s", describe(p.currentToken()))
 	}
 
 	p.advance()
@@ -202,24 +317,24 @@ func (p *Parser) parseLetStmt() *LetStmt {
 	value := p.parserExpression(1)
 
 	if p.currentToken().Type != lexer.TOKEN_SEMICOLON {
-		panic(fmt.Sprintf("Expected ';', got: %v", tok))
+		p.errorf("expected ';', got %s", describe(p.currentToken()))
 	}
 	p.advance()
 
-	return &LetStmt{Name: id, Value: value}
+	return &LetStmt{Span: p.span(tok.Pos), Name: id, Type: typ, Value: value}
 }
 
 func (p *Parser) parseWhileStmt() *WhileStmt {
 	tok := p.currentToken()
 
 	if tok.Type != lexer.TOKEN_WHILE {
-		panic(fmt.Sprintf("Expected 'while', got: %v", tok))
+		p.errorf("expected 'while', got %s", describe(tok))
 	}
 
 	p.advance()
 
 	if p.currentToken().Type != lexer.TOKEN_LPAREN {
-		panic(fmt.Sprintf("Expected '(', got: %v", tok))
+		p.errorf("expected '(', got %s", describe(p.currentToken()))
 	}
 
 	p.advance()
@@ -227,53 +342,56 @@ func (p *Parser) parseWhileStmt() *WhileStmt {
 	guard := p.parserExpression(1)
 
 	if p.currentToken().Type != lexer.TOKEN_RPAREN {
-		panic(fmt.Sprintf("Expected ')', got: %v", tok))
+		p.errorf("expected ')', got %s", describe(p.currentToken()))
 	}
 
 	p.advance()
 
 	body := p.parseBlock()
 
-	return &WhileStmt{Guard: guard, Body: body}
+	return &WhileStmt{Span: p.span(tok.Pos), Guard: guard, Body: body}
 }
 
 func (p *Parser) parseBreakStmt() *BreakStmt {
 	tok := p.currentToken()
 
 	if tok.Type != lexer.TOKEN_BREAK {
-		panic(fmt.Sprintf("Expected 'break', got: %v", tok))
+		p.errorf("expected 'break', got %s", describe(tok))
 	}
 	p.advance()
 
 	if p.currentToken().Type != lexer.TOKEN_SEMICOLON {
-		panic(fmt.Sprintf("Expected ';', got: %v", tok))
+		p.errorf("expected ';', got %s", describe(p.currentToken()))
 	}
 	p.advance()
 
-	return &BreakStmt{}
+	return &BreakStmt{Span: p.span(tok.Pos)}
 }
 
 func (p *Parser) parseContinueStmt() *ContinueStmt {
 	tok := p.currentToken()
 
 	if tok.Type != lexer.TOKEN_CONTINUE {
-		panic(fmt.Sprintf("Expected 'continue', got: %v", tok))
+		p.errorf("expected 'continue', got %s", describe(tok))
 	}
 	p.advance()
 
 	if p.currentToken().Type != lexer.TOKEN_SEMICOLON {
-		panic(fmt.Sprintf("Expected ';', got: %v", tok))
+		p.errorf("expected ';', got %s", describe(p.currentToken()))
 	}
 	p.advance()
 
-	return &ContinueStmt{}
+	return &ContinueStmt{Span: p.span(tok.Pos)}
 }
 
-func (p *Parser) parseBlock() []Node {
-	stmts := []Node{}
+func (p *Parser) parseBlock() []Stmt {
+	p.enter()
+	defer p.leave()
+
+	stmts := []Stmt{}
 
 	if p.currentToken().Type != lexer.TOKEN_LBRACE {
-		panic("Expected '{' at start of block")
+		p.errorf("expected '{' at start of block, got %s", describe(p.currentToken()))
 	}
 	p.advance() // consume '{'
 
@@ -288,14 +406,18 @@ func (p *Parser) parseBlock() []Node {
 			stmts = append(stmts, p.parsePrint())
 		case lexer.TOKEN_IF:
 			stmts = append(stmts, p.parseIfStmt())
+		case lexer.TOKEN_WHILE:
+			stmts = append(stmts, p.parseWhileStmt())
 		case lexer.TOKEN_IDENT:
-			stmts = append(stmts, p.parseAssignmentStmt())
+			stmts = append(stmts, p.parseIdentStmt())
 		case lexer.TOKEN_BREAK:
 			stmts = append(stmts, p.parseBreakStmt())
 		case lexer.TOKEN_CONTINUE:
 			stmts = append(stmts, p.parseContinueStmt())
+		case lexer.TOKEN_STRUCT:
+			p.errorf("struct declarations are only allowed at the top level")
 		default:
-			panic(fmt.Sprintf("Unexpected token in block: %v", tok))
+			p.errorf("unexpected %s in block", describe(tok))
 		}
 	}
 
@@ -304,39 +426,185 @@ func (p *Parser) parseBlock() []Node {
 }
 
 func (p *Parser) parseIfStmt() *IfStmt {
-	if p.currentToken().Type != lexer.TOKEN_IF {
-		panic(fmt.Sprintf("Expected 'if', got: %v", p.currentToken()))
+	tok := p.currentToken()
+	if tok.Type != lexer.TOKEN_IF {
+		p.errorf("expected 'if', got %s", describe(tok))
 	}
 	p.advance()
 
 	if p.currentToken().Type != lexer.TOKEN_LPAREN {
-		panic("Expected '(' after if statement")
+		p.errorf("expected '(' after if, got %s", describe(p.currentToken()))
 	}
 	p.advance()
 
 	guard := p.parserExpression(1)
 
 	if p.currentToken().Type != lexer.TOKEN_RPAREN {
-		panic("Expected ')' after if statement")
+		p.errorf("expected ')' after if condition, got %s", describe(p.currentToken()))
 	}
 	p.advance()
 
 	thenBlock := p.parseBlock()
 
-	var elseBlock []Node
+	var elseBlock []Stmt
 	if p.currentToken().Type == lexer.TOKEN_ELSE {
 		p.advance()
 		elseBlock = p.parseBlock()
 	}
 
 	return &IfStmt{
+		Span:  p.span(tok.Pos),
 		Guard: guard,
 		Then:  thenBlock,
 		Else:  elseBlock,
 	}
 }
 
-func (p *Parser) parserExpression(minPrec int) Node {
+// expect consumes a token of type typ, which is described as what in the
+// error if the current token is another.
+func (p *Parser) expect(typ int, what string) lexer.Token {
+	tok := p.currentToken()
+	if tok.Type != typ {
+		p.errorf("expected %s, got %s", what, describe(tok))
+	}
+	p.advance()
+	return tok
+}
+
+// parseCall parses a call of a built-in function. The names of the
+// built-ins are not reserved: they are only calls when followed by '(', so
+// variables can still be called input.
+func (p *Parser) parseCall() Expr {
+	switch tok := p.currentToken(); tok.Literal {
+	case "input":
+		return p.parseInput()
+	case "argc":
+		return p.parseArgc()
+	case "arg":
+		return p.parseArg()
+	case "env":
+		return p.parseEnv()
+	case "alloc":
+		return p.parseAlloc()
+	case "free":
+		p.errorf("free(...) is a statement and has no value")
+		return nil
+	default:
+		p.errorf("undefined function: %s", tok.Literal)
+		return nil
+	}
+}
+
+func (p *Parser) parseInput() *InputExpr {
+	tok := p.currentToken()
+	p.advance()
+	p.expect(lexer.TOKEN_LPAREN, "'('")
+	p.expect(lexer.TOKEN_RPAREN, "')'")
+	return &InputExpr{Span: p.span(tok.Pos)}
+}
+
+func (p *Parser) parseArgc() *ArgcExpr {
+	tok := p.currentToken()
+	p.advance()
+	p.expect(lexer.TOKEN_LPAREN, "'('")
+	p.expect(lexer.TOKEN_RPAREN, "')'")
+	return &ArgcExpr{Span: p.span(tok.Pos)}
+}
+
+func (p *Parser) parseArg() *ArgExpr {
+	tok := p.currentToken()
+	p.advance()
+	p.expect(lexer.TOKEN_LPAREN, "'('")
+	index := p.parserExpression(1)
+	p.expect(lexer.TOKEN_RPAREN, "')'")
+	return &ArgExpr{Span: p.span(tok.Pos), Index: index}
+}
+
+func (p *Parser) parseAlloc() *AllocExpr {
+	tok := p.currentToken()
+	p.advance()
+	p.expect(lexer.TOKEN_LPAREN, "'('")
+	size := p.parserExpression(1)
+	p.expect(lexer.TOKEN_RPAREN, "')'")
+	return &AllocExpr{Span: p.span(tok.Pos), Size: size}
+}
+
+func (p *Parser) parseEnv() *EnvExpr {
+	tok := p.currentToken()
+	p.advance()
+	p.expect(lexer.TOKEN_LPAREN, "'('")
+	if name := p.currentToken(); name.Type == lexer.TOKEN_STRING && !validEnvName(name.Literal) {
+		p.errorf("invalid environment variable name %q", name.Literal)
+	}
+	name := p.expect(lexer.TOKEN_STRING, "an environment variable name")
+	p.expect(lexer.TOKEN_RPAREN, "')'")
+	return &EnvExpr{Span: p.span(tok.Pos), Name: name.Literal}
+}
+
+// parseStructDecl parses a struct declaration: struct Name { field: type,
+// ... }. The last field may be followed by a comma.
+func (p *Parser) parseStructDecl() *StructDecl {
+	tok := p.currentToken()
+	p.advance()
+	name := p.parseIdent()
+	p.expect(lexer.TOKEN_LBRACE, "'{'")
+	fields := []*FieldDecl{}
+	for p.currentToken().Type != lexer.TOKEN_RBRACE {
+		field := p.parseIdent()
+		p.expect(lexer.TOKEN_COLON, "':' after field name")
+		if p.currentToken().Type != lexer.TOKEN_IDENT {
+			p.errorf("expected type name after ':', got %s", describe(p.currentToken()))
+		}
+		typ := p.parseIdent()
+		fields = append(fields, &FieldDecl{Span: p.span(field.Pos()), Name: field, Type: typ})
+		if p.currentToken().Type != lexer.TOKEN_COMMA {
+			break
+		}
+		p.advance()
+	}
+	p.expect(lexer.TOKEN_RBRACE, "',' or '}'")
+	return &StructDecl{Span: p.span(tok.Pos), Name: name, Fields: fields}
+}
+
+// parseStructLit parses the fields of a struct literal, Name { field:
+// value, ... }, whose name has been parsed. The last field may be followed
+// by a comma.
+func (p *Parser) parseStructLit(name *IDent) *StructLit {
+	p.advance() // consume '{'
+	fields := []*FieldInit{}
+	for p.currentToken().Type != lexer.TOKEN_RBRACE {
+		field := p.parseIdent()
+		p.expect(lexer.TOKEN_COLON, "':' after field name")
+		value := p.parserExpression(1)
+		fields = append(fields, &FieldInit{Span: p.span(field.Pos()), Name: field, Value: value})
+		if p.currentToken().Type != lexer.TOKEN_COMMA {
+			break
+		}
+		p.advance()
+	}
+	p.expect(lexer.TOKEN_RBRACE, "',' or '}'")
+	return &StructLit{Span: p.span(name.Pos()), Type: name, Fields: fields}
+}
+
+// parseSelectors parses the field selectors that follow x, as in p.a.x.
+func (p *Parser) parseSelectors(x Expr) Expr {
+	for p.currentToken().Type == lexer.TOKEN_DOT {
+		p.advance()
+		field := p.parseIdent()
+		x = &FieldExpr{Span: p.span(x.Pos()), X: x, Field: field}
+	}
+	return x
+}
+
+// validEnvName reports whether name can name an environment variable: it
+// is not empty and holds no '=', NUL or newline.
+func validEnvName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "=\x00\n")
+}
+
+func (p *Parser) parserExpression(minPrec int) Expr {
+	p.enter()
+	defer p.leave()
 
 	left := p.parsePrimary()
 
@@ -354,6 +622,8 @@ func (p *Parser) parserExpression(minPrec int) Node {
 		right := p.parserExpression(prec + 1)
 
 		left = &BinaryExpr{
+			Span:     p.span(left.Pos()),
+			OpPos:    tok.Pos,
 			Left:     left,
 			Operator: op,
 			Right:    right,
@@ -363,19 +633,29 @@ func (p *Parser) parserExpression(minPrec int) Node {
 
 }
 
-func (p *Parser) parsePrimary() Node {
+func (p *Parser) parsePrimary() Expr {
+	p.enter()
+	defer p.leave()
+
 	tok := p.currentToken()
 
 	switch tok.Type {
 	case lexer.TOKEN_NUMBER:
 		return p.parseNumber()
 	case lexer.TOKEN_IDENT:
-		return p.parseIdent()
+		if p.peek().Type == lexer.TOKEN_LPAREN {
+			return p.parseCall()
+		}
+		id := p.parseIdent()
+		if p.currentToken().Type == lexer.TOKEN_LBRACE {
+			return p.parseSelectors(p.parseStructLit(id))
+		}
+		return p.parseSelectors(id)
 	case lexer.TOKEN_LPAREN:
 		p.advance()
 		expr := p.parserExpression(1)
 		if p.currentToken().Type != lexer.TOKEN_RPAREN {
-			panic(fmt.Sprintf("Expected ')', got: %v", p.currentToken()))
+			p.errorf("expected ')', got %s", describe(p.currentToken()))
 		}
 		p.advance()
 		return expr
@@ -384,20 +664,38 @@ func (p *Parser) parsePrimary() Node {
 		p.advance()
 		right := p.parsePrimary()
 		return &UnaryExpr{
+			Span:     p.span(tok.Pos),
 			Operator: op,
 			Right:    right,
 		}
 	case lexer.TOKEN_TRUE, lexer.TOKEN_FALSE:
 		val := tok.Type == lexer.TOKEN_TRUE
 		p.advance()
-		return &BoolLit{Value: val}
+		return &BoolLit{Span: p.span(tok.Pos), Value: val}
 	default:
-		panic(fmt.Sprintf("Expected number after return, got: %v", p.currentToken()))
+		p.errorf("expected expression, got %s", describe(tok))
+		return nil
 	}
 }
 
-func (p *Parser) ParseProgram() *Program {
-	prog := &Program{}
+// ParseProgram parses the whole token stream. Syntax errors are returned as
+// *Error.
+func (p *Parser) ParseProgram() (prog *Program, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			prog, err = nil, perr
+		}
+	}()
+
+	prog = &Program{}
+	if len(p.Tokens) > 0 {
+		prog.Start = p.Tokens[0].Pos
+		prog.Stop = p.endPos()
+	}
 
 	for p.pos < len(p.Tokens) {
 		tok := p.currentToken()
@@ -424,11 +722,14 @@ func (p *Parser) ParseProgram() *Program {
 			stmt := p.parseContinueStmt()
 			prog.Statements = append(prog.Statements, stmt)
 		case lexer.TOKEN_IDENT:
-			stmt := p.parseAssignmentStmt()
+			stmt := p.parseIdentStmt()
+			prog.Statements = append(prog.Statements, stmt)
+		case lexer.TOKEN_STRUCT:
+			stmt := p.parseStructDecl()
 			prog.Statements = append(prog.Statements, stmt)
 		default:
-			panic(fmt.Sprintf("Unexpected lexer.token: %v", tok))
+			p.errorf("unexpected %s", describe(tok))
 		}
 	}
-	return prog
+	return prog, nil
 }
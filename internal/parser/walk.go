@@ -0,0 +1,197 @@
+package parser
+
+import "fmt"
+
+// Visitor is called by Walk for every node. If Visit returns a non-nil
+// visitor w, Walk visits the node's children with w and then calls
+// w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses a syntax tree in depth-first order, children in source
+// order.
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		walkStmts(v, n.Statements)
+	case *ReturnStmt:
+		Walk(v, n.Value)
+	case *PrintStmt:
+		Walk(v, n.Value)
+	case *AssignmentStmt:
+		Walk(v, n.Name)
+		Walk(v, n.Value)
+	case *LetStmt:
+		Walk(v, n.Name)
+		if n.Type != nil {
+			Walk(v, n.Type)
+		}
+		Walk(v, n.Value)
+	case *WhileStmt:
+		Walk(v, n.Guard)
+		walkStmts(v, n.Body)
+	case *IfStmt:
+		Walk(v, n.Guard)
+		walkStmts(v, n.Then)
+		walkStmts(v, n.Else)
+	case *BinaryExpr:
+		Walk(v, n.Left)
+		Walk(v, n.Right)
+	case *UnaryExpr:
+		Walk(v, n.Right)
+	case *ArgExpr:
+		Walk(v, n.Index)
+	case *AllocExpr:
+		Walk(v, n.Size)
+	case *FreeStmt:
+		Walk(v, n.Value)
+	case *StructDecl:
+		Walk(v, n.Name)
+		for _, field := range n.Fields {
+			Walk(v, field)
+		}
+	case *FieldDecl:
+		Walk(v, n.Name)
+		Walk(v, n.Type)
+	case *StructLit:
+		Walk(v, n.Type)
+		for _, field := range n.Fields {
+			Walk(v, field)
+		}
+	case *FieldInit:
+		Walk(v, n.Name)
+		Walk(v, n.Value)
+	case *FieldExpr:
+		Walk(v, n.X)
+		Walk(v, n.Field)
+	case *FieldAssignStmt:
+		Walk(v, n.Target)
+		Walk(v, n.Value)
+	case *NumberLiteral, *IDent, *BoolLit, *InputExpr, *ArgcExpr, *EnvExpr, *BreakStmt, *ContinueStmt:
+	default:
+		panic(fmt.Sprintf("parser.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+func walkStmts(v Visitor, stmts []Stmt) {
+	for _, stmt := range stmts {
+		Walk(v, stmt)
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses a syntax tree like Walk, calling f for each node. The
+// children of a node are visited only if f returns true for it, and f is
+// called with nil after them.
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// Rewrite traverses a syntax tree bottom-up and replaces every node by
+// what f returns for it, after the node's children have been rewritten. A
+// replacement must fit where the node was: an Expr for an expression, a
+// Stmt for a statement, an *IDent for a name and a node of the same type
+// for a struct field or the target of a field assignment. The rewritten root is
+// returned.
+func Rewrite(node Node, f func(Node) Node) Node {
+	switch n := node.(type) {
+	case *Program:
+		n.Statements = rewriteStmts(n.Statements, f)
+	case *ReturnStmt:
+		n.Value = rewriteExpr(n.Value, f)
+	case *PrintStmt:
+		n.Value = rewriteExpr(n.Value, f)
+	case *AssignmentStmt:
+		n.Name = rewriteIdent(n.Name, f)
+		n.Value = rewriteExpr(n.Value, f)
+	case *LetStmt:
+		n.Name = rewriteIdent(n.Name, f)
+		if n.Type != nil {
+			n.Type = rewriteIdent(n.Type, f)
+		}
+		n.Value = rewriteExpr(n.Value, f)
+	case *WhileStmt:
+		n.Guard = rewriteExpr(n.Guard, f)
+		n.Body = rewriteStmts(n.Body, f)
+	case *IfStmt:
+		n.Guard = rewriteExpr(n.Guard, f)
+		n.Then = rewriteStmts(n.Then, f)
+		n.Else = rewriteStmts(n.Else, f)
+	case *BinaryExpr:
+		n.Left = rewriteExpr(n.Left, f)
+		n.Right = rewriteExpr(n.Right, f)
+	case *UnaryExpr:
+		n.Right = rewriteExpr(n.Right, f)
+	case *ArgExpr:
+		n.Index = rewriteExpr(n.Index, f)
+	case *AllocExpr:
+		n.Size = rewriteExpr(n.Size, f)
+	case *FreeStmt:
+		n.Value = rewriteExpr(n.Value, f)
+	case *StructDecl:
+		n.Name = rewriteIdent(n.Name, f)
+		for i, field := range n.Fields {
+			n.Fields[i] = rewriteAs[*FieldDecl](field, f)
+		}
+	case *FieldDecl:
+		n.Name = rewriteIdent(n.Name, f)
+		n.Type = rewriteIdent(n.Type, f)
+	case *StructLit:
+		n.Type = rewriteIdent(n.Type, f)
+		for i, field := range n.Fields {
+			n.Fields[i] = rewriteAs[*FieldInit](field, f)
+		}
+	case *FieldInit:
+		n.Name = rewriteIdent(n.Name, f)
+		n.Value = rewriteExpr(n.Value, f)
+	case *FieldExpr:
+		n.X = rewriteExpr(n.X, f)
+		n.Field = rewriteIdent(n.Field, f)
+	case *FieldAssignStmt:
+		n.Target = rewriteAs[*FieldExpr](n.Target, f)
+		n.Value = rewriteExpr(n.Value, f)
+	case *NumberLiteral, *IDent, *BoolLit, *InputExpr, *ArgcExpr, *EnvExpr, *BreakStmt, *ContinueStmt:
+	default:
+		panic(fmt.Sprintf("parser.Rewrite: unexpected node type %T", n))
+	}
+	return f(node)
+}
+
+func rewriteStmts(stmts []Stmt, f func(Node) Node) []Stmt {
+	for i, stmt := range stmts {
+		stmts[i] = rewriteAs[Stmt](stmt, f)
+	}
+	return stmts
+}
+
+func rewriteExpr(expr Expr, f func(Node) Node) Expr {
+	return rewriteAs[Expr](expr, f)
+}
+
+func rewriteIdent(id *IDent, f func(Node) Node) *IDent {
+	return rewriteAs[*IDent](id, f)
+}
+
+func rewriteAs[T Node](node T, f func(Node) Node) T {
+	replaced := Rewrite(node, f)
+	typed, ok := replaced.(T)
+	if !ok {
+		panic(fmt.Sprintf("parser.Rewrite: cannot replace %T with %T", node, replaced))
+	}
+	return typed
+}
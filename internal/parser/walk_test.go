@@ -0,0 +1,101 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	prog := parse(t, "let x: int = 1 + y; if (x < 2) { print -x; } else { break; }")
+
+	var kinds []string
+	depth := 0
+	Inspect(prog, func(n Node) bool {
+		if n == nil {
+			depth--
+			return false
+		}
+		kinds = append(kinds, fmt.Sprintf("%d:%s", depth, strings.TrimPrefix(fmt.Sprintf("%T", n), "*parser.")))
+		depth++
+		return true
+	})
+	want := "0:Program 1:LetStmt 2:IDent 2:IDent 2:BinaryExpr 3:NumberLiteral 3:IDent " +
+		"1:IfStmt 2:BinaryExpr 3:IDent 3:NumberLiteral 2:PrintStmt 3:UnaryExpr 4:IDent 2:BreakStmt"
+	if got := strings.Join(kinds, " "); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	if depth != 0 {
+		t.Errorf("f(nil) was called unevenly, depth %d", depth)
+	}
+
+	// Returning false skips the children.
+	count := 0
+	Inspect(prog, func(n Node) bool {
+		if n != nil {
+			count++
+		}
+		_, isIf := n.(*IfStmt)
+		return !isIf
+	})
+	if count != 8 {
+		t.Errorf("visited %d nodes with the if pruned, want 8", count)
+	}
+}
+
+func TestInspectStructs(t *testing.T) {
+	prog := parse(t, "struct P { x: int, } let p = P { x: 1 }; p.x = p.x;")
+
+	var kinds []string
+	Inspect(prog, func(n Node) bool {
+		if n != nil {
+			kinds = append(kinds, strings.TrimPrefix(fmt.Sprintf("%T", n), "*parser."))
+		}
+		return true
+	})
+	want := "Program StructDecl IDent FieldDecl IDent IDent LetStmt IDent StructLit IDent FieldInit IDent NumberLiteral " +
+		"FieldAssignStmt FieldExpr IDent IDent FieldExpr IDent IDent"
+	if got := strings.Join(kinds, " "); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	prog := parse(t, "let x = 1; print x + 2;")
+
+	// Rename every x and double every literal.
+	Rewrite(prog, func(n Node) Node {
+		switch n := n.(type) {
+		case *IDent:
+			if n.Name == "x" {
+				return &IDent{Span: n.Span, Name: "y"}
+			}
+		case *NumberLiteral:
+			return &BinaryExpr{Span: n.Span, OpPos: n.Pos(), Left: n, Operator: "*", Right: &NumberLiteral{Value: "2"}}
+		}
+		return n
+	})
+	let := prog.Statements[0].(*LetStmt)
+	if let.Name.Name != "y" {
+		t.Errorf("let declares %s, want y", let.Name.Name)
+	}
+	if _, ok := let.Value.(*BinaryExpr); !ok {
+		t.Errorf("let value is %T, want *BinaryExpr", let.Value)
+	}
+	sum := prog.Statements[1].(*PrintStmt).Value.(*BinaryExpr)
+	if sum.Left.(*IDent).Name != "y" || sum.Right.(*BinaryExpr).Operator != "*" {
+		t.Errorf("print was not rewritten bottom-up")
+	}
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "cannot replace *parser.NumberLiteral with *parser.BreakStmt") {
+			t.Errorf("replacing an expression by a statement: got %v", r)
+		}
+	}()
+	Rewrite(parse(t, "print 1;"), func(n Node) Node {
+		if _, ok := n.(*NumberLiteral); ok {
+			return &BreakStmt{}
+		}
+		return n
+	})
+}
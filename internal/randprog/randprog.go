@@ -0,0 +1,257 @@
+// Package randprog generates random, well-formed Bingus programs for
+// differential testing of the evaluator and the compiler backends.
+//
+// Every generated program lexes, parses and compiles, is well typed (ints and
+// bools are never mixed), always terminates and never divides by zero.
+package randprog
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+)
+
+type varType int
+
+const (
+	typeInt varType = iota
+	typeBool
+)
+
+func (t varType) String() string {
+	if t == typeBool {
+		return "bool"
+	}
+	return "int"
+}
+
+type variable struct {
+	name    string
+	typ     varType
+	mutable bool // loop counters must not be reassigned by the body
+}
+
+type generator struct {
+	r         *rand.Rand
+	sb        strings.Builder
+	indent    int
+	scope     [][]variable
+	nextVar   int
+	loopDepth int
+	stmtDepth int
+	budget    int
+}
+
+const (
+	maxStmtDepth = 3
+	maxLoopDepth = 2
+	maxExprDepth = 4
+)
+
+// Generate returns the source of a random program drawn from r.
+func Generate(r *rand.Rand) string {
+	g := &generator{r: r, scope: [][]variable{{}}, budget: 10 + r.IntN(30)}
+
+	for g.budget > 0 {
+		g.stmt()
+	}
+	g.line(fmt.Sprintf("return %s;", g.expr(typeInt, 0)))
+
+	return g.sb.String()
+}
+
+func (g *generator) line(s string) {
+	g.sb.WriteString(strings.Repeat("    ", g.indent))
+	g.sb.WriteString(s)
+	g.sb.WriteString("\n")
+}
+
+func (g *generator) pushScope() {
+	g.scope = append(g.scope, nil)
+}
+
+func (g *generator) popScope() {
+	g.scope = g.scope[:len(g.scope)-1]
+}
+
+func (g *generator) declare(typ varType, mutable bool) string {
+	g.nextVar++
+	name := fmt.Sprintf("v%d", g.nextVar)
+	top := len(g.scope) - 1
+	g.scope[top] = append(g.scope[top], variable{name: name, typ: typ, mutable: mutable})
+	return name
+}
+
+// visible returns the variables of the given type that are in scope.
+func (g *generator) visible(typ varType, mutableOnly bool) []variable {
+	var vars []variable
+	for _, s := range g.scope {
+		for _, v := range s {
+			if v.typ == typ && (v.mutable || !mutableOnly) {
+				vars = append(vars, v)
+			}
+		}
+	}
+	return vars
+}
+
+func (g *generator) randType() varType {
+	if g.r.IntN(4) == 0 {
+		return typeBool
+	}
+	return typeInt
+}
+
+func (g *generator) stmt() {
+	g.budget--
+
+	switch n := g.r.IntN(20); {
+	case n < 6:
+		typ := g.randType()
+		val := g.expr(typ, 0)
+		annot := ""
+		if g.r.IntN(3) == 0 {
+			annot = ": " + typ.String()
+		}
+		g.line(fmt.Sprintf("let %s%s = %s;", g.declare(typ, true), annot, val))
+	case n < 10:
+		typ := g.randType()
+		vars := g.visible(typ, true)
+		if len(vars) == 0 {
+			g.line(fmt.Sprintf("print %s;", g.expr(typ, 0)))
+			return
+		}
+		v := vars[g.r.IntN(len(vars))]
+		g.line(fmt.Sprintf("%s = %s;", v.name, g.expr(typ, 0)))
+	case n < 14:
+		g.line(fmt.Sprintf("print %s;", g.expr(g.randType(), 0)))
+	case n < 17 && g.stmtDepth < maxStmtDepth:
+		g.ifStmt()
+	case n < 19 && g.stmtDepth < maxStmtDepth && g.loopDepth < maxLoopDepth:
+		g.whileStmt()
+	case n == 19 && g.loopDepth > 0 && g.stmtDepth < maxStmtDepth:
+		// break and continue are only ever conditional, so that loops still
+		// make progress and code after them stays reachable.
+		jump := "break"
+		if g.r.IntN(2) == 0 {
+			jump = "continue"
+		}
+		g.line(fmt.Sprintf("if (%s) {", g.expr(typeBool, 0)))
+		g.indent++
+		g.line(jump + ";")
+		g.indent--
+		g.line("}")
+	default:
+		g.line(fmt.Sprintf("print %s;", g.expr(typeInt, 0)))
+	}
+}
+
+func (g *generator) block(n int) {
+	g.pushScope()
+	g.indent++
+	g.stmtDepth++
+	for i := 0; i < n; i++ {
+		g.stmt()
+	}
+	g.stmtDepth--
+	g.indent--
+	g.popScope()
+}
+
+func (g *generator) ifStmt() {
+	g.line(fmt.Sprintf("if (%s) {", g.expr(typeBool, 0)))
+	g.block(1 + g.r.IntN(3))
+	if g.r.IntN(2) == 0 {
+		g.line("} else {")
+		g.block(1 + g.r.IntN(3))
+	}
+	g.line("}")
+}
+
+// whileStmt emits a counted loop. The counter is incremented first so that
+// a conditional continue cannot skip it.
+func (g *generator) whileStmt() {
+	counter := g.declare(typeInt, false)
+	g.line(fmt.Sprintf("let %s = 0;", counter))
+	g.line(fmt.Sprintf("while (%s < %d) {", counter, g.r.IntN(6)))
+	g.indent++
+	g.line(fmt.Sprintf("%s = %s + 1;", counter, counter))
+	g.indent--
+	g.loopDepth++
+	g.block(1 + g.r.IntN(4))
+	g.loopDepth--
+	g.line("}")
+}
+
+func (g *generator) expr(typ varType, depth int) string {
+	if typ == typeBool {
+		return g.boolExpr(depth)
+	}
+	return g.intExpr(depth)
+}
+
+func (g *generator) intExpr(depth int) string {
+	leaf := depth >= maxExprDepth || g.r.IntN(3) == 0
+	if leaf {
+		vars := g.visible(typeInt, false)
+		if len(vars) > 0 && g.r.IntN(2) == 0 {
+			return vars[g.r.IntN(len(vars))].name
+		}
+		return g.literal()
+	}
+
+	switch g.r.IntN(8) {
+	case 0:
+		return "-" + g.operand(depth+1)
+	case 1, 2:
+		// Divisors are positive literals, so there is no division by zero
+		// and no overflowing MinInt64 / -1.
+		op := "/"
+		if g.r.IntN(2) == 0 {
+			op = "%"
+		}
+		return fmt.Sprintf("%s %s %d", g.operand(depth+1), op, 1+g.r.IntN(9))
+	default:
+		ops := []string{"+", "-", "*"}
+		op := ops[g.r.IntN(len(ops))]
+		return fmt.Sprintf("%s %s %s", g.operand(depth+1), op, g.operand(depth+1))
+	}
+}
+
+// operand returns an int expression that is safe to use as the operand of a
+// binary or unary operator.
+func (g *generator) operand(depth int) string {
+	e := g.intExpr(depth)
+	if strings.ContainsAny(e, " ") || strings.HasPrefix(e, "-") {
+		return "(" + e + ")"
+	}
+	return e
+}
+
+func (g *generator) literal() string {
+	switch g.r.IntN(10) {
+	case 0:
+		return fmt.Sprint(g.r.Int64())
+	case 1:
+		return "0"
+	default:
+		return fmt.Sprint(g.r.IntN(100))
+	}
+}
+
+func (g *generator) boolExpr(depth int) string {
+	if depth >= maxExprDepth || g.r.IntN(4) == 0 {
+		vars := g.visible(typeBool, false)
+		if len(vars) > 0 && g.r.IntN(2) == 0 {
+			return vars[g.r.IntN(len(vars))].name
+		}
+		if g.r.IntN(2) == 0 {
+			return "true"
+		}
+		return "false"
+	}
+
+	ops := []string{"<", ">", "<=", ">=", "=="}
+	op := ops[g.r.IntN(len(ops))]
+	return fmt.Sprintf("%s %s %s", g.operand(depth+1), op, g.operand(depth+1))
+}
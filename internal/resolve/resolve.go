@@ -0,0 +1,340 @@
+// Package resolve binds every variable reference in a program to the
+// declaration it refers to.
+//
+// The resolver walks the AST once, following the language's block scoping:
+// the program body is the outermost scope and every if, else and while body
+// opens a new one. Each let declares a fresh Symbol, so two variables that
+// share a name are always distinct symbols. Backends and the evaluator key
+// their storage on symbols instead of keeping their own scope stacks.
+//
+// Struct types have a namespace of their own. They are declared at the top
+// level and, like variables, must be declared before they are used. The
+// table lays out every struct and binds type names and field selectors to
+// the structs and fields they refer to.
+package resolve
+
+import (
+	"fmt"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+)
+
+// Error is a name resolution error at a position in the source.
+type Error struct {
+	Pos lexer.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// Scope is a block that variables can be declared in.
+type Scope struct {
+	Parent *Scope
+	Depth  int // 0 for the program body
+
+	names map[string]*Symbol
+	// later holds every name declared directly in this block, so that a
+	// reference to one that is not declared yet can be reported as such.
+	later map[string]*parser.IDent
+}
+
+// Symbol is a declared variable.
+type Symbol struct {
+	ID      int // index in Table.Symbols
+	Name    string
+	Decl    *parser.IDent // the name in the declaring let
+	Scope   *Scope
+	Shadows *Symbol         // the variable of an enclosing scope this one hides
+	Uses    []*parser.IDent // reads and assignments, in source order
+	Struct  *Struct         // the struct the variable holds, or nil
+}
+
+// Struct is a declared struct type. Its fields are laid out one after
+// another in words, a field of struct type taking the words of its struct.
+type Struct struct {
+	Name   string
+	Decl   *parser.StructDecl
+	Fields []*Field // in declaration order
+	Size   int      // in words
+}
+
+// Field is a field of a struct.
+type Field struct {
+	Name   string
+	Decl   *parser.FieldDecl
+	Struct *Struct // the field's struct type, or nil for int, bool and ptr
+	Offset int     // in words from the start of the struct
+}
+
+// Field returns the struct's field called name, or nil if it has none.
+func (s *Struct) Field(name string) *Field {
+	for _, f := range s.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Size returns the number of words the field takes.
+func (f *Field) Size() int {
+	if f.Struct != nil {
+		return f.Struct.Size
+	}
+	return 1
+}
+
+// Table is the result of resolving a program.
+type Table struct {
+	Symbols []*Symbol // in declaration order
+	Structs []*Struct // in declaration order
+	refs    map[*parser.IDent]*Symbol
+	structs map[*parser.IDent]*Struct
+	fields  map[*parser.FieldExpr]*Field
+}
+
+// Lookup returns the symbol an identifier declares or refers to, or nil if
+// it is not a variable of the resolved program.
+func (t *Table) Lookup(id *parser.IDent) *Symbol {
+	return t.refs[id]
+}
+
+// Struct returns the struct a type name declares or refers to, or nil if it
+// does not name a struct.
+func (t *Table) Struct(id *parser.IDent) *Struct {
+	return t.structs[id]
+}
+
+// Field returns the field a selector refers to, or nil if its operand is
+// not a struct or has no such field.
+func (t *Table) Field(x *parser.FieldExpr) *Field {
+	return t.fields[x]
+}
+
+// StructOf returns the struct type of a variable, struct literal or field
+// selector that holds a struct, or nil for any other expression.
+func (t *Table) StructOf(e parser.Expr) *Struct {
+	switch e := e.(type) {
+	case *parser.IDent:
+		if sym := t.refs[e]; sym != nil {
+			return sym.Struct
+		}
+	case *parser.StructLit:
+		return t.structs[e.Type]
+	case *parser.FieldExpr:
+		if f := t.fields[e]; f != nil {
+			return f.Struct
+		}
+	}
+	return nil
+}
+
+type resolver struct {
+	table *Table
+	scope *Scope
+
+	structs map[string]*Struct // the structs declared so far
+	// laterStructs holds every struct the program declares, so that a
+	// reference to one that is not declared yet can be reported as such.
+	laterStructs map[string]*parser.IDent
+}
+
+// errorf aborts resolution with an *Error at pos. It is recovered by
+// Resolve.
+func (r *resolver) errorf(pos lexer.Position, format string, args ...interface{}) {
+	panic(&Error{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Resolve builds the symbol table of a program. The first undefined,
+// not-yet-declared or redeclared variable or struct is returned as an
+// *Error.
+func Resolve(prog *parser.Program) (table *Table, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			resolveErr, ok := rec.(*Error)
+			if !ok {
+				panic(rec)
+			}
+			table, err = nil, resolveErr
+		}
+	}()
+
+	r := &resolver{
+		table: &Table{
+			refs:    map[*parser.IDent]*Symbol{},
+			structs: map[*parser.IDent]*Struct{},
+			fields:  map[*parser.FieldExpr]*Field{},
+		},
+		structs:      map[string]*Struct{},
+		laterStructs: map[string]*parser.IDent{},
+	}
+	for _, stmt := range prog.Statements {
+		if decl, ok := stmt.(*parser.StructDecl); ok {
+			if _, seen := r.laterStructs[decl.Name.Name]; !seen {
+				r.laterStructs[decl.Name.Name] = decl.Name
+			}
+		}
+	}
+	r.block(prog.Statements)
+	return r.table, nil
+}
+
+// block resolves a list of statements in a new scope.
+func (r *resolver) block(stmts []parser.Stmt) {
+	s := &Scope{Parent: r.scope, names: map[string]*Symbol{}, later: map[string]*parser.IDent{}}
+	if r.scope != nil {
+		s.Depth = r.scope.Depth + 1
+	}
+	for _, stmt := range stmts {
+		if let, ok := stmt.(*parser.LetStmt); ok {
+			if _, seen := s.later[let.Name.Name]; !seen {
+				s.later[let.Name.Name] = let.Name
+			}
+		}
+	}
+
+	r.scope = s
+	for _, stmt := range stmts {
+		r.stmt(stmt)
+	}
+	r.scope = s.Parent
+}
+
+func (r *resolver) declare(id *parser.IDent) *Symbol {
+	if prev, exists := r.scope.names[id.Name]; exists {
+		r.errorf(id.Pos(), "variable already declared in this scope: %s (previous declaration at %s)", id.Name, prev.Decl.Pos())
+	}
+	sym := &Symbol{
+		ID:    len(r.table.Symbols),
+		Name:  id.Name,
+		Decl:  id,
+		Scope: r.scope,
+	}
+	for s := r.scope.Parent; s != nil && sym.Shadows == nil; s = s.Parent {
+		sym.Shadows = s.names[id.Name]
+	}
+	r.table.Symbols = append(r.table.Symbols, sym)
+	r.table.refs[id] = sym
+	r.scope.names[id.Name] = sym
+	return sym
+}
+
+func (r *resolver) use(id *parser.IDent) {
+	for s := r.scope; s != nil; s = s.Parent {
+		if sym, ok := s.names[id.Name]; ok {
+			sym.Uses = append(sym.Uses, id)
+			r.table.refs[id] = sym
+			return
+		}
+	}
+	for s := r.scope; s != nil; s = s.Parent {
+		if decl, ok := s.later[id.Name]; ok {
+			r.errorf(id.Pos(), "variable %s used before its declaration at %s", id.Name, decl.Pos())
+		}
+	}
+	r.errorf(id.Pos(), "undefined variable: %s", id.Name)
+}
+
+// declareStruct declares a struct and lays out its fields.
+func (r *resolver) declareStruct(decl *parser.StructDecl) {
+	name := decl.Name.Name
+	if prev, exists := r.structs[name]; exists {
+		r.errorf(decl.Name.Pos(), "struct already declared: %s (previous declaration at %s)", name, prev.Decl.Name.Pos())
+	}
+	s := &Struct{Name: name, Decl: decl}
+	for _, fd := range decl.Fields {
+		if s.Field(fd.Name.Name) != nil {
+			r.errorf(fd.Name.Pos(), "duplicate field %s in struct %s", fd.Name.Name, name)
+		}
+		if fd.Type.Name == name {
+			r.errorf(fd.Type.Pos(), "struct %s cannot contain itself", name)
+		}
+		f := &Field{Name: fd.Name.Name, Decl: fd, Struct: r.typeName(fd.Type), Offset: s.Size}
+		s.Fields = append(s.Fields, f)
+		s.Size += f.Size()
+	}
+	r.table.Structs = append(r.table.Structs, s)
+	r.table.structs[decl.Name] = s
+	r.structs[name] = s
+}
+
+// typeName binds a type name to the struct it names and returns it. Other
+// names are left to the type checker, unless they name a struct that is
+// declared further down.
+func (r *resolver) typeName(id *parser.IDent) *Struct {
+	if s, ok := r.structs[id.Name]; ok {
+		r.table.structs[id] = s
+		return s
+	}
+	if decl, ok := r.laterStructs[id.Name]; ok {
+		r.errorf(id.Pos(), "struct %s used before its declaration at %s", id.Name, decl.Pos())
+	}
+	return nil
+}
+
+func (r *resolver) stmt(node parser.Stmt) {
+	switch n := node.(type) {
+	case *parser.LetStmt:
+		// The initializer is resolved first, so `let x = x + 1;` in a
+		// nested block reads the enclosing x.
+		r.expr(n.Value)
+		if n.Type != nil {
+			r.typeName(n.Type)
+		}
+		r.declare(n.Name).Struct = r.table.StructOf(n.Value)
+	case *parser.AssignmentStmt:
+		r.expr(n.Value)
+		r.use(n.Name)
+	case *parser.FieldAssignStmt:
+		r.expr(n.Value)
+		r.expr(n.Target)
+	case *parser.StructDecl:
+		r.declareStruct(n)
+	case *parser.PrintStmt:
+		r.expr(n.Value)
+	case *parser.FreeStmt:
+		r.expr(n.Value)
+	case *parser.ReturnStmt:
+		r.expr(n.Value)
+	case *parser.IfStmt:
+		r.expr(n.Guard)
+		r.block(n.Then)
+		r.block(n.Else)
+	case *parser.WhileStmt:
+		r.expr(n.Guard)
+		r.block(n.Body)
+	}
+}
+
+func (r *resolver) expr(node parser.Expr) {
+	switch n := node.(type) {
+	case *parser.IDent:
+		r.use(n)
+	case *parser.UnaryExpr:
+		r.expr(n.Right)
+	case *parser.ArgExpr:
+		r.expr(n.Index)
+	case *parser.AllocExpr:
+		r.expr(n.Size)
+	case *parser.BinaryExpr:
+		r.expr(n.Left)
+		r.expr(n.Right)
+	case *parser.StructLit:
+		if r.typeName(n.Type) == nil {
+			r.errorf(n.Type.Pos(), "undefined struct: %s", n.Type.Name)
+		}
+		for _, field := range n.Fields {
+			r.expr(field.Value)
+		}
+	case *parser.FieldExpr:
+		r.expr(n.X)
+		if s := r.table.StructOf(n.X); s != nil {
+			if f := s.Field(n.Field.Name); f != nil {
+				r.table.fields[n] = f
+			}
+		}
+	}
+}
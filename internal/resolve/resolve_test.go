@@ -0,0 +1,144 @@
+package resolve
+
+import (
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+)
+
+func parse(t *testing.T, src string) *parser.Program {
+	t.Helper()
+	tokens, err := lexer.Lex(src)
+	if err != nil {
+		t.Fatalf("lex: %v\n%s", err, src)
+	}
+	p := parser.Parser{Tokens: tokens}
+	prog, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, src)
+	}
+	return prog
+}
+
+func TestResolveErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"print y;", "1:7: undefined variable: y"},
+		{"if (true) { let y = 1; } print y;", "1:32: undefined variable: y"},
+		{"print y;\nlet y = 1;", "1:7: variable y used before its declaration at 2:5"},
+		{"let x = x + 1;", "1:9: variable x used before its declaration at 1:5"},
+		{"while (true) { x = 1; let x = 2; }", "1:16: variable x used before its declaration at 1:27"},
+		{"let x = 1;\nlet x = 2;", "2:5: variable already declared in this scope: x (previous declaration at 1:5)"},
+		{"let p = P {};", "1:9: undefined struct: P"},
+		{"let p = P {};\nstruct P {}", "1:9: struct P used before its declaration at 2:8"},
+		{"struct A { b: B }\nstruct B {}", "1:15: struct B used before its declaration at 2:8"},
+		{"struct A { a: A }", "1:15: struct A cannot contain itself"},
+		{"struct A { x: int, x: bool }", "1:20: duplicate field x in struct A"},
+		{"struct A {}\nstruct A {}", "2:8: struct already declared: A (previous declaration at 1:8)"},
+	}
+	for _, tt := range tests {
+		_, err := Resolve(parse(t, tt.src))
+		if err == nil {
+			t.Errorf("%q: no error, want %q", tt.src, tt.want)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestResolveBindings(t *testing.T) {
+	prog := parse(t, `
+		let x = 1;
+		if (x == 1) {
+			let x = x + 1;
+			print x;
+		}
+		x = 3;`)
+	syms, err := Resolve(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(syms.Symbols) != 2 {
+		t.Fatalf("got %d symbols, want 2", len(syms.Symbols))
+	}
+	outer, inner := syms.Symbols[0], syms.Symbols[1]
+
+	if outer.Scope.Depth != 0 || inner.Scope.Depth != 1 || inner.Scope.Parent != outer.Scope {
+		t.Errorf("got scope depths %d and %d, want 0 and 1 with the outer scope as parent", outer.Scope.Depth, inner.Scope.Depth)
+	}
+	if inner.Shadows != outer || outer.Shadows != nil {
+		t.Errorf("inner x should shadow outer x and nothing else")
+	}
+
+	ifStmt := prog.Statements[1].(*parser.IfStmt)
+	guard := ifStmt.Guard.(*parser.BinaryExpr).Left.(*parser.IDent)
+	let := ifStmt.Then[0].(*parser.LetStmt)
+	init := let.Value.(*parser.BinaryExpr).Left.(*parser.IDent)
+	printed := ifStmt.Then[1].(*parser.PrintStmt).Value.(*parser.IDent)
+	assigned := prog.Statements[2].(*parser.AssignmentStmt).Name
+
+	for _, tt := range []struct {
+		id   *parser.IDent
+		want *Symbol
+	}{
+		{guard, outer},
+		{init, outer}, // the initializer runs before the inner x exists
+		{let.Name, inner},
+		{printed, inner},
+		{assigned, outer},
+	} {
+		if got := syms.Lookup(tt.id); got != tt.want {
+			t.Errorf("%s at %s bound to symbol %v, want %d", tt.id.Name, tt.id.Pos(), got, tt.want.ID)
+		}
+	}
+	if len(outer.Uses) != 3 || len(inner.Uses) != 1 {
+		t.Errorf("got %d and %d uses, want 3 and 1", len(outer.Uses), len(inner.Uses))
+	}
+}
+
+func TestResolveStructs(t *testing.T) {
+	prog := parse(t, `
+		struct Point { x: int, y: int }
+		struct Line { from: Point, to: Point, visible: bool }
+		let l = Line { from: Point { x: 1, y: 2 }, to: Point { x: 3, y: 4 }, visible: true };
+		print l.to.y;`)
+	syms, err := Resolve(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(syms.Structs) != 2 {
+		t.Fatalf("got %d structs, want 2", len(syms.Structs))
+	}
+	point, line := syms.Structs[0], syms.Structs[1]
+	if point.Size != 2 || line.Size != 5 {
+		t.Errorf("got sizes %d and %d, want 2 and 5", point.Size, line.Size)
+	}
+	for _, tt := range []struct {
+		name   string
+		offset int
+		typ    *Struct
+	}{
+		{"from", 0, point},
+		{"to", 2, point},
+		{"visible", 4, nil},
+	} {
+		if f := line.Field(tt.name); f == nil || f.Offset != tt.offset || f.Struct != tt.typ {
+			t.Errorf("field %s: got %+v, want offset %d", tt.name, f, tt.offset)
+		}
+	}
+
+	if sym := syms.Symbols[0]; sym.Struct != line {
+		t.Errorf("l holds %v, want Line", sym.Struct)
+	}
+	y := prog.Statements[3].(*parser.PrintStmt).Value.(*parser.FieldExpr)
+	if f := syms.Field(y); f != point.Field("y") {
+		t.Errorf("l.to.y selects %+v, want Point.y", f)
+	}
+	if s := syms.StructOf(y.X); s != point {
+		t.Errorf("l.to holds %v, want Point", s)
+	}
+}
@@ -0,0 +1,327 @@
+// Package types implements the static type checker.
+//
+// Bingus has three built-in types: int, bool and ptr, a pointer to a heap
+// block. Literals, operators and variables each have exactly one type; a
+// let without an annotation takes the type of its initializer. Conditions
+// must be bool and the program's exit code must be an int. Pointers only
+// come from alloc and can only be compared, stored in variables and freed.
+//
+// Programs can declare struct types. A struct literal gives every field a
+// value of the field's type. Struct values can be stored in variables and
+// fields and copied as a whole, and their fields read and assigned, but
+// they cannot be printed, compared or returned.
+package types
+
+import (
+	"fmt"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+// Type is the static type of an expression or variable: a Basic type or a
+// *Struct. Types can be compared with ==.
+type Type interface {
+	String() string
+	isType()
+}
+
+// Basic is a built-in type.
+type Basic int
+
+const (
+	Int Basic = iota
+	Bool
+	Ptr
+)
+
+func (t Basic) String() string {
+	switch t {
+	case Int:
+		return "int"
+	case Bool:
+		return "bool"
+	case Ptr:
+		return "ptr"
+	}
+	return fmt.Sprintf("type(%d)", int(t))
+}
+
+// Struct is a struct type declared by the program.
+type Struct struct {
+	Decl   *resolve.Struct
+	Fields []Type // the types of Decl.Fields
+}
+
+func (s *Struct) String() string {
+	return s.Decl.Name
+}
+
+// Field returns the type of the field called name, or nil if there is no
+// such field.
+func (s *Struct) Field(name string) Type {
+	for i, f := range s.Decl.Fields {
+		if f.Name == name {
+			return s.Fields[i]
+		}
+	}
+	return nil
+}
+
+func (Basic) isType()   {}
+func (*Struct) isType() {}
+
+// byName maps the built-in type names to their types.
+var byName = map[string]Basic{
+	"int":  Int,
+	"bool": Bool,
+	"ptr":  Ptr,
+}
+
+// Error is a type error at a position in the source.
+type Error struct {
+	Pos lexer.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+type checker struct {
+	syms    *resolve.Table
+	types   map[*resolve.Symbol]Type
+	structs map[*resolve.Struct]*Struct
+}
+
+// errorf aborts checking with an *Error at pos. It is recovered by Check.
+func (c *checker) errorf(pos lexer.Position, format string, args ...interface{}) {
+	panic(&Error{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// symbol returns the variable an identifier refers to.
+func (c *checker) symbol(id *parser.IDent) *resolve.Symbol {
+	sym := c.syms.Lookup(id)
+	if sym == nil {
+		c.errorf(id.Pos(), "unresolved identifier: %s", id.Name)
+	}
+	return sym
+}
+
+// Check type-checks a program whose names have been resolved into syms.
+// The first error found is returned as an *Error.
+func Check(prog *parser.Program, syms *resolve.Table) error {
+	_, err := Infer(prog, syms)
+	return err
+}
+
+// Infer type-checks a program like Check and also returns the type of every
+// variable. After an error it returns the types found before it.
+func Infer(prog *parser.Program, syms *resolve.Table) (vars map[*resolve.Symbol]Type, err error) {
+	c := &checker{syms: syms, types: map[*resolve.Symbol]Type{}, structs: map[*resolve.Struct]*Struct{}}
+	defer func() {
+		if r := recover(); r != nil {
+			typeErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			vars, err = c.types, typeErr
+		}
+	}()
+
+	c.checkStmts(prog.Statements)
+	return c.types, nil
+}
+
+func (c *checker) checkStmts(stmts []parser.Stmt) {
+	for _, stmt := range stmts {
+		c.checkStmt(stmt)
+	}
+}
+
+func (c *checker) checkStmt(node parser.Stmt) {
+	switch n := node.(type) {
+	case *parser.LetStmt:
+		t := c.checkExpr(n.Value)
+		if n.Type != nil {
+			if declared := c.typeNamed(n.Type); t != declared {
+				c.errorf(n.Value.Pos(), "cannot use %s value to initialize %s of type %s", t, n.Name.Name, declared)
+			}
+		}
+		c.types[c.symbol(n.Name)] = t
+
+	case *parser.AssignmentStmt:
+		want := c.types[c.symbol(n.Name)]
+		if t := c.checkExpr(n.Value); t != want {
+			c.errorf(n.Value.Pos(), "cannot assign %s value to %s of type %s", t, n.Name.Name, want)
+		}
+
+	case *parser.FieldAssignStmt:
+		want := c.checkExpr(n.Target)
+		if t := c.checkExpr(n.Value); t != want {
+			c.errorf(n.Value.Pos(), "cannot assign %s value to field %s of type %s", t, n.Target.Field.Name, want)
+		}
+
+	case *parser.PrintStmt:
+		if t := c.checkExpr(n.Value); t != Int && t != Bool {
+			c.errorf(n.Value.Pos(), "cannot print %s value", t)
+		}
+
+	case *parser.FreeStmt:
+		c.expect(n.Value, Ptr, "freed value")
+
+	case *parser.ReturnStmt:
+		c.expect(n.Value, Int, "return value")
+
+	case *parser.IfStmt:
+		c.expect(n.Guard, Bool, "if condition")
+		c.checkStmts(n.Then)
+		c.checkStmts(n.Else)
+
+	case *parser.WhileStmt:
+		c.expect(n.Guard, Bool, "while condition")
+		c.checkStmts(n.Body)
+
+	case *parser.StructDecl:
+		if _, ok := byName[n.Name.Name]; ok {
+			c.errorf(n.Name.Pos(), "cannot declare struct %s: it is a built-in type", n.Name.Name)
+		}
+		c.structType(c.syms.Struct(n.Name))
+
+	case *parser.BreakStmt, *parser.ContinueStmt:
+	}
+}
+
+// typeNamed returns the type a type name stands for.
+func (c *checker) typeNamed(id *parser.IDent) Type {
+	if t, ok := byName[id.Name]; ok {
+		return t
+	}
+	if s := c.syms.Struct(id); s != nil {
+		return c.structType(s)
+	}
+	c.errorf(id.Pos(), "unknown type %s", id.Name)
+	return nil
+}
+
+// structType returns the type of a declared struct. A struct's fields only
+// use structs declared before it, so building the type terminates.
+func (c *checker) structType(s *resolve.Struct) *Struct {
+	if t, ok := c.structs[s]; ok {
+		return t
+	}
+	t := &Struct{Decl: s}
+	for _, f := range s.Fields {
+		t.Fields = append(t.Fields, c.typeNamed(f.Decl.Type))
+	}
+	c.structs[s] = t
+	return t
+}
+
+// checkStructLit checks that a struct literal gives each field of its
+// struct exactly one value of the field's type.
+func (c *checker) checkStructLit(n *parser.StructLit) Type {
+	s := c.syms.Struct(n.Type)
+	if s == nil {
+		c.errorf(n.Type.Pos(), "undefined struct: %s", n.Type.Name)
+	}
+	t := c.structType(s)
+	seen := map[string]bool{}
+	for _, field := range n.Fields {
+		name := field.Name.Name
+		want := t.Field(name)
+		if want == nil {
+			c.errorf(field.Name.Pos(), "%s has no field %s", t, name)
+		}
+		if seen[name] {
+			c.errorf(field.Name.Pos(), "duplicate field %s in %s literal", name, t)
+		}
+		seen[name] = true
+		if got := c.checkExpr(field.Value); got != want {
+			c.errorf(field.Value.Pos(), "cannot use %s value as field %s of type %s", got, name, want)
+		}
+	}
+	for _, f := range s.Fields {
+		if !seen[f.Name] {
+			c.errorf(n.Pos(), "missing field %s in %s literal", f.Name, t)
+		}
+	}
+	return t
+}
+
+// expect checks that an expression has type want.
+func (c *checker) expect(node parser.Expr, want Type, what string) {
+	if t := c.checkExpr(node); t != want {
+		c.errorf(node.Pos(), "%s must be %s, got %s", what, want, t)
+	}
+}
+
+func (c *checker) checkExpr(node parser.Expr) Type {
+	switch n := node.(type) {
+	case *parser.NumberLiteral:
+		return Int
+
+	case *parser.BoolLit:
+		return Bool
+
+	case *parser.InputExpr, *parser.ArgcExpr, *parser.EnvExpr:
+		return Int
+
+	case *parser.ArgExpr:
+		c.expect(n.Index, Int, "argument index")
+		return Int
+
+	case *parser.AllocExpr:
+		c.expect(n.Size, Int, "allocation size")
+		return Ptr
+
+	case *parser.IDent:
+		return c.types[c.symbol(n)]
+
+	case *parser.StructLit:
+		return c.checkStructLit(n)
+
+	case *parser.FieldExpr:
+		t := c.checkExpr(n.X)
+		s, ok := t.(*Struct)
+		if !ok || s.Field(n.Field.Name) == nil {
+			c.errorf(n.Field.Pos(), "%s has no field %s", t, n.Field.Name)
+		}
+		return s.Field(n.Field.Name)
+
+	case *parser.UnaryExpr:
+		if t := c.checkExpr(n.Right); t != Int {
+			c.errorf(n.Pos(), "operator %s expects an int operand, got %s", n.Operator, t)
+		}
+		return Int
+
+	case *parser.BinaryExpr:
+		left := c.checkExpr(n.Left)
+		right := c.checkExpr(n.Right)
+		switch n.Operator {
+		case "==":
+			if left != right {
+				c.errorf(n.OpPos, "cannot compare %s with %s", left, right)
+			}
+			if _, ok := left.(*Struct); ok {
+				c.errorf(n.OpPos, "cannot compare %s values", left)
+			}
+			return Bool
+		case "<", ">", "<=", ">=":
+			c.intOperands(n, left, right)
+			return Bool
+		default:
+			c.intOperands(n, left, right)
+			return Int
+		}
+	}
+	c.errorf(node.Pos(), "unsupported expression: %T", node)
+	return Int
+}
+
+func (c *checker) intOperands(n *parser.BinaryExpr, left, right Type) {
+	if left != Int || right != Int {
+		c.errorf(n.OpPos, "operator %s expects int operands, got %s and %s", n.Operator, left, right)
+	}
+}
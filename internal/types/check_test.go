@@ -0,0 +1,107 @@
+package types
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/randprog"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+// parse parses a program and resolves its names.
+func parse(t *testing.T, src string) (*parser.Program, *resolve.Table) {
+	t.Helper()
+	tokens, err := lexer.Lex(src)
+	if err != nil {
+		t.Fatalf("lex: %v\n%s", err, src)
+	}
+	p := parser.Parser{Tokens: tokens}
+	prog, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, src)
+	}
+	syms, err := resolve.Resolve(prog)
+	if err != nil {
+		t.Fatalf("resolve: %v\n%s", err, src)
+	}
+	return prog, syms
+}
+
+func TestCheckErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"if (5) {}", "1:5: if condition must be bool, got int"},
+		{"let b = true + 3;", "1:14: operator + expects int operands, got bool and int"},
+		{"while (1 + 1) {}", "1:8: while condition must be bool, got int"},
+		{"let x: int = true;", "1:14: cannot use bool value to initialize x of type int"},
+		{"let x: float = 1;", "1:8: unknown type float"},
+		{"let x = 1 < 2;\nx = 3;", "2:5: cannot assign int value to x of type bool"},
+		{"return 1 == true;", "1:10: cannot compare int with bool"},
+		{"return 1 < 2;", "1:8: return value must be int, got bool"},
+		{"let b = false; print -b;", "1:22: operator - expects an int operand, got bool"},
+		{"let p = alloc(true);", "1:15: allocation size must be int, got bool"},
+		{"let p = alloc(8);\nprint p + 1;", "2:9: operator + expects int operands, got ptr and int"},
+		{"print alloc(8);", "1:7: cannot print ptr value"},
+		{"free(1);", "1:6: freed value must be ptr, got int"},
+		{"let p: int = alloc(1);", "1:14: cannot use ptr value to initialize p of type int"},
+		{"struct P { x: float }", "1:15: unknown type float"},
+		{"struct int {}", "1:8: cannot declare struct int: it is a built-in type"},
+		{"struct P { x: int }\nlet p = P { x: true };", "2:16: cannot use bool value as field x of type int"},
+		{"struct P { x: int }\nlet p = P { y: 1 };", "2:13: P has no field y"},
+		{"struct P { x: int }\nlet p = P { x: 1, x: 2 };", "2:19: duplicate field x in P literal"},
+		{"struct P { x: int, y: int }\nlet p = P { x: 1 };", "2:9: missing field y in P literal"},
+		{"struct P { x: int }\nlet p = P { x: 1 };\nprint p.y;", "3:9: P has no field y"},
+		{"let x = 1;\nprint x.y;", "2:9: int has no field y"},
+		{"struct P { b: bool }\nlet p = P { b: true };\np.b = 1;", "3:7: cannot assign int value to field b of type bool"},
+		{"struct P {}\nstruct Q {}\nlet p: P = Q {};", "3:12: cannot use Q value to initialize p of type P"},
+		{"struct P {}\nprint P {};", "2:7: cannot print P value"},
+		{"struct P {}\nprint P {} == P {};", "2:12: cannot compare P values"},
+		{"struct P {}\nreturn P {};", "2:8: return value must be int, got P"},
+	}
+	for _, tt := range tests {
+		err := Check(parse(t, tt.src))
+		if err == nil {
+			t.Errorf("%q: no error, want %q", tt.src, tt.want)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestCheckAccepts(t *testing.T) {
+	src := `
+		let x: int = 1;
+		let done: bool = false;
+		let b = x < 2;
+		while (done == false) {
+			let x = x + 1;
+			done = x >= 2;
+		}
+		if (b == true) { print b; }
+		let p: ptr = alloc(x * 8);
+		if (p == p) { free(p); }
+		struct Point { x: int, y: int }
+		struct Box { at: Point, data: ptr }
+		let box: Box = Box { data: alloc(8), at: Point { x: 1, y: x } };
+		box.at.y = box.at.x + 1;
+		box.at = Point { x: 0, y: 0 };
+		let q: Point = box.at;
+		free(box.data);
+		return q.y;`
+	if err := Check(parse(t, src)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewPCG(6, 6))
+	for i := 0; i < 200; i++ {
+		src := randprog.Generate(r)
+		if err := Check(parse(t, src)); err != nil {
+			t.Fatalf("%v\n%s", err, src)
+		}
+	}
+}
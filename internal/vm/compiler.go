@@ -0,0 +1,414 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+// Error is a compile-time or runtime error in the VM.
+type Error struct {
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+type loop struct {
+	start  int   // address of the loop guard
+	breaks []int // operand addresses of jumps to patch with the loop end
+}
+
+type compiler struct {
+	chunk     *Chunk
+	constIdx  map[int64]int
+	nameIdx   map[string]int
+	syms      *resolve.Table
+	slots     map[*resolve.Symbol]int
+	slotMark  []int
+	nextSlot  int
+	loopStack []*loop
+}
+
+func newCompiler(syms *resolve.Table) *compiler {
+	return &compiler{
+		chunk:    &Chunk{},
+		constIdx: map[int64]int{},
+		nameIdx:  map[string]int{},
+		syms:     syms,
+		slots:    map[*resolve.Symbol]int{},
+	}
+}
+
+func (c *compiler) errorf(format string, args ...interface{}) {
+	panic(&Error{Msg: fmt.Sprintf(format, args...)})
+}
+
+// Compile translates a program whose names have been resolved into syms to
+// bytecode. Semantic errors such as a break outside a loop are returned as
+// *Error.
+func Compile(prog *parser.Program, syms *resolve.Table) (chunk *Chunk, err error) {
+	c := newCompiler(syms)
+
+	defer func() {
+		if r := recover(); r != nil {
+			vmErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			chunk, err = nil, vmErr
+		}
+	}()
+
+	for _, stmt := range prog.Statements {
+		c.compileStmt(stmt)
+	}
+
+	// Running off the end exits with status 0, like the native backend.
+	c.emitConst(0)
+	c.emit(OpHalt)
+
+	return c.chunk, nil
+}
+
+func (c *compiler) emit(op Op) {
+	c.chunk.Code = append(c.chunk.Code, byte(op))
+}
+
+func (c *compiler) emitU16(op Op, operand int) {
+	if operand > math.MaxUint16 {
+		c.errorf("operand %d of %s out of range", operand, op)
+	}
+	c.emit(op)
+	c.chunk.Code = binary.BigEndian.AppendUint16(c.chunk.Code, uint16(operand))
+}
+
+// emitJump emits a jump to target and returns the address of its operand
+// so that forward jumps can be patched once the target is known.
+func (c *compiler) emitJump(op Op, target int) int {
+	c.emit(op)
+	at := len(c.chunk.Code)
+	c.chunk.Code = binary.BigEndian.AppendUint32(c.chunk.Code, uint32(target))
+	return at
+}
+
+func (c *compiler) patchJump(at int) {
+	binary.BigEndian.PutUint32(c.chunk.Code[at:], uint32(len(c.chunk.Code)))
+}
+
+func (c *compiler) emitConst(val int64) {
+	idx, ok := c.constIdx[val]
+	if !ok {
+		idx = len(c.chunk.Consts)
+		c.chunk.Consts = append(c.chunk.Consts, val)
+		c.constIdx[val] = idx
+	}
+	c.emitU16(OpConst, idx)
+}
+
+func (c *compiler) emitEnv(name string) {
+	idx, ok := c.nameIdx[name]
+	if !ok {
+		idx = len(c.chunk.Names)
+		c.chunk.Names = append(c.chunk.Names, name)
+		c.nameIdx[name] = idx
+	}
+	c.emitU16(OpEnv, idx)
+}
+
+func (c *compiler) pushScope() {
+	c.slotMark = append(c.slotMark, c.nextSlot)
+}
+
+// popScope frees the slots of the innermost scope for reuse.
+func (c *compiler) popScope() {
+	c.nextSlot = c.slotMark[len(c.slotMark)-1]
+	c.slotMark = c.slotMark[:len(c.slotMark)-1]
+}
+
+func (c *compiler) symbol(id *parser.IDent) *resolve.Symbol {
+	sym := c.syms.Lookup(id)
+	if sym == nil {
+		c.errorf("unresolved identifier: %s", id.Name)
+	}
+	return sym
+}
+
+// reserve takes the next n free slots and returns the first.
+func (c *compiler) reserve(n int) int {
+	slot := c.nextSlot
+	c.nextSlot += n
+	if c.nextSlot > c.chunk.NumSlots {
+		c.chunk.NumSlots = c.nextSlot
+	}
+	return slot
+}
+
+// declareVar gives the variable a let declares the next free slot, or a
+// slot for each word of a struct.
+func (c *compiler) declareVar(id *parser.IDent) int {
+	sym := c.symbol(id)
+	size := 1
+	if sym.Struct != nil {
+		size = sym.Struct.Size
+	}
+	slot := c.reserve(size)
+	c.slots[sym] = slot
+	return slot
+}
+
+func (c *compiler) lookupVar(id *parser.IDent) int {
+	return c.slots[c.symbol(id)]
+}
+
+func (c *compiler) compileBlock(stmts []parser.Stmt) {
+	c.pushScope()
+	for _, stmt := range stmts {
+		c.compileStmt(stmt)
+	}
+	c.popScope()
+}
+
+func (c *compiler) compileStmt(node parser.Stmt) {
+	switch n := node.(type) {
+	case *parser.ReturnStmt:
+		c.compileExpr(n.Value)
+		c.emit(OpHalt)
+
+	case *parser.LetStmt:
+		if s := c.syms.StructOf(n.Value); s != nil {
+			c.compileStruct(n.Value)
+			c.storeWords(c.declareVar(n.Name), s.Size)
+		} else {
+			c.compileExpr(n.Value)
+			c.emitU16(OpStore, c.declareVar(n.Name))
+		}
+
+	case *parser.AssignmentStmt:
+		if s := c.symbol(n.Name).Struct; s != nil {
+			c.compileStruct(n.Value)
+			c.storeWords(c.lookupVar(n.Name), s.Size)
+		} else {
+			c.compileExpr(n.Value)
+			c.emitU16(OpStore, c.lookupVar(n.Name))
+		}
+
+	case *parser.FieldAssignStmt:
+		f := c.field(n.Target)
+		if f.Struct != nil {
+			c.compileStruct(n.Value)
+			c.storeWords(c.structSlot(n.Target.X)+f.Offset, f.Struct.Size)
+		} else {
+			c.compileExpr(n.Value)
+			c.emitU16(OpStore, c.structSlot(n.Target.X)+f.Offset)
+		}
+
+	case *parser.StructDecl:
+		// Structs are laid out by the resolver.
+
+	case *parser.PrintStmt:
+		c.compileExpr(n.Value)
+		c.emit(OpPrint)
+
+	case *parser.FreeStmt:
+		c.compileExpr(n.Value)
+		c.emit(OpFree)
+
+	case *parser.IfStmt:
+		c.compileExpr(n.Guard)
+		elseJump := c.emitJump(OpJumpIfFalse, 0)
+
+		c.compileBlock(n.Then)
+
+		if len(n.Else) > 0 {
+			endJump := c.emitJump(OpJump, 0)
+			c.patchJump(elseJump)
+			c.compileBlock(n.Else)
+			c.patchJump(endJump)
+		} else {
+			c.patchJump(elseJump)
+		}
+
+	case *parser.WhileStmt:
+		l := &loop{start: len(c.chunk.Code)}
+		c.loopStack = append(c.loopStack, l)
+
+		c.compileExpr(n.Guard)
+		exitJump := c.emitJump(OpJumpIfFalse, 0)
+
+		c.compileBlock(n.Body)
+		c.emitJump(OpJump, l.start)
+
+		c.patchJump(exitJump)
+		for _, at := range l.breaks {
+			c.patchJump(at)
+		}
+		c.loopStack = c.loopStack[:len(c.loopStack)-1]
+
+	case *parser.BreakStmt:
+		if len(c.loopStack) == 0 {
+			c.errorf("break statement not inside loop")
+		}
+		l := c.loopStack[len(c.loopStack)-1]
+		l.breaks = append(l.breaks, c.emitJump(OpJump, 0))
+
+	case *parser.ContinueStmt:
+		if len(c.loopStack) == 0 {
+			c.errorf("continue statement not inside loop")
+		}
+		c.emitJump(OpJump, c.loopStack[len(c.loopStack)-1].start)
+
+	default:
+		c.errorf("unsupported statement: %T", n)
+	}
+}
+
+var binaryOps = map[string]Op{
+	"+":  OpAdd,
+	"-":  OpSub,
+	"*":  OpMul,
+	"/":  OpDiv,
+	"%":  OpMod,
+	"<":  OpLess,
+	">":  OpGreater,
+	"<=": OpLessEq,
+	">=": OpGreaterEq,
+	"==": OpEqual,
+}
+
+func (c *compiler) compileExpr(node parser.Expr) {
+	switch n := node.(type) {
+	case *parser.NumberLiteral:
+		val, err := strconv.ParseInt(n.Value, 10, 64)
+		if err != nil {
+			c.errorf("invalid integer literal: %s", n.Value)
+		}
+		c.emitConst(val)
+
+	case *parser.BoolLit:
+		if n.Value {
+			c.emitConst(1)
+		} else {
+			c.emitConst(0)
+		}
+
+	case *parser.IDent:
+		c.emitU16(OpLoad, c.lookupVar(n))
+
+	case *parser.InputExpr:
+		c.emit(OpInput)
+
+	case *parser.ArgcExpr:
+		c.emit(OpArgc)
+
+	case *parser.ArgExpr:
+		c.compileExpr(n.Index)
+		c.emit(OpArg)
+
+	case *parser.EnvExpr:
+		c.emitEnv(n.Name)
+
+	case *parser.FieldExpr:
+		mark := c.nextSlot
+		c.emitU16(OpLoad, c.structSlot(n.X)+c.field(n).Offset)
+		c.nextSlot = mark
+
+	case *parser.AllocExpr:
+		c.compileExpr(n.Size)
+		c.emit(OpAlloc)
+
+	case *parser.UnaryExpr:
+		c.compileExpr(n.Right)
+		switch n.Operator {
+		case "+":
+		case "-":
+			c.emit(OpNeg)
+		default:
+			c.errorf("unknown unary operator %s", n.Operator)
+		}
+
+	case *parser.BinaryExpr:
+		op, ok := binaryOps[n.Operator]
+		if !ok {
+			c.errorf("unknown operator %s", n.Operator)
+		}
+		c.compileExpr(n.Left)
+		c.compileExpr(n.Right)
+		c.emit(op)
+
+	default:
+		c.errorf("unsupported expression: %T", n)
+	}
+}
+
+// compileStruct pushes the words of a struct value in order.
+func (c *compiler) compileStruct(node parser.Expr) {
+	s := c.syms.StructOf(node)
+	if s == nil {
+		c.errorf("unsupported struct expression: %T", node)
+	}
+	mark := c.nextSlot
+	slot := c.structSlot(node)
+	for i := 0; i < s.Size; i++ {
+		c.emitU16(OpLoad, slot+i)
+	}
+	c.nextSlot = mark
+}
+
+// storeWords pops the n words of a struct value into the slots from slot
+// on.
+func (c *compiler) storeWords(slot, n int) {
+	for i := n - 1; i >= 0; i-- {
+		c.emitU16(OpStore, slot+i)
+	}
+}
+
+// structSlot returns the first of the consecutive slots that hold the
+// words of a struct value. A struct literal is built in slots reserved
+// past the variables, which the caller frees once it has read them.
+func (c *compiler) structSlot(node parser.Expr) int {
+	switch n := node.(type) {
+	case *parser.IDent:
+		return c.lookupVar(n)
+
+	case *parser.FieldExpr:
+		return c.structSlot(n.X) + c.field(n).Offset
+
+	case *parser.StructLit:
+		s := c.syms.Struct(n.Type)
+		if s == nil {
+			c.errorf("undefined struct: %s", n.Type.Name)
+		}
+		slot := c.reserve(s.Size)
+		for _, init := range n.Fields {
+			f := s.Field(init.Name.Name)
+			if f == nil {
+				c.errorf("unknown field %s of %s", init.Name.Name, s.Name)
+			}
+			if f.Struct != nil {
+				c.compileStruct(init.Value)
+				c.storeWords(slot+f.Offset, f.Struct.Size)
+			} else {
+				c.compileExpr(init.Value)
+				c.emitU16(OpStore, slot+f.Offset)
+			}
+		}
+		return slot
+	}
+	c.errorf("unsupported struct expression: %T", node)
+	return 0
+}
+
+// field returns the field a selector refers to.
+func (c *compiler) field(x *parser.FieldExpr) *resolve.Field {
+	f := c.syms.Field(x)
+	if f == nil {
+		c.errorf("unresolved field: %s", x.Field.Name)
+	}
+	return f
+}
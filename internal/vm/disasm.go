@@ -0,0 +1,39 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+)
+
+// Disassemble writes a human-readable listing of the chunk to w, one
+// instruction per line prefixed with its address.
+func Disassemble(w io.Writer, c *Chunk) {
+	fmt.Fprintf(w, "; %d bytes, %d constants, %d slots\n", len(c.Code), len(c.Consts), c.NumSlots)
+
+	for ip := 0; ip < len(c.Code); {
+		op := Op(c.Code[ip])
+		info, ok := opTable[op]
+		if !ok || ip+1+info.operand > len(c.Code) {
+			fmt.Fprintf(w, "%04d  <bad opcode %d>\n", ip, op)
+			return
+		}
+
+		switch info.operand {
+		case 0:
+			fmt.Fprintf(w, "%04d  %s\n", ip, info.name)
+		case 2:
+			operand := readU16(c.Code, ip+1)
+			switch {
+			case op == OpConst && operand < len(c.Consts):
+				fmt.Fprintf(w, "%04d  %-14s %d\t; %d\n", ip, info.name, operand, c.Consts[operand])
+			case op == OpEnv && operand < len(c.Names):
+				fmt.Fprintf(w, "%04d  %-14s %d\t; %s\n", ip, info.name, operand, c.Names[operand])
+			default:
+				fmt.Fprintf(w, "%04d  %-14s %d\n", ip, info.name, operand)
+			}
+		case 4:
+			fmt.Fprintf(w, "%04d  %-14s %04d\n", ip, info.name, readU32(c.Code, ip+1))
+		}
+		ip += 1 + info.operand
+	}
+}
@@ -0,0 +1,117 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// A .bngc file stores a Chunk. All integers are big-endian:
+//
+//	magic     [4]byte "BNGC"
+//	version   u16
+//	reserved  u16
+//	numSlots  u32
+//	numConsts u32
+//	consts    [numConsts]i64
+//	numNames  u32
+//	names     [numNames]{len u32, bytes [len]byte}
+//	codeLen   u32
+//	code      [codeLen]byte
+//	checksum  u32, CRC-32 (IEEE) of everything before it
+const (
+	FileExtension = ".bngc"
+	FormatVersion = 2
+)
+
+var magic = [4]byte{'B', 'N', 'G', 'C'}
+
+const headerSize = 4 + 2 + 2 + 4 + 4
+
+// Encode serializes a chunk in the .bngc format.
+func Encode(c *Chunk) []byte {
+	var buf bytes.Buffer
+	buf.Write(magic[:])
+	binary.Write(&buf, binary.BigEndian, uint16(FormatVersion))
+	binary.Write(&buf, binary.BigEndian, uint16(0))
+	binary.Write(&buf, binary.BigEndian, uint32(c.NumSlots))
+	binary.Write(&buf, binary.BigEndian, uint32(len(c.Consts)))
+	binary.Write(&buf, binary.BigEndian, c.Consts)
+	binary.Write(&buf, binary.BigEndian, uint32(len(c.Names)))
+	for _, name := range c.Names {
+		binary.Write(&buf, binary.BigEndian, uint32(len(name)))
+		buf.WriteString(name)
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(len(c.Code)))
+	buf.Write(c.Code)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// Decode parses and verifies a .bngc file. Files that are truncated,
+// corrupt, from another format version or contain invalid bytecode are
+// rejected with an *Error.
+func Decode(data []byte) (*Chunk, error) {
+	if len(data) < len(magic) || !bytes.Equal(data[:len(magic)], magic[:]) {
+		return nil, &Error{Msg: "not a bingus bytecode file (bad magic number)"}
+	}
+	if len(data) < headerSize+4 {
+		return nil, &Error{Msg: "bytecode file is truncated"}
+	}
+
+	version := binary.BigEndian.Uint16(data[4:])
+	if version != FormatVersion {
+		return nil, &Error{Msg: fmt.Sprintf("bytecode format version %d is not supported (expected %d)", version, FormatVersion)}
+	}
+
+	truncated := &Error{Msg: "bytecode file is truncated"}
+	r := bytes.NewReader(data[8:])
+	var numSlots, numConsts, codeLen uint32
+
+	binary.Read(r, binary.BigEndian, &numSlots)
+	binary.Read(r, binary.BigEndian, &numConsts)
+	if uint64(numConsts)*8+4 > uint64(r.Len()) {
+		return nil, truncated
+	}
+	consts := make([]int64, numConsts)
+	binary.Read(r, binary.BigEndian, consts)
+
+	var numNames uint32
+	binary.Read(r, binary.BigEndian, &numNames)
+	var names []string
+	for range numNames {
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil || uint64(n)+4 > uint64(r.Len()) {
+			return nil, truncated
+		}
+		name := make([]byte, n)
+		r.Read(name)
+		names = append(names, string(name))
+	}
+
+	if r.Len() < 4 {
+		return nil, truncated
+	}
+	binary.Read(r, binary.BigEndian, &codeLen)
+	switch {
+	case uint64(codeLen)+4 > uint64(r.Len()):
+		return nil, truncated
+	case uint64(codeLen)+4 < uint64(r.Len()):
+		return nil, &Error{Msg: "bytecode file has trailing data"}
+	}
+	code := make([]byte, codeLen)
+	r.Read(code)
+
+	var sum uint32
+	binary.Read(r, binary.BigEndian, &sum)
+	if crc32.ChecksumIEEE(data[:len(data)-4]) != sum {
+		return nil, &Error{Msg: "bytecode file is corrupt (checksum mismatch)"}
+	}
+
+	c := &Chunk{Code: code, Consts: consts, Names: names, NumSlots: int(numSlots)}
+	if err := Verify(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,113 @@
+package vm
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/randprog"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	r := rand.New(rand.NewPCG(5, 5))
+
+	for i := 0; i < 100; i++ {
+		src := randprog.Generate(r)
+		chunk, err := Compile(parse(t, src))
+		if err != nil {
+			t.Fatalf("compile: %v\n%s", err, src)
+		}
+		if err := Verify(chunk); err != nil {
+			t.Fatalf("compiled chunk does not verify: %v\n%s", err, src)
+		}
+
+		decoded, err := Decode(Encode(chunk))
+		if err != nil {
+			t.Fatalf("decode: %v\n%s", err, src)
+		}
+		if !reflect.DeepEqual(decoded, chunk) {
+			t.Fatalf("round trip changed the chunk\n%s", src)
+		}
+	}
+}
+
+func TestDecodeRejectsBadFiles(t *testing.T) {
+	chunk, err := Compile(parse(t, "let x = 1; print x; return x;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := Encode(chunk)
+
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(bytes.Clone(good))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "bad magic"},
+		{"magic", modify(func(b []byte) []byte { b[0] = 'X'; return b }), "bad magic"},
+		{"version", modify(func(b []byte) []byte { b[5] = 99; return b }), "version 99"},
+		{"truncated", good[:len(good)-6], "truncated"},
+		{"trailing", append(bytes.Clone(good), 0), "trailing data"},
+		{"corrupt", modify(func(b []byte) []byte { b[len(b)-6] ^= 0xff; return b }), "checksum"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Decode error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsInvalidCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk *Chunk
+		want  string
+	}{
+		{"unknown opcode", &Chunk{Code: []byte{0xee}}, "unknown opcode"},
+		{"underflow", &Chunk{Code: []byte{byte(OpAdd), byte(OpHalt)}}, "underflows"},
+		{"constant", &Chunk{Code: []byte{byte(OpConst), 0, 3, byte(OpHalt)}}, "constant 3"},
+		{"slot", &Chunk{Code: []byte{byte(OpLoad), 0, 0, byte(OpHalt)}}, "slot 0"},
+		{"falls off end", &Chunk{Code: []byte{byte(OpConst), 0, 0}, Consts: []int64{1}}, "past the end"},
+		{"mid-instruction jump", &Chunk{Code: []byte{byte(OpJump), 0, 0, 0, 2}}, "not an instruction"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.chunk)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Verify error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	r := rand.New(rand.NewPCG(6, 6))
+	for i := 0; i < 4; i++ {
+		chunk, err := Compile(parse(f, randprog.Generate(r)))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(Encode(chunk))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		chunk, err := Decode(data)
+		if err != nil {
+			return
+		}
+		if err := Verify(chunk); err != nil {
+			t.Fatalf("decoded chunk does not verify: %v", err)
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package vm
+
+import "encoding/binary"
+
+type Op byte
+
+const (
+	OpConst       Op = iota // u16 constant index; push Consts[i]
+	OpLoad                  // u16 slot; push Slots[i]
+	OpStore                 // u16 slot; pop into Slots[i]
+	OpAdd                   // pop b, a; push a+b
+	OpSub                   // pop b, a; push a-b
+	OpMul                   // pop b, a; push a*b
+	OpDiv                   // pop b, a; push a/b
+	OpMod                   // pop b, a; push a%b
+	OpNeg                   // pop a; push -a
+	OpLess                  // pop b, a; push a<b
+	OpGreater               // pop b, a; push a>b
+	OpLessEq                // pop b, a; push a<=b
+	OpGreaterEq             // pop b, a; push a>=b
+	OpEqual                 // pop b, a; push a==b
+	OpJump                  // u32 target; jump unconditionally
+	OpJumpIfFalse           // u32 target; pop a; jump if a == 0
+	OpPrint                 // pop a; print a
+	OpHalt                  // pop a; exit with status a
+	OpInput                 // push an integer read from the input
+	OpArgc                  // push the number of command-line arguments
+	OpArg                   // pop i; push command-line argument i as an integer
+	OpEnv                   // u16 name index; push environment variable Names[i] as an integer
+	OpAlloc                 // pop n; push a pointer to a new heap block of n bytes
+	OpFree                  // pop p; free the heap block at p
+)
+
+type opInfo struct {
+	name    string
+	operand int // operand width in bytes
+}
+
+var opTable = map[Op]opInfo{
+	OpConst:       {"CONST", 2},
+	OpLoad:        {"LOAD", 2},
+	OpStore:       {"STORE", 2},
+	OpAdd:         {"ADD", 0},
+	OpSub:         {"SUB", 0},
+	OpMul:         {"MUL", 0},
+	OpDiv:         {"DIV", 0},
+	OpMod:         {"MOD", 0},
+	OpNeg:         {"NEG", 0},
+	OpLess:        {"LT", 0},
+	OpGreater:     {"GT", 0},
+	OpLessEq:      {"LE", 0},
+	OpGreaterEq:   {"GE", 0},
+	OpEqual:       {"EQ", 0},
+	OpJump:        {"JUMP", 4},
+	OpJumpIfFalse: {"JUMP_IF_FALSE", 4},
+	OpPrint:       {"PRINT", 0},
+	OpHalt:        {"HALT", 0},
+	OpInput:       {"INPUT", 0},
+	OpArgc:        {"ARGC", 0},
+	OpArg:         {"ARG", 0},
+	OpEnv:         {"ENV", 2},
+	OpAlloc:       {"ALLOC", 0},
+	OpFree:        {"FREE", 0},
+}
+
+func (op Op) String() string {
+	if info, ok := opTable[op]; ok {
+		return info.name
+	}
+	return "UNKNOWN"
+}
+
+// Chunk is a compiled program: a flat instruction stream with its constant
+// pool, the names of the environment variables it reads and the number of
+// variable slots it needs.
+//
+// Each instruction is a one-byte opcode followed by a big-endian operand
+// of the width given for that opcode.
+type Chunk struct {
+	Code     []byte
+	Consts   []int64
+	Names    []string
+	NumSlots int
+}
+
+func readU16(code []byte, at int) int {
+	return int(binary.BigEndian.Uint16(code[at:]))
+}
+
+func readU32(code []byte, at int) int {
+	return int(binary.BigEndian.Uint32(code[at:]))
+}
@@ -0,0 +1,115 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+)
+
+// stackEffect returns how many values an instruction pops and pushes.
+func stackEffect(op Op) (pops, pushes int) {
+	switch op {
+	case OpConst, OpLoad, OpInput, OpArgc, OpEnv:
+		return 0, 1
+	case OpStore, OpJumpIfFalse, OpPrint, OpHalt, OpFree:
+		return 1, 0
+	case OpNeg, OpArg, OpAlloc:
+		return 1, 1
+	case OpJump:
+		return 0, 0
+	default:
+		return 2, 1
+	}
+}
+
+// Verify checks that a chunk is safe to run: every opcode is known, operands
+// are in range, jumps land on instruction boundaries, the operand stack never
+// underflows and has the same depth on every path into an instruction, and
+// execution cannot run off the end of the code.
+func Verify(c *Chunk) error {
+	fail := func(ip int, format string, args ...interface{}) error {
+		return &Error{Msg: fmt.Sprintf("invalid bytecode at %04d: %s", ip, fmt.Sprintf(format, args...))}
+	}
+
+	if c.NumSlots > math.MaxUint16+1 {
+		return &Error{Msg: fmt.Sprintf("invalid bytecode: %d slots exceeds the maximum of %d", c.NumSlots, math.MaxUint16+1)}
+	}
+	if len(c.Code) == 0 {
+		return &Error{Msg: "invalid bytecode: empty code"}
+	}
+
+	// Find instruction boundaries and check operands.
+	start := make([]bool, len(c.Code))
+	for ip := 0; ip < len(c.Code); {
+		op := Op(c.Code[ip])
+		info, ok := opTable[op]
+		if !ok {
+			return fail(ip, "unknown opcode %d", op)
+		}
+		if ip+1+info.operand > len(c.Code) {
+			return fail(ip, "truncated %s instruction", op)
+		}
+		switch op {
+		case OpConst:
+			if idx := readU16(c.Code, ip+1); idx >= len(c.Consts) {
+				return fail(ip, "constant %d out of range", idx)
+			}
+		case OpEnv:
+			if idx := readU16(c.Code, ip+1); idx >= len(c.Names) {
+				return fail(ip, "name %d out of range", idx)
+			}
+		case OpLoad, OpStore:
+			if slot := readU16(c.Code, ip+1); slot >= c.NumSlots {
+				return fail(ip, "slot %d out of range", slot)
+			}
+		}
+		start[ip] = true
+		ip += 1 + info.operand
+	}
+
+	// Propagate stack depths along every control-flow edge.
+	depth := make([]int, len(c.Code))
+	for i := range depth {
+		depth[i] = -1
+	}
+	depth[0] = 0
+	work := []int{0}
+
+	for len(work) > 0 {
+		ip := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		op := Op(c.Code[ip])
+		pops, pushes := stackEffect(op)
+		if depth[ip] < pops {
+			return fail(ip, "%s underflows the stack", op)
+		}
+		out := depth[ip] - pops + pushes
+
+		var succ []int
+		switch op {
+		case OpHalt:
+		case OpJump:
+			succ = []int{readU32(c.Code, ip+1)}
+		case OpJumpIfFalse:
+			succ = []int{ip + 5, readU32(c.Code, ip+1)}
+		default:
+			succ = []int{ip + 1 + opTable[op].operand}
+		}
+
+		for _, next := range succ {
+			if next >= len(c.Code) {
+				return fail(ip, "control flows past the end of the code")
+			}
+			if !start[next] {
+				return fail(ip, "jump target %04d is not an instruction", next)
+			}
+			if depth[next] == -1 {
+				depth[next] = out
+				work = append(work, next)
+			} else if depth[next] != out {
+				return fail(next, "stack depth %d differs from %d on another path", out, depth[next])
+			}
+		}
+	}
+	return nil
+}
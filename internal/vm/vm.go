@@ -0,0 +1,218 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/BergurDavidsen/bingus/internal/heap"
+)
+
+type VM struct {
+	// Args are the program's command-line arguments, starting with its
+	// name, and Environ its environment as "key=value" strings, as in
+	// os.Args and os.Environ.
+	Args    []string
+	Environ []string
+
+	in   *bufio.Reader
+	out  io.Writer
+	heap heap.Heap
+}
+
+// New returns a VM whose input instructions read lines from in and whose
+// print instructions write to out. in may be nil for programs that read no
+// input.
+func New(in io.Reader, out io.Writer) *VM {
+	if in == nil {
+		in = strings.NewReader("")
+	}
+	return &VM{in: bufio.NewReader(in), out: out}
+}
+
+// readInt reads a line holding a signed decimal integer. Spaces and tabs may
+// surround it, and a carriage return may end it.
+func (vm *VM) readInt() (int64, error) {
+	line, err := vm.in.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return 0, &Error{Msg: "unexpected end of input"}
+	}
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	text := strings.TrimLeft(strings.TrimRight(line, " \t\r\n"), " \t")
+	val, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return 0, &Error{Msg: fmt.Sprintf("invalid input: %q", text)}
+	}
+	return val, nil
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// arg reads command-line argument i as an integer.
+func (vm *VM) arg(i int64) (int64, error) {
+	if i < 0 || i >= int64(len(vm.Args)) {
+		return 0, &Error{Msg: fmt.Sprintf("argument index %d out of range", i)}
+	}
+	val, err := strconv.ParseInt(vm.Args[i], 10, 64)
+	if err != nil {
+		return 0, &Error{Msg: fmt.Sprintf("invalid argument %d: %q", i, vm.Args[i])}
+	}
+	return val, nil
+}
+
+// env reads the first definition of the environment variable name as an
+// integer.
+func (vm *VM) env(name string) (int64, error) {
+	for _, kv := range vm.Environ {
+		value, ok := strings.CutPrefix(kv, name+"=")
+		if !ok {
+			continue
+		}
+		val, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, &Error{Msg: fmt.Sprintf("environment variable %s is not an integer: %q", name, value)}
+		}
+		return val, nil
+	}
+	return 0, &Error{Msg: fmt.Sprintf("environment variable %s is not set", name)}
+}
+
+// Run executes a chunk until it halts and returns the exit status.
+// Division by zero, malformed input and missing or malformed arguments
+// and environment variables are reported as an *Error, and misuse of the
+// heap as a *heap.Error.
+func (vm *VM) Run(c *Chunk) (int, error) {
+	code := c.Code
+	consts := c.Consts
+	slots := make([]int64, c.NumSlots)
+	stack := make([]int64, 0, 64)
+	buf := make([]byte, 0, 24)
+
+	ip := 0
+	for {
+		op := Op(code[ip])
+		ip++
+
+		switch op {
+		case OpConst:
+			stack = append(stack, consts[readU16(code, ip)])
+			ip += 2
+		case OpLoad:
+			stack = append(stack, slots[readU16(code, ip)])
+			ip += 2
+		case OpStore:
+			slots[readU16(code, ip)] = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			ip += 2
+
+		case OpNeg:
+			stack[len(stack)-1] = -stack[len(stack)-1]
+
+		case OpAdd:
+			stack[len(stack)-2] += stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case OpSub:
+			stack[len(stack)-2] -= stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case OpMul:
+			stack[len(stack)-2] *= stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case OpDiv, OpMod:
+			b := stack[len(stack)-1]
+			if b == 0 {
+				return 0, &Error{Msg: "division by zero"}
+			}
+			if op == OpDiv {
+				stack[len(stack)-2] /= b
+			} else {
+				stack[len(stack)-2] %= b
+			}
+			stack = stack[:len(stack)-1]
+
+		case OpLess:
+			stack[len(stack)-2] = boolToInt(stack[len(stack)-2] < stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		case OpGreater:
+			stack[len(stack)-2] = boolToInt(stack[len(stack)-2] > stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		case OpLessEq:
+			stack[len(stack)-2] = boolToInt(stack[len(stack)-2] <= stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		case OpGreaterEq:
+			stack[len(stack)-2] = boolToInt(stack[len(stack)-2] >= stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		case OpEqual:
+			stack[len(stack)-2] = boolToInt(stack[len(stack)-2] == stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+
+		case OpJump:
+			ip = readU32(code, ip)
+		case OpJumpIfFalse:
+			cond := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if cond == 0 {
+				ip = readU32(code, ip)
+			} else {
+				ip += 4
+			}
+
+		case OpPrint:
+			buf = strconv.AppendInt(buf[:0], stack[len(stack)-1], 10)
+			buf = append(buf, '\n')
+			stack = stack[:len(stack)-1]
+			if _, err := vm.out.Write(buf); err != nil {
+				return 0, err
+			}
+
+		case OpInput:
+			val, err := vm.readInt()
+			if err != nil {
+				return 0, err
+			}
+			stack = append(stack, val)
+
+		case OpArgc:
+			stack = append(stack, int64(len(vm.Args)))
+		case OpArg:
+			val, err := vm.arg(stack[len(stack)-1])
+			if err != nil {
+				return 0, err
+			}
+			stack[len(stack)-1] = val
+		case OpEnv:
+			val, err := vm.env(c.Names[readU16(code, ip)])
+			if err != nil {
+				return 0, err
+			}
+			stack = append(stack, val)
+			ip += 2
+
+		case OpAlloc:
+			p, err := vm.heap.Alloc(stack[len(stack)-1])
+			if err != nil {
+				return 0, err
+			}
+			stack[len(stack)-1] = p
+		case OpFree:
+			if err := vm.heap.Free(stack[len(stack)-1]); err != nil {
+				return 0, err
+			}
+			stack = stack[:len(stack)-1]
+
+		case OpHalt:
+			return int(stack[len(stack)-1]), nil
+
+		default:
+			return 0, &Error{Msg: fmt.Sprintf("invalid opcode %d at %d", op, ip-1)}
+		}
+	}
+}
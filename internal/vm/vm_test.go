@@ -0,0 +1,389 @@
+package vm
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/BergurDavidsen/bingus/internal/eval"
+	"github.com/BergurDavidsen/bingus/internal/lexer"
+	"github.com/BergurDavidsen/bingus/internal/parser"
+	"github.com/BergurDavidsen/bingus/internal/randprog"
+	"github.com/BergurDavidsen/bingus/internal/resolve"
+)
+
+// parse parses a program and resolves its names.
+func parse(tb testing.TB, src string) (*parser.Program, *resolve.Table) {
+	tb.Helper()
+	tokens, err := lexer.Lex(src)
+	if err != nil {
+		tb.Fatalf("lex: %v\n%s", err, src)
+	}
+	p := parser.Parser{Tokens: tokens}
+	prog, err := p.ParseProgram()
+	if err != nil {
+		tb.Fatalf("parse: %v\n%s", err, src)
+	}
+	syms, err := resolve.Resolve(prog)
+	if err != nil {
+		tb.Fatalf("resolve: %v\n%s", err, src)
+	}
+	return prog, syms
+}
+
+func TestEvalAgreement(t *testing.T) {
+	r := rand.New(rand.NewPCG(4, 4))
+
+	for i := 0; i < 500; i++ {
+		src := randprog.Generate(r)
+		prog, syms := parse(t, src)
+
+		var want bytes.Buffer
+		wantCode, err := eval.NewEnv(nil, &want, syms).Eval(prog)
+		if err != nil {
+			t.Fatalf("eval: %v\n%s", err, src)
+		}
+
+		chunk, err := Compile(prog, syms)
+		if err != nil {
+			t.Fatalf("compile: %v\n%s", err, src)
+		}
+		var got bytes.Buffer
+		gotCode, err := New(nil, &got).Run(chunk)
+		if err != nil {
+			t.Fatalf("run: %v\n%s", err, src)
+		}
+
+		if got.String() != want.String() || gotCode != wantCode {
+			t.Fatalf("VM disagrees with evaluator\n%s\nvm: exit %d, output:\n%s\neval: exit %d, output:\n%s",
+				src, gotCode, got.String(), wantCode, want.String())
+		}
+	}
+}
+
+func TestInput(t *testing.T) {
+	const src = `
+let n = input();
+let sum = 0;
+while (n > 0) {
+    sum = sum + input();
+    n = n - 1;
+}
+print sum;
+`
+	tests := []struct {
+		input, output, err string
+	}{
+		{input: "3\n  10\n-4 \r\n+7", output: "13\n"},
+		{input: "1\n-9223372036854775808\n", output: "-9223372036854775808\n"},
+		{input: "0\n", output: "0\n"},
+		{input: "", err: "unexpected end of input"},
+		{input: "2\n1\n", err: "unexpected end of input"},
+		{input: "1\n1x\n", err: `invalid input: "1x"`},
+		{input: "1\n\n", err: `invalid input: ""`},
+		{input: "1\n9223372036854775808\n", err: `invalid input: "9223372036854775808"`},
+	}
+
+	prog, syms := parse(t, src)
+	chunk, err := Compile(prog, syms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		var want bytes.Buffer
+		_, wantErr := eval.NewEnv(strings.NewReader(tt.input), &want, syms).Eval(prog)
+		var got bytes.Buffer
+		_, gotErr := New(strings.NewReader(tt.input), &got).Run(chunk)
+
+		for name, res := range map[string]struct {
+			out string
+			err error
+		}{"eval": {want.String(), wantErr}, "vm": {got.String(), gotErr}} {
+			errMsg := ""
+			if res.err != nil {
+				errMsg = res.err.Error()
+			}
+			if errMsg != tt.err || tt.err == "" && res.out != tt.output {
+				t.Errorf("%s with input %q: got output %q, error %q; want output %q, error %q",
+					name, tt.input, res.out, errMsg, tt.output, tt.err)
+			}
+		}
+	}
+}
+
+func TestArgsAndEnv(t *testing.T) {
+	const src = `
+let sum = 0;
+let i = 1;
+while (i < argc()) {
+    sum = sum + arg(i);
+    i = i + 1;
+}
+print sum;
+print env("N") * 10 + env("M");
+print arg(argc());
+`
+	tests := []struct {
+		args, env []string
+		output    string
+		err       string
+	}{
+		{
+			args:   []string{"prog", "1", "-9223372036854775808", "+7"},
+			env:    []string{"NN=1", "N=4", "M=-2", "N=5"},
+			output: "-9223372036854775800\n38\n",
+			err:    "argument index 4 out of range",
+		},
+		{args: []string{"prog", "1", "x"}, err: `invalid argument 2: "x"`},
+		{args: []string{"prog"}, env: []string{"N=1"}, output: "0\n", err: "environment variable M is not set"},
+		{args: []string{"prog"}, env: []string{"N=1 ", "M=1"}, output: "0\n", err: `environment variable N is not an integer: "1 "`},
+	}
+
+	prog, syms := parse(t, src)
+	chunk, err := Compile(prog, syms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(Encode(chunk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		var want bytes.Buffer
+		env := eval.NewEnv(nil, &want, syms)
+		env.Args, env.Environ = tt.args, tt.env
+		_, wantErr := env.Eval(prog)
+		var got bytes.Buffer
+		machine := New(nil, &got)
+		machine.Args, machine.Environ = tt.args, tt.env
+		_, gotErr := machine.Run(decoded)
+
+		for name, res := range map[string]struct {
+			out string
+			err error
+		}{"eval": {want.String(), wantErr}, "vm": {got.String(), gotErr}} {
+			if res.err == nil || res.err.Error() != tt.err || res.out != tt.output {
+				t.Errorf("%s with args %q and environment %q: got output %q, error %v; want output %q, error %q",
+					name, tt.args, tt.env, res.out, res.err, tt.output, tt.err)
+			}
+		}
+	}
+}
+
+func TestHeap(t *testing.T) {
+	tests := []struct {
+		src    string
+		output string
+		err    string
+	}{
+		{"let p = alloc(8); let q = alloc(0); print p == q; free(p); free(q);", "0\n", ""},
+		{"let p = alloc(8); free(p); free(p);", "", "double free"},
+		{"print 1; let p = alloc(0 - 1);", "1\n", "invalid allocation size -1"},
+		{"let p = alloc(8); let q = p; free(p); free(q);", "", "double free"},
+		{"let free = alloc(8); let alloc = free; free(alloc); free(free);", "", "double free"},
+	}
+
+	for _, tt := range tests {
+		prog, syms := parse(t, tt.src)
+		chunk, err := Compile(prog, syms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want bytes.Buffer
+		_, wantErr := eval.NewEnv(nil, &want, syms).Eval(prog)
+		var got bytes.Buffer
+		_, gotErr := New(nil, &got).Run(chunk)
+
+		for name, res := range map[string]struct {
+			out string
+			err error
+		}{"eval": {want.String(), wantErr}, "vm": {got.String(), gotErr}} {
+			errMsg := ""
+			if res.err != nil {
+				errMsg = res.err.Error()
+			}
+			if errMsg != tt.err || res.out != tt.output {
+				t.Errorf("%s on %q: got output %q, error %q; want output %q, error %q",
+					name, tt.src, res.out, errMsg, tt.output, tt.err)
+			}
+		}
+	}
+}
+
+// The VM's heap counts the blocks a program allocates and has not freed,
+// rounded up to 16 bytes. Neither it nor the evaluator hands out a freed
+// block again.
+func TestHeapBookkeeping(t *testing.T) {
+	const src = `
+let a = alloc(1);
+let b = alloc(17);
+let c = alloc(0);
+free(b);
+let d = alloc(40);
+print a == b;
+print d == b;
+free(a);
+let e = alloc(8);
+free(d);
+`
+	prog, syms := parse(t, src)
+	chunk, err := Compile(prog, syms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	machine := New(nil, &got)
+	if _, err := machine.Run(chunk); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var want bytes.Buffer
+	if _, err := eval.NewEnv(nil, &want, syms).Eval(prog); err != nil {
+		t.Fatalf("eval: %v", err)
+	}
+	if got.String() != "0\n0\n" || want.String() != got.String() {
+		t.Errorf("vm output %q, eval output %q; want %q", got.String(), want.String(), "0\n0\n")
+	}
+	if blocks, bytes := machine.heap.Live(); blocks != 2 || bytes != 32 {
+		t.Errorf("live = %d blocks, %d bytes; want 2, 32", blocks, bytes)
+	}
+}
+
+// structProgram copies, swaps and updates struct values and their fields.
+const structProgram = `
+struct Point { x: int, y: int }
+struct Line { from: Point, to: Point, visible: bool }
+
+let p = Point { y: 2, x: 1 };
+let q = p;
+q.x = 10;
+print p.x;
+print q.x;
+p = Point { x: p.y, y: p.x };
+print p.x * 10 + p.y;
+
+let l = Line { from: p, to: q, visible: true };
+l.from.y = l.to.x + l.to.y;
+l.to = l.from;
+let i = 0;
+while (i < 3) {
+    let step = Point { x: i, y: 1 };
+    l.to.x = l.to.x + step.x * step.y;
+    i = i + 1;
+}
+print l.from.y;
+print l.to.x;
+print l.visible;
+print Point { x: 7, y: 8 }.y;
+return l.to.y + p.x;
+`
+
+func TestStructs(t *testing.T) {
+	prog, syms := parse(t, structProgram)
+	chunk, err := Compile(prog, syms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	wantCode, err := eval.NewEnv(nil, &want, syms).Eval(prog)
+	if err != nil {
+		t.Fatalf("eval: %v", err)
+	}
+	var got bytes.Buffer
+	gotCode, err := New(nil, &got).Run(chunk)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	const output = "1\n10\n21\n12\n5\n1\n8\n"
+	if want.String() != output || wantCode != 14 {
+		t.Errorf("eval: exit %d, output:\n%s\nwant exit 14, output:\n%s", wantCode, want.String(), output)
+	}
+	if got.String() != output || gotCode != 14 {
+		t.Errorf("vm: exit %d, output:\n%s\nwant exit 14, output:\n%s", gotCode, got.String(), output)
+	}
+}
+
+// Struct values are copied on assignment, whether whole or a field at a
+// time, and a literal reads every field before the assignment it is in.
+func TestStructCopies(t *testing.T) {
+	const src = `
+struct Point { x: int, y: int }
+struct Line { from: Point, to: Point }
+
+let l = Line { from: Point { x: 1, y: 2 }, to: Point { x: 3, y: 4 } };
+let f = l.from;
+f.x = 9;
+print l.from.x;
+l.to = l.from;
+l.from.x = 7;
+print l.to.x;
+let m = l;
+m.to.y = 0;
+print l.to.y;
+l = Line { from: l.to, to: l.from };
+print l.from.x * 10 + l.to.x;
+let i = 0;
+while (i < 2) {
+    let p = Point { x: i, y: i };
+    p.x = p.x + 10;
+    print p.x;
+    i = i + 1;
+}
+`
+	const output = "1\n1\n2\n17\n10\n11\n"
+
+	prog, syms := parse(t, src)
+	chunk, err := Compile(prog, syms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if _, err := eval.NewEnv(nil, &want, syms).Eval(prog); err != nil {
+		t.Fatalf("eval: %v", err)
+	}
+	var got bytes.Buffer
+	if _, err := New(nil, &got).Run(chunk); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if want.String() != output {
+		t.Errorf("eval output:\n%s\nwant:\n%s", want.String(), output)
+	}
+	if got.String() != output {
+		t.Errorf("vm output:\n%s\nwant:\n%s", got.String(), output)
+	}
+}
+
+const loopProgram = `
+let i = 0;
+let sum = 0;
+while (i < 100000) {
+    if (i % 3 == 0) {
+        sum = sum + i;
+    }
+    i = i + 1;
+}
+return sum % 256;
+`
+
+func BenchmarkLoopVM(b *testing.B) {
+	chunk, err := Compile(parse(b, loopProgram))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for b.Loop() {
+		if _, err := New(nil, io.Discard).Run(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoopEval(b *testing.B) {
+	prog, syms := parse(b, loopProgram)
+	for b.Loop() {
+		if _, err := eval.NewEnv(nil, io.Discard, syms).Eval(prog); err != nil {
+			b.Fatal(err)
+		}
+	}
+}